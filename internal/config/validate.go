@@ -0,0 +1,177 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Component types main knows how to build, keep these in sync with it
+var (
+	Services      = []string{"dummy", "glimesh"}
+	Orchestrators = []string{"dummy", "rt", "chain"}
+	Inputs        = []string{"fs", "janus", "rtmp", "ftl", "whip", "mpegts", "rtsp"}
+	Outputs       = []string{"hls", "whep"}
+)
+
+// Keys that hold a time.Duration, wherever they appear in the config
+var durationKeys = map[string]bool{
+	"audio_gap_threshold":      true,
+	"auth_cache_ttl":           true,
+	"base_delay":               true,
+	"circuit_breaker_cooldown": true,
+	"ice_gathering_timeout":    true,
+	"max_connect_duration":     true,
+	"reconnect_grace_period":   true,
+	"reconnect_interval":       true,
+	"wait_timeout":             true,
+	"whip_inactivity_timeout":  true,
+}
+
+// Input types whose address is a URL to connect to rather than one to listen on
+var dialingInputs = map[string]bool{
+	"janus": true,
+}
+
+type ValidationError struct {
+	Key     string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// Validate checks the whole config before anything is built from it, and
+// returns every problem it finds instead of stopping at the first
+func Validate(v *viper.Viper) []ValidationError {
+	var errs []ValidationError
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	checkEnum := func(key string, allowed []string) {
+		if !v.IsSet(key) || v.GetString(key) == "" {
+			add(key, "is required")
+			return
+		}
+		if value := v.GetString(key); !contains(allowed, value) {
+			add(key, "unknown value %q, expected one of %s", value, strings.Join(allowed, ", "))
+		}
+	}
+
+	checkEnum("control.service", Services)
+	checkEnum("control.orchestrator", Orchestrators)
+	if v.GetString("control.orchestrator") == "chain" {
+		key := "orchestrator.chain.orchestrators"
+		chain := v.GetStringSlice(key)
+		if len(chain) == 0 {
+			add(key, "is required for the chain orchestrator")
+		}
+		for _, orchestrator := range chain {
+			if orchestrator == "chain" || !contains(Orchestrators, orchestrator) {
+				add(key, "unknown orchestrator %q", orchestrator)
+			}
+		}
+	}
+
+	if _, err := logrus.ParseLevel(v.GetString("control.log_level")); err != nil {
+		add("control.log_level", "%s", err)
+	}
+	if v.IsSet("control.http_address") {
+		checkAddress(add, "control.http_address", v.GetString("control.http_address"))
+	}
+	if v.IsSet("control.pprof_address") {
+		checkAddress(add, "control.pprof_address", v.GetString("control.pprof_address"))
+	}
+	if v.GetBool("control.cors.allow_credentials") && contains(v.GetStringSlice("control.cors.allowed_origins"), "*") {
+		// Any site could make credentialed calls to the control API
+		add("control.cors.allowed_origins", "can't contain \"*\" with allow_credentials, list the origins instead")
+	}
+
+	for _, section := range []struct {
+		name    string
+		allowed []string
+	}{{"input", Inputs}, {"output", Outputs}} {
+		for _, name := range sortedKeys(v.GetStringMap(section.name)) {
+			prefix := fmt.Sprintf("%s.%s", section.name, name)
+			checkEnum(prefix+".type", section.allowed)
+
+			addressKey := prefix + ".address"
+			if v.IsSet(addressKey) && !dialingInputs[v.GetString(prefix+".type")] {
+				checkAddress(add, addressKey, v.GetString(addressKey))
+			}
+		}
+	}
+
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		if durationKeys[parts[len(parts)-1]] {
+			checkDuration(add, key, v.Get(key))
+		}
+	}
+
+	return errs
+}
+
+func checkAddress(add func(string, string, ...interface{}), key string, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		add(key, "%q is not a valid host:port address", address)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		add(key, "%q does not have a valid port", address)
+	}
+}
+
+func checkDuration(add func(string, string, ...interface{}), key string, value interface{}) {
+	var d time.Duration
+	switch value := value.(type) {
+	case string:
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			add(key, "%q is not a valid duration, eg 30s", value)
+			return
+		}
+	case int:
+		d = time.Duration(value)
+	case int64:
+		d = time.Duration(value)
+	case float64:
+		d = time.Duration(value)
+	default:
+		add(key, "%v is not a valid duration, eg 30s", value)
+		return
+	}
+
+	if d <= 0 {
+		add(key, "must be positive, leave it out to use the default")
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
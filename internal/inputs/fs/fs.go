@@ -59,7 +59,7 @@ func (s *FSSource) Listen(ctx context.Context) {
 		panic(videoTrackErr)
 	}
 
-	stream, ctx, err := s.control.StartStream(1234)
+	stream, ctx, err := s.control.StartStream(ctx, 1234, control.InputMetadata("fs"))
 	if err != nil {
 		panic(err)
 	}
@@ -1,10 +1,16 @@
 package ftl
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"net"
+	"net/http"
 
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/geoip"
+	"github.com/Glimesh/waveguide/pkg/h264"
 	ftlproto "github.com/Glimesh/waveguide/pkg/protocols/ftl"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
@@ -19,6 +25,22 @@ type FTLSource struct {
 
 type FTLSourceConfig struct {
 	Address string
+
+	// Optional inclusive UDP port range used for media, eg 40000-49999. Every
+	// connection takes two, the media port and the RTCP port above it.
+	MediaPortMin int `mapstructure:"media_port_min"`
+	MediaPortMax int `mapstructure:"media_port_max"`
+
+	// FTL protocol versions clients may announce, defaults to 0.9 and 1.0
+	SupportedVersions []string `mapstructure:"supported_versions"`
+
+	// Media each connection may send in megabits per second, packets past it
+	// are dropped. Unset (0) for no limit.
+	MediaRateLimitMbps float64 `mapstructure:"media_rate_limit_mbps"`
+
+	// HMAC algorithm clients authenticate with, sha256 or sha512. Defaults to
+	// sha512, the only one most FTL clients support.
+	HMACAlgorithm string `mapstructure:"hmac_algorithm"`
 }
 
 func New(config FTLSourceConfig) *FTLSource {
@@ -36,6 +58,11 @@ func (s *FTLSource) SetLogger(log logrus.FieldLogger) {
 }
 
 func (s *FTLSource) Listen(ctx context.Context) {
+	if !ftlproto.ValidHmacAlgorithm(s.config.HMACAlgorithm) {
+		s.log.Errorf("hmac_algorithm must be %s or %s", ftlproto.HmacSHA256, ftlproto.HmacSHA512)
+		return
+	}
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", s.config.Address)
 	if err != nil {
 		s.log.Errorf("Failed: %+v", err)
@@ -55,22 +82,57 @@ func (s *FTLSource) Listen(ctx context.Context) {
 		OnNewConnect: func(conn net.Conn) (net.Conn, *ftlproto.ConnConfig) {
 			return conn, &ftlproto.ConnConfig{
 				Handler: &connHandler{
-					control: s.control,
-					log:     s.log,
+					ctx:        ctx,
+					control:    s.control,
+					log:        s.log,
+					remoteAddr: conn.RemoteAddr().String(),
 				},
+				MediaPortMin: s.config.MediaPortMin,
+				MediaPortMax: s.config.MediaPortMax,
+
+				SupportedVersions: s.config.SupportedVersions,
+
+				MediaRateLimitMbps: s.config.MediaRateLimitMbps,
+
+				HMACAlgorithm: s.config.HMACAlgorithm,
 			}
 		},
 	})
 
+	// Lists every broadcaster's address and custom attributes
+	s.control.RegisterHandleFunc("/ftl/connections", s.control.RequireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(srv.Connections())
+	}))
+	s.control.RegisterHandleFunc("/ftl/port-stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ftlproto.MediaPortUsage(s.config.MediaPortMin, s.config.MediaPortMax))
+	})
+
+	// Clients are disconnected once control has stopped their streams
+	s.control.RegisterShutdownHook(srv.Shutdown)
+
 	if err := srv.Serve(listener); err != nil {
 		s.log.Panicf("Failed: %+v", err)
 	}
 }
 
 type connHandler struct {
+	ctx        context.Context
 	control    *control.Control
 	log        logrus.FieldLogger
 	controlCtx context.Context
+	remoteAddr string
 
 	channelID control.ChannelID
 
@@ -78,17 +140,27 @@ type connHandler struct {
 	videoTrack *webrtc.TrackLocalStaticRTP
 	audioTrack *webrtc.TrackLocalStaticRTP
 
+	// Parameter sets seen in the video so far, FTL sends them in band
+	sps []byte
+	pps []byte
+
 	cancel chan bool
 }
 
 func (c *connHandler) OnConnect(channelID ftlproto.ChannelID) error {
 	c.channelID = control.ChannelID(channelID)
 
-	var err error
-	c.stream, c.controlCtx, err = c.control.StartStream(c.channelID)
-	if err != nil {
+	stream, controlCtx, err := c.control.StartStream(c.ctx, c.channelID,
+		control.InputMetadata("ftl"),
+		control.SourceIPMetadata(geoip.HostIP(c.remoteAddr)),
+	)
+	if errors.Is(err, control.ErrStreamAlreadyExists) {
+		return ftlproto.ErrChannelInUse
+	} else if err != nil {
 		return err
 	}
+	// Only set once the stream is ours, OnClose stops whatever it points at
+	c.stream, c.controlCtx = stream, controlCtx
 
 	// Create a video track
 	c.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: "video/h264"}, "video", "pion")
@@ -108,6 +180,7 @@ func (c *connHandler) OnConnect(channelID ftlproto.ChannelID) error {
 	c.stream.ReportMetadata(
 		control.AudioCodecMetadata(webrtc.MimeTypeOpus),
 		control.VideoCodecMetadata(webrtc.MimeTypeH264),
+		control.SourceIPMetadata(geoip.HostIP(c.remoteAddr)),
 	)
 
 	return nil
@@ -133,6 +206,7 @@ func (c *connHandler) OnAudio(packet *rtp.Packet) error {
 
 	err := c.audioTrack.WriteRTP(packet)
 
+	c.stream.AddReceivedBytes(packet.MarshalSize())
 	c.stream.ReportMetadata(control.AudioPacketsMetadata(len(packet.Payload)))
 
 	return err
@@ -146,12 +220,49 @@ func (c *connHandler) OnVideo(packet *rtp.Packet) error {
 	// Write the RTP packet immediately, log after
 	err := c.videoTrack.WriteRTP(packet)
 
+	c.stream.AddReceivedBytes(packet.MarshalSize())
 	c.stream.ReportMetadata(control.VideoPacketsMetadata(len(packet.Payload)))
+	if h264.IsAnyKeyframe(packet.Payload) {
+		c.stream.ReportMetadata(control.KeyframeMetadata())
+	}
+	if sps, pps := h264.ParameterSets(packet.Payload); sps != nil || pps != nil {
+		c.setDecoderConfig(sps, pps)
+	}
 
 	return err
 }
 
+// setDecoderConfig passes new parameter sets on to control once both have
+// arrived, they usually come in separate packets ahead of every keyframe
+func (c *connHandler) setDecoderConfig(sps, pps []byte) {
+	changed := false
+	if sps != nil && !bytes.Equal(sps, c.sps) {
+		c.sps = append([]byte(nil), sps...)
+		changed = true
+	}
+	if pps != nil && !bytes.Equal(pps, c.pps) {
+		c.pps = append([]byte(nil), pps...)
+		changed = true
+	}
+	if changed && c.sps != nil && c.pps != nil {
+		c.stream.SetDecoderConfig(c.sps, c.pps)
+	}
+}
+
+func (c *connHandler) OnRTCPStats(stats ftlproto.RTCPStats) {
+	c.stream.ReportMetadata(
+		control.LostPacketsMetadata(int(stats.TotalLost)),
+		control.FractionLostMetadata(stats.FractionLostRatio()),
+		control.JitterMetadata(stats.JitterDuration()),
+	)
+}
+
 func (c *connHandler) OnClose() {
+	if c.controlCtx == nil {
+		// We never started a stream, eg a CONNECT for a channel that's already
+		// live, so the one that's there belongs to someone else
+		return
+	}
 	if c.controlCtx.Err() == nil {
 		// This is the FTL => Control cancellation
 		// Only since if we're not the canceller.
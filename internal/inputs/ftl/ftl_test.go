@@ -0,0 +1,80 @@
+package ftl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/orchestrators/dummy_orchestrator"
+	ftlproto "github.com/Glimesh/waveguide/pkg/protocols/ftl"
+	"github.com/Glimesh/waveguide/pkg/services/dummy_service"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestControl runs streams against the dummy service and orchestrator.
+// The thumbnailer's WHEP request hangs until the test is over, if it failed
+// the thumbnailer would stop the stream itself.
+func newTestControl(t *testing.T) *control.Control {
+	release := make(chan struct{})
+	whep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(whep.Close)
+	t.Cleanup(func() { close(release) })
+
+	log := logrus.New()
+	service := dummy_service.New(dummy_service.Config{})
+	service.SetLogger(log)
+	orchestrator := dummy_orchestrator.New(dummy_orchestrator.Config{}, "test")
+	orchestrator.SetLogger(log)
+
+	mgr := control.New(control.Config{})
+	mgr.SetLogger(log)
+	mgr.SetService(service)
+	mgr.SetOrchestrator(orchestrator)
+	mgr.SetWHEPEndpoint(whep.URL)
+	return mgr
+}
+
+func newTestHandler(mgr *control.Control, remoteAddr string) *connHandler {
+	return &connHandler{
+		ctx:        context.Background(),
+		control:    mgr,
+		log:        logrus.New(),
+		remoteAddr: remoteAddr,
+	}
+}
+
+func TestSecondConnectKeepsStream(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newTestControl(t)
+
+	first := newTestHandler(mgr, "203.0.113.7:51234")
+	if !assert.NoError(first.OnConnect(1)) {
+		return
+	}
+
+	second := newTestHandler(mgr, "198.51.100.9:40000")
+	assert.ErrorIs(second.OnConnect(1), ftlproto.ErrChannelInUse)
+	// The server closes the connection it turned away
+	second.OnClose()
+
+	assert.NoError(first.controlCtx.Err())
+	_, err := mgr.GetTracks(1)
+	assert.NoError(err)
+
+	first.OnClose()
+	assert.Error(first.controlCtx.Err())
+	_, err = mgr.GetTracks(1)
+	assert.Error(err)
+}
+
+func TestCloseBeforeConnect(t *testing.T) {
+	mgr := newTestControl(t)
+
+	// Clients can be disconnected before they ever CONNECT
+	assert.NotPanics(t, newTestHandler(mgr, "203.0.113.7:51234").OnClose)
+}
@@ -156,7 +156,7 @@ func (s *JanusSource) Listen(ctx context.Context) {
 			} else {
 				if offerResponse.Jsep.Sdp != "" {
 					s.log.Infof("Got offer: %s", offerResponse.Jsep.Sdp)
-					s.negotiate(offerResponse.Jsep.Sdp, pluginUrl)
+					s.negotiate(ctx, offerResponse.Jsep.Sdp, pluginUrl)
 				}
 			}
 
@@ -167,8 +167,8 @@ func (s *JanusSource) Listen(ctx context.Context) {
 	}()
 }
 
-func (s *JanusSource) negotiate(sdpString string, pluginUrl string) {
-	stream, ctx, err := s.control.StartStream(control.ChannelID(s.config.ChannelId))
+func (s *JanusSource) negotiate(ctx context.Context, sdpString string, pluginUrl string) {
+	stream, ctx, err := s.control.StartStream(ctx, control.ChannelID(s.config.ChannelId), control.InputMetadata("janus"))
 	if err != nil {
 		panic(err)
 	}
@@ -200,7 +200,7 @@ func (s *JanusSource) negotiate(sdpString string, pluginUrl string) {
 
 	// Create a new RTCPeerConnection
 	var peerConnection *webrtc.PeerConnection
-	peerConnection, err = webrtc.NewPeerConnection(webrtc.Configuration{
+	peerConnection, err = s.control.GetWebRTCAPI().NewPeerConnection(webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{},
 		},
@@ -238,6 +238,7 @@ func (s *JanusSource) negotiate(sdpString string, pluginUrl string) {
 					panic(err)
 				}
 				audioTrack.WriteRTP(p)
+				stream.AddReceivedBytes(p.MarshalSize())
 				stream.ReportMetadata(control.AudioPacketsMetadata(len(p.Payload)))
 			}
 		} else if codec.MimeType == "video/H264" {
@@ -252,6 +253,7 @@ func (s *JanusSource) negotiate(sdpString string, pluginUrl string) {
 					panic(err)
 				}
 				videoTrack.WriteRTP(p)
+				stream.AddReceivedBytes(p.MarshalSize())
 				stream.ReportMetadata(control.VideoPacketsMetadata(len(p.Payload)))
 			}
 		}
@@ -0,0 +1,230 @@
+package mpegts
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A minimal MPEG-TS demuxer, only supporting what we need to pull H.264 and
+// AAC out of a single program transport stream. PSI sections are expected to
+// fit within a single TS packet, which is the case for every encoder we've seen.
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	pidPAT = 0x0000
+
+	streamTypeAAC  = 0x0F
+	streamTypeH264 = 0x1B
+)
+
+var (
+	ErrSyncByte     = errors.New("mpegts: missing sync byte")
+	ErrShortPacket  = errors.New("mpegts: packet is too short")
+	ErrInvalidPES   = errors.New("mpegts: invalid PES header")
+	ErrInvalidTable = errors.New("mpegts: invalid PSI table")
+)
+
+type pesPacket struct {
+	streamType uint8
+	pts        int64
+	hasPTS     bool
+	data       []byte
+}
+
+type demuxer struct {
+	pmtPIDs map[uint16]bool
+	// Elementary stream PID => stream type
+	streams map[uint16]uint8
+	// PES payloads being reassembled, per PID
+	buffers map[uint16][]byte
+
+	onProgram func(streams map[uint16]uint8)
+	onPES     func(pes *pesPacket)
+}
+
+func newDemuxer(onProgram func(map[uint16]uint8), onPES func(*pesPacket)) *demuxer {
+	return &demuxer{
+		pmtPIDs:   make(map[uint16]bool),
+		streams:   make(map[uint16]uint8),
+		buffers:   make(map[uint16][]byte),
+		onProgram: onProgram,
+		onPES:     onPES,
+	}
+}
+
+// Write accepts one or more 188 byte TS packets, as typically found in a UDP datagram
+func (d *demuxer) Write(data []byte) error {
+	for len(data) >= tsPacketSize {
+		if err := d.writePacket(data[:tsPacketSize]); err != nil {
+			return err
+		}
+		data = data[tsPacketSize:]
+	}
+	return nil
+}
+
+func (d *demuxer) writePacket(pkt []byte) error {
+	if pkt[0] != tsSyncByte {
+		return ErrSyncByte
+	}
+
+	payloadUnitStart := pkt[1]&0x40 != 0
+	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1FFF
+	adaptationFieldControl := (pkt[3] >> 4) & 0x3
+
+	offset := 4
+	if adaptationFieldControl&0x2 != 0 {
+		offset += 1 + int(pkt[4])
+	}
+	if adaptationFieldControl&0x1 == 0 || offset >= len(pkt) {
+		// No payload
+		return nil
+	}
+	payload := pkt[offset:]
+
+	switch {
+	case pid == pidPAT:
+		return d.parsePAT(payload, payloadUnitStart)
+	case d.pmtPIDs[pid]:
+		return d.parsePMT(payload, payloadUnitStart)
+	}
+
+	if _, ok := d.streams[pid]; !ok {
+		return nil
+	}
+
+	if payloadUnitStart {
+		// A new PES packet starting means the previous one is complete
+		if err := d.flush(pid); err != nil {
+			return err
+		}
+		d.buffers[pid] = append([]byte{}, payload...)
+	} else if buf, ok := d.buffers[pid]; ok {
+		d.buffers[pid] = append(buf, payload...)
+	}
+
+	return nil
+}
+
+func (d *demuxer) flush(pid uint16) error {
+	buf, ok := d.buffers[pid]
+	if !ok || len(buf) == 0 {
+		return nil
+	}
+	delete(d.buffers, pid)
+
+	pes, err := parsePES(buf)
+	if err != nil {
+		return err
+	}
+	pes.streamType = d.streams[pid]
+	d.onPES(pes)
+
+	return nil
+}
+
+func psiSection(payload []byte, payloadUnitStart bool) ([]byte, error) {
+	if !payloadUnitStart || len(payload) < 1 {
+		return nil, nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, ErrInvalidTable
+	}
+	section := payload[1+pointer:]
+	sectionLength := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+	if 3+sectionLength > len(section) || sectionLength < 9 {
+		return nil, ErrInvalidTable
+	}
+	// Strip the CRC
+	return section[:3+sectionLength-4], nil
+}
+
+func (d *demuxer) parsePAT(payload []byte, payloadUnitStart bool) error {
+	section, err := psiSection(payload, payloadUnitStart)
+	if err != nil || section == nil {
+		return err
+	}
+
+	for i := 8; i+4 <= len(section); i += 4 {
+		programNumber := binary.BigEndian.Uint16(section[i : i+2])
+		pid := binary.BigEndian.Uint16(section[i+2:i+4]) & 0x1FFF
+		if programNumber == 0 {
+			// Network PID, not a program
+			continue
+		}
+		d.pmtPIDs[pid] = true
+	}
+
+	return nil
+}
+
+func (d *demuxer) parsePMT(payload []byte, payloadUnitStart bool) error {
+	section, err := psiSection(payload, payloadUnitStart)
+	if err != nil || section == nil {
+		return err
+	}
+	if len(section) < 12 {
+		return ErrInvalidTable
+	}
+
+	programInfoLength := int(binary.BigEndian.Uint16(section[10:12]) & 0x0FFF)
+	streams := make(map[uint16]uint8)
+	for i := 12 + programInfoLength; i+5 <= len(section); {
+		streamType := section[i]
+		pid := binary.BigEndian.Uint16(section[i+1:i+3]) & 0x1FFF
+		esInfoLength := int(binary.BigEndian.Uint16(section[i+3:i+5]) & 0x0FFF)
+
+		if streamType == streamTypeH264 || streamType == streamTypeAAC {
+			streams[pid] = streamType
+		}
+
+		i += 5 + esInfoLength
+	}
+
+	changed := len(streams) != len(d.streams)
+	for pid, streamType := range streams {
+		if d.streams[pid] != streamType {
+			changed = true
+		}
+	}
+	if changed {
+		d.streams = streams
+		d.onProgram(streams)
+	}
+
+	return nil
+}
+
+func parsePES(buf []byte) (*pesPacket, error) {
+	if len(buf) < 9 || buf[0] != 0x00 || buf[1] != 0x00 || buf[2] != 0x01 {
+		return nil, ErrInvalidPES
+	}
+
+	ptsDtsFlags := buf[7] >> 6
+	headerLength := int(buf[8])
+	if 9+headerLength > len(buf) {
+		return nil, ErrInvalidPES
+	}
+
+	pes := &pesPacket{
+		data: buf[9+headerLength:],
+	}
+	if ptsDtsFlags&0x2 != 0 && headerLength >= 5 {
+		pes.pts = parseTimestamp(buf[9:14])
+		pes.hasPTS = true
+	}
+
+	return pes, nil
+}
+
+// parseTimestamp decodes the 33 bit PTS/DTS spread over 5 bytes with marker bits
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
@@ -0,0 +1,302 @@
+package mpegts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+)
+
+// testPacket builds a TS packet, stuffing the adaptation field so the payload
+// ends with the packet
+func testPacket(pid uint16, start bool, payload []byte) []byte {
+	pkt := []byte{tsSyncByte, byte(pid>>8) & 0x1F, byte(pid), 0x10}
+	if start {
+		pkt[1] |= 0x40
+	}
+	if stuffing := tsPacketSize - 4 - len(payload); stuffing > 0 {
+		pkt[3] |= 0x20
+		pkt = append(pkt, byte(stuffing-1))
+		if stuffing > 1 {
+			pkt = append(pkt, 0x00)
+			for i := 2; i < stuffing; i++ {
+				pkt = append(pkt, 0xFF)
+			}
+		}
+	}
+	return append(pkt, payload...)
+}
+
+// testSection wraps a PSI table in its header, with the pointer field in
+// front and a dummy CRC on the end
+func testSection(tableID byte, body []byte) []byte {
+	length := len(body) + 4
+	section := []byte{0x00, tableID, 0xB0 | byte(length>>8), byte(length)}
+	section = append(section, body...)
+	return append(section, 0xDE, 0xAD, 0xBE, 0xEF)
+}
+
+func testPAT(pmtPID uint16) []byte {
+	return testSection(0x00, []byte{
+		0x00, 0x01, 0xC1, 0x00, 0x00,
+		// Network PID, which isn't a program
+		0x00, 0x00, 0xE0, 0x10,
+		0x00, 0x01, 0xE0 | byte(pmtPID>>8), byte(pmtPID),
+	})
+}
+
+func testPMT(streams ...[]byte) []byte {
+	body := []byte{0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00}
+	for _, stream := range streams {
+		body = append(body, stream...)
+	}
+	return testSection(0x02, body)
+}
+
+func testStream(streamType byte, pid uint16, esInfo ...byte) []byte {
+	return append([]byte{streamType, 0xE0 | byte(pid>>8), byte(pid), 0xF0, byte(len(esInfo))}, esInfo...)
+}
+
+// testPES is a PES packet with a PTS of 90000
+func testPES(data []byte) []byte {
+	pes := []byte{0x00, 0x00, 0x01, 0xE0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x05, 0xBF, 0x21}
+	return append(pes, data...)
+}
+
+type testDemux struct {
+	*demuxer
+	programs []map[uint16]uint8
+	pes      []*pesPacket
+}
+
+func newTestDemux() *testDemux {
+	d := &testDemux{}
+	d.demuxer = newDemuxer(func(streams map[uint16]uint8) {
+		d.programs = append(d.programs, streams)
+	}, func(pes *pesPacket) {
+		d.pes = append(d.pes, pes)
+	})
+	return d
+}
+
+func TestDemuxerTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		streams map[uint16]uint8
+		err     error
+	}{
+		{
+			name: "video and audio",
+			packets: [][]byte{
+				testPacket(pidPAT, true, testPAT(testPMTPID)),
+				testPacket(testPMTPID, true, testPMT(
+					testStream(streamTypeH264, testVideoPID),
+					testStream(streamTypeAAC, testAudioPID, 0x0A, 0x04, 'e', 'n', 'g', 0x00),
+				)),
+			},
+			streams: map[uint16]uint8{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC},
+		},
+		{
+			name: "unsupported streams are left out",
+			packets: [][]byte{
+				testPacket(pidPAT, true, testPAT(testPMTPID)),
+				testPacket(testPMTPID, true, testPMT(
+					testStream(streamTypeH264, testVideoPID),
+					// MPEG-1 audio
+					testStream(0x03, testAudioPID),
+				)),
+			},
+			streams: map[uint16]uint8{testVideoPID: streamTypeH264},
+		},
+		{
+			name: "PMT before the PAT is ignored",
+			packets: [][]byte{
+				testPacket(testPMTPID, true, testPMT(testStream(streamTypeH264, testVideoPID))),
+			},
+		},
+		{
+			name: "PAT without payload unit start is ignored",
+			packets: [][]byte{
+				testPacket(pidPAT, false, testPAT(testPMTPID)),
+				testPacket(testPMTPID, true, testPMT(testStream(streamTypeH264, testVideoPID))),
+			},
+		},
+		{
+			name: "pointer past the end",
+			packets: [][]byte{
+				testPacket(pidPAT, true, []byte{0xB7, 0x00}),
+			},
+			err: ErrInvalidTable,
+		},
+		{
+			name: "section longer than the packet",
+			packets: [][]byte{
+				testPacket(pidPAT, true, []byte{0x00, 0x00, 0xB0, 0xFF, 0x00, 0x01}),
+			},
+			err: ErrInvalidTable,
+		},
+		{
+			name: "PMT too short",
+			packets: [][]byte{
+				testPacket(pidPAT, true, testPAT(testPMTPID)),
+				testPacket(testPMTPID, true, testSection(0x02, []byte{0x00, 0x01, 0xC1, 0x00, 0x00})),
+			},
+			err: ErrInvalidTable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			d := newTestDemux()
+			var err error
+			for _, pkt := range test.packets {
+				if err = d.Write(pkt); err != nil {
+					break
+				}
+			}
+			assert.Equal(test.err, err)
+			if test.streams == nil {
+				assert.Empty(d.programs)
+				return
+			}
+			if assert.Len(d.programs, 1) {
+				assert.Equal(test.streams, d.programs[0])
+			}
+		})
+	}
+}
+
+func TestDemuxerPES(t *testing.T) {
+	frame := make([]byte, 400)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	pes := testPES(frame)
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		data    [][]byte
+		err     error
+	}{
+		{
+			name: "single packet",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, testPES([]byte{0x01, 0x02, 0x03})),
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			data: [][]byte{{0x01, 0x02, 0x03}},
+		},
+		{
+			name: "spanning packets",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, pes[:184]),
+				testPacket(testVideoPID, false, pes[184:368]),
+				testPacket(testVideoPID, false, pes[368:]),
+				// Only finished by the next one starting
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			data: [][]byte{frame},
+		},
+		{
+			name: "interleaved with other streams",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, pes[:184]),
+				testPacket(testAudioPID, true, testPES([]byte{0xAA})),
+				testPacket(testVideoPID, false, pes[184:368]),
+				testPacket(0x1FFF, false, make([]byte, 184)),
+				testPacket(testVideoPID, false, pes[368:]),
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			data: [][]byte{frame},
+		},
+		{
+			name: "continuation without a start is dropped",
+			packets: [][]byte{
+				testPacket(testVideoPID, false, pes[184:368]),
+				testPacket(testVideoPID, true, testPES([]byte{0x01})),
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			data: [][]byte{{0x01}},
+		},
+		{
+			name: "missing start code",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, []byte{0x00, 0x00, 0x02, 0xE0, 0x00, 0x00, 0x80, 0x00, 0x00}),
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			err: ErrInvalidPES,
+		},
+		{
+			name: "truncated PES header",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, []byte{0x00, 0x00, 0x01, 0xE0, 0x00}),
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			err: ErrInvalidPES,
+		},
+		{
+			name: "header length past the end",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, []byte{0x00, 0x00, 0x01, 0xE0, 0x00, 0x00, 0x80, 0x80, 0x40, 0x21}),
+				testPacket(testVideoPID, true, testPES(nil)),
+			},
+			err: ErrInvalidPES,
+		},
+		{
+			name: "missing sync byte",
+			packets: [][]byte{
+				append([]byte{0x48}, testPacket(testVideoPID, true, testPES(nil))[1:]...),
+			},
+			err: ErrSyncByte,
+		},
+		{
+			name: "truncated packet is ignored",
+			packets: [][]byte{
+				testPacket(testVideoPID, true, testPES([]byte{0x01}))[:100],
+			},
+		},
+		{
+			name: "adaptation field past the end",
+			packets: [][]byte{
+				append([]byte{tsSyncByte, 0x41, 0x00, 0x30, 0xFF}, make([]byte, 183)...),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			d := newTestDemux()
+			d.streams = map[uint16]uint8{testVideoPID: streamTypeH264, testAudioPID: streamTypeAAC}
+
+			var err error
+			for _, pkt := range test.packets {
+				if err = d.Write(pkt); err != nil {
+					break
+				}
+			}
+			assert.Equal(test.err, err)
+
+			var data [][]byte
+			for _, pes := range d.pes {
+				if pes.streamType != streamTypeH264 {
+					continue
+				}
+				assert.True(pes.hasPTS)
+				assert.Equal(int64(90000), pes.pts)
+				data = append(data, pes.data)
+			}
+			assert.Equal(test.data, data)
+		})
+	}
+}
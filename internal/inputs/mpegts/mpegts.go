@@ -0,0 +1,341 @@
+package mpegts
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Glimesh/go-fdkaac/fdkaac"
+	"github.com/Glimesh/waveguide/pkg/control"
+	h264joy "github.com/nareix/joy5/codec/h264"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	opus "gopkg.in/hraban/opus.v2"
+)
+
+const (
+	FTL_MTU      uint16 = 1392
+	FTL_VIDEO_PT uint8  = 96
+	FTL_AUDIO_PT uint8  = 97
+
+	// Enough for 7 TS packets per datagram, the usual for UDP transport
+	udpPacketSize = 7 * tsPacketSize
+
+	// If we don't receive anything for this long the stream is considered stopped
+	inactivityTimeout = 10 * time.Second
+
+	videoClockRate uint32 = 90000
+	audioClockRate uint32 = 48000
+)
+
+type MPEGTSSource struct {
+	log     logrus.FieldLogger
+	config  MPEGTSSourceConfig
+	control *control.Control
+
+	ctx        context.Context
+	channelID  control.ChannelID
+	stream     *control.Stream
+	controlCtx context.Context
+	started    bool
+
+	videoTrack      *webrtc.TrackLocalStaticRTP
+	videoPacketizer rtp.Packetizer
+	lastVideoPTS    int64
+
+	audioTrack      *webrtc.TrackLocalStaticRTP
+	audioPacketizer rtp.Packetizer
+	audioDecoder    *fdkaac.AacDecoder
+	audioEncoder    *opus.Encoder
+	audioBuffer     []byte
+}
+
+type MPEGTSSourceConfig struct {
+	// Listen address for the UDP socket in the ip:port format
+	Address string
+	// Optional multicast group to join, eg 239.0.0.1
+	MulticastGroup string `mapstructure:"multicast_group"`
+	// Optional network interface name to join the multicast group on
+	Interface string
+	// Socket receive buffer size in bytes, unset uses the OS default
+	BufferSize int `mapstructure:"buffer_size"`
+	// Channel the incoming transport stream is published to
+	ChannelID int `mapstructure:"channel_id"`
+}
+
+func New(config MPEGTSSourceConfig) control.Input {
+	return &MPEGTSSource{
+		config: config,
+	}
+}
+
+func (s *MPEGTSSource) SetControl(ctrl *control.Control) {
+	s.control = ctrl
+}
+
+func (s *MPEGTSSource) SetLogger(log logrus.FieldLogger) {
+	s.log = log
+}
+
+func (s *MPEGTSSource) Listen(ctx context.Context) {
+	s.ctx = ctx
+	s.channelID = control.ChannelID(s.config.ChannelID)
+
+	conn, err := s.listenUDP()
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	if s.config.BufferSize > 0 {
+		if err := conn.SetReadBuffer(s.config.BufferSize); err != nil {
+			s.log.Warnf("Could not set buffer_size=%d: %+v", s.config.BufferSize, err)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	s.log.Infof("Starting MPEG-TS Server on %s for channel_id=%d", s.config.Address, s.channelID)
+
+	demux := newDemuxer(s.onProgram, s.onPES)
+	buf := make([]byte, udpPacketSize*2)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(inactivityTimeout)); err != nil {
+			s.log.Errorf("Failed: %+v", err)
+			return
+		}
+
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if s.started {
+					s.log.Infof("No data received for %s, stopping stream", inactivityTimeout)
+					s.stopStream()
+					demux = newDemuxer(s.onProgram, s.onPES)
+				}
+				continue
+			}
+			if ctx.Err() == nil {
+				s.log.Errorf("Failed: %+v", err)
+			}
+			s.stopStream()
+			return
+		}
+
+		if err := demux.Write(buf[:n]); err != nil {
+			s.log.Debugf("Dropping datagram: %+v", err)
+		}
+		if s.started {
+			s.stream.AddReceivedBytes(n)
+		}
+	}
+}
+
+func (s *MPEGTSSource) listenUDP() (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", s.config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.MulticastGroup == "" {
+		return net.ListenUDP("udp", addr)
+	}
+
+	group := net.ParseIP(s.config.MulticastGroup)
+	if group == nil || !group.IsMulticast() {
+		return nil, fmt.Errorf("multicast_group %q is not a multicast address", s.config.MulticastGroup)
+	}
+
+	var iface *net.Interface
+	if s.config.Interface != "" {
+		iface, err = net.InterfaceByName(s.config.Interface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return net.ListenMulticastUDP("udp", iface, &net.UDPAddr{IP: group, Port: addr.Port})
+}
+
+func (s *MPEGTSSource) onProgram(streams map[uint16]uint8) {
+	if s.started {
+		// The program changed underneath us, start over with the new tracks
+		s.stopStream()
+	}
+
+	var err error
+	s.stream, s.controlCtx, err = s.control.StartStream(s.ctx, s.channelID, control.InputMetadata("mpegts"))
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+	s.started = true
+
+	for _, streamType := range streams {
+		switch streamType {
+		case streamTypeH264:
+			err = s.initVideo()
+		case streamTypeAAC:
+			err = s.initAudio()
+		}
+		if err != nil {
+			s.log.Errorf("Failed: %+v", err)
+			s.stopStream()
+			return
+		}
+	}
+}
+
+func (s *MPEGTSSource) stopStream() {
+	if s.started && s.controlCtx.Err() == nil {
+		if err := s.control.StopStream(s.channelID); err != nil {
+			s.log.Error(err)
+		}
+	}
+	s.started = false
+	s.stream = nil
+
+	s.videoTrack = nil
+	s.audioTrack = nil
+	s.audioBuffer = nil
+	if s.audioDecoder != nil {
+		s.audioDecoder.Close()
+		s.audioDecoder = nil
+	}
+}
+
+func (s *MPEGTSSource) initVideo() (err error) {
+	s.videoPacketizer = rtp.NewPacketizer(FTL_MTU, FTL_VIDEO_PT, uint32(s.channelID+1), &codecs.H264Payloader{}, rtp.NewFixedSequencer(25000), videoClockRate)
+	s.lastVideoPTS = -1
+
+	s.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	if err != nil {
+		return err
+	}
+
+	s.stream.AddTrack(s.videoTrack, webrtc.MimeTypeH264)
+	s.stream.ReportMetadata(control.VideoCodecMetadata(webrtc.MimeTypeH264))
+
+	return nil
+}
+
+func (s *MPEGTSSource) initAudio() (err error) {
+	s.audioPacketizer = rtp.NewPacketizer(FTL_MTU, FTL_AUDIO_PT, uint32(s.channelID), &codecs.OpusPayloader{}, rtp.NewFixedSequencer(0), audioClockRate)
+
+	s.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	if err != nil {
+		return err
+	}
+
+	s.audioEncoder, err = opus.NewEncoder(int(audioClockRate), 2, opus.AppAudio)
+	if err != nil {
+		return err
+	}
+	s.audioDecoder = fdkaac.NewAacDecoder()
+	if err := s.audioDecoder.InitAdts(); err != nil {
+		return err
+	}
+
+	s.stream.AddTrack(s.audioTrack, webrtc.MimeTypeOpus)
+	s.stream.ReportMetadata(control.AudioCodecMetadata(webrtc.MimeTypeOpus))
+
+	return nil
+}
+
+func (s *MPEGTSSource) onPES(pes *pesPacket) {
+	if !s.started || s.controlCtx.Err() != nil {
+		return
+	}
+
+	var err error
+	switch pes.streamType {
+	case streamTypeH264:
+		err = s.writeVideo(pes)
+	case streamTypeAAC:
+		err = s.writeAudio(pes)
+	}
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+	}
+}
+
+func (s *MPEGTSSource) writeVideo(pes *pesPacket) error {
+	if s.videoTrack == nil {
+		return nil
+	}
+
+	nalus, _ := h264joy.SplitNALUs(pes.data)
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1F == 5 {
+			s.stream.ReportMetadata(control.KeyframeMetadata())
+			break
+		}
+	}
+
+	// PES timestamps are already in the 90kHz video clock, so we can use the
+	// delta between frames directly as the RTP sample count
+	var samples uint32
+	if pes.hasPTS && s.lastVideoPTS >= 0 && pes.pts > s.lastVideoPTS {
+		samples = uint32(pes.pts - s.lastVideoPTS)
+	}
+	if pes.hasPTS {
+		s.lastVideoPTS = pes.pts
+	}
+
+	packets := s.videoPacketizer.Packetize(pes.data, samples)
+	for _, p := range packets {
+		if err := s.videoTrack.WriteRTP(p); err != nil {
+			return err
+		}
+	}
+
+	s.stream.ReportMetadata(control.VideoPacketsMetadata(len(packets)))
+
+	return nil
+}
+
+func (s *MPEGTSSource) writeAudio(pes *pesPacket) error {
+	if s.audioTrack == nil {
+		return nil
+	}
+
+	// Convert AAC to opus
+	pcm, err := s.audioDecoder.Decode(pes.data)
+	if err != nil {
+		return fmt.Errorf("decode error: %w", err)
+	}
+
+	blockSize := 960
+	for s.audioBuffer = append(s.audioBuffer, pcm...); len(s.audioBuffer) >= blockSize*4; s.audioBuffer = s.audioBuffer[blockSize*4:] {
+		pcm16 := make([]int16, blockSize*2)
+		for i := 0; i < len(pcm16); i++ {
+			pcm16[i] = int16(binary.LittleEndian.Uint16(s.audioBuffer[i*2:]))
+		}
+		opusData := make([]byte, 1024)
+		n, err := s.audioEncoder.Encode(pcm16, opusData)
+		if err != nil {
+			return err
+		}
+
+		packets := s.audioPacketizer.Packetize(opusData[:n], uint32(blockSize))
+		for _, p := range packets {
+			if err := s.audioTrack.WriteRTP(p); err != nil {
+				return err
+			}
+		}
+
+		s.stream.ReportMetadata(control.AudioPacketsMetadata(len(packets)))
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Nesting allowed in script data, onMetaData is flat in practice
+const maxAMF0Depth = 32
+
+var errAMF0Malformed = errors.New("malformed AMF0 script data")
+
+// checkAMF0 walks AMF0 encoded data without decoding it, making sure every
+// length and count fits in the bytes that are left. go-amf0 allocates
+// whatever a strict array or long string claims up front, so a few bytes
+// claiming billions of elements would otherwise run us out of memory.
+func checkAMF0(data []byte) error {
+	s := amf0Scanner{data: data}
+	for s.pos < len(s.data) {
+		if err := s.value(0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type amf0Scanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *amf0Scanner) remaining() int {
+	return len(s.data) - s.pos
+}
+
+func (s *amf0Scanner) skip(n int) error {
+	if n < 0 || n > s.remaining() {
+		return errAMF0Malformed
+	}
+	s.pos += n
+	return nil
+}
+
+func (s *amf0Scanner) u16() (int, error) {
+	if s.remaining() < 2 {
+		return 0, errAMF0Malformed
+	}
+	n := binary.BigEndian.Uint16(s.data[s.pos:])
+	s.pos += 2
+	return int(n), nil
+}
+
+func (s *amf0Scanner) u32() (int, error) {
+	if s.remaining() < 4 {
+		return 0, errAMF0Malformed
+	}
+	n := binary.BigEndian.Uint32(s.data[s.pos:])
+	s.pos += 4
+	if int64(n) > int64(s.remaining()) {
+		// Every element or byte it claims needs at least a byte of its own
+		return 0, errAMF0Malformed
+	}
+	return int(n), nil
+}
+
+func (s *amf0Scanner) value(depth int) error {
+	if depth > maxAMF0Depth {
+		return errAMF0Malformed
+	}
+	if s.remaining() < 1 {
+		return errAMF0Malformed
+	}
+	marker := s.data[s.pos]
+	s.pos++
+
+	switch marker {
+	case 0x00: // number
+		return s.skip(8)
+	case 0x01: // boolean
+		return s.skip(1)
+	case 0x02: // string
+		n, err := s.u16()
+		if err != nil {
+			return err
+		}
+		return s.skip(n)
+	case 0x03: // object
+		return s.properties(depth + 1)
+	case 0x05, 0x06, 0x0D: // null, undefined, unsupported
+		return nil
+	case 0x07: // reference
+		return s.skip(2)
+	case 0x08: // ECMA array, the count is only a hint
+		if err := s.skip(4); err != nil {
+			return err
+		}
+		return s.properties(depth + 1)
+	case 0x0A: // strict array
+		n, err := s.u32()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := s.value(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 0x0B: // date, with its timezone
+		return s.skip(10)
+	case 0x0C, 0x0F: // long string, XML document
+		n, err := s.u32()
+		if err != nil {
+			return err
+		}
+		return s.skip(n)
+	case 0x10: // typed object
+		n, err := s.u16()
+		if err != nil {
+			return err
+		}
+		if err := s.skip(n); err != nil {
+			return err
+		}
+		return s.properties(depth + 1)
+	}
+
+	return errAMF0Malformed
+}
+
+// properties skips key/value pairs up to the empty key and object end marker
+func (s *amf0Scanner) properties(depth int) error {
+	for {
+		n, err := s.u16()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return s.skip(1)
+		}
+		if err := s.skip(n); err != nil {
+			return err
+		}
+		if err := s.value(depth); err != nil {
+			return err
+		}
+	}
+}
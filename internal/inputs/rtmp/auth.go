@@ -0,0 +1,140 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+const (
+	AuthModeKey     = "key"
+	AuthModeWebhook = "webhook"
+	AuthModeJWT     = "jwt"
+
+	DefaultAuthCacheTTL = time.Minute
+
+	authWebhookTimeout = 5 * time.Second
+	authCacheSize      = 1024
+)
+
+var ErrAuthRejected = errors.New("stream rejected by auth webhook")
+
+// authenticator decides if a client may publish to a channel
+type authenticator interface {
+	authenticate(channelID control.ChannelID, streamKey control.StreamKey, remoteAddr string) error
+}
+
+func newAuthenticator(config RTMPSourceConfig, ctrl *control.Control) (authenticator, error) {
+	switch config.AuthMode {
+	case AuthModeKey:
+		return keyAuth{control: ctrl}, nil
+	case AuthModeWebhook:
+		if config.AuthWebhookURL == "" {
+			return nil, errors.New("auth_mode webhook requires auth_webhook_url")
+		}
+		return &webhookAuth{
+			url:    config.AuthWebhookURL,
+			client: &http.Client{Timeout: authWebhookTimeout},
+			cache:  expirable.NewLRU[string, bool](authCacheSize, nil, config.AuthCacheTTL),
+		}, nil
+	case AuthModeJWT:
+		if config.AuthJWTSecret == "" {
+			return nil, errors.New("auth_mode jwt requires auth_jwt_secret")
+		}
+		return jwtAuth{secret: []byte(config.AuthJWTSecret)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth_mode %q, expected one of key, webhook, jwt", config.AuthMode)
+}
+
+// keyAuth compares the stream key with the one from the service
+type keyAuth struct {
+	control *control.Control
+}
+
+func (a keyAuth) authenticate(channelID control.ChannelID, streamKey control.StreamKey, remoteAddr string) error {
+	return a.control.Authenticate(channelID, streamKey)
+}
+
+// webhookAuth asks an external service, caching streams it allowed
+type webhookAuth struct {
+	url    string
+	client *http.Client
+	cache  *expirable.LRU[string, bool]
+}
+
+type webhookAuthRequest struct {
+	ChannelID  control.ChannelID `json:"channel_id"`
+	StreamKey  string            `json:"stream_key"`
+	RemoteAddr string            `json:"remote_addr"`
+}
+
+func (a *webhookAuth) authenticate(channelID control.ChannelID, streamKey control.StreamKey, remoteAddr string) error {
+	cacheKey := fmt.Sprintf("%d-%s", channelID, streamKey)
+	if _, ok := a.cache.Get(cacheKey); ok {
+		return nil
+	}
+
+	// The webhook only gets the IP, the client's port means nothing to it
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	body, err := json.Marshal(webhookAuthRequest{
+		ChannelID:  channelID,
+		StreamKey:  string(streamKey),
+		RemoteAddr: host,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", ErrAuthRejected, resp.StatusCode)
+	}
+
+	a.cache.Add(cacheKey, true)
+	return nil
+}
+
+// jwtAuth accepts stream keys that are HS256 tokens for the channel, signed with a shared secret
+type jwtAuth struct {
+	secret []byte
+}
+
+type streamClaims struct {
+	ChannelID control.ChannelID `json:"channel_id"`
+	jwt.RegisteredClaims
+}
+
+func (a jwtAuth) authenticate(channelID control.ChannelID, streamKey control.StreamKey, remoteAddr string) error {
+	claims := &streamClaims{}
+	_, err := jwt.ParseWithClaims(string(streamKey), claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return a.secret, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if claims.ChannelID != channelID {
+		return fmt.Errorf("token is for channel %d, not %d", claims.ChannelID, channelID)
+	}
+	return nil
+}
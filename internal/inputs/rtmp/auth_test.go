@@ -0,0 +1,136 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testWebhook allows channel 1 with stream key "good", recording every request
+func testWebhook(requests *[]webhookAuthRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webhookAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, req)
+
+		if req.ChannelID != 1 || req.StreamKey != "good" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestWebhookAuth(t *testing.T) {
+	assert := assert.New(t)
+	var requests []webhookAuthRequest
+	server := testWebhook(&requests)
+	defer server.Close()
+
+	auth, err := newAuthenticator(RTMPSourceConfig{
+		AuthMode:       AuthModeWebhook,
+		AuthWebhookURL: server.URL,
+		AuthCacheTTL:   time.Minute,
+	}, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NoError(auth.authenticate(1, control.StreamKey("good"), "203.0.113.7:51234"))
+	if assert.Len(requests, 1) {
+		assert.Equal(webhookAuthRequest{ChannelID: 1, StreamKey: "good", RemoteAddr: "203.0.113.7"}, requests[0])
+	}
+
+	// Allowed streams are cached
+	assert.NoError(auth.authenticate(1, control.StreamKey("good"), "203.0.113.7:51235"))
+	assert.Len(requests, 1)
+
+	err = auth.authenticate(1, control.StreamKey("bad"), "[2001:db8::1]:51234")
+	assert.ErrorIs(err, ErrAuthRejected)
+	if assert.Len(requests, 2) {
+		assert.Equal("2001:db8::1", requests[1].RemoteAddr)
+	}
+
+	// Rejections aren't, the key may be fixed any moment
+	assert.ErrorIs(auth.authenticate(1, control.StreamKey("bad"), "203.0.113.7:51234"), ErrAuthRejected)
+	assert.Len(requests, 3)
+
+	assert.ErrorIs(auth.authenticate(2, control.StreamKey("good"), "203.0.113.7:51234"), ErrAuthRejected)
+}
+
+func TestWebhookAuthUnreachable(t *testing.T) {
+	assert := assert.New(t)
+	var requests []webhookAuthRequest
+	server := testWebhook(&requests)
+	server.Close()
+
+	auth, err := newAuthenticator(RTMPSourceConfig{
+		AuthMode:       AuthModeWebhook,
+		AuthWebhookURL: server.URL,
+		AuthCacheTTL:   time.Minute,
+	}, nil)
+	if assert.NoError(err) {
+		assert.Error(auth.authenticate(1, control.StreamKey("good"), "203.0.113.7:51234"))
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(method jwt.SigningMethod, key interface{}, claims streamClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expired := jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}
+
+	tests := []struct {
+		name      string
+		channelID control.ChannelID
+		token     string
+		ok        bool
+	}{
+		{"valid", 1, sign(jwt.SigningMethodHS256, secret, streamClaims{ChannelID: 1}), true},
+		{"other channel", 2, sign(jwt.SigningMethodHS256, secret, streamClaims{ChannelID: 1}), false},
+		{"wrong secret", 1, sign(jwt.SigningMethodHS256, []byte("wrong"), streamClaims{ChannelID: 1}), false},
+		{"expired", 1, sign(jwt.SigningMethodHS256, secret, streamClaims{ChannelID: 1, RegisteredClaims: expired}), false},
+		{"unsigned", 1, sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, streamClaims{ChannelID: 1}), false},
+		{"not a token", 1, "plainkey", false},
+	}
+
+	auth, err := newAuthenticator(RTMPSourceConfig{AuthMode: AuthModeJWT, AuthJWTSecret: string(secret)}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := auth.authenticate(test.channelID, control.StreamKey(test.token), "203.0.113.7:51234")
+			if test.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newAuthenticator(RTMPSourceConfig{AuthMode: AuthModeWebhook}, nil)
+	assert.Error(err)
+	_, err = newAuthenticator(RTMPSourceConfig{AuthMode: AuthModeJWT}, nil)
+	assert.Error(err)
+	_, err = newAuthenticator(RTMPSourceConfig{AuthMode: "password"}, nil)
+	assert.Error(err)
+}
@@ -0,0 +1,58 @@
+package rtmp
+
+// avSync keeps the RTMP timestamps, in milliseconds, of the first audio and
+// video frames of a connection. Sequence headers don't count, encoders send
+// them at 0 whatever their media starts at.
+type avSync struct {
+	audioBaseTime uint32
+	videoBaseTime uint32
+	haveAudioBase bool
+	haveVideoBase bool
+
+	// videoBaseTime - audioBaseTime, pending until it has been taken off the
+	// video RTP timestamps
+	videoOffset int64
+	pending     bool
+}
+
+// syncAudio notes the timestamp of an audio frame, only the first one matters
+func (h *connHandler) syncAudio(timestamp uint32) {
+	if !h.config.AVSyncCorrection || h.avSync.haveAudioBase {
+		return
+	}
+	h.avSync.audioBaseTime = timestamp
+	h.avSync.haveAudioBase = true
+	h.computeVideoOffset()
+}
+
+// syncVideo notes the timestamp of a video frame, only the first one matters
+func (h *connHandler) syncVideo(timestamp uint32) {
+	if !h.config.AVSyncCorrection || h.avSync.haveVideoBase {
+		return
+	}
+	h.avSync.videoBaseTime = timestamp
+	h.avSync.haveVideoBase = true
+	h.computeVideoOffset()
+}
+
+func (h *connHandler) computeVideoOffset() {
+	if !h.avSync.haveAudioBase || !h.avSync.haveVideoBase {
+		return
+	}
+
+	h.avSync.videoOffset = int64(h.avSync.videoBaseTime) - int64(h.avSync.audioBaseTime)
+	h.avSync.pending = h.avSync.videoOffset != 0
+	h.log.Infof("Video timestamps are %d ms off from audio, correcting", h.avSync.videoOffset)
+}
+
+// videoSyncSamples returns the correction to add to the next video RTP
+// timestamp, once, after the offset has been worked out. A positive offset
+// comes back as a wrapped negative number, SkipSamples adding it takes the
+// timestamp backwards.
+func (h *connHandler) videoSyncSamples() uint32 {
+	if !h.avSync.pending {
+		return 0
+	}
+	h.avSync.pending = false
+	return uint32(-h.avSync.videoOffset * int64(h.videoClockRate) / 1000)
+}
@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/rtp"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// skipCounter adds up the samples video RTP timestamps are moved on by
+type skipCounter struct {
+	skipped int64
+}
+
+func (c *skipCounter) Packetize(payload []byte, samples uint32) []*rtp.Packet {
+	return nil
+}
+
+func (c *skipCounter) EnableAbsSendTime(value int) {}
+
+func (c *skipCounter) SkipSamples(skippedSamples uint32) {
+	c.skipped += int64(int32(skippedSamples))
+}
+
+// avSyncDrift sends audio and video captured at the same time, with the video
+// stamped 200ms later, and returns the largest gap in ms between the audio
+// timestamp and the time the video RTP timestamp stands for
+func avSyncDrift(t *testing.T, correction bool) int64 {
+	h := &connHandler{
+		controlCtx:          context.Background(),
+		stream:              &control.Stream{},
+		log:                 logrus.New(),
+		videoClockRate:      90000,
+		firstVideoTimestamp: true,
+		config:              RTMPSourceConfig{AVSyncCorrection: correction},
+	}
+	assert.NoError(t, h.initVideo(h.videoClockRate))
+	counter := &skipCounter{}
+	h.videoPacketizer = counter
+
+	// AAC raw frame, then an AVC inter frame as in TestOnVideoWithoutDebugSaveVideo
+	audioTag := []byte{0xaf, 0x01, 0x21, 0x00}
+	videoTag := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x41, 0x9a}
+	const videoOffset = 200
+
+	var drift int64
+	for captured := uint32(0); captured <= 2000; captured += 20 {
+		assert.NoError(t, h.OnAudio(captured, bytes.NewReader(audioTag)))
+		if captured%40 != 0 {
+			continue
+		}
+		assert.NoError(t, h.OnVideo(captured+videoOffset, bytes.NewReader(videoTag)))
+
+		videoTime := videoOffset + counter.skipped*1000/int64(h.videoClockRate)
+		gap := videoTime - int64(captured)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap > drift {
+			drift = gap
+		}
+	}
+	return drift
+}
+
+func TestAVSyncCorrection(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.GreaterOrEqual(avSyncDrift(t, false), int64(190))
+	assert.LessOrEqual(avSyncDrift(t, true), int64(10))
+}
@@ -0,0 +1,120 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"time"
+
+	gortmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// Broadcasters get a chance to lower their bitrate before being cut off
+const (
+	bandwidthTierOK = iota
+	// 75% of the limit, the broadcaster is warned with onBWDone
+	bandwidthTierWarn
+	// 90% of the limit, the acknowledgement window is shrunk
+	bandwidthTierThrottle
+	// The limit itself, the stream is stopped
+	bandwidthTierExceeded
+)
+
+// bandwidthTier compares the bytes received in one check interval against the
+// limit in bytes per interval, reaching the limit exactly counts as exceeding it
+func bandwidthTier(receivedBytes int64, limitBytes int64) int {
+	switch {
+	case receivedBytes >= limitBytes:
+		return bandwidthTierExceeded
+	case receivedBytes >= limitBytes*9/10:
+		return bandwidthTierThrottle
+	case receivedBytes >= limitBytes*3/4:
+		return bandwidthTierWarn
+	}
+	return bandwidthTierOK
+}
+
+func (h *connHandler) bandwidthCheckInterval() time.Duration {
+	return time.Duration(h.config.BandwidthCheckIntervalSeconds) * time.Second
+}
+
+// bitsPerSecond converts bytes per check interval to a bitrate for logging
+func (h *connHandler) bitsPerSecond(bytesPerInterval int64) int64 {
+	return bytesPerInterval * 8 / int64(h.config.BandwidthCheckIntervalSeconds)
+}
+
+// countInputBytes adds media received from the broadcaster to the bitrate
+func (h *connHandler) countInputBytes(n int) {
+	atomic.AddInt64(&h.inputBytes, int64(n))
+	if h.stream != nil {
+		h.stream.AddReceivedBytes(n)
+	}
+}
+
+// checkBandwidth measures the bytes received since the last check, one
+// interval ago, and responds when it moves up a tier. Dropping back down lets
+// the same tier trigger again.
+func (h *connHandler) checkBandwidth() {
+	// Both in bytes per BandwidthCheckIntervalSeconds
+	received := atomic.SwapInt64(&h.inputBytes, 0)
+	limit := h.config.BandwidthLimitBytesPerInterval
+
+	tier := bandwidthTier(received, limit)
+	previous := h.bandwidthTier
+	h.bandwidthTier = tier
+	if tier <= previous {
+		return
+	}
+
+	switch tier {
+	case bandwidthTierWarn:
+		bandwidthSoftLimitHitsTotal.Inc()
+		h.log.Warnf("Bitrate of %d bps is over 75%% of the %d bps limit", h.bitsPerSecond(received), h.bitsPerSecond(limit))
+		if err := h.sendBWDone(); err != nil {
+			h.log.Errorf("Failed to send onBWDone: %+v", err)
+		}
+	case bandwidthTierThrottle:
+		bandwidthSoftLimitHitsTotal.Inc()
+		h.log.Warnf("Bitrate of %d bps is over 90%% of the %d bps limit, shrinking the acknowledgement window", h.bitsPerSecond(received), h.bitsPerSecond(limit))
+		// One second worth of the limit
+		if err := h.sendWinAckSize(int32(limit / int64(h.config.BandwidthCheckIntervalSeconds))); err != nil {
+			h.log.Errorf("Failed to send window acknowledgement size: %+v", err)
+		}
+	case bandwidthTierExceeded:
+		bandwidthHardLimitHitsTotal.Inc()
+		h.log.Warnf("Bitrate of %d bps is over the %d bps limit, stopping stream", h.bitsPerSecond(received), h.bitsPerSecond(limit))
+		h.terminate("bandwidth_limit")
+	}
+}
+
+// sendBWDone sends the onBWDone command, which encoders like OBS and FFmpeg
+// take as the server having finished its bandwidth check
+func (h *connHandler) sendBWDone() error {
+	body := new(bytes.Buffer)
+	if err := rtmpmsg.NewAMFEncoder(body, rtmpmsg.EncodingTypeAMF0).Encode(nil); err != nil {
+		return err
+	}
+
+	return h.writeControlMessage(3, &rtmpmsg.CommandMessage{
+		CommandName:   "onBWDone",
+		TransactionID: 0,
+		Encoding:      rtmpmsg.EncodingTypeAMF0,
+		Body:          body,
+	})
+}
+
+func (h *connHandler) sendWinAckSize(size int32) error {
+	return h.writeControlMessage(2, &rtmpmsg.WinAckSize{Size: size})
+}
+
+// writeControlMessage sends a message on stream 0 of the broadcaster's connection
+func (h *connHandler) writeControlMessage(chunkStreamID int, msg rtmpmsg.Message) error {
+	if h.conn == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+	return h.conn.Write(ctx, chunkStreamID, 0, &gortmp.ChunkMessage{Message: msg})
+}
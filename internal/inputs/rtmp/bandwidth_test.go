@@ -0,0 +1,34 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBandwidthLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &connHandler{
+		control: &control.Control{},
+		log:     logrus.New(),
+		config: RTMPSourceConfig{
+			BandwidthLimitBytesPerInterval: 1000,
+			BandwidthCheckIntervalSeconds:  5,
+		},
+	}
+
+	// One byte short of the limit only gets throttled
+	h.inputBytes = 999
+	h.checkBandwidth()
+	assert.Equal(bandwidthTierThrottle, h.bandwidthTier)
+	assert.False(h.isErrored())
+
+	h.inputBytes = 1000
+	h.checkBandwidth()
+	assert.Equal(bandwidthTierExceeded, h.bandwidthTier)
+	assert.True(h.isErrored())
+	assert.Equal("bandwidth_limit", h.takeCloseReason())
+}
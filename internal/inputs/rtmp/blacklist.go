@@ -0,0 +1,233 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Glimesh/waveguide/pkg/geoip"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errIPBlacklisted      = errors.New("ip is blacklisted")
+	errTooManyConnections = errors.New("too many connections from ip")
+)
+
+// connectionGuard limits how many connections each IP can have open, and
+// keeps out blacklisted IPs
+type connectionGuard struct {
+	log      logrus.FieldLogger
+	maxPerIP int
+	path     string
+
+	// ip => struct{}
+	blacklist sync.Map
+
+	// ip => open connections, an IP is dropped once its last one closes
+	connsMutex sync.Mutex
+	conns      map[string]map[*guardedConn]struct{}
+
+	// Serializes writes to the blacklist file
+	saveMutex sync.Mutex
+}
+
+func newConnectionGuard(maxPerIP int, path string, log logrus.FieldLogger) *connectionGuard {
+	return &connectionGuard{
+		log:      log,
+		maxPerIP: maxPerIP,
+		path:     path,
+		conns:    make(map[string]map[*guardedConn]struct{}),
+	}
+}
+
+// guardedConn gives its slot back to the guard when go-rtmp closes it
+type guardedConn struct {
+	net.Conn
+	guard *connectionGuard
+	ip    string
+	once  sync.Once
+}
+
+func (c *guardedConn) Close() error {
+	c.once.Do(func() {
+		c.guard.release(c)
+	})
+	return c.Conn.Close()
+}
+
+// admit counts conn against its IP, the returned conn has to be closed to
+// free the slot again
+func (g *connectionGuard) admit(conn net.Conn) (net.Conn, error) {
+	ip := geoip.HostIP(conn.RemoteAddr().String()).String()
+	if _, blocked := g.blacklist.Load(ip); blocked {
+		return conn, errIPBlacklisted
+	}
+
+	g.connsMutex.Lock()
+	defer g.connsMutex.Unlock()
+	if g.maxPerIP > 0 && len(g.conns[ip]) >= g.maxPerIP {
+		return conn, errTooManyConnections
+	}
+
+	gc := &guardedConn{Conn: conn, guard: g, ip: ip}
+	if g.conns[ip] == nil {
+		g.conns[ip] = make(map[*guardedConn]struct{})
+	}
+	g.conns[ip][gc] = struct{}{}
+
+	return gc, nil
+}
+
+func (g *connectionGuard) release(gc *guardedConn) {
+	g.connsMutex.Lock()
+	defer g.connsMutex.Unlock()
+	delete(g.conns[gc.ip], gc)
+	if len(g.conns[gc.ip]) == 0 {
+		delete(g.conns, gc.ip)
+	}
+}
+
+// block blacklists ip and closes every connection it has open
+func (g *connectionGuard) block(ip string) error {
+	g.blacklist.Store(ip, struct{}{})
+
+	g.connsMutex.Lock()
+	var open []*guardedConn
+	for gc := range g.conns[ip] {
+		open = append(open, gc)
+	}
+	g.connsMutex.Unlock()
+
+	for _, gc := range open {
+		gc.Close()
+	}
+	g.log.Infof("Blacklisted %s, closed %d connections", ip, len(open))
+
+	return g.save()
+}
+
+func (g *connectionGuard) unblock(ip string) error {
+	g.blacklist.Delete(ip)
+	g.log.Infof("Removed %s from the blacklist", ip)
+
+	return g.save()
+}
+
+func (g *connectionGuard) blacklisted() []string {
+	var ips []string
+	g.blacklist.Range(func(key, _ interface{}) bool {
+		ips = append(ips, key.(string))
+		return true
+	})
+	sort.Strings(ips)
+	return ips
+}
+
+// load reads the newline delimited blacklist file, it's fine for it not to exist yet
+func (g *connectionGuard) load() error {
+	if g.path == "" {
+		return nil
+	}
+
+	f, err := os.Open(g.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if ip := strings.TrimSpace(scanner.Text()); ip != "" {
+			g.blacklist.Store(ip, struct{}{})
+		}
+	}
+	return scanner.Err()
+}
+
+// save replaces the blacklist file, going through a temporary file so a
+// crash can't leave it half written
+func (g *connectionGuard) save() error {
+	if g.path == "" {
+		return nil
+	}
+
+	g.saveMutex.Lock()
+	defer g.saveMutex.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(g.path), filepath.Base(g.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, ip := range g.blacklisted() {
+		if _, err := tmp.WriteString(ip + "\n"); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), g.path)
+}
+
+// blacklistHandler serves POST /api/v1/blacklist with {"ip":"1.2.3.4"}
+func (g *connectionGuard) blacklistHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.blacklisted())
+	case http.MethodPost:
+		var body struct {
+			IP string `json:"ip"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		ip := net.ParseIP(body.IP)
+		if ip == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		if err := g.block(ip.String()); err != nil {
+			g.log.Errorf("Failed to save blacklist: %+v", err)
+			http.Error(w, "failed to save blacklist", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// unblacklistHandler serves DELETE /api/v1/blacklist/{ip}
+func (g *connectionGuard) unblacklistHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := net.ParseIP(strings.TrimPrefix(req.URL.Path, "/api/v1/blacklist/"))
+	if ip == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+	if err := g.unblock(ip.String()); err != nil {
+		g.log.Errorf("Failed to save blacklist: %+v", err)
+		http.Error(w, "failed to save blacklist", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
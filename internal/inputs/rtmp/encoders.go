@@ -0,0 +1,134 @@
+package rtmp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often the /rtmp/encoders stats are recomputed
+const encoderStatsInterval = 60 * time.Second
+
+// encoderInfo is what a publisher told us about its encoder
+type encoderInfo struct {
+	vendorName     string
+	videoCodec     string
+	videoHeight    int
+	audioClockRate uint32
+}
+
+// EncoderStats counts the publishing connections by their encoder setup
+type EncoderStats struct {
+	Vendors         map[string]int `json:"vendors"`
+	VideoCodecs     map[string]int `json:"video_codecs"`
+	VideoHeights    map[string]int `json:"video_heights"`
+	AudioClockRates map[string]int `json:"audio_clock_rates"`
+	Connections     int            `json:"connections"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
+// encoderRegistry tracks the encoder of every publishing connection. Each
+// connection hands in a copy of its info, so aggregating never touches the
+// connection handlers themselves.
+type encoderRegistry struct {
+	mutex       sync.RWMutex
+	connections map[*connHandler]encoderInfo
+
+	statsMutex sync.RWMutex
+	stats      EncoderStats
+}
+
+func newEncoderRegistry() *encoderRegistry {
+	return &encoderRegistry{
+		connections: make(map[*connHandler]encoderInfo),
+		stats:       newEncoderStats(),
+	}
+}
+
+func newEncoderStats() EncoderStats {
+	return EncoderStats{
+		Vendors:         make(map[string]int),
+		VideoCodecs:     make(map[string]int),
+		VideoHeights:    make(map[string]int),
+		AudioClockRates: make(map[string]int),
+		UpdatedAt:       time.Now(),
+	}
+}
+
+func (r *encoderRegistry) update(h *connHandler, info encoderInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.connections[h] = info
+}
+
+func (r *encoderRegistry) remove(h *connHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.connections, h)
+}
+
+func (r *encoderRegistry) aggregate() EncoderStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	stats := newEncoderStats()
+	for _, info := range r.connections {
+		stats.Vendors[unknownIfEmpty(info.vendorName)]++
+		stats.VideoCodecs[unknownIfEmpty(info.videoCodec)]++
+		if info.videoHeight > 0 {
+			stats.VideoHeights[strconv.Itoa(info.videoHeight)]++
+		} else {
+			stats.VideoHeights["unknown"]++
+		}
+		stats.AudioClockRates[strconv.Itoa(int(info.audioClockRate))]++
+	}
+	stats.Connections = len(r.connections)
+
+	return stats
+}
+
+// run recomputes the cached stats every encoderStatsInterval until ctx is done
+func (r *encoderRegistry) run(ctx context.Context) {
+	ticker := time.NewTicker(encoderStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *encoderRegistry) refresh() {
+	stats := r.aggregate()
+
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+	r.stats = stats
+}
+
+func (r *encoderRegistry) statsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.statsMutex.RLock()
+	defer r.statsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.stats)
+}
+
+func unknownIfEmpty(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+)
+
+// Events sent on /rtmp/events
+const (
+	eventConnect       = "connect"
+	eventAuthenticated = "authenticated"
+	eventClosed        = "closed"
+)
+
+const (
+	// Events queued for a subscriber before it counts as stale
+	eventSubscriberBuffer = 64
+	// Comments sent to idle subscribers, so dead connections fail a write
+	eventKeepaliveInterval = 15 * time.Second
+)
+
+type streamEvent struct {
+	Event      string            `json:"event"`
+	ChannelID  control.ChannelID `json:"channel_id"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+}
+
+type eventSubscriber struct {
+	// Only events for this channel are sent, every channel when 0
+	channelID control.ChannelID
+	events    chan string
+}
+
+// eventHub fans stream state changes out to the /rtmp/events subscribers.
+// Subscribers that fall behind are dropped rather than holding up publishers.
+type eventHub struct {
+	mutex       sync.RWMutex
+	subscribers []*eventSubscriber
+	// Set once the http server is shutting down, see close
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{}
+}
+
+// subscribe adds a subscriber, or returns nil once the hub is closed
+func (hub *eventHub) subscribe(channelID control.ChannelID) *eventSubscriber {
+	sub := &eventSubscriber{
+		channelID: channelID,
+		events:    make(chan string, eventSubscriberBuffer),
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.closed {
+		return nil
+	}
+	hub.subscribers = append(hub.subscribers, sub)
+	return sub
+}
+
+// unsubscribe removes sub and closes its channel, it's fine to call twice
+func (hub *eventHub) unsubscribe(sub *eventSubscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for i, s := range hub.subscribers {
+		if s == sub {
+			hub.subscribers = append(hub.subscribers[:i], hub.subscribers[i+1:]...)
+			close(sub.events)
+			return
+		}
+	}
+}
+
+// close ends every subscription and turns new ones away, the http server
+// would otherwise wait on subscribers until its shutdown times out
+func (hub *eventHub) close() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.closed = true
+	for _, sub := range hub.subscribers {
+		close(sub.events)
+	}
+	hub.subscribers = nil
+}
+
+func (hub *eventHub) publish(event streamEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	var stale []*eventSubscriber
+	hub.mutex.RLock()
+	for _, sub := range hub.subscribers {
+		if sub.channelID != 0 && sub.channelID != event.ChannelID {
+			continue
+		}
+		select {
+		case sub.events <- string(data):
+		default:
+			stale = append(stale, sub)
+		}
+	}
+	hub.mutex.RUnlock()
+
+	for _, sub := range stale {
+		hub.unsubscribe(sub)
+	}
+}
+
+// handler serves the events as text/event-stream, ?channel_id=X only sends
+// the events of one channel
+func (hub *eventHub) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var channelID control.ChannelID
+	if value := r.URL.Query().Get("channel_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid channel_id", http.StatusBadRequest)
+			return
+		}
+		channelID = control.ChannelID(id)
+	}
+
+	sub := hub.subscribe(channelID)
+	if sub == nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case data, ok := <-sub.events:
+			if !ok {
+				// Dropped for falling behind, or shutting down
+				return
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,56 @@
+package rtmp
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHubCloseEndsSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	hub := newEventHub()
+	server := httptest.NewServer(http.HandlerFunc(hub.handler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?channel_id=1")
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	hub.publish(streamEvent{Event: eventConnect, ChannelID: 1})
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(line, `data: {"event":"connect"`), line)
+
+	// The subscriber's stream ends rather than waiting for it to hang up
+	hub.close()
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber wasn't closed")
+	}
+
+	w := httptest.NewRecorder()
+	hub.handler(w, httptest.NewRequest(http.MethodGet, "/rtmp/events", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+
+	// Publishing after close is fine
+	assert.NotPanics(func() { hub.publish(streamEvent{Event: eventClosed, ChannelID: 1}) })
+}
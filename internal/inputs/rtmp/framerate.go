@@ -0,0 +1,45 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the frame rate actually received is measured against MaxFrameRate
+const frameRateCheckInterval = 5 * time.Second
+
+const (
+	// Declared and actual frame rates drift, only well over the limit counts
+	frameRateTolerance = 1.2
+	// Checks in a row over the limit before the stream is stopped
+	maxFrameRateViolations = 3
+)
+
+// countVideoFrame adds a frame received from the broadcaster to the frame rate
+func (h *connHandler) countVideoFrame() {
+	atomic.AddInt64(&h.videoFrames, 1)
+}
+
+// checkFrameRate measures the frame rate since the last check, and stops the
+// stream once it has been over MaxFrameRate for maxFrameRateViolations checks
+// in a row. The declared rate is only informational, this is what counts.
+func (h *connHandler) checkFrameRate(elapsed time.Duration) {
+	frames := atomic.SwapInt64(&h.videoFrames, 0)
+	if h.config.MaxFrameRate <= 0 {
+		return
+	}
+
+	frameRate := float64(frames) / elapsed.Seconds()
+	if frameRate <= h.config.MaxFrameRate*frameRateTolerance {
+		h.frameRateViolations = 0
+		return
+	}
+
+	h.frameRateViolations++
+	h.log.Warnf("Frame rate of %.1f is over the %g limit", frameRate, h.config.MaxFrameRate)
+
+	if h.frameRateViolations >= maxFrameRateViolations {
+		h.log.Warnf("Stopping stream after %d checks over the frame rate limit", h.frameRateViolations)
+		h.terminate("frame_rate")
+	}
+}
@@ -0,0 +1,21 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+)
+
+// listen opens the RTMP server's TCP listener, sharing the port with other
+// processes when ReusePort is set and the platform supports it
+func (s *RTMPSource) listen(ctx context.Context) (net.Listener, error) {
+	var lc net.ListenConfig
+	if s.config.ReusePort {
+		if reusePortSupported {
+			lc.Control = reusePortControl
+		} else {
+			s.log.Warnf("reuse_port is not supported on this platform, listening without it")
+		}
+	}
+
+	return lc.Listen(ctx, "tcp", s.config.Address)
+}
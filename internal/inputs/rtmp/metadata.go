@@ -0,0 +1,96 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// streamMetadata is the subset of the onMetaData script tag we care about.
+// See the FLV spec, section E.5 onMetaData
+type streamMetadata struct {
+	Encoder   string
+	Width     int
+	Height    int
+	FrameRate float64
+}
+
+// Script tags from encoders are a few hundred bytes, anything past this is
+// skipped rather than handed to the AMF0 decoder
+const maxMetadataBytes = 64 * 1024
+
+var (
+	errNoOnMetaData     = errors.New("script data does not contain onMetaData")
+	errMetadataTooLarge = fmt.Errorf("script data is larger than %d bytes", maxMetadataBytes)
+	errMetadataPanic    = errors.New("AMF0 decoder panicked")
+)
+
+func parseMetadata(payload []byte, log logrus.FieldLogger) (metadata streamMetadata, err error) {
+	if len(payload) > maxMetadataBytes {
+		return streamMetadata{}, errMetadataTooLarge
+	}
+	if err := checkAMF0(payload); err != nil {
+		return streamMetadata{}, err
+	}
+
+	// The payload comes straight from the publisher, don't let a malformed
+	// one take the connection down with it
+	defer func() {
+		if r := recover(); r != nil {
+			metadata, err = streamMetadata{}, fmt.Errorf("%w: %v", errMetadataPanic, r)
+		}
+	}()
+
+	var script flvtag.ScriptData
+	reader := io.LimitReader(bytes.NewReader(payload), maxMetadataBytes)
+	if err := flvtag.DecodeScriptData(reader, &script); err != nil {
+		return streamMetadata{}, err
+	}
+
+	values, ok := script.Objects["onMetaData"]
+	if !ok {
+		return streamMetadata{}, errNoOnMetaData
+	}
+
+	if encoder, ok := values["encoder"].(string); ok {
+		metadata.Encoder = encoder
+	}
+	if width, ok := metadataNumber(values, "width", log); ok {
+		metadata.Width = int(width)
+	}
+	if height, ok := metadataNumber(values, "height", log); ok {
+		metadata.Height = int(height)
+	}
+	// OBS sends framerate, while the FLV spec & ffmpeg use videoframerate
+	if frameRate, ok := metadataNumber(values, "videoframerate", log); ok {
+		metadata.FrameRate = frameRate
+	} else if frameRate, ok := metadataNumber(values, "framerate", log); ok {
+		metadata.FrameRate = frameRate
+	}
+
+	return metadata, nil
+}
+
+// metadataNumber reads a field that should be an AMF0 Number. Some encoders,
+// mostly mobile SDKs, send them as strings instead, those are parsed and
+// anything unparseable counts as 0.
+func metadataNumber(values map[string]interface{}, field string, log logrus.FieldLogger) (float64, bool) {
+	switch value := values[field].(type) {
+	case float64:
+		return value, true
+	case string:
+		metadataTypeCoercionsTotal.WithLabelValues(field).Inc()
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Debugf("Metadata field %s is not a number: %q", field, value)
+			return 0, true
+		}
+		return number, true
+	}
+	return 0, false
+}
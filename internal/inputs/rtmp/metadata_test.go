@@ -0,0 +1,94 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// onMetaData builds an AMF0 onMetaData script tag with the given numbers and strings
+func onMetaData(numbers map[string]float64, strings map[string]string) []byte {
+	var b bytes.Buffer
+	writeKey := func(key string) {
+		binary.Write(&b, binary.BigEndian, uint16(len(key)))
+		b.WriteString(key)
+	}
+
+	b.WriteByte(0x02) // string
+	writeKey("onMetaData")
+	b.WriteByte(0x08) // ECMA array
+	binary.Write(&b, binary.BigEndian, uint32(len(numbers)+len(strings)))
+	for key, value := range numbers {
+		writeKey(key)
+		b.WriteByte(0x00) // number
+		binary.Write(&b, binary.BigEndian, math.Float64bits(value))
+	}
+	for key, value := range strings {
+		writeKey(key)
+		b.WriteByte(0x02)
+		writeKey(value)
+	}
+	b.Write([]byte{0x00, 0x00, 0x09}) // object end
+
+	return b.Bytes()
+}
+
+func TestParseMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata, err := parseMetadata(onMetaData(
+		map[string]float64{"width": 1920, "height": 1080, "framerate": 60},
+		map[string]string{"encoder": "obs-output module"},
+	), logrus.New())
+	assert.NoError(err)
+	assert.Equal(streamMetadata{Encoder: "obs-output module", Width: 1920, Height: 1080, FrameRate: 60}, metadata)
+}
+
+func TestParseMetadataStringNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata, err := parseMetadata(onMetaData(nil, map[string]string{
+		"width":          "1280",
+		"height":         "720",
+		"videoframerate": "thirty",
+	}), logrus.New())
+	assert.NoError(err)
+	assert.Equal(streamMetadata{Width: 1280, Height: 720}, metadata)
+}
+
+func TestParseMetadataTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := parseMetadata(onMetaData(nil, map[string]string{
+		"encoder": string(bytes.Repeat([]byte("a"), 60*1024)),
+		"comment": string(bytes.Repeat([]byte("b"), 10*1024)),
+	}), logrus.New())
+	assert.ErrorIs(err, errMetadataTooLarge)
+}
+
+func TestParseMetadataHugeStrictArray(t *testing.T) {
+	assert := assert.New(t)
+
+	// A strict array claiming 0x30303030 elements inside onMetaData, which
+	// go-amf0 would allocate up front
+	_, err := parseMetadata([]byte("\x02\x00\n0000000000\b0000\x00\x0e00000000000000\n0\xf100"), logrus.New())
+	assert.ErrorIs(err, errAMF0Malformed)
+}
+
+func FuzzParseMetadata(f *testing.F) {
+	f.Add(onMetaData(
+		map[string]float64{"width": 1280, "height": 720, "videoframerate": 30},
+		map[string]string{"encoder": "Lavf58.76.100"},
+	))
+	f.Add(onMetaData(nil, nil))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		// Any error is fine, it just mustn't panic or hang
+		parseMetadata(payload, logrus.New())
+	})
+}
@@ -0,0 +1,53 @@
+package rtmp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtmp_connections_total",
+		Help: "RTMP connections accepted, by the country of the broadcaster",
+	}, []string{"country"})
+
+	rejectedNonRTMPTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rtmp_rejected_non_rtmp_total",
+		Help: "Connections closed because the first byte wasn't an RTMP version",
+	})
+
+	audioGapsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtmp_audio_gaps_total",
+		Help: "Times a publisher sent no audio for longer than the audio gap threshold",
+	}, []string{"channel_id"})
+
+	metadataTypeCoercionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtmp_metadata_type_coercions_total",
+		Help: "onMetaData number fields sent as strings, by field",
+	}, []string{"field"})
+
+	videoErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rtmp_video_errors_total",
+		Help: "Video tags that failed to decode or forward",
+	})
+
+	videoProcessingTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rtmp_video_processing_timeouts_total",
+		Help: "Connections closed after a video tag took longer than video_processing_timeout to process",
+	})
+
+	qualityTerminationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtmp_quality_terminations_total",
+		Help: "Streams stopped after their quality stayed degraded, by what was wrong",
+	}, []string{"reason"})
+
+	bandwidthSoftLimitHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rtmp_bandwidth_soft_limit_hits_total",
+		Help: "Times a publisher went over 75% or 90% of the bandwidth limit and was warned",
+	})
+
+	bandwidthHardLimitHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rtmp_bandwidth_hard_limit_hits_total",
+		Help: "Times a publisher went over the bandwidth limit and was stopped",
+	})
+)
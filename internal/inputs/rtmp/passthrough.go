@@ -0,0 +1,89 @@
+package rtmp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// AAC sample rates by their AudioSpecificConfig frequency index
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Samples per channel in an AAC frame
+const aacFrameSamples = 1024
+
+var errInvalidAudioSpecificConfig = errors.New("invalid AAC AudioSpecificConfig")
+
+// aacConfig is the part of the AudioSpecificConfig an ADTS header needs
+type aacConfig struct {
+	objectType     uint8
+	frequencyIndex uint8
+	channels       uint8
+}
+
+func parseAudioSpecificConfig(data []byte) (aacConfig, error) {
+	if len(data) < 2 {
+		return aacConfig{}, errInvalidAudioSpecificConfig
+	}
+	config := aacConfig{
+		objectType:     data[0] >> 3,
+		frequencyIndex: (data[0]&0x07)<<1 | data[1]>>7,
+		channels:       (data[1] >> 3) & 0x0F,
+	}
+	// Extended object types and explicit frequencies can't go in ADTS
+	if config.objectType == 0 || config.objectType > 4 || int(config.frequencyIndex) >= len(aacSampleRates) {
+		return aacConfig{}, errInvalidAudioSpecificConfig
+	}
+	return config, nil
+}
+
+// adtsFrame prefixes a raw AAC frame with its 7 byte ADTS header, without CRC
+func (c aacConfig) adtsFrame(frame []byte) []byte {
+	length := len(frame) + 7
+	return append([]byte{
+		0xFF,
+		0xF1, // MPEG-4, layer 0, no CRC
+		(c.objectType-1)<<6 | c.frequencyIndex<<2 | c.channels>>2,
+		(c.channels&0x03)<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length<<5) | 0x1F,
+		0xFC, // buffer fullness 0x7FF, one raw data block
+	}, frame...)
+}
+
+// initAudioPassthrough decides whether AAC goes to the outputs untouched,
+// which only happens when one of them takes it. Opus is still transcoded as
+// long as any output needs it, eg WHEP.
+func (h *connHandler) initAudioPassthrough() error {
+	supported, all := h.control.OutputCodecSupport(control.MimeTypeAAC)
+	h.audioPassthrough = h.config.AudioPassthrough && supported
+	h.audioTranscode = !h.audioPassthrough || !all
+	if !h.audioPassthrough || h.audioPassthroughTrack != nil {
+		return nil
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: control.MimeTypeAAC}, "audio-aac", "pion")
+	if err != nil {
+		return err
+	}
+	h.audioPassthroughTrack = track
+	h.log.Infof("Passing AAC audio through, transcoding to Opus: %t", h.audioTranscode)
+	return h.stream.AddTrack(track, control.MimeTypeAAC)
+}
+
+// writeAudioPassthrough hands an AAC frame to the outputs as ADTS
+func (h *connHandler) writeAudioPassthrough(frame []byte) error {
+	if h.aacConfig == nil {
+		// Nothing to frame it with until the sequence header arrives
+		return nil
+	}
+
+	sampleRate := aacSampleRates[h.aacConfig.frequencyIndex]
+	return h.audioPassthroughTrack.WriteSample(media.Sample{
+		Data:     h.aacConfig.adtsFrame(frame),
+		Duration: time.Duration(aacFrameSamples) * time.Second / time.Duration(sampleRate),
+	})
+}
@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"io"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The C0 byte every RTMP handshake starts with
+const (
+	rtmpVersionPlain     = 0x03
+	rtmpVersionEncrypted = 0x06
+)
+
+// preambleConn checks the first byte a client sends is an RTMP version, so
+// HTTP scanners and SSH probes are dropped before go-rtmp logs errors about
+// their handshake
+type preambleConn struct {
+	net.Conn
+	log     logrus.FieldLogger
+	checked bool
+}
+
+func newPreambleConn(conn net.Conn, log logrus.FieldLogger) *preambleConn {
+	return &preambleConn{Conn: conn, log: log}
+}
+
+func (c *preambleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.checked || n == 0 {
+		return n, err
+	}
+	c.checked = true
+
+	if p[0] == rtmpVersionPlain || p[0] == rtmpVersionEncrypted {
+		return n, err
+	}
+
+	rejectedNonRTMPTotal.Inc()
+	c.log.Debugf("Rejected non-RTMP connection from %s, first byte 0x%02x", c.RemoteAddr(), p[0])
+
+	// Reset instead of a graceful close, there's nothing to say to them
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	c.Conn.Close()
+	// go-rtmp treats EOF as the client going away rather than an error
+	return 0, io.EOF
+}
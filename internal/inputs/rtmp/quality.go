@@ -0,0 +1,78 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the stream is checked for sustained degradation
+const qualityCheckInterval = 5 * time.Second
+
+const (
+	// No keyframe for two checks, viewers joining can't start playing
+	maxKeyframeGap = 2 * qualityCheckInterval
+	maxAudioGap    = 5 * time.Second
+	// Video tags failing per check, on top of MaxConsecutiveVideoErrors
+	maxVideoErrorsPerCheck = 5
+)
+
+// Reasons a check counts as degraded, reported as rtmp_quality_terminations_total{reason}
+const (
+	qualityKeyframeGap = "keyframe_gap"
+	qualityAudioGap    = "audio_gap"
+	qualityVideoErrors = "video_errors"
+)
+
+// markKeyframe records when the last keyframe arrived, see checkQuality
+func (h *connHandler) markKeyframe() {
+	atomic.StoreInt64(&h.lastKeyframeTime, time.Now().UnixNano())
+}
+
+// countQualityVideoError adds a failed video tag to the current check
+func (h *connHandler) countQualityVideoError() {
+	atomic.AddInt64(&h.qualityVideoErrors, 1)
+}
+
+// checkQuality counts checks in a row where the stream was unwatchable, and
+// stops it after MaxSustainedDegradation of them. Streams that haven't sent
+// any video or audio yet aren't held against it.
+func (h *connHandler) checkQuality() {
+	reason := h.degradation()
+	if reason == "" {
+		h.sustainedDegradation = 0
+		return
+	}
+
+	h.sustainedDegradation++
+	h.log.Warnf("Stream quality degraded (%s), %d checks in a row", reason, h.sustainedDegradation)
+	if h.sustainedDegradation < h.config.MaxSustainedDegradation {
+		return
+	}
+
+	qualityTerminationsTotal.WithLabelValues(reason).Inc()
+	h.log.Warn("Stream quality degraded beyond threshold, terminating")
+	h.terminate("quality_" + reason)
+}
+
+// degradation returns why the stream is degraded since the last check, or
+// nothing when it's fine
+func (h *connHandler) degradation() string {
+	now := time.Now()
+
+	videoErrors := atomic.SwapInt64(&h.qualityVideoErrors, 0)
+	if lastKeyframe := atomic.LoadInt64(&h.lastKeyframeTime); lastKeyframe != 0 && now.Sub(time.Unix(0, lastKeyframe)) > maxKeyframeGap {
+		return qualityKeyframeGap
+	}
+
+	h.audioMutex.Lock()
+	lastAudio := h.lastAudioTime
+	h.audioMutex.Unlock()
+	if !lastAudio.IsZero() && now.Sub(lastAudio) > maxAudioGap {
+		return qualityAudioGap
+	}
+
+	if videoErrors > maxVideoErrorsPerCheck {
+		return qualityVideoErrors
+	}
+	return ""
+}
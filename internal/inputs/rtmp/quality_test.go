@@ -0,0 +1,35 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckQualityTerminates(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &connHandler{
+		control: &control.Control{},
+		log:     logrus.New(),
+		config:  RTMPSourceConfig{MaxSustainedDegradation: 2},
+	}
+	h.lastKeyframeTime = time.Now().Add(-2 * maxKeyframeGap).UnixNano()
+
+	h.checkQuality()
+	assert.False(h.isErrored())
+
+	// The checker runs on its own goroutine while the connection closes
+	done := make(chan struct{})
+	go func() {
+		h.checkQuality()
+		close(done)
+	}()
+	<-done
+	assert.True(h.isErrored())
+	assert.Equal("quality_"+qualityKeyframeGap, h.takeCloseReason())
+	assert.Empty(h.takeCloseReason())
+}
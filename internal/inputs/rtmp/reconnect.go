@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// detachedStream is what a closed connection leaves behind for its
+// broadcaster to pick up again. Carrying the tracks and packetizers over
+// means viewers keep the same tracks, and RTP sequence numbers and
+// timestamps carry on from where they were.
+type detachedStream struct {
+	timer *time.Timer
+
+	videoTrack      *webrtc.TrackLocalStaticRTP
+	videoSequencer  rtp.Sequencer
+	videoPacketizer rtp.Packetizer
+
+	audioTrack      *webrtc.TrackLocalStaticRTP
+	audioSequencer  rtp.Sequencer
+	audioPacketizer rtp.Packetizer
+
+	audioPassthroughTrack *webrtc.TrackLocalStaticSample
+}
+
+// reconnectRegistry holds the streams waiting out their grace period
+type reconnectRegistry struct {
+	mutex   sync.Mutex
+	streams map[control.ChannelID]*detachedStream
+}
+
+func newReconnectRegistry() *reconnectRegistry {
+	return &reconnectRegistry{
+		streams: make(map[control.ChannelID]*detachedStream),
+	}
+}
+
+// detach keeps the stream for grace, then calls expire unless it was taken
+func (r *reconnectRegistry) detach(channelID control.ChannelID, stream *detachedStream, grace time.Duration, expire func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stream.timer = time.AfterFunc(grace, func() {
+		r.mutex.Lock()
+		if r.streams[channelID] != stream {
+			r.mutex.Unlock()
+			return
+		}
+		delete(r.streams, channelID)
+		r.mutex.Unlock()
+
+		expire()
+	})
+	r.streams[channelID] = stream
+}
+
+// take returns the stream detached for the channel, or nil if there is none
+// or its grace period is over
+func (r *reconnectRegistry) take(channelID control.ChannelID) *detachedStream {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stream, ok := r.streams[channelID]
+	if !ok {
+		return nil
+	}
+	delete(r.streams, channelID)
+	stream.timer.Stop()
+
+	return stream
+}
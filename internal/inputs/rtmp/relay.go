@@ -0,0 +1,398 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/sirupsen/logrus"
+	gortmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+const (
+	DefaultRelayMaxRetries        = 5
+	DefaultRelayReconnectInterval = 2 * time.Second
+
+	// Upper bound for the exponential reconnect backoff
+	maxRelayReconnectInterval = time.Minute
+	// Tags queued per target before new ones are dropped, a slow target
+	// should never hold up the ingest
+	relayQueueSize = 512
+	relayChunkSize = 4096
+
+	relayAudioChunkStreamID = 4
+	relayVideoChunkStreamID = 6
+	relayDataChunkStreamID  = 8
+)
+
+// RTMPForwardTarget is a downstream RTMP server every published stream is relayed to
+type RTMPForwardTarget struct {
+	// Server and application to publish to, eg rtmp://live.example.com/app
+	URL string
+	// Publishing name used on the target
+	StreamKey string `mapstructure:"stream_key"`
+	// Consecutive failed reconnects before the target is given up on
+	MaxRetries int `mapstructure:"max_retries"`
+	// Delay before the first reconnect, doubled after every failure
+	ReconnectInterval time.Duration `mapstructure:"reconnect_interval"`
+}
+
+func (t RTMPForwardTarget) validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return fmt.Errorf("invalid forward target url %q: %w", t.URL, err)
+	}
+	if u.Scheme != "rtmp" || u.Host == "" {
+		return fmt.Errorf("forward target url %q must be in the rtmp://host/app format", t.URL)
+	}
+	if t.StreamKey == "" {
+		return fmt.Errorf("forward target %q is missing a stream_key", t.URL)
+	}
+
+	return nil
+}
+
+// RelayStats are the counters reported for a single forward target
+type RelayStats struct {
+	ChannelID      control.ChannelID `json:"channel_id"`
+	URL            string            `json:"url"`
+	Connected      bool              `json:"connected"`
+	BytesForwarded uint64            `json:"bytes_forwarded"`
+	ReconnectCount int               `json:"reconnect_count"`
+	LastError      string            `json:"last_error"`
+}
+
+type relayTag struct {
+	typ       rtmpmsg.TypeID
+	timestamp uint32
+	payload   []byte
+}
+
+// relayRegistry keeps track of every running relay for the stats endpoint
+type relayRegistry struct {
+	mutex  sync.Mutex
+	relays map[*relay]struct{}
+}
+
+func newRelayRegistry() *relayRegistry {
+	return &relayRegistry{
+		relays: make(map[*relay]struct{}),
+	}
+}
+
+func (r *relayRegistry) add(rl *relay) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.relays[rl] = struct{}{}
+}
+
+func (r *relayRegistry) remove(rl *relay) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.relays, rl)
+}
+
+func (r *relayRegistry) stats() []RelayStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := make([]RelayStats, 0, len(r.relays))
+	for rl := range r.relays {
+		stats = append(stats, rl.stats())
+	}
+	return stats
+}
+
+func (r *relayRegistry) statsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.stats())
+}
+
+// relay forwards the FLV tags of one published stream to one target
+type relay struct {
+	target    RTMPForwardTarget
+	channelID control.ChannelID
+	log       logrus.FieldLogger
+
+	tags chan relayTag
+	done chan struct{}
+
+	// The last sequence headers and metadata, resent after every reconnect
+	// so the target can decode the stream from the next keyframe
+	headerMutex    sync.Mutex
+	metadata       []byte
+	audioSeqHeader []byte
+	videoSeqHeader []byte
+
+	statsMutex     sync.Mutex
+	connected      bool
+	bytesForwarded uint64
+	reconnectCount int
+	lastError      string
+
+	droppedTags int
+}
+
+func newRelay(target RTMPForwardTarget, channelID control.ChannelID, log logrus.FieldLogger) *relay {
+	if target.MaxRetries == 0 {
+		target.MaxRetries = DefaultRelayMaxRetries
+	}
+	if target.ReconnectInterval == 0 {
+		target.ReconnectInterval = DefaultRelayReconnectInterval
+	}
+
+	return &relay{
+		target:    target,
+		channelID: channelID,
+		log:       log.WithField("relay", target.URL),
+		tags:      make(chan relayTag, relayQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (r *relay) stats() RelayStats {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	return RelayStats{
+		ChannelID:      r.channelID,
+		URL:            r.target.URL,
+		Connected:      r.connected,
+		BytesForwarded: r.bytesForwarded,
+		ReconnectCount: r.reconnectCount,
+		LastError:      r.lastError,
+	}
+}
+
+// push queues a tag without blocking, the payload must not be modified afterwards
+func (r *relay) push(tag relayTag) {
+	r.rememberHeader(tag)
+
+	select {
+	case r.tags <- tag:
+	default:
+		// Only warn occasionally, a dead target would otherwise flood the log
+		if r.droppedTags%100 == 0 {
+			r.log.Warn("Relay queue is full, dropping tags")
+		}
+		r.droppedTags++
+	}
+}
+
+func (r *relay) rememberHeader(tag relayTag) {
+	r.headerMutex.Lock()
+	defer r.headerMutex.Unlock()
+
+	switch {
+	case tag.typ == rtmpmsg.TypeIDDataMessageAMF0:
+		r.metadata = tag.payload
+	// AAC sequence header: SoundFormat 10, AACPacketType 0
+	case tag.typ == rtmpmsg.TypeIDAudioMessage && len(tag.payload) > 1 && tag.payload[0]>>4 == 10 && tag.payload[1] == 0:
+		r.audioSeqHeader = tag.payload
+	// AVC sequence header: CodecID 7, AVCPacketType 0
+	case tag.typ == rtmpmsg.TypeIDVideoMessage && len(tag.payload) > 1 && tag.payload[0]&0x0f == 7 && tag.payload[1] == 0:
+		r.videoSeqHeader = tag.payload
+	}
+}
+
+func (r *relay) headers() []relayTag {
+	r.headerMutex.Lock()
+	defer r.headerMutex.Unlock()
+
+	var tags []relayTag
+	if r.metadata != nil {
+		tags = append(tags, relayTag{typ: rtmpmsg.TypeIDDataMessageAMF0, payload: r.metadata})
+	}
+	if r.videoSeqHeader != nil {
+		tags = append(tags, relayTag{typ: rtmpmsg.TypeIDVideoMessage, payload: r.videoSeqHeader})
+	}
+	if r.audioSeqHeader != nil {
+		tags = append(tags, relayTag{typ: rtmpmsg.TypeIDAudioMessage, payload: r.audioSeqHeader})
+	}
+	return tags
+}
+
+func (r *relay) setError(err error) {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+	r.connected = false
+	r.lastError = err.Error()
+}
+
+func (r *relay) stop() {
+	close(r.done)
+}
+
+// run keeps the target connected and forwards queued tags until stop is called
+// or the target has failed MaxRetries reconnects in a row
+func (r *relay) run() {
+	failures := 0
+	for {
+		connected, err := r.forward()
+		if err == nil {
+			return
+		}
+		if connected {
+			failures = 0
+		}
+		r.log.Warnf("Relay failed: %s", err)
+		r.setError(err)
+
+		if failures >= r.target.MaxRetries {
+			r.log.Errorf("Giving up on relay after %d retries", failures)
+			return
+		}
+
+		backoff := r.target.ReconnectInterval << failures
+		if backoff > maxRelayReconnectInterval || backoff <= 0 {
+			backoff = maxRelayReconnectInterval
+		}
+		failures++
+
+		select {
+		case <-r.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		r.statsMutex.Lock()
+		r.reconnectCount++
+		r.statsMutex.Unlock()
+
+		// Anything queued while we were away is stale by now
+		r.drain()
+	}
+}
+
+func (r *relay) drain() {
+	for {
+		select {
+		case <-r.tags:
+		default:
+			return
+		}
+	}
+}
+
+// forward connects to the target and writes tags until stopped (nil) or an
+// error occurs, connected reports whether the target was ever reached
+func (r *relay) forward() (connected bool, err error) {
+	client, stream, err := r.connect()
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	r.statsMutex.Lock()
+	r.connected = true
+	r.statsMutex.Unlock()
+	r.log.Info("Relay connected")
+
+	for _, tag := range r.headers() {
+		if err := r.write(stream, tag); err != nil {
+			return true, err
+		}
+	}
+
+	for {
+		select {
+		case <-r.done:
+			r.statsMutex.Lock()
+			r.connected = false
+			r.statsMutex.Unlock()
+			return true, nil
+		case tag := <-r.tags:
+			if err := r.write(stream, tag); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+func (r *relay) connect() (*gortmp.ClientConn, *gortmp.Stream, error) {
+	u, err := url.Parse(r.target.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := gortmp.Dial("rtmp", u.Host, &gortmp.ConnConfig{
+		Logger: r.log.WithField("app", "yutopp/go-rtmp"),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = client.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{
+			App:      strings.TrimPrefix(u.Path, "/"),
+			Type:     "nonprivate",
+			FlashVer: "FMLE/3.0 (compatible; waveguide)",
+			TCURL:    r.target.URL,
+		},
+	})
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	stream, err := client.CreateStream(nil, relayChunkSize)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	err = stream.Publish(&rtmpmsg.NetStreamPublish{
+		PublishingName: r.target.StreamKey,
+		PublishingType: "live",
+	})
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	return client, stream, nil
+}
+
+func (r *relay) write(stream *gortmp.Stream, tag relayTag) error {
+	var err error
+	switch tag.typ {
+	case rtmpmsg.TypeIDAudioMessage:
+		err = stream.Write(relayAudioChunkStreamID, tag.timestamp, &rtmpmsg.AudioMessage{
+			Payload: bytes.NewReader(tag.payload),
+		})
+	case rtmpmsg.TypeIDVideoMessage:
+		err = stream.Write(relayVideoChunkStreamID, tag.timestamp, &rtmpmsg.VideoMessage{
+			Payload: bytes.NewReader(tag.payload),
+		})
+	case rtmpmsg.TypeIDDataMessageAMF0:
+		err = stream.Write(relayDataChunkStreamID, tag.timestamp, &rtmpmsg.DataMessage{
+			Name:     "@setDataFrame",
+			Encoding: rtmpmsg.EncodingTypeAMF0,
+			Body:     bytes.NewReader(tag.payload),
+		})
+	default:
+		err = errors.New("unexpected relay tag type")
+	}
+	if err != nil {
+		return err
+	}
+
+	r.statsMutex.Lock()
+	r.bytesForwarded += uint64(len(tag.payload))
+	r.statsMutex.Unlock()
+
+	return nil
+}
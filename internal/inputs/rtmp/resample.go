@@ -0,0 +1,66 @@
+package rtmp
+
+import "encoding/binary"
+
+// Opus only encodes a few sample rates and Opus RTP always runs at a 48kHz
+// clock, so AAC at other rates, eg 44.1kHz, is resampled to this first
+const opusSampleRate = 48000
+
+// resampler converts interleaved 16 bit PCM between sample rates with linear
+// interpolation. It keeps its position across calls, so a stream can be fed
+// in one decoded frame at a time without clicks at the frame boundaries.
+type resampler struct {
+	channels int
+	// Input samples per output sample
+	step float64
+	// Position of the next output sample in input frames, counted from prev
+	pos float64
+	// The last input frame of the previous call
+	prev []int16
+}
+
+func newResampler(from, to, channels int) *resampler {
+	return &resampler{
+		channels: channels,
+		step:     float64(from) / float64(to),
+	}
+}
+
+func (r *resampler) resample(in []int16) []int16 {
+	frames := append(append([]int16{}, r.prev...), in...)
+	count := len(frames) / r.channels
+	if count < 2 {
+		r.prev = frames
+		return nil
+	}
+
+	out := make([]int16, 0, int(float64(count)/r.step+1)*r.channels)
+	for ; r.pos+1 < float64(count); r.pos += r.step {
+		i := int(r.pos)
+		frac := r.pos - float64(i)
+		for c := 0; c < r.channels; c++ {
+			a := float64(frames[i*r.channels+c])
+			b := float64(frames[(i+1)*r.channels+c])
+			out = append(out, int16(a+(b-a)*frac))
+		}
+	}
+
+	r.pos -= float64(count - 1)
+	r.prev = frames[(count-1)*r.channels : count*r.channels]
+	return out
+}
+
+// resamplePCM resamples little endian 16 bit PCM as the AAC decoder outputs it
+func (r *resampler) resamplePCM(pcm []byte) []byte {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+
+	resampled := r.resample(samples)
+	out := make([]byte, len(resampled)*2)
+	for i, sample := range resampled {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(sample))
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package rtmp
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sine returns frames of interleaved 16 bit samples of a tone at rate, the
+// same on every channel
+func sine(frames, channels, rate int) []int16 {
+	samples := make([]int16, frames*channels)
+	for i := 0; i < frames; i++ {
+		sample := int16(10000 * math.Sin(2*math.Pi*440*float64(i)/float64(rate)))
+		for c := 0; c < channels; c++ {
+			samples[i*channels+c] = sample
+		}
+	}
+	return samples
+}
+
+func TestResampleRatio(t *testing.T) {
+	tests := []struct {
+		from, to, channels int
+	}{
+		{44100, 48000, 2},
+		{44100, 48000, 1},
+		{22050, 48000, 2},
+		{96000, 48000, 2},
+	}
+
+	for _, tt := range tests {
+		r := newResampler(tt.from, tt.to, tt.channels)
+		in := sine(tt.from, tt.channels, tt.from)
+
+		// A second of AAC frames at a time, like the decoder hands them over
+		out := 0
+		for i := 0; i < len(in); i += 1024 * tt.channels {
+			end := i + 1024*tt.channels
+			if end > len(in) {
+				end = len(in)
+			}
+			resampled := r.resample(in[i:end])
+			assert.Zero(t, len(resampled)%tt.channels, "%d -> %d", tt.from, tt.to)
+			out += len(resampled)
+		}
+
+		// A second in is a second out, give or take the frame held back
+		assert.InDelta(t, tt.to, out/tt.channels, 2, "%d -> %d", tt.from, tt.to)
+	}
+}
+
+func TestResampleAcrossFrames(t *testing.T) {
+	assert := assert.New(t)
+	in := sine(4410, 2, 44100)
+
+	whole := newResampler(44100, 48000, 2).resample(in)
+
+	r := newResampler(44100, 48000, 2)
+	var chunked []int16
+	for i := 0; i < len(in); i += 1024 * 2 {
+		end := i + 1024*2
+		if end > len(in) {
+			end = len(in)
+		}
+		chunked = append(chunked, r.resample(in[i:end])...)
+	}
+
+	// Splitting the input into frames doesn't drop, repeat or jump samples
+	// at the boundaries, only rounding differs
+	if !assert.Len(chunked, len(whole)) {
+		return
+	}
+	for i := range whole {
+		if !assert.InDelta(whole[i], chunked[i], 1, "sample %d", i) {
+			return
+		}
+	}
+
+	// Neighbouring samples of a 440Hz tone at 48kHz never move more than
+	// 2*pi*440/48000 of the amplitude
+	maxStep := 10000*2*math.Pi*440/48000 + 2
+	for i := 2; i < len(chunked); i += 2 {
+		assert.LessOrEqual(math.Abs(float64(chunked[i])-float64(chunked[i-2])), maxStep, "sample %d", i/2)
+	}
+}
+
+func TestResamplePCM(t *testing.T) {
+	assert := assert.New(t)
+	r := newResampler(44100, 48000, 2)
+
+	// Too short to interpolate, held for the next call
+	assert.Empty(r.resamplePCM([]byte{0x01, 0x00, 0x02, 0x00}))
+
+	// 44.1kHz steps 0.91875 of an input frame per output frame
+	out := r.resamplePCM([]byte{0x03, 0x00, 0x04, 0x00})
+	assert.Equal([]byte{0x01, 0x00, 0x02, 0x00, 0x02, 0x00, 0x03, 0x00}, out)
+}
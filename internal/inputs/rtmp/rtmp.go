@@ -1,18 +1,25 @@
 package rtmp
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
-	"strconv"
-	"strings"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Glimesh/go-fdkaac/fdkaac"
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/geoip"
+	"github.com/Glimesh/waveguide/pkg/h264"
 	h264joy "github.com/nareix/joy5/codec/h264"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
@@ -29,26 +36,245 @@ const (
 	FTL_VIDEO_PT uint8  = 96
 	FTL_AUDIO_PT uint8  = 97
 
-	BANDWIDTH_LIMIT int = 8000 * 1000
+	DefaultOpusBitrate     = 96000
+	DefaultOpusComplexity  = 5
+	DefaultOpusApplication = "audio"
+
+	DefaultAudioGapThreshold = 2 * time.Second
+	// Consecutive audio gaps before the stream is stopped
+	maxAudioGaps = 3
+
+	DefaultMaxConsecutiveVideoErrors = 10
+
+	DefaultMaxSustainedDegradation = 3
+
+	// 5 MB every 5 seconds, 8 Mbps
+	DefaultBandwidthLimitBytesPerInterval = 5_000_000
+	DefaultBandwidthCheckIntervalSeconds  = 5
+
+	DefaultVideoProcessingTimeout = 5 * time.Second
+
+	DefaultChunkSize = 4096
+	minChunkSize     = 128
+	maxChunkSize     = 65536
 )
 
 type RTMPSource struct {
 	log     logrus.FieldLogger
 	config  RTMPSourceConfig
 	control *control.Control
+
+	relays     *relayRegistry
+	encoders   *encoderRegistry
+	reconnects *reconnectRegistry
+	events     *eventHub
 }
 
 type RTMPSourceConfig struct {
 	// Listen address of the RTMP server in the ip:port format
 	Address string
+
+	// Bitrate of the transcoded Opus audio in bits per second, 6000-510000
+	OpusBitrate int `mapstructure:"opus_bitrate"`
+	// Opus encoder complexity, 1-10. Lower values use less CPU at some cost
+	// to quality. Unset (0) uses the default of 5.
+	OpusComplexity int `mapstructure:"opus_complexity"`
+	// Opus application mode, one of: audio, voip, lowdelay
+	OpusApplication string `mapstructure:"opus_application"`
+
+	// How the channel ID and stream key are encoded in the publishing name,
+	// one of: channelid-key (default), channelid/key, app/channelid-key
+	// (eg live/1234-key), key-only, or regexp:<pattern> with named groups
+	// channel and key
+	StreamKeyFormat string `mapstructure:"stream_key_format"`
+
+	// How publishers are authenticated, one of: key (default) to compare the
+	// stream key with the service, webhook, or jwt
+	AuthMode string `mapstructure:"auth_mode"`
+	// Receives a POST for every publish in webhook mode, a 200 allows the stream
+	AuthWebhookURL string `mapstructure:"auth_webhook_url"`
+	// How long allowed webhook responses are cached for, eg 5m
+	AuthCacheTTL time.Duration `mapstructure:"auth_cache_ttl"`
+	// HMAC secret stream key tokens are signed with in jwt mode
+	AuthJWTSecret string `mapstructure:"auth_jwt_secret"`
+
+	// Downstream RTMP servers every published stream is relayed to
+	ForwardTargets []RTMPForwardTarget `mapstructure:"forward_targets"`
+
+	// Optional MaxMind GeoLite2 City and ASN databases used to locate broadcasters
+	GeoIPDatabasePath    string `mapstructure:"geoip_database_path"`
+	GeoIPASNDatabasePath string `mapstructure:"geoip_asn_database_path"`
+
+	// How long a stream can go without audio before it counts as a gap, eg 2s
+	AudioGapThreshold time.Duration `mapstructure:"audio_gap_threshold"`
+
+	// Hand AAC from publishers to outputs that take it, eg HLS, as is rather
+	// than transcoding it. Opus is still produced while any output, eg WHEP,
+	// needs it.
+	AudioPassthrough bool `mapstructure:"audio_passthrough"`
+
+	// Write the Annex B video of every stream to DebugVideoDir, for debugging only
+	DebugSaveVideo bool   `mapstructure:"debug_save_video"`
+	DebugVideoDir  string `mapstructure:"debug_video_dir"`
+
+	// Mask the stream key in publishing names before they are logged
+	SanitizeLogs bool `mapstructure:"sanitize_logs"`
+
+	// RTMP chunk size in bytes sent to clients after the handshake, 128-65536.
+	// Every chunk carries its own header, so the protocol default of 128 splits
+	// a 6 Mbps stream into thousands of chunks a second. 4096-8192 keeps the
+	// reassembly overhead low at the cost of larger writes per chunk.
+	ChunkSize int `mapstructure:"chunk_size"`
+
+	// Bad video tags in a row before the connection is closed, a single
+	// corrupted tag is logged and skipped
+	MaxConsecutiveVideoErrors int `mapstructure:"max_consecutive_video_errors"`
+
+	// How long a single video tag may take to process before the connection
+	// is closed, a hung H.264 parser would otherwise block it for good.
+	// Defaults to 5s.
+	VideoProcessingTimeout time.Duration `mapstructure:"video_processing_timeout"`
+
+	// Quality checks in a row, 5 seconds apart, a stream can fail before it's
+	// stopped. A check fails on no keyframe for 10s, no audio for 5s or more
+	// than 5 bad video tags.
+	MaxSustainedDegradation int `mapstructure:"max_sustained_degradation"`
+
+	// Media bytes, not bits, a broadcaster may send in one bandwidth check
+	// interval before their stream is stopped. They're warned at 75% of it and
+	// have their acknowledgement window shrunk at 90%. The default of
+	// 5000000 bytes every 5 seconds is 8 Mbps.
+	BandwidthLimitBytesPerInterval int64 `mapstructure:"bandwidth_limit_bytes_per_interval"`
+	// How often, in seconds, the bytes received are checked against
+	// BandwidthLimitBytesPerInterval
+	BandwidthCheckIntervalSeconds int `mapstructure:"bandwidth_check_interval_seconds"`
+
+	// How long a stream is kept after its broadcaster drops, eg 10s. If they
+	// publish again in time the stream carries on with the same StreamID and
+	// viewers stay connected. Unset (0) stops streams straight away.
+	ReconnectGracePeriod time.Duration `mapstructure:"reconnect_grace_period"`
+
+	// Set SO_REUSEPORT so several waveguide processes can listen on the same
+	// address, with the kernel spreading connections between them. Linux only.
+	ReusePort bool `mapstructure:"reuse_port"`
+
+	// Highest frame rate publishers may send, unset (0) for no limit. A
+	// higher declared rate is only logged, streams actually going over it by
+	// more than 20% for 15 seconds are stopped.
+	MaxFrameRate float64 `mapstructure:"max_frame_rate"`
+
+	// Line video up with audio for encoders, mostly mobile ones, that stamp
+	// them from different starting points. The gap between the first audio
+	// and video tags is taken off the video RTP timestamps.
+	AVSyncCorrection bool `mapstructure:"av_sync_correction"`
+
+	// RTP SSRCs to send video and audio with, eg to pick streams out of a
+	// packet capture. Unset (0) picks a random one for each stream.
+	VideoSSRC uint32 `mapstructure:"video_ssrc"`
+	AudioSSRC uint32 `mapstructure:"audio_ssrc"`
+
+	// Connections a single IP can have open at once, unset (0) for no limit
+	MaxConnectionsPerIP int `mapstructure:"max_connections_per_ip"`
+	// Newline delimited file the IP blacklist managed through
+	// /api/v1/blacklist is kept in, it's only kept in memory when unset. The
+	// API is only served with the control api_token set.
+	BlacklistPath string `mapstructure:"blacklist_path"`
 }
 
 func New(config RTMPSourceConfig) *RTMPSource {
+	if config.OpusBitrate == 0 {
+		config.OpusBitrate = DefaultOpusBitrate
+	}
+	if config.OpusComplexity == 0 {
+		config.OpusComplexity = DefaultOpusComplexity
+	}
+	if config.OpusApplication == "" {
+		config.OpusApplication = DefaultOpusApplication
+	}
+	if config.StreamKeyFormat == "" {
+		config.StreamKeyFormat = StreamKeyFormatChannelIDKey
+	}
+	if config.AuthMode == "" {
+		config.AuthMode = AuthModeKey
+	}
+	if config.AuthCacheTTL == 0 {
+		config.AuthCacheTTL = DefaultAuthCacheTTL
+	}
+	if config.AudioGapThreshold == 0 {
+		config.AudioGapThreshold = DefaultAudioGapThreshold
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = DefaultChunkSize
+	}
+	if config.MaxConsecutiveVideoErrors == 0 {
+		config.MaxConsecutiveVideoErrors = DefaultMaxConsecutiveVideoErrors
+	}
+	if config.VideoProcessingTimeout == 0 {
+		config.VideoProcessingTimeout = DefaultVideoProcessingTimeout
+	}
+	if config.MaxSustainedDegradation == 0 {
+		config.MaxSustainedDegradation = DefaultMaxSustainedDegradation
+	}
+	if config.BandwidthLimitBytesPerInterval == 0 {
+		config.BandwidthLimitBytesPerInterval = DefaultBandwidthLimitBytesPerInterval
+	}
+	if config.BandwidthCheckIntervalSeconds == 0 {
+		config.BandwidthCheckIntervalSeconds = DefaultBandwidthCheckIntervalSeconds
+	}
+
 	return &RTMPSource{
-		config: config,
+		config:     config,
+		relays:     newRelayRegistry(),
+		encoders:   newEncoderRegistry(),
+		reconnects: newReconnectRegistry(),
+		events:     newEventHub(),
 	}
 }
 
+func (c RTMPSourceConfig) validate() error {
+	if c.OpusBitrate < 6000 || c.OpusBitrate > 510000 {
+		return fmt.Errorf("opus_bitrate must be between 6000 and 510000, got %d", c.OpusBitrate)
+	}
+	if c.OpusComplexity < 0 || c.OpusComplexity > 10 {
+		return fmt.Errorf("opus_complexity must be between 0 and 10, got %d", c.OpusComplexity)
+	}
+	if _, err := opusApplication(c.OpusApplication); err != nil {
+		return err
+	}
+	if c.MaxFrameRate < 0 {
+		return fmt.Errorf("max_frame_rate must not be negative, got %g", c.MaxFrameRate)
+	}
+	if c.ChunkSize < minChunkSize || c.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk_size must be between %d and %d, got %d", minChunkSize, maxChunkSize, c.ChunkSize)
+	}
+	if c.BandwidthLimitBytesPerInterval < 0 {
+		return fmt.Errorf("bandwidth_limit_bytes_per_interval must be positive, got %d", c.BandwidthLimitBytesPerInterval)
+	}
+	if c.BandwidthCheckIntervalSeconds < 0 {
+		return fmt.Errorf("bandwidth_check_interval_seconds must be positive, got %d", c.BandwidthCheckIntervalSeconds)
+	}
+	for _, target := range c.ForwardTargets {
+		if err := target.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func opusApplication(name string) (opus.Application, error) {
+	switch name {
+	case "audio":
+		return opus.AppAudio, nil
+	case "voip":
+		return opus.AppVoIP, nil
+	case "lowdelay":
+		return opus.AppRestrictedLowdelay, nil
+	}
+
+	return 0, fmt.Errorf("unknown opus_application %q, expected one of audio, voip, lowdelay", name)
+}
+
 func (s *RTMPSource) SetControl(ctrl *control.Control) {
 	s.control = ctrl
 }
@@ -58,29 +284,91 @@ func (s *RTMPSource) SetLogger(log logrus.FieldLogger) {
 }
 
 func (s *RTMPSource) Listen(ctx context.Context) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", s.config.Address)
+	if err := s.config.validate(); err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+
+	listener, err := s.listen(ctx)
 	if err != nil {
 		s.log.Errorf("Failed: %+v", err)
+		return
 	}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+	parseStreamKey, err := newStreamKeyParser(s.config.StreamKeyFormat)
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+	auth, err := newAuthenticator(s.config, s.control)
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+	geo, err := geoip.Open(s.config.GeoIPDatabasePath, s.config.GeoIPASNDatabasePath)
 	if err != nil {
 		s.log.Errorf("Failed: %+v", err)
+		return
 	}
 
+	if len(s.config.ForwardTargets) > 0 {
+		s.control.RegisterHandleFunc("/rtmp/relay/stats", s.relays.statsHandler)
+	}
+
+	guard := newConnectionGuard(s.config.MaxConnectionsPerIP, s.config.BlacklistPath, s.log)
+	if err := guard.load(); err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+	if s.control.HasAPIToken() {
+		s.control.RegisterHandleFunc("/api/v1/blacklist", s.control.RequireAPIToken(guard.blacklistHandler))
+		s.control.RegisterHandleFunc("/api/v1/blacklist/", s.control.RequireAPIToken(guard.unblacklistHandler))
+	} else {
+		// RequireAPIToken lets everything through without a token, and anyone
+		// could kick any broadcaster off
+		s.log.Warnf("Not serving the blacklist API without a control api_token")
+	}
+
+	s.control.RegisterHandleFunc("/rtmp/encoders", s.encoders.statsHandler)
+	s.control.RegisterHandleFunc("/rtmp/events", s.control.RequireAPIToken(s.events.handler))
+	s.control.RegisterOnHTTPShutdown(s.events.close)
+	go s.encoders.run(ctx)
+
 	s.log.Infof("Starting RTMP Server on %s", s.config.Address)
 
 	srv := gortmp.NewServer(&gortmp.ServerConfig{
 		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *gortmp.ConnConfig) {
+			conn, err := guard.admit(newPreambleConn(conn, s.log))
+			if err != nil {
+				// Closing it straight away fails the handshake
+				s.log.Warnf("Rejected connection from %s: %s", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+
 			return conn, &gortmp.ConnConfig{
 				Handler: &connHandler{
-					control:                s.control,
-					log:                    s.log,
-					stopMetadataCollection: make(chan bool, 1),
+					ctx:            ctx,
+					control:        s.control,
+					config:         s.config,
+					parseStreamKey: parseStreamKey,
+					auth:           auth,
+					relays:         s.relays,
+					encoders:       s.encoders,
+					reconnects:     s.reconnects,
+					events:         s.events,
+					geo:            geo,
+					remoteAddr:     conn.RemoteAddr().String(),
+					netConn:        conn,
+					log:            s.log,
+					debugSaveVideo: s.config.DebugSaveVideo,
+					debugVideoDir:  s.config.DebugVideoDir,
 				},
 
 				ControlState: gortmp.StreamControlStateConfig{
 					DefaultBandwidthWindowSize: 6 * 1024 * 1024 / 8,
+					// Chunks we send are split at this size, OnServe tells
+					// the client about it
+					DefaultChunkSize: uint32(s.config.ChunkSize),
 				},
 				Logger: s.log.WithField("app", "yutopp/go-rtmp"),
 			}
@@ -93,17 +381,44 @@ func (s *RTMPSource) Listen(ctx context.Context) {
 
 type connHandler struct {
 	gortmp.DefaultHandler
+	ctx        context.Context
 	control    *control.Control
 	controlCtx context.Context
+	config     RTMPSourceConfig
+
+	parseStreamKey streamKeyParser
+	auth           authenticator
+	remoteAddr     string
+	conn           *gortmp.Conn
+	// The connection under conn, closed by the video watchdog
+	netConn net.Conn
+	// Running while a video tag is being processed, see OnVideo
+	videoWatchdog *time.Timer
+
+	relays       *relayRegistry
+	activeRelays []*relay
+	encoders     *encoderRegistry
+	reconnects   *reconnectRegistry
+	events       *eventHub
+
+	geo      *geoip.Reader
+	location geoip.Location
 
 	log logrus.FieldLogger
 
-	channelID        control.ChannelID
-	streamID         control.StreamID
-	streamKey        []byte
-	started          bool
-	authenticated    bool
-	errored          bool
+	channelID     control.ChannelID
+	streamID      control.StreamID
+	streamKey     []byte
+	started       bool
+	authenticated bool
+	// Set once the stream has to be cut off, read and written with
+	// isErrored and setErrored as the quality checker and video watchdog
+	// set it from their own goroutines
+	errored int32
+	// Why the connection is being closed, reported on /rtmp/events. Like
+	// errored it's set from other goroutines, see terminate.
+	closeReasonMutex sync.Mutex
+	closeReason      string
 	metadataFailures int
 
 	stream *control.Stream
@@ -115,75 +430,216 @@ type connHandler struct {
 	videoPacketizer rtp.Packetizer
 	videoClockRate  uint32
 
+	// RTMP timestamps are 32 bit milliseconds, these keep the video timeline
+	// monotonic across wraps and encoder resets
+	lastVideoTimestamp   uint32
+	videoTimestampOffset uint64
+	firstVideoTimestamp  bool
+	lastVideoTime        uint64
+	avSync               avSync
+
 	audioSequencer  rtp.Sequencer
 	audioPacketizer rtp.Packetizer
 	audioClockRate  uint32
 	audioDecoder    *fdkaac.AacDecoder
 	audioBuffer     []byte
 	audioEncoder    *opus.Encoder
+	// Only set when the AAC isn't at 48kHz, audioSampleRate is what it
+	// decodes to, found out from the first frame
+	audioSampleRate int
+	audioResampler  *resampler
+
+	// AAC handed to outputs untouched, only set with AudioPassthrough and an
+	// output that takes it. audioTranscode is unset when no output needs Opus.
+	audioPassthrough      bool
+	audioTranscode        bool
+	audioPassthroughTrack *webrtc.TrackLocalStaticSample
+	aacConfig             *aacConfig
+
+	// Set on every OnAudio, checked by collectMetadata to spot audio gaps
+	audioMutex    sync.Mutex
+	lastAudioTime time.Time
+	audioGaps     int
+
+	// Video tags in a row that failed to process
+	videoErrors int
+
+	// Media bytes received since the last bandwidth check, see checkBandwidth
+	inputBytes    int64
+	bandwidthTier int
 
 	keyframes       int
 	lastKeyFrames   int
 	lastInterFrames int
 
-	stopMetadataCollection chan bool
+	// Video frames received since the last frame rate check, see checkFrameRate
+	videoFrames         int64
+	frameRateViolations int
+
+	// See checkQuality
+	lastKeyframeTime     int64
+	qualityVideoErrors   int64
+	sustainedDegradation int
+
+	// Values declared by the client in its onMetaData script tag
+	clientVendorName string
+	videoWidth       int
+	videoHeight      int
+	videoFrameRate   float64
+
+	// Closed to stop the collectMetadata of the current publish
+	stopMetadataCollection chan struct{}
 
 	videoJoyCodec *h264joy.Codec
+
+	debugSaveVideo bool
+	debugVideoDir  string
+	debugVideoFile *os.File
 }
 
 func (h *connHandler) OnServe(conn *gortmp.Conn) {
 	h.log.Info("OnServe: %#v", conn)
+
+	h.conn = conn
+
+	// go-rtmp starts writing with the configured chunk size but only announces
+	// it when creating streams as a client, so send Set Chunk Size ourselves
+	// before anything else goes out on the connection.
+	err := h.writeControlMessage(2, &rtmpmsg.SetChunkSize{ChunkSize: uint32(h.config.ChunkSize)})
+	if err != nil {
+		h.log.Errorf("Failed to set chunk size: %+v", err)
+	}
 }
 
 func (h *connHandler) OnConnect(timestamp uint32, cmd *rtmpmsg.NetConnectionConnect) (err error) {
 	h.log.Info("OnConnect: %#v", cmd)
 
 	h.metadataFailures = 0
-	h.errored = false
+	h.setErrored(false)
+
+	h.location = h.geo.Lookup(geoip.HostIP(h.remoteAddr))
+	country := h.location.Country
+	if country == "" {
+		country = "unknown"
+	}
+	connectionsTotal.WithLabelValues(country).Inc()
+	h.log.WithFields(logrus.Fields{
+		"remote_addr": h.remoteAddr,
+		"country":     h.location.Country,
+		"city":        h.location.City,
+		"asn":         h.location.ASN,
+	}).Info("RTMP connection")
 
 	h.videoClockRate = 90000
-	// TODO: This can be customized by the user, we should figure out how to infer it from the client
-	h.audioClockRate = 48000
+	h.firstVideoTimestamp = true
+	h.videoTimestampOffset = 0
+	h.avSync = avSync{}
+	// Opus RTP always runs at 48kHz, AAC at other rates is resampled to it
+	h.audioClockRate = opusSampleRate
 
 	return nil
 }
 
+// resetCounters zeroes everything counted for a publish, so a broadcaster
+// publishing again on the same connection starts from scratch. The stream's
+// start time is reset by control.StartStream, or kept on purpose when a
+// reconnect reattaches to it.
+func (h *connHandler) resetCounters() {
+	h.metadataFailures = 0
+	h.keyframes = 0
+	h.lastKeyFrames = 0
+	h.lastInterFrames = 0
+	h.videoErrors = 0
+	h.bandwidthTier = bandwidthTierOK
+	h.frameRateViolations = 0
+	h.sustainedDegradation = 0
+	atomic.StoreInt64(&h.inputBytes, 0)
+	atomic.StoreInt64(&h.videoFrames, 0)
+	atomic.StoreInt64(&h.lastKeyframeTime, 0)
+	atomic.StoreInt64(&h.qualityVideoErrors, 0)
+
+	// Tracks belong to the previous stream, new ones are made for this one
+	// unless a reconnect adopts the detached ones
+	h.videoTrack = nil
+	h.audioTrack = nil
+	h.audioPassthroughTrack = nil
+	h.firstVideoTimestamp = true
+	h.videoTimestampOffset = 0
+	h.avSync = avSync{}
+
+	h.audioMutex.Lock()
+	h.lastAudioTime = time.Time{}
+	h.audioGaps = 0
+	h.audioMutex.Unlock()
+}
+
 func (h *connHandler) OnCreateStream(timestamp uint32, cmd *rtmpmsg.NetConnectionCreateStream) error {
 	h.log.Info("OnCreateStream: %#v", cmd)
 	return nil
 }
 
 func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) (err error) {
-	h.log.Info("OnPublish: %#v", cmd)
+	if h.config.SanitizeLogs {
+		sanitized := *cmd
+		sanitized.PublishingName = sanitizePublishingName(cmd.PublishingName)
+		h.log.Infof("OnPublish: %#v", &sanitized)
+	} else {
+		h.log.Infof("OnPublish: %#v", cmd)
+	}
+	// The previous publish's checks would count against this one
+	h.stopCollectingMetadata()
+	h.resetCounters()
 
 	if cmd.PublishingName == "" {
 		return errors.New("PublishingName is empty")
 	}
 	// Authenticate
-	auth := strings.SplitN(cmd.PublishingName, "-", 2)
-	u64, err := strconv.ParseUint(auth[0], 10, 32)
-
+	h.channelID, h.streamKey, err = h.parseStreamKey(h.control, cmd.PublishingName)
 	if err != nil {
 		h.log.Error(err)
 		return err
 	}
-	h.channelID = control.ChannelID(u64)
-	h.streamKey = []byte(auth[1])
 
 	h.started = true
+	h.events.publish(streamEvent{Event: eventConnect, ChannelID: h.channelID, RemoteAddr: h.remoteAddr})
 
-	if err := h.control.Authenticate(h.channelID, h.streamKey); err != nil {
+	if err := h.auth.authenticate(h.channelID, h.streamKey, h.remoteAddr); err != nil {
 		h.log.Error(err)
+		h.setCloseReason("auth_failed")
+		h.control.Audit(control.AuditEntry{
+			Event:     control.AuditAuthFail,
+			ChannelID: h.channelID,
+			SourceIP:  geoip.HostIP(h.remoteAddr).String(),
+			Input:     "rtmp",
+			Reason:    err.Error(),
+		})
 		return err
 	}
 
-	h.stream, h.controlCtx, err = h.control.StartStream(h.channelID)
-	if err != nil {
-		h.log.Error(err)
-		return err
+	detached := h.reconnects.take(h.channelID)
+	if detached != nil {
+		h.stream, err = h.control.ReattachStream(h.channelID)
+		if err != nil {
+			h.log.Warnf("Failed to reattach stream, starting a new one: %+v", err)
+			detached = nil
+		} else {
+			h.controlCtx = h.stream.Context()
+			h.adopt(detached)
+		}
+	}
+	if detached == nil {
+		h.stream, h.controlCtx, err = h.control.StartStream(h.ctx, h.channelID,
+			control.InputMetadata("rtmp"),
+			control.SourceIPMetadata(geoip.HostIP(h.remoteAddr)),
+		)
+		if err != nil {
+			h.log.Error(err)
+			return err
+		}
 	}
 
 	h.authenticated = true
+	h.events.publish(streamEvent{Event: eventAuthenticated, ChannelID: h.channelID})
 
 	h.streamID = h.stream.StreamID
 
@@ -196,7 +652,11 @@ func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd
 	h.stream.ReportMetadata(
 		control.ClientVendorNameMetadata("waveguide-rtmp-input"),
 		control.ClientVendorVersionMetadata("0.0.1"),
+		control.SourceLocationMetadata(h.location.Country, h.location.City, h.location.ASN),
+		control.SourceIPMetadata(geoip.HostIP(h.remoteAddr)),
 	)
+	// Some clients send onMetaData before publishing, prefer their values if we have them
+	h.reportClientMetadata()
 
 	if err := h.initVideo(h.videoClockRate); err != nil {
 		return err
@@ -205,66 +665,376 @@ func (h *connHandler) OnPublish(ctx *gortmp.StreamContext, timestamp uint32, cmd
 		return err
 	}
 
+	h.startRelays()
+	h.reportEncoder()
+
+	h.stopMetadataCollection = make(chan struct{})
+	go h.collectMetadata(h.stopMetadataCollection)
+
 	return nil
 }
 
+// stopCollectingMetadata stops the collectMetadata of the previous publish,
+// if there is one
+func (h *connHandler) stopCollectingMetadata() {
+	if h.stopMetadataCollection != nil {
+		close(h.stopMetadataCollection)
+		h.stopMetadataCollection = nil
+	}
+}
+
+// collectMetadata watches the stream for problems the client won't tell us
+// about until OnClose
+func (h *connHandler) collectMetadata(stop chan struct{}) {
+	ticker := time.NewTicker(h.config.AudioGapThreshold)
+	defer ticker.Stop()
+	bandwidthTicker := time.NewTicker(h.bandwidthCheckInterval())
+	defer bandwidthTicker.Stop()
+	frameRateTicker := time.NewTicker(frameRateCheckInterval)
+	defer frameRateTicker.Stop()
+	qualityTicker := time.NewTicker(qualityCheckInterval)
+	defer qualityTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.checkAudioGap()
+		case <-bandwidthTicker.C:
+			h.checkBandwidth()
+		case <-frameRateTicker.C:
+			h.checkFrameRate(frameRateCheckInterval)
+		case <-qualityTicker.C:
+			h.checkQuality()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkAudioGap counts a gap when audio has stopped arriving, and gives up on
+// the stream after maxAudioGaps in a row. Streams that never sent audio are
+// left alone.
+func (h *connHandler) checkAudioGap() {
+	h.audioMutex.Lock()
+	defer h.audioMutex.Unlock()
+
+	if h.lastAudioTime.IsZero() {
+		return
+	}
+	since := time.Since(h.lastAudioTime)
+	if since <= h.config.AudioGapThreshold {
+		h.audioGaps = 0
+		return
+	}
+
+	h.audioGaps++
+	h.stream.ReportMetadata(control.AudioGapMetadata())
+	audioGapsTotal.WithLabelValues(h.channelID.String()).Inc()
+	h.log.Warnf("No audio received for %s", since.Round(time.Millisecond))
+
+	if h.audioGaps >= maxAudioGaps {
+		h.log.Warnf("Stopping stream after %d consecutive audio gaps", h.audioGaps)
+		h.terminate("audio_gaps")
+	}
+}
+
+func (h *connHandler) isErrored() bool {
+	return atomic.LoadInt32(&h.errored) != 0
+}
+
+func (h *connHandler) setErrored(errored bool) {
+	var value int32
+	if errored {
+		value = 1
+	}
+	atomic.StoreInt32(&h.errored, value)
+}
+
+func (h *connHandler) setCloseReason(reason string) {
+	h.closeReasonMutex.Lock()
+	h.closeReason = reason
+	h.closeReasonMutex.Unlock()
+}
+
+// takeCloseReason returns why the connection is being closed and clears it
+// for the next publish
+func (h *connHandler) takeCloseReason() string {
+	h.closeReasonMutex.Lock()
+	defer h.closeReasonMutex.Unlock()
+	reason := h.closeReason
+	h.closeReason = ""
+	return reason
+}
+
+// terminate stops the stream at the next media message, and reports the
+// broadcaster if an abuse report URL is configured
+func (h *connHandler) terminate(reason string) {
+	h.setErrored(true)
+	h.setCloseReason(reason)
+	h.control.ReportAbuse(h.channelID, reason)
+}
+
+func (h *connHandler) startRelays() {
+	for _, target := range h.config.ForwardTargets {
+		r := newRelay(target, h.channelID, h.log)
+		h.relays.add(r)
+		h.activeRelays = append(h.activeRelays, r)
+		go r.run()
+	}
+}
+
+func (h *connHandler) stopRelays() {
+	for _, r := range h.activeRelays {
+		r.stop()
+		h.relays.remove(r)
+	}
+	h.activeRelays = nil
+}
+
+// relay hands a copy of the raw FLV tag to every forward target
+func (h *connHandler) relay(typ rtmpmsg.TypeID, timestamp uint32, payload []byte) {
+	for _, r := range h.activeRelays {
+		r.push(relayTag{typ: typ, timestamp: timestamp, payload: payload})
+	}
+}
+
+func (h *connHandler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
+	h.relay(rtmpmsg.TypeIDDataMessageAMF0, timestamp, data.Payload)
+
+	metadata, err := parseMetadata(data.Payload, h.log)
+	if errors.Is(err, errMetadataPanic) {
+		h.log.Warnf("AMF0 parse panic recovered: %s", err)
+		return nil
+	} else if err != nil {
+		// Metadata is informational, a broken script tag should not end the stream
+		h.log.Debugf("Failed to parse onMetaData: %s", err)
+		return nil
+	}
+	h.log.Debugf("OnSetDataFrame: %+v", metadata)
+
+	if metadata.Encoder != "" {
+		h.clientVendorName = metadata.Encoder
+	}
+	if metadata.Width > 0 && metadata.Height > 0 {
+		h.videoWidth = metadata.Width
+		h.videoHeight = metadata.Height
+	}
+	if metadata.FrameRate > 0 {
+		h.videoFrameRate = metadata.FrameRate
+		if h.config.MaxFrameRate > 0 && metadata.FrameRate > h.config.MaxFrameRate {
+			h.log.Warnf("Declared frame rate of %g is over the %g limit", metadata.FrameRate, h.config.MaxFrameRate)
+		}
+	}
+
+	if h.stream != nil {
+		h.reportClientMetadata()
+		h.reportEncoder()
+	}
+
+	return nil
+}
+
+// setDecoderConfig hands the parameter sets from the sequence header to
+// control, for outputs with viewers joining between keyframes
+func (h *connHandler) setDecoderConfig() {
+	sps := h264joy.Map2arr(h.videoJoyCodec.SPS)
+	pps := h264joy.Map2arr(h.videoJoyCodec.PPS)
+	if len(sps) == 0 || len(pps) == 0 {
+		return
+	}
+	h.stream.SetDecoderConfig(sps[0], pps[0])
+}
+
+// reportResolution reports the video size from the SPS, so it's known from
+// the start rather than once the first thumbnail is decoded
+func (h *connHandler) reportResolution() {
+	for _, sps := range h264joy.Map2arr(h.videoJoyCodec.SPS) {
+		width, height, err := h264.SPSResolution(sps)
+		if err != nil {
+			h.log.Debugf("Failed to parse SPS: %s", err)
+			continue
+		}
+		h.stream.ReportMetadata(
+			control.VideoWidthMetadata(width),
+			control.VideoHeightMetadata(height),
+		)
+		return
+	}
+}
+
+// reportEncoder updates what /rtmp/encoders knows about this publisher
+func (h *connHandler) reportEncoder() {
+	h.encoders.update(h, encoderInfo{
+		vendorName:     h.clientVendorName,
+		videoCodec:     webrtc.MimeTypeH264,
+		videoHeight:    h.videoHeight,
+		audioClockRate: h.audioClockRate,
+	})
+}
+
+// reportClientMetadata forwards whatever the client told us in onMetaData to the stream
+func (h *connHandler) reportClientMetadata() {
+	if h.clientVendorName != "" {
+		h.stream.ReportMetadata(control.ClientVendorNameMetadata(h.clientVendorName))
+	}
+	if h.videoWidth > 0 && h.videoHeight > 0 {
+		h.stream.ReportMetadata(
+			control.VideoWidthMetadata(h.videoWidth),
+			control.VideoHeightMetadata(h.videoHeight),
+		)
+	}
+	if h.videoFrameRate > 0 {
+		h.stream.ReportMetadata(control.VideoFrameRateMetadata(h.videoFrameRate))
+	}
+}
+
 func (h *connHandler) OnClose() {
 	h.log.Info("OnClose")
 
-	h.stopMetadataCollection <- true
+	h.stopCollectingMetadata()
 
 	// We only want to publish the stop if it's ours
 	// We also don't want control to stop the stream if we're respond to a stop
 	if h.authenticated && h.controlCtx.Err() == nil {
-		// StopStream mainly calls external services, there's a chance this call can hang for a bit while the other services are processing
-		// However it's not safe to call RemoveStream until this is finished or the pointer wont... exist?
-		if err := h.control.StopStream(h.channelID); err != nil {
+		if h.config.ReconnectGracePeriod > 0 && !h.isErrored() {
+			// Give the broadcaster a chance to come back to the same stream
+			h.detach()
+		} else if err := h.control.StopStream(h.channelID); err != nil {
+			// StopStream mainly calls external services, there's a chance this call can hang for a bit while the other services are processing
+			// However it's not safe to call RemoveStream until this is finished or the pointer wont... exist?
 			h.log.Error(err)
 			// panic(err)
 		}
 	}
 	h.authenticated = false
 
+	reason := h.takeCloseReason()
+	if h.started {
+		if reason == "" {
+			reason = "disconnected"
+		}
+		h.events.publish(streamEvent{Event: eventClosed, ChannelID: h.channelID, Reason: reason})
+	}
 	h.started = false
 
+	h.stopRelays()
+	h.encoders.remove(h)
+
 	if h.audioDecoder != nil {
 		h.audioDecoder.Close()
 		h.audioDecoder = nil
 	}
+
+	if h.debugVideoFile != nil {
+		h.debugVideoFile.Close()
+		h.debugVideoFile = nil
+	}
+}
+
+// detach leaves the stream running for ReconnectGracePeriod so the
+// broadcaster can pick it up again, and stops it if they don't
+func (h *connHandler) detach() {
+	h.log.Infof("Publisher disconnected, keeping the stream for %s", h.config.ReconnectGracePeriod)
+
+	channelID := h.channelID
+	ctrl := h.control
+	log := h.log
+	h.reconnects.detach(channelID, &detachedStream{
+		videoTrack:      h.videoTrack,
+		videoSequencer:  h.videoSequencer,
+		videoPacketizer: h.videoPacketizer,
+		audioTrack:      h.audioTrack,
+		audioSequencer:  h.audioSequencer,
+		audioPacketizer: h.audioPacketizer,
+
+		audioPassthroughTrack: h.audioPassthroughTrack,
+	}, h.config.ReconnectGracePeriod, func() {
+		log.Infof("Publisher did not reconnect, stopping stream")
+		if err := ctrl.StopStream(channelID); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// adopt takes over the media state of the connection this one replaced
+func (h *connHandler) adopt(detached *detachedStream) {
+	h.videoTrack = detached.videoTrack
+	h.videoSequencer = detached.videoSequencer
+	h.videoPacketizer = detached.videoPacketizer
+	h.audioTrack = detached.audioTrack
+	h.audioSequencer = detached.audioSequencer
+	h.audioPacketizer = detached.audioPacketizer
+	h.audioPassthroughTrack = detached.audioPassthroughTrack
 }
 
 func (h *connHandler) initAudio(clockRate uint32) (err error) {
-	h.audioSequencer = rtp.NewFixedSequencer(0) // ftl client says this should be changed to a random value
-	h.audioPacketizer = rtp.NewPacketizer(FTL_MTU, FTL_AUDIO_PT, uint32(h.channelID), &codecs.OpusPayloader{}, h.audioSequencer, clockRate)
+	if err := h.initAudioPassthrough(); err != nil {
+		return err
+	}
+	if !h.audioTranscode {
+		h.stream.ReportMetadata(control.AudioCodecMetadata(control.MimeTypeAAC))
+		return nil
+	}
 
-	h.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	// A reattached stream already has its track
+	if h.audioTrack == nil {
+		ssrc := h.audioSSRC()
+		h.audioSequencer = rtp.NewFixedSequencer(0) // ftl client says this should be changed to a random value
+		h.audioPacketizer = rtp.NewPacketizer(FTL_MTU, FTL_AUDIO_PT, ssrc, &codecs.OpusPayloader{}, h.audioSequencer, clockRate)
+		h.stream.SetAudioSSRC(ssrc)
+		h.log.Infof("Sending audio with SSRC %d", ssrc)
+
+		h.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+		if err != nil {
+			return err
+		}
+		h.stream.AddTrack(h.audioTrack, webrtc.MimeTypeOpus)
+	}
+
+	application, err := opusApplication(h.config.OpusApplication)
 	if err != nil {
 		return err
 	}
-
-	h.audioEncoder, err = opus.NewEncoder(int(clockRate), 2, opus.AppAudio)
+	h.audioEncoder, err = opus.NewEncoder(int(clockRate), 2, application)
 	if err != nil {
 		return err
 	}
+	if err := h.audioEncoder.SetBitrate(h.config.OpusBitrate); err != nil {
+		return err
+	}
+	if err := h.audioEncoder.SetComplexity(h.config.OpusComplexity); err != nil {
+		return err
+	}
 	h.audioDecoder = fdkaac.NewAacDecoder()
 
-	h.stream.AddTrack(h.audioTrack, webrtc.MimeTypeOpus)
 	h.stream.ReportMetadata(control.AudioCodecMetadata(webrtc.MimeTypeOpus))
 
 	return nil
 }
 
 func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
-	if h.errored {
+	if h.isErrored() {
 		return errors.New("stream is not longer authenticated")
 	}
 	if h.controlCtx.Err() != nil {
 		return h.controlCtx.Err()
 	}
 
+	h.audioMutex.Lock()
+	h.lastAudioTime = time.Now()
+	h.audioGaps = 0
+	h.audioMutex.Unlock()
+
+	raw, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	h.countInputBytes(len(raw))
+	h.relay(rtmpmsg.TypeIDAudioMessage, timestamp, raw)
+
 	// Convert AAC to opus
 	var audio flvtag.AudioData
-	if err := flvtag.DecodeAudioData(payload, &audio); err != nil {
+	if err := flvtag.DecodeAudioData(bytes.NewReader(raw), &audio); err != nil {
 		return err
 	}
 
@@ -275,7 +1045,19 @@ func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 
 	if audio.AACPacketType == flvtag.AACPacketTypeSequenceHeader {
 		h.log.Infof("Created new codec %s", hex.EncodeToString(data))
+		if h.audioPassthrough {
+			config, err := parseAudioSpecificConfig(data)
+			if err != nil {
+				return fmt.Errorf("can't pass through codec %s: %w", hex.EncodeToString(data), err)
+			}
+			h.aacConfig = &config
+		}
+		if !h.audioTranscode {
+			return nil
+		}
 		err := h.audioDecoder.InitRaw(data)
+		h.audioSampleRate = 0
+		h.audioResampler = nil
 
 		if err != nil {
 			h.log.WithError(err).Errorf("error initializing stream")
@@ -284,12 +1066,28 @@ func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 
 		return nil
 	}
+	h.syncAudio(timestamp)
+
+	if h.audioPassthrough {
+		if err := h.writeAudioPassthrough(data); err != nil {
+			return err
+		}
+	}
+	if !h.audioTranscode {
+		return nil
+	}
 
 	pcm, err := h.audioDecoder.Decode(data)
 	if err != nil {
 		h.log.Errorf("decode error: %s %s", hex.EncodeToString(data), err)
 		return fmt.Errorf("decode error")
 	}
+	if h.audioSampleRate == 0 && len(pcm) > 0 {
+		h.initResampler()
+	}
+	if h.audioResampler != nil {
+		pcm = h.audioResampler.resamplePCM(pcm)
+	}
 
 	blockSize := 960
 	for h.audioBuffer = append(h.audioBuffer, pcm...); len(h.audioBuffer) >= blockSize*4; h.audioBuffer = h.audioBuffer[blockSize*4:] {
@@ -319,31 +1117,134 @@ func (h *connHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 	return nil
 }
 
-func (h *connHandler) initVideo(clockRate uint32) (err error) {
-	h.videoSequencer = rtp.NewFixedSequencer(25000)
-	h.videoPacketizer = rtp.NewPacketizer(FTL_MTU, FTL_VIDEO_PT, uint32(h.channelID+1), &codecs.H264Payloader{}, h.videoSequencer, clockRate)
+// initResampler checks the rate the decoder produces once it has decoded a
+// frame, anything but 48kHz would otherwise come out pitched. The Opus
+// encoder and packetizer stay at 48kHz, the audio is resampled to match.
+func (h *connHandler) initResampler() {
+	h.audioSampleRate = h.audioDecoder.SampleRate()
+	if h.audioSampleRate == opusSampleRate || h.audioSampleRate <= 0 {
+		return
+	}
 
-	h.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
-	if err != nil {
-		return err
+	// Resampled in whatever layout the decoder interleaves
+	channels := h.audioDecoder.NumChannels()
+	if channels <= 0 {
+		h.log.Warnf("Decoder reported %d channels, not resampling %d Hz audio", channels, h.audioSampleRate)
+		return
+	}
+
+	h.log.Infof("Resampling %d Hz %d channel audio to %d Hz", h.audioSampleRate, channels, opusSampleRate)
+	h.audioResampler = newResampler(h.audioSampleRate, opusSampleRate, channels)
+}
+
+// videoSamples returns how many clock rate samples passed since the previous
+// video tag, unwrapping the 32 bit RTMP timestamp into a monotonic one
+func (h *connHandler) videoSamples(timestamp uint32) uint32 {
+	if h.firstVideoTimestamp {
+		h.firstVideoTimestamp = false
+		h.lastVideoTimestamp = timestamp
+		h.lastVideoTime = uint64(timestamp)
+		return 0
+	}
+
+	if timestamp < h.lastVideoTimestamp {
+		if h.lastVideoTimestamp-timestamp > math.MaxInt32 {
+			// Wrapped around after ~49 days
+			h.videoTimestampOffset += math.MaxUint32 + 1
+		} else {
+			// The encoder went back in time, carry on from where we were
+			// rather than jumping the RTP timestamps backwards
+			h.log.Warnf("Video timestamp went backwards from %d to %d", h.lastVideoTimestamp, timestamp)
+			h.videoTimestampOffset = h.lastVideoTime - uint64(timestamp)
+		}
+	}
+	h.lastVideoTimestamp = timestamp
+
+	current := h.videoTimestampOffset + uint64(timestamp)
+	elapsed := current - h.lastVideoTime
+	h.lastVideoTime = current
+
+	return uint32(elapsed * uint64(h.videoClockRate) / 1000)
+}
+
+// extractCaptions passes any CEA-608 captions carried in SEI NAL units on to the stream
+func (h *connHandler) extractCaptions(nalus [][]byte) {
+	for _, nalu := range nalus {
+		if ccData := h264.CaptionData(nalu); len(ccData) > 0 {
+			h.stream.WriteClosedCaptions(ccData)
+		}
 	}
+}
 
-	h.stream.AddTrack(h.videoTrack, webrtc.MimeTypeH264)
+func (h *connHandler) initVideo(clockRate uint32) (err error) {
+	// A reattached stream already has its track
+	if h.videoTrack == nil {
+		ssrc := h.videoSSRC()
+		h.videoSequencer = rtp.NewFixedSequencer(25000)
+		h.videoPacketizer = rtp.NewPacketizer(FTL_MTU, FTL_VIDEO_PT, ssrc, &codecs.H264Payloader{}, h.videoSequencer, clockRate)
+		h.stream.SetVideoSSRC(ssrc)
+		h.log.Infof("Sending video with SSRC %d", ssrc)
+
+		h.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+		if err != nil {
+			return err
+		}
+		h.stream.AddTrack(h.videoTrack, webrtc.MimeTypeH264)
+	}
 	h.stream.ReportMetadata(control.VideoCodecMetadata(webrtc.MimeTypeH264))
 
+	if h.debugSaveVideo {
+		name := filepath.Join(h.debugVideoDir, fmt.Sprintf("rtmp-%d-%d.h264", h.channelID, h.streamID))
+		// Only a debugging aid, so failing to create it shouldn't end the stream
+		h.debugVideoFile, err = os.Create(name)
+		if err != nil {
+			h.log.Errorf("Failed to create debug video file: %+v", err)
+			h.debugVideoFile = nil
+		} else {
+			h.log.Infof("Saving video to %s", name)
+		}
+	}
+
 	return nil
 }
 
 func (h *connHandler) OnVideo(timestamp uint32, payload io.Reader) error {
-	if h.errored {
+	if h.isErrored() {
 		return errors.New("stream is not longer authenticated")
 	}
 	if h.controlCtx.Err() != nil {
 		return h.controlCtx.Err()
 	}
 
+	h.startVideoWatchdog()
+	defer h.stopVideoWatchdog()
+
+	if err := h.handleVideo(timestamp, payload); err != nil {
+		h.videoErrors++
+		videoErrorsTotal.Inc()
+		h.countQualityVideoError()
+		h.log.Warnf("Failed to handle video tag (%d in a row): %+v", h.videoErrors, err)
+		if h.videoErrors >= h.config.MaxConsecutiveVideoErrors {
+			h.terminate("video_errors")
+			return err
+		}
+		return nil
+	}
+	h.videoErrors = 0
+
+	return nil
+}
+
+func (h *connHandler) handleVideo(timestamp uint32, payload io.Reader) error {
+	raw, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	h.countInputBytes(len(raw))
+	h.relay(rtmpmsg.TypeIDVideoMessage, timestamp, raw)
+
 	var video flvtag.VideoData
-	if err := flvtag.DecodeVideoData(payload, &video); err != nil {
+	if err := flvtag.DecodeVideoData(bytes.NewReader(raw), &video); err != nil {
 		return err
 	}
 
@@ -354,8 +1255,12 @@ func (h *connHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 	case flvtag.FrameTypeKeyFrame:
 		h.lastKeyFrames += 1
 		h.keyframes += 1
+		h.countVideoFrame()
+		h.markKeyframe()
+		h.stream.ReportMetadata(control.KeyframeMetadata())
 	case flvtag.FrameTypeInterFrame:
 		h.lastInterFrames += 1
+		h.countVideoFrame()
 	default:
 		h.log.Debug("Unknown FLV Video Frame: %+v\n", video)
 	}
@@ -374,12 +1279,15 @@ func (h *connHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 		if err != nil {
 			return err
 		}
+		h.reportResolution()
+		h.setDecoderConfig()
 	}
 
 	var outBuf []byte
 	if video.FrameType == flvtag.FrameTypeKeyFrame {
 		// This fails ffprobe
 		pktnalus, _ := h264joy.SplitNALUs(data)
+		h.extractCaptions(pktnalus)
 		nalus := [][]byte{}
 		nalus = append(nalus, h264joy.Map2arr(h.videoJoyCodec.SPS)...)
 		nalus = append(nalus, h264joy.Map2arr(h.videoJoyCodec.PPS)...)
@@ -388,13 +1296,23 @@ func (h *connHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 		outBuf = data
 	} else {
 		pktnalus, _ := h264joy.SplitNALUs(data)
+		h.extractCaptions(pktnalus)
 		data := h264joy.JoinNALUsAnnexb(pktnalus)
 		outBuf = data
 	}
 
-	// Likely there's more than one set of RTP packets in this read
-	samples := uint32(len(outBuf)) + h.videoClockRate
-	packets := h.videoPacketizer.Packetize(outBuf, samples)
+	if h.debugSaveVideo && h.debugVideoFile != nil {
+		h.debugVideoFile.Write(outBuf)
+	}
+
+	if video.AVCPacketType != flvtag.AVCPacketTypeSequenceHeader {
+		h.syncVideo(timestamp)
+	}
+
+	// Move the RTP timestamp on by the time since the last frame, then stamp
+	// every packet of this frame with it
+	h.videoPacketizer.SkipSamples(h.videoSamples(timestamp) + h.videoSyncSamples())
+	packets := h.videoPacketizer.Packetize(outBuf, 0)
 
 	for _, p := range packets {
 		if err := h.videoTrack.WriteRTP(p); err != nil {
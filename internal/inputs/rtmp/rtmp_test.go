@@ -0,0 +1,36 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnVideoWithoutDebugSaveVideo(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &connHandler{
+		controlCtx:          context.Background(),
+		stream:              &control.Stream{},
+		log:                 logrus.New(),
+		videoClockRate:      90000,
+		firstVideoTimestamp: true,
+		debugSaveVideo:      false,
+	}
+	assert.NoError(h.initVideo(h.videoClockRate))
+
+	// AVC inter frame: frame type 2, codec 7, NALU packet, no composition
+	// time, then a single length prefixed slice
+	tag := []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x41, 0x9a}
+
+	var err error
+	assert.NotPanics(func() {
+		err = h.OnVideo(0, bytes.NewReader(tag))
+	})
+	assert.NoError(err)
+	assert.Nil(h.debugVideoFile)
+}
@@ -0,0 +1,110 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/scte35"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+var errNoSCTE35 = errors.New("onFI does not carry SCTE35")
+
+func init() {
+	// go-rtmp drops data messages it has no decoder for before they reach
+	// OnUnknownDataMessage, leaving the body unread passes onFI through whole
+	rtmpmsg.DataBodyDecoders["onFI"] = func(io.Reader, rtmpmsg.AMFDecoder, *rtmpmsg.AMFConvertible) error {
+		return nil
+	}
+}
+
+// OnUnknownDataMessage picks SCTE-35 ad markers out of onFI messages and
+// hands them to outputs as splice events
+func (h *connHandler) OnUnknownDataMessage(timestamp uint32, data *rtmpmsg.DataMessage) error {
+	if data.Name != "onFI" || h.stream == nil {
+		return nil
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(data.Body, maxMetadataBytes+1))
+	if err != nil {
+		return err
+	}
+
+	section, err := parseOnFI(payload)
+	if errors.Is(err, errNoSCTE35) {
+		return nil
+	} else if err != nil {
+		// Like onMetaData, a broken marker should not end the stream
+		h.log.Debugf("Failed to parse onFI: %s", err)
+		return nil
+	}
+
+	info, err := scte35.Parse(section)
+	if err != nil {
+		h.log.Debugf("Failed to parse SCTE-35: %s", err)
+		return nil
+	}
+	if info.Insert == nil {
+		h.log.Debugf("Ignoring SCTE-35 splice command %#x", info.CommandType)
+		return nil
+	}
+
+	insert := info.Insert
+	h.log.Infof("SCTE-35 splice_insert event=%d out_of_network=%t cancel=%t duration=%s", insert.EventID, insert.OutOfNetwork, insert.Cancel, insert.Duration)
+	h.stream.WriteSpliceEvent(control.SpliceEvent{
+		EventID:      insert.EventID,
+		Cancel:       insert.Cancel,
+		OutOfNetwork: insert.OutOfNetwork,
+		Duration:     insert.Duration,
+		AutoReturn:   insert.AutoReturn,
+	})
+
+	return nil
+}
+
+// parseOnFI returns the splice_info_section carried base64 encoded in the
+// SCTE35 field of an onFI message
+func parseOnFI(payload []byte) (section []byte, err error) {
+	if len(payload) > maxMetadataBytes {
+		return nil, errMetadataTooLarge
+	}
+	if err := checkAMF0(payload); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			section, err = nil, fmt.Errorf("%w: %v", errMetadataPanic, r)
+		}
+	}()
+
+	dec := rtmpmsg.NewAMFDecoder(bytes.NewReader(payload), rtmpmsg.EncodingTypeAMF0)
+	for {
+		var value interface{}
+		if err := dec.Decode(&value); err == io.EOF {
+			return nil, errNoSCTE35
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Objects and ECMA arrays decode to different map types
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			continue
+		}
+		field := v.MapIndex(reflect.ValueOf("SCTE35").Convert(v.Type().Key()))
+		if !field.IsValid() {
+			continue
+		}
+		encoded, ok := field.Interface().(string)
+		if !ok {
+			return nil, errNoSCTE35
+		}
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+}
@@ -0,0 +1,32 @@
+package rtmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// videoSSRC is VideoSSRC when it's configured, or a random one
+func (h *connHandler) videoSSRC() uint32 {
+	if h.config.VideoSSRC != 0 {
+		return h.config.VideoSSRC
+	}
+	return randomSSRC()
+}
+
+// audioSSRC is AudioSSRC when it's configured, or a random one
+func (h *connHandler) audioSSRC() uint32 {
+	if h.config.AudioSSRC != 0 {
+		return h.config.AudioSSRC
+	}
+	return randomSSRC()
+}
+
+// randomSSRC uses crypto/rand, math/rand isn't seeded for this module's Go
+// version and would hand every stream the same SSRCs
+func randomSSRC() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
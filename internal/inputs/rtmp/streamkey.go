@@ -0,0 +1,108 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+)
+
+const (
+	StreamKeyFormatChannelIDKey      = "channelid-key"
+	StreamKeyFormatChannelIDSlashKey = "channelid/key"
+	StreamKeyFormatAppChannelIDKey   = "app/channelid-key"
+	StreamKeyFormatKeyOnly           = "key-only"
+
+	streamKeyFormatRegexpPrefix = "regexp:"
+)
+
+var ErrInvalidStreamKey = errors.New("stream key does not match the configured format")
+
+// streamKeyParser extracts the channel ID and stream key from the RTMP publishing name
+type streamKeyParser func(ctrl *control.Control, publishingName string) (control.ChannelID, control.StreamKey, error)
+
+// newStreamKeyParser compiles one of the StreamKeyFormat values into a parser
+func newStreamKeyParser(format string) (streamKeyParser, error) {
+	switch format {
+	case StreamKeyFormatChannelIDKey:
+		return separatorParser("-"), nil
+	case StreamKeyFormatChannelIDSlashKey:
+		return separatorParser("/"), nil
+	case StreamKeyFormatAppChannelIDKey:
+		return appParser(separatorParser("-")), nil
+	case StreamKeyFormatKeyOnly:
+		return func(ctrl *control.Control, publishingName string) (control.ChannelID, control.StreamKey, error) {
+			channelID, err := ctrl.LookupChannel(control.StreamKey(publishingName))
+			return channelID, control.StreamKey(publishingName), err
+		}, nil
+	}
+
+	if strings.HasPrefix(format, streamKeyFormatRegexpPrefix) {
+		return regexpParser(strings.TrimPrefix(format, streamKeyFormatRegexpPrefix))
+	}
+
+	return nil, fmt.Errorf("unknown stream_key_format %q, expected one of %s, %s, %s, %s or regexp:<pattern>",
+		format, StreamKeyFormatChannelIDKey, StreamKeyFormatChannelIDSlashKey, StreamKeyFormatAppChannelIDKey, StreamKeyFormatKeyOnly)
+}
+
+func separatorParser(sep string) streamKeyParser {
+	return func(ctrl *control.Control, publishingName string) (control.ChannelID, control.StreamKey, error) {
+		auth := strings.SplitN(publishingName, sep, 2)
+		if len(auth) != 2 {
+			return 0, nil, ErrInvalidStreamKey
+		}
+		return parseChannelID(auth[0], auth[1])
+	}
+}
+
+// appParser drops an app name prefix, eg live/ in live/1234-key, for
+// platforms that put one in the stream key, and parses the rest with parse
+func appParser(parse streamKeyParser) streamKeyParser {
+	return func(ctrl *control.Control, publishingName string) (control.ChannelID, control.StreamKey, error) {
+		app := strings.SplitN(publishingName, "/", 2)
+		if len(app) != 2 || app[0] == "" {
+			return 0, nil, ErrInvalidStreamKey
+		}
+		return parse(ctrl, app[1])
+	}
+}
+
+func regexpParser(pattern string) (streamKeyParser, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream_key_format regexp: %w", err)
+	}
+	channelIndex := re.SubexpIndex("channel")
+	keyIndex := re.SubexpIndex("key")
+	if channelIndex < 0 || keyIndex < 0 {
+		return nil, errors.New("stream_key_format regexp must have named groups channel and key")
+	}
+
+	return func(ctrl *control.Control, publishingName string) (control.ChannelID, control.StreamKey, error) {
+		match := re.FindStringSubmatch(publishingName)
+		if match == nil {
+			return 0, nil, ErrInvalidStreamKey
+		}
+		return parseChannelID(match[channelIndex], match[keyIndex])
+	}, nil
+}
+
+func parseChannelID(channel, key string) (control.ChannelID, control.StreamKey, error) {
+	u64, err := strconv.ParseUint(channel, 10, 32)
+	if err != nil {
+		return 0, nil, err
+	}
+	return control.ChannelID(u64), control.StreamKey(key), nil
+}
+
+// sanitizePublishingName masks everything after the channel ID separator,
+// or the whole name when there isn't one
+func sanitizePublishingName(name string) string {
+	if i := strings.IndexAny(name, "-/"); i >= 0 {
+		return name[:i+1] + "***"
+	}
+	return "***"
+}
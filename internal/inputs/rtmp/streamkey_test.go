@@ -0,0 +1,23 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAppChannelIDKey(t *testing.T) {
+	assert := assert.New(t)
+
+	parse, err := newStreamKeyParser(StreamKeyFormatAppChannelIDKey)
+	assert.NoError(err)
+
+	channelID, streamKey, err := parse(nil, "live/1234-secretkey")
+	assert.NoError(err)
+	assert.Equal(control.ChannelID(1234), channelID)
+	assert.Equal(control.StreamKey("secretkey"), streamKey)
+
+	_, _, err = parse(nil, "1234-secretkey")
+	assert.ErrorIs(err, ErrInvalidStreamKey)
+}
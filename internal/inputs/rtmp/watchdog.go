@@ -0,0 +1,40 @@
+package rtmp
+
+import "time"
+
+// OnVideo runs on the go-rtmp read loop, so a video tag that never finishes
+// processing would hang the connection without anything noticing. The
+// watchdog runs while a tag is processed and closes the connection if it
+// takes longer than VideoProcessingTimeout.
+
+func (h *connHandler) startVideoWatchdog() {
+	if h.config.VideoProcessingTimeout <= 0 {
+		return
+	}
+	if h.videoWatchdog == nil {
+		h.videoWatchdog = time.AfterFunc(h.config.VideoProcessingTimeout, h.videoProcessingTimedOut)
+		return
+	}
+	h.videoWatchdog.Reset(h.config.VideoProcessingTimeout)
+}
+
+func (h *connHandler) stopVideoWatchdog() {
+	if h.videoWatchdog != nil {
+		h.videoWatchdog.Stop()
+	}
+}
+
+// videoProcessingTimedOut runs on the timer goroutine. Closing the net.Conn
+// fails the read loop's next read once the stuck tag gives up, or straight
+// away if it's stuck writing to the connection.
+func (h *connHandler) videoProcessingTimedOut() {
+	videoProcessingTimeoutsTotal.Inc()
+	h.log.Errorf("Processing a video tag took longer than %s, closing connection", h.config.VideoProcessingTimeout)
+
+	h.setErrored(true)
+	if h.netConn != nil {
+		if err := h.netConn.Close(); err != nil {
+			h.log.Errorf("Failed: %+v", err)
+		}
+	}
+}
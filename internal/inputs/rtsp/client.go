@@ -0,0 +1,257 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+)
+
+const (
+	reconnectDelay    = 5 * time.Second
+	keepaliveInterval = 30 * time.Second
+)
+
+func (s *RTSPSource) pull(ctx context.Context) {
+	s.log.Infof("Pulling RTSP stream from %s for channel_id=%d", s.config.PullURL, s.config.ChannelID)
+
+	for {
+		if err := s.pullOnce(ctx); err != nil && ctx.Err() == nil {
+			s.log.Errorf("Failed: %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (s *RTSPSource) pullOnce(ctx context.Context) error {
+	u, err := url.Parse(s.config.PullURL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+	// Credentials are sent with digest auth, never in the URL
+	u.User = nil
+
+	netConn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	c := &pullClient{
+		source:  s,
+		netConn: netConn,
+		conn:    newConn(netConn),
+		closed:  make(chan struct{}),
+	}
+	defer c.close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-c.closed:
+		}
+	}()
+
+	return c.run(ctx, u.String())
+}
+
+// pullClient is a single connection to the remote server in pull mode
+type pullClient struct {
+	source *RTSPSource
+
+	netConn net.Conn
+	conn    *conn
+	closed  chan struct{}
+
+	// Requests can be written by the keepalive goroutine during playback
+	mutex   sync.Mutex
+	cseq    int
+	session string
+	auth    *digestClient
+
+	publisher *publisher
+	udpTracks []*udpTrack
+}
+
+func (c *pullClient) close() {
+	close(c.closed)
+	c.netConn.Close()
+	for _, u := range c.udpTracks {
+		u.close()
+	}
+	if c.publisher != nil {
+		c.publisher.stop()
+	}
+}
+
+func (c *pullClient) send(method, uri string, header textproto.MIMEHeader) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+	c.cseq += 1
+	header.Set("CSeq", strconv.Itoa(c.cseq))
+	header.Set("User-Agent", "waveguide")
+	if c.session != "" {
+		header.Set("Session", c.session)
+	}
+	if c.auth != nil {
+		header.Set("Authorization", c.auth.authorization(method, uri))
+	}
+
+	return c.conn.writeRequest(&request{Method: method, URL: uri, Header: header})
+}
+
+// do sends a request and waits for the response, authenticating if asked to
+func (c *pullClient) do(method, uri string, header textproto.MIMEHeader) (*response, error) {
+	if err := c.send(method, uri, header); err != nil {
+		return nil, err
+	}
+	res, err := c.conn.readResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == 401 && c.auth == nil && c.source.config.Username != "" {
+		c.auth, err = newDigestClient(c.source.config.Username, c.source.config.Password, res.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+		return c.do(method, uri, header)
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("rtsp: %s %s returned %d %s", method, uri, res.StatusCode, res.Status)
+	}
+	return res, nil
+}
+
+func (c *pullClient) run(ctx context.Context, uri string) error {
+	if _, err := c.do("OPTIONS", uri, nil); err != nil {
+		return err
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Accept", "application/sdp")
+	res, err := c.do("DESCRIBE", uri, header)
+	if err != nil {
+		return err
+	}
+	tracks, err := parseSDP(res.Body)
+	if err != nil {
+		return err
+	}
+
+	base := res.Header.Get("Content-Base")
+	if base == "" {
+		base = uri
+	}
+
+	transport := c.source.config.Transport
+	if transport == "" {
+		transport = TransportTCP
+	}
+
+	channels := make(map[uint8]*mediaTrack)
+	for i, t := range tracks {
+		header := make(textproto.MIMEHeader)
+		if transport == TransportTCP {
+			header.Set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", i*2, i*2+1))
+			channels[uint8(i*2)] = t
+		} else {
+			rtpConn, rtcpConn, err := listenRTPPair()
+			if err != nil {
+				return err
+			}
+			c.udpTracks = append(c.udpTracks, &udpTrack{track: t, rtpConn: rtpConn, rtcpConn: rtcpConn, source: remoteIP(c.netConn)})
+			header.Set("Transport", fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", udpPort(rtpConn), udpPort(rtcpConn)))
+		}
+
+		res, err := c.do("SETUP", controlURL(base, t.control), header)
+		if err != nil {
+			return err
+		}
+		if c.session == "" {
+			// Strip any ;timeout= parameter
+			c.session = strings.SplitN(res.Header.Get("Session"), ";", 2)[0]
+		}
+	}
+
+	header = make(textproto.MIMEHeader)
+	header.Set("Range", "npt=0.000-")
+	if _, err := c.do("PLAY", uri, header); err != nil {
+		return err
+	}
+
+	c.publisher = newPublisher(c.source.log, c.source.control, control.ChannelID(c.source.config.ChannelID), tracks)
+	if err := c.publisher.start(ctx); err != nil {
+		return err
+	}
+
+	for _, u := range c.udpTracks {
+		go u.read(c.publisher)
+	}
+	go c.keepalive(uri)
+
+	// Read until the connection drops. With UDP transport we only see
+	// responses to our keepalives here.
+	for {
+		msg, err := c.conn.read()
+		if err != nil {
+			return err
+		}
+		frame, ok := msg.(*interleavedFrame)
+		if !ok {
+			continue
+		}
+		if track, ok := channels[frame.Channel]; ok {
+			if err := c.publisher.writeRTP(track, frame.Payload); err != nil {
+				c.source.log.Debugf("Dropping RTP packet: %+v", err)
+			}
+		}
+	}
+}
+
+func (c *pullClient) keepalive(uri string) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.send("GET_PARAMETER", uri, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func controlURL(base, trackControl string) string {
+	if trackControl == "" || trackControl == "*" {
+		return base
+	}
+	if strings.HasPrefix(trackControl, "rtsp://") {
+		return trackControl
+	}
+	return strings.TrimSuffix(base, "/") + "/" + trackControl
+}
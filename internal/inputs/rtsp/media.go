@@ -0,0 +1,371 @@
+package rtsp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Glimesh/go-fdkaac/fdkaac"
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/h264"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	opus "gopkg.in/hraban/opus.v2"
+)
+
+const (
+	mimeTypeAAC = "audio/aac"
+
+	audioClockRate uint32 = 48000
+
+	// RFC 3640 AU header fields wider than this are refused, sizes and
+	// indexes that big don't fit in a packet anyway
+	maxAUHeaderFieldBits = 16
+)
+
+var ErrNoSupportedTracks = errors.New("rtsp: no H.264 or AAC tracks in SDP")
+
+type mediaTrack struct {
+	mimeType    string
+	control     string
+	payloadType uint8
+	clockRate   uint32
+
+	// RFC 3640 parameters for MPEG4-GENERIC audio
+	aacConfig   []byte
+	sizeLength  int
+	indexLength int
+
+	track      *webrtc.TrackLocalStaticRTP
+	packetizer rtp.Packetizer
+	decoder    *fdkaac.AacDecoder
+	encoder    *opus.Encoder
+	buffer     []byte
+}
+
+// parseSDP returns the tracks we know how to ingest, ignoring everything else
+func parseSDP(body []byte) ([]*mediaTrack, error) {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal(body); err != nil {
+		return nil, err
+	}
+
+	tracks := []*mediaTrack{}
+	for _, md := range sd.MediaDescriptions {
+		if len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		format := md.MediaName.Formats[0]
+		pt, err := strconv.ParseUint(format, 10, 8)
+		if err != nil {
+			continue
+		}
+
+		track := &mediaTrack{
+			payloadType: uint8(pt),
+			sizeLength:  13,
+			indexLength: 3,
+		}
+		track.control, _ = md.Attribute("control")
+
+		var fmtp string
+		for _, attr := range md.Attributes {
+			switch {
+			case attr.Key == "rtpmap" && strings.HasPrefix(attr.Value, format+" "):
+				encoding := strings.Split(strings.TrimPrefix(attr.Value, format+" "), "/")
+				switch strings.ToUpper(encoding[0]) {
+				case "H264":
+					track.mimeType = webrtc.MimeTypeH264
+				case "MPEG4-GENERIC":
+					track.mimeType = mimeTypeAAC
+				}
+				if len(encoding) > 1 {
+					clockRate, _ := strconv.ParseUint(encoding[1], 10, 32)
+					track.clockRate = uint32(clockRate)
+				}
+			case attr.Key == "fmtp" && strings.HasPrefix(attr.Value, format+" "):
+				fmtp = strings.TrimPrefix(attr.Value, format+" ")
+			}
+		}
+
+		if track.mimeType == "" {
+			continue
+		}
+		if track.mimeType == mimeTypeAAC {
+			if err := track.parseAACParameters(fmtp); err != nil {
+				return nil, err
+			}
+		}
+		tracks = append(tracks, track)
+	}
+
+	if len(tracks) == 0 {
+		return nil, ErrNoSupportedTracks
+	}
+	return tracks, nil
+}
+
+func (t *mediaTrack) parseAACParameters(fmtp string) (err error) {
+	for _, param := range strings.Split(fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "config":
+			if t.aacConfig, err = hex.DecodeString(kv[1]); err != nil {
+				return fmt.Errorf("rtsp: invalid AAC config %q", kv[1])
+			}
+		case "sizelength":
+			if t.sizeLength, err = strconv.Atoi(kv[1]); err != nil {
+				return err
+			}
+		case "indexlength":
+			if t.indexLength, err = strconv.Atoi(kv[1]); err != nil {
+				return err
+			}
+		}
+	}
+	if t.aacConfig == nil {
+		return errors.New("rtsp: AAC track is missing config")
+	}
+	if t.sizeLength < 1 || t.sizeLength > maxAUHeaderFieldBits {
+		return fmt.Errorf("rtsp: invalid AAC sizelength %d", t.sizeLength)
+	}
+	if t.indexLength < 0 || t.indexLength > maxAUHeaderFieldBits {
+		return fmt.Errorf("rtsp: invalid AAC indexlength %d", t.indexLength)
+	}
+	return nil
+}
+
+// publisher takes the tracks negotiated with an RTSP peer and feeds them into control
+type publisher struct {
+	log     logrus.FieldLogger
+	control *control.Control
+
+	// Tracks received over UDP are written from their own goroutines
+	mutex sync.Mutex
+
+	channelID  control.ChannelID
+	stream     *control.Stream
+	controlCtx context.Context
+	started    bool
+
+	tracks []*mediaTrack
+}
+
+func newPublisher(log logrus.FieldLogger, ctrl *control.Control, channelID control.ChannelID, tracks []*mediaTrack) *publisher {
+	return &publisher{
+		log:       log.WithField("channel_id", channelID),
+		control:   ctrl,
+		channelID: channelID,
+		tracks:    tracks,
+	}
+}
+
+func (p *publisher) start(ctx context.Context) (err error) {
+	p.stream, p.controlCtx, err = p.control.StartStream(ctx, p.channelID, control.InputMetadata("rtsp"))
+	if err != nil {
+		return err
+	}
+	p.started = true
+
+	p.stream.ReportMetadata(
+		control.ClientVendorNameMetadata("waveguide-rtsp-input"),
+		control.ClientVendorVersionMetadata("0.0.1"),
+	)
+
+	for _, t := range p.tracks {
+		switch t.mimeType {
+		case webrtc.MimeTypeH264:
+			err = p.initVideo(t)
+		case mimeTypeAAC:
+			err = p.initAudio(t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *publisher) stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// We don't want to stop the stream if control is the one stopping us
+	if p.started && p.controlCtx.Err() == nil {
+		if err := p.control.StopStream(p.channelID); err != nil {
+			p.log.Error(err)
+		}
+	}
+	p.started = false
+
+	for _, t := range p.tracks {
+		if t.decoder != nil {
+			t.decoder.Close()
+			t.decoder = nil
+		}
+	}
+}
+
+func (p *publisher) initVideo(t *mediaTrack) (err error) {
+	t.track, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+	if err != nil {
+		return err
+	}
+
+	p.stream.AddTrack(t.track, webrtc.MimeTypeH264)
+	p.stream.ReportMetadata(control.VideoCodecMetadata(webrtc.MimeTypeH264))
+
+	return nil
+}
+
+func (p *publisher) initAudio(t *mediaTrack) (err error) {
+	t.packetizer = rtp.NewPacketizer(FTL_MTU, FTL_AUDIO_PT, uint32(p.channelID), &codecs.OpusPayloader{}, rtp.NewFixedSequencer(0), audioClockRate)
+
+	t.track, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+	if err != nil {
+		return err
+	}
+
+	t.encoder, err = opus.NewEncoder(int(audioClockRate), 2, opus.AppAudio)
+	if err != nil {
+		return err
+	}
+	t.decoder = fdkaac.NewAacDecoder()
+	if err := t.decoder.InitRaw(t.aacConfig); err != nil {
+		return err
+	}
+
+	p.stream.AddTrack(t.track, webrtc.MimeTypeOpus)
+	p.stream.ReportMetadata(control.AudioCodecMetadata(webrtc.MimeTypeOpus))
+
+	return nil
+}
+
+func (p *publisher) writeRTP(t *mediaTrack, buf []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.started {
+		return nil
+	}
+	if err := p.controlCtx.Err(); err != nil {
+		return err
+	}
+	p.stream.AddReceivedBytes(len(buf))
+
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(buf); err != nil {
+		return err
+	}
+	if packet.PayloadType != t.payloadType {
+		return nil
+	}
+
+	switch t.mimeType {
+	case webrtc.MimeTypeH264:
+		// H.264 is passed through untouched, the track rewrites SSRC and payload type
+		if h264.IsAnyKeyframe(packet.Payload) {
+			p.stream.ReportMetadata(control.KeyframeMetadata())
+		}
+		if err := t.track.WriteRTP(packet); err != nil {
+			return err
+		}
+		p.stream.ReportMetadata(control.VideoPacketsMetadata(1))
+	case mimeTypeAAC:
+		units, err := t.accessUnits(packet.Payload)
+		if err != nil {
+			return err
+		}
+		for _, au := range units {
+			if err := p.writeAAC(t, au); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// accessUnits splits an RFC 3640 AAC payload into its access units. Fragmented
+// access units are not supported, they are rare for AAC at typical MTUs.
+func (t *mediaTrack) accessUnits(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, ErrMalformedMessage
+	}
+	// parseAACParameters checks these, but a bad track mustn't panic here
+	if t.sizeLength < 1 || t.sizeLength > maxAUHeaderFieldBits || t.indexLength < 0 || t.indexLength > maxAUHeaderFieldBits {
+		return nil, ErrMalformedMessage
+	}
+	headersLength := int(binary.BigEndian.Uint16(payload)) // in bits
+	headerSize := t.sizeLength + t.indexLength
+	headersBytes := (headersLength + 7) / 8
+	if 2+headersBytes > len(payload) {
+		return nil, ErrMalformedMessage
+	}
+	headers := payload[2 : 2+headersBytes]
+	data := payload[2+headersBytes:]
+
+	units := [][]byte{}
+	for bit := 0; bit+headerSize <= headersLength; bit += headerSize {
+		size := readBits(headers, bit, t.sizeLength)
+		if size > len(data) {
+			return nil, ErrMalformedMessage
+		}
+		units = append(units, data[:size])
+		data = data[size:]
+	}
+
+	return units, nil
+}
+
+func readBits(buf []byte, offset, count int) int {
+	value := 0
+	for i := offset; i < offset+count; i++ {
+		value = value<<1 | int(buf[i/8]>>(7-i%8)&1)
+	}
+	return value
+}
+
+func (p *publisher) writeAAC(t *mediaTrack, au []byte) error {
+	// Convert AAC to opus
+	pcm, err := t.decoder.Decode(au)
+	if err != nil {
+		return fmt.Errorf("decode error: %w", err)
+	}
+
+	blockSize := 960
+	for t.buffer = append(t.buffer, pcm...); len(t.buffer) >= blockSize*4; t.buffer = t.buffer[blockSize*4:] {
+		pcm16 := make([]int16, blockSize*2)
+		for i := 0; i < len(pcm16); i++ {
+			pcm16[i] = int16(binary.LittleEndian.Uint16(t.buffer[i*2:]))
+		}
+		opusData := make([]byte, 1024)
+		n, err := t.encoder.Encode(pcm16, opusData)
+		if err != nil {
+			return err
+		}
+
+		packets := t.packetizer.Packetize(opusData[:n], uint32(blockSize))
+		for _, pkt := range packets {
+			if err := t.track.WriteRTP(pkt); err != nil {
+				return err
+			}
+		}
+
+		p.stream.ReportMetadata(control.AudioPacketsMetadata(len(packets)))
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package rtsp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAACParameters(t *testing.T) {
+	tests := []struct {
+		name        string
+		fmtp        string
+		sizeLength  int
+		indexLength int
+		err         bool
+	}{
+		{"defaults", "config=1210", 13, 3, false},
+		{"low bitrate", "config=1210;sizelength=6;indexlength=2", 6, 2, false},
+		{"missing config", "sizelength=13", 0, 0, true},
+		{"zero sizelength", "config=1210;sizelength=0", 0, 0, true},
+		{"huge sizelength", "config=1210;sizelength=64", 0, 0, true},
+		{"negative indexlength", "config=1210;indexlength=-1", 0, 0, true},
+		{"huge indexlength", "config=1210;indexlength=100", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			track := &mediaTrack{sizeLength: 13, indexLength: 3}
+			err := track.parseAACParameters(test.fmtp)
+			if test.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(test.sizeLength, track.sizeLength)
+			assert.Equal(test.indexLength, track.indexLength)
+		})
+	}
+}
+
+func TestAccessUnits(t *testing.T) {
+	tests := []struct {
+		name        string
+		sizeLength  int
+		indexLength int
+		payload     []byte
+		units       [][]byte
+		err         bool
+	}{
+		{
+			name:        "one unit",
+			sizeLength:  13,
+			indexLength: 3,
+			// 16 bits of headers, one 3 byte unit
+			payload: []byte{0x00, 0x10, 0x00, 0x18, 0xA, 0xB, 0xC},
+			units:   [][]byte{{0xA, 0xB, 0xC}},
+		},
+		{
+			name:        "two units",
+			sizeLength:  13,
+			indexLength: 3,
+			payload:     []byte{0x00, 0x20, 0x00, 0x10, 0x00, 0x08, 0xA, 0xB, 0xC},
+			units:       [][]byte{{0xA, 0xB}, {0xC}},
+		},
+		{
+			name:        "low bitrate",
+			sizeLength:  6,
+			indexLength: 2,
+			payload:     []byte{0x00, 0x08, 0x08, 0xA, 0xB},
+			units:       [][]byte{{0xA, 0xB}},
+		},
+		{
+			name:        "too short",
+			sizeLength:  13,
+			indexLength: 3,
+			payload:     []byte{0x00},
+			err:         true,
+		},
+		{
+			name:        "truncated headers",
+			sizeLength:  13,
+			indexLength: 3,
+			payload:     []byte{0x00, 0x20, 0x00, 0x10},
+			err:         true,
+		},
+		{
+			name:        "unit past the end",
+			sizeLength:  13,
+			indexLength: 3,
+			payload:     []byte{0x00, 0x10, 0x00, 0x28, 0xA, 0xB},
+			err:         true,
+		},
+		{
+			name:        "no header bits",
+			sizeLength:  0,
+			indexLength: 0,
+			payload:     []byte{0x00, 0x10, 0x00, 0x18, 0xA, 0xB, 0xC},
+			err:         true,
+		},
+		{
+			name:        "sizelength too wide",
+			sizeLength:  200,
+			indexLength: 3,
+			payload:     []byte{0x00, 0x10, 0x00, 0x18, 0xA, 0xB, 0xC},
+			err:         true,
+		},
+		{
+			name:        "negative indexlength",
+			sizeLength:  13,
+			indexLength: -13,
+			payload:     []byte{0x00, 0x10, 0x00, 0x18, 0xA, 0xB, 0xC},
+			err:         true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			track := &mediaTrack{sizeLength: test.sizeLength, indexLength: test.indexLength}
+			units, err := track.accessUnits(test.payload)
+			if test.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(test.units, units)
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtspVersion = "RTSP/1.0"
+
+	// Interleaved binary frames start with a dollar sign, see RFC 2326 10.12
+	interleavedMagic = '$'
+)
+
+var ErrMalformedMessage = errors.New("rtsp: malformed message")
+
+type request struct {
+	Method string
+	URL    string
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+type response struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+type interleavedFrame struct {
+	Channel uint8
+	Payload []byte
+}
+
+type conn struct {
+	br *bufio.Reader
+	tp *textproto.Reader
+	w  io.Writer
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	br := bufio.NewReader(rw)
+	return &conn{
+		br: br,
+		tp: textproto.NewReader(br),
+		w:  rw,
+	}
+}
+
+// read returns the next request, response or interleaved frame from the connection
+func (c *conn) read() (interface{}, error) {
+	b, err := c.br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] == interleavedMagic {
+		return c.readFrame()
+	}
+
+	line, err := c.tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return nil, ErrMalformedMessage
+	}
+
+	header, err := c.tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	body, err := c.readBody(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if parts[0] == rtspVersion {
+		code, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, ErrMalformedMessage
+		}
+		return &response{StatusCode: code, Status: parts[2], Header: header, Body: body}, nil
+	}
+
+	if parts[2] != rtspVersion {
+		return nil, ErrMalformedMessage
+	}
+	return &request{Method: parts[0], URL: parts[1], Header: header, Body: body}, nil
+}
+
+func (c *conn) readBody(header textproto.MIMEHeader) ([]byte, error) {
+	length := header.Get("Content-Length")
+	if length == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 {
+		return nil, ErrMalformedMessage
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (c *conn) readFrame() (*interleavedFrame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return nil, err
+	}
+	return &interleavedFrame{Channel: header[1], Payload: payload}, nil
+}
+
+// readResponse skips over any interleaved frames until a response arrives
+func (c *conn) readResponse() (*response, error) {
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch m := msg.(type) {
+		case *response:
+			return m, nil
+		case *request:
+			return nil, fmt.Errorf("rtsp: unexpected %s request while waiting for response", m.Method)
+		}
+	}
+}
+
+func (c *conn) writeRequest(req *request) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\r\n", req.Method, req.URL, rtspVersion)
+	writeHeader(&buf, req.Header, req.Body)
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
+
+func (c *conn) writeResponse(res *response) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %d %s\r\n", rtspVersion, res.StatusCode, res.Status)
+	writeHeader(&buf, res.Header, res.Body)
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
+
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader, body []byte) {
+	for key, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(buf, "Content-Length: %d\r\n", len(body))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+}
+
+// parseTransport parses a Transport header into its parameters. Only the
+// first transport spec is considered.
+func parseTransport(value string) (string, map[string]string) {
+	spec := strings.SplitN(value, ",", 2)[0]
+	parts := strings.Split(spec, ";")
+	params := make(map[string]string)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = kv[1]
+		} else {
+			params[strings.ToLower(kv[0])] = ""
+		}
+	}
+	return strings.TrimSpace(parts[0]), params
+}
+
+// parsePortRange parses values such as "5000-5001" or "0-1"
+func parsePortRange(value string) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	first, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return first, first + 1, nil
+	}
+	second, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, second, nil
+}
@@ -0,0 +1,89 @@
+package rtsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FTL_MTU      uint16 = 1392
+	FTL_VIDEO_PT uint8  = 96
+	FTL_AUDIO_PT uint8  = 97
+
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+)
+
+type RTSPSource struct {
+	log     logrus.FieldLogger
+	config  RTSPSourceConfig
+	control *control.Control
+}
+
+type RTSPSourceConfig struct {
+	// Listen address of the RTSP server in the ip:port format, used in server mode
+	Address string
+	// URL to pull the stream from, eg rtsp://camera.local/stream. Setting this
+	// enables pull mode, where we connect out instead of accepting publishers.
+	PullURL string `mapstructure:"pull_url"`
+	// Channel the pulled stream is published to, only used in pull mode
+	ChannelID int `mapstructure:"channel_id"`
+
+	// In server mode, require publishers to authenticate with Username and Password
+	AuthRequired bool `mapstructure:"auth_required"`
+	// Credentials for digest authentication. In pull mode these are sent to
+	// the remote server when it asks for them.
+	Username string
+	Password string
+
+	// RTP transport, either tcp or udp. In server mode leaving this empty
+	// accepts both, in pull mode it defaults to tcp.
+	Transport string
+}
+
+func New(config RTSPSourceConfig) control.Input {
+	return &RTSPSource{
+		config: config,
+	}
+}
+
+func (c RTSPSourceConfig) validate() error {
+	switch c.Transport {
+	case "", TransportTCP, TransportUDP:
+	default:
+		return fmt.Errorf("unknown transport %q, expected one of tcp, udp", c.Transport)
+	}
+	if c.AuthRequired && c.Username == "" {
+		return errors.New("auth_required is set but no username is configured")
+	}
+	if c.PullURL == "" && c.Address == "" {
+		return errors.New("either address or pull_url must be set")
+	}
+	return nil
+}
+
+func (s *RTSPSource) SetControl(ctrl *control.Control) {
+	s.control = ctrl
+}
+
+func (s *RTSPSource) SetLogger(log logrus.FieldLogger) {
+	s.log = log
+}
+
+func (s *RTSPSource) Listen(ctx context.Context) {
+	if err := s.config.validate(); err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+
+	if s.config.PullURL != "" {
+		s.pull(ctx)
+		return
+	}
+
+	s.serve(ctx)
+}
@@ -0,0 +1,264 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/sirupsen/logrus"
+)
+
+func (s *RTSPSource) serve(ctx context.Context) {
+	listener, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	s.log.Infof("Starting RTSP Server on %s", s.config.Address)
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.log.Errorf("Failed: %+v", err)
+			}
+			return
+		}
+
+		session := &serverSession{
+			source:    s,
+			log:       s.log.WithField("remote_addr", netConn.RemoteAddr().String()),
+			netConn:   netConn,
+			conn:      newConn(netConn),
+			sessionID: newNonce()[:16],
+			channels:  make(map[uint8]*mediaTrack),
+		}
+		if s.config.AuthRequired {
+			session.auth = newDigestAuth(s.config.Username, s.config.Password)
+		}
+		go session.serve(ctx)
+	}
+}
+
+// serverSession is a single publisher connection in server mode
+type serverSession struct {
+	source *RTSPSource
+	log    logrus.FieldLogger
+
+	netConn   net.Conn
+	conn      *conn
+	auth      *digestAuth
+	sessionID string
+
+	publisher *publisher
+	recording bool
+
+	// Interleaved RTP channel => track, for TCP transport
+	channels  map[uint8]*mediaTrack
+	udpTracks []*udpTrack
+}
+
+func (ss *serverSession) serve(ctx context.Context) {
+	defer ss.close()
+
+	for {
+		msg, err := ss.conn.read()
+		if err != nil {
+			ss.log.Debugf("Connection closed: %+v", err)
+			return
+		}
+
+		switch m := msg.(type) {
+		case *interleavedFrame:
+			track, ok := ss.channels[m.Channel]
+			if !ok || !ss.recording {
+				continue
+			}
+			if err := ss.publisher.writeRTP(track, m.Payload); err != nil {
+				ss.log.Debugf("Dropping RTP packet: %+v", err)
+			}
+		case *request:
+			res := ss.handle(ctx, m)
+			res.Header.Set("CSeq", m.Header.Get("CSeq"))
+			if err := ss.conn.writeResponse(res); err != nil {
+				ss.log.Errorf("Failed: %+v", err)
+				return
+			}
+			if m.Method == "TEARDOWN" || res.StatusCode == 403 {
+				return
+			}
+		}
+	}
+}
+
+func (ss *serverSession) close() {
+	ss.netConn.Close()
+	for _, u := range ss.udpTracks {
+		u.close()
+	}
+	if ss.publisher != nil {
+		ss.publisher.stop()
+	}
+}
+
+func newResponse(code int, status string) *response {
+	return &response{
+		StatusCode: code,
+		Status:     status,
+		Header:     make(textproto.MIMEHeader),
+	}
+}
+
+func (ss *serverSession) handle(ctx context.Context, req *request) *response {
+	if req.Method != "OPTIONS" && ss.auth != nil && !ss.auth.verify(req.Method, req.Header.Get("Authorization")) {
+		res := newResponse(401, "Unauthorized")
+		res.Header.Set("WWW-Authenticate", ss.auth.challenge())
+		return res
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		res := newResponse(200, "OK")
+		res.Header.Set("Public", "OPTIONS, ANNOUNCE, SETUP, RECORD, TEARDOWN")
+		return res
+	case "ANNOUNCE":
+		return ss.handleAnnounce(req)
+	case "SETUP":
+		return ss.handleSetup(req)
+	case "RECORD":
+		return ss.handleRecord(ctx, req)
+	case "TEARDOWN":
+		return newResponse(200, "OK")
+	}
+
+	return newResponse(501, "Not Implemented")
+}
+
+func (ss *serverSession) handleAnnounce(req *request) *response {
+	if ss.publisher != nil {
+		return newResponse(455, "Method Not Valid in This State")
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return newResponse(400, "Bad Request")
+	}
+
+	// Publishers push to rtsp://host/live/{channelID}-{streamKey}, same as RTMP
+	auth := strings.SplitN(path.Base(u.Path), "-", 2)
+	if len(auth) != 2 {
+		return newResponse(400, "Bad Request")
+	}
+	u64, err := strconv.ParseUint(auth[0], 10, 32)
+	if err != nil {
+		return newResponse(400, "Bad Request")
+	}
+	channelID := control.ChannelID(u64)
+
+	if err := ss.source.control.Authenticate(channelID, control.StreamKey(auth[1])); err != nil {
+		ss.log.Error(err)
+		return newResponse(403, "Forbidden")
+	}
+
+	tracks, err := parseSDP(req.Body)
+	if err != nil {
+		ss.log.Errorf("Failed: %+v", err)
+		return newResponse(415, "Unsupported Media Type")
+	}
+
+	ss.publisher = newPublisher(ss.log, ss.source.control, channelID, tracks)
+
+	return newResponse(200, "OK")
+}
+
+func (ss *serverSession) findTrack(setupURL string) *mediaTrack {
+	for _, t := range ss.publisher.tracks {
+		if t.control != "" && strings.HasSuffix(setupURL, t.control) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (ss *serverSession) handleSetup(req *request) *response {
+	if ss.publisher == nil || ss.recording {
+		return newResponse(455, "Method Not Valid in This State")
+	}
+
+	track := ss.findTrack(req.URL)
+	if track == nil {
+		return newResponse(404, "Not Found")
+	}
+
+	transport := req.Header.Get("Transport")
+	profile, params := parseTransport(transport)
+	configured := ss.source.config.Transport
+
+	res := newResponse(200, "OK")
+	res.Header.Set("Session", ss.sessionID)
+
+	if strings.HasSuffix(profile, "/TCP") {
+		if configured == TransportUDP {
+			return newResponse(461, "Unsupported Transport")
+		}
+		rtpChannel, _, err := parsePortRange(params["interleaved"])
+		if err != nil {
+			return newResponse(400, "Bad Request")
+		}
+		ss.channels[uint8(rtpChannel)] = track
+		res.Header.Set("Transport", transport)
+		return res
+	}
+
+	if configured == TransportTCP {
+		return newResponse(461, "Unsupported Transport")
+	}
+	if _, ok := params["client_port"]; !ok {
+		return newResponse(400, "Bad Request")
+	}
+
+	rtpConn, rtcpConn, err := listenRTPPair()
+	if err != nil {
+		ss.log.Errorf("Failed: %+v", err)
+		return newResponse(500, "Internal Server Error")
+	}
+	ss.udpTracks = append(ss.udpTracks, &udpTrack{track: track, rtpConn: rtpConn, rtcpConn: rtcpConn, source: remoteIP(ss.netConn)})
+	res.Header.Set("Transport", fmt.Sprintf("%s;server_port=%d-%d", transport, udpPort(rtpConn), udpPort(rtcpConn)))
+
+	return res
+}
+
+func (ss *serverSession) handleRecord(ctx context.Context, req *request) *response {
+	if ss.publisher == nil || ss.recording {
+		return newResponse(455, "Method Not Valid in This State")
+	}
+	if len(ss.channels) == 0 && len(ss.udpTracks) == 0 {
+		return newResponse(455, "Method Not Valid in This State")
+	}
+
+	if err := ss.publisher.start(ctx); err != nil {
+		ss.log.Errorf("Failed: %+v", err)
+		return newResponse(500, "Internal Server Error")
+	}
+	ss.recording = true
+
+	for _, u := range ss.udpTracks {
+		go u.read(ss.publisher)
+	}
+
+	res := newResponse(200, "OK")
+	res.Header.Set("Session", ss.sessionID)
+	return res
+}
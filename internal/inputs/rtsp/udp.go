@@ -0,0 +1,79 @@
+package rtsp
+
+import (
+	"errors"
+	"net"
+)
+
+const maxRTPPacketSize = 2048
+
+// listenRTPPair listens on an even RTP port with RTCP on the next odd port,
+// as expected by RFC 3550
+func listenRTPPair() (*net.UDPConn, *net.UDPConn, error) {
+	for i := 0; i < 10; i++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtpConn.Close()
+			continue
+		}
+
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		return rtpConn, rtcpConn, nil
+	}
+	return nil, nil, errors.New("rtsp: could not allocate RTP/RTCP port pair")
+}
+
+func udpPort(conn *net.UDPConn) int {
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// remoteIP is the address of the peer on the other end of the RTSP connection
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// udpTrack is a track received over UDP. RTCP is accepted but ignored.
+type udpTrack struct {
+	track    *mediaTrack
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+	// Only RTP from the RTSP peer is taken, anyone can send to the port
+	source net.IP
+}
+
+func (u *udpTrack) read(p *publisher) {
+	buf := make([]byte, maxRTPPacketSize)
+	for {
+		n, addr, err := u.rtpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !u.accepts(addr) {
+			continue
+		}
+		if err := p.writeRTP(u.track, buf[:n]); err != nil {
+			p.log.Debugf("Dropping RTP packet: %+v", err)
+		}
+	}
+}
+
+// accepts is whether a packet from addr is from the RTSP peer
+func (u *udpTrack) accepts(addr *net.UDPAddr) bool {
+	return addr != nil && addr.IP.Equal(u.source)
+}
+
+func (u *udpTrack) close() {
+	u.rtpConn.Close()
+	u.rtcpConn.Close()
+}
@@ -0,0 +1,22 @@
+package rtsp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPTrackAcceptsOnlyPeer(t *testing.T) {
+	assert := assert.New(t)
+
+	u := &udpTrack{source: net.ParseIP("192.0.2.10")}
+	assert.True(u.accepts(&net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}))
+	// The same address as IPv4 in IPv6, as dual stack sockets report it
+	assert.True(u.accepts(&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.10"), Port: 5002}))
+	assert.False(u.accepts(&net.UDPAddr{IP: net.ParseIP("192.0.2.11"), Port: 5000}))
+	assert.False(u.accepts(nil))
+
+	// Without a known peer nothing gets in
+	assert.False((&udpTrack{}).accepts(&net.UDPAddr{IP: net.ParseIP("192.0.2.10")}))
+}
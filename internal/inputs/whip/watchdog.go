@@ -0,0 +1,67 @@
+package whip
+
+import (
+	"sync"
+	"time"
+)
+
+// inactivityWatchdog calls onTimeout once if reset isn't called for timeout.
+// The timer only starts on the first reset, so a peer that never sends
+// anything is left to PC_TIMEOUT instead.
+type inactivityWatchdog struct {
+	mutex     sync.Mutex
+	timeout   time.Duration
+	timer     *time.Timer
+	deadline  time.Time
+	stopped   bool
+	onTimeout func()
+}
+
+func newInactivityWatchdog(timeout time.Duration, onTimeout func()) *inactivityWatchdog {
+	return &inactivityWatchdog{
+		timeout:   timeout,
+		onTimeout: onTimeout,
+	}
+}
+
+// reset pushes the deadline back by timeout. It's called for every packet, so
+// it only moves the deadline and the timer re-arms itself when it goes off early.
+func (w *inactivityWatchdog) reset() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopped {
+		return
+	}
+	w.deadline = time.Now().Add(w.timeout)
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.timeout, w.fire)
+	}
+}
+
+func (w *inactivityWatchdog) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+func (w *inactivityWatchdog) fire() {
+	w.mutex.Lock()
+	if w.stopped {
+		w.mutex.Unlock()
+		return
+	}
+	if remaining := time.Until(w.deadline); remaining > 0 {
+		w.timer.Reset(remaining)
+		w.mutex.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mutex.Unlock()
+
+	w.onTimeout()
+}
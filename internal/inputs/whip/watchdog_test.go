@@ -0,0 +1,82 @@
+package whip
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroadcaster stands in for a WHIP client, it "sends" a packet every
+// interval until sendFor has passed and then goes quiet.
+func fakeBroadcaster(w *inactivityWatchdog, interval, sendFor time.Duration) {
+	stopSending := time.After(sendFor)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopSending:
+			return
+		case <-ticker.C:
+			w.reset()
+		}
+	}
+}
+
+func TestInactivityWatchdogFiresAfterClientGoesQuiet(t *testing.T) {
+	assert := assert.New(t)
+
+	var fired int32
+	timedOut := make(chan time.Time, 1)
+	w := newInactivityWatchdog(100*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+		timedOut <- time.Now()
+	})
+
+	w.reset()
+	started := time.Now()
+	fakeBroadcaster(w, 10*time.Millisecond, 300*time.Millisecond)
+	quiet := time.Now()
+	assert.Equal(int32(0), atomic.LoadInt32(&fired), "fired while the client was still sending")
+
+	select {
+	case at := <-timedOut:
+		assert.True(at.Sub(started) >= 300*time.Millisecond)
+		assert.True(at.Sub(quiet) < 200*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("watchdog didn't fire after the client went quiet")
+	}
+
+	// It only fires once, even if packets show up again
+	w.reset()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&fired))
+}
+
+func TestInactivityWatchdogStop(t *testing.T) {
+	assert := assert.New(t)
+
+	var fired int32
+	w := newInactivityWatchdog(50*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+	})
+
+	w.reset()
+	w.stop()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(0), atomic.LoadInt32(&fired))
+}
+
+func TestInactivityWatchdogWaitsForFirstPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	var fired int32
+	newInactivityWatchdog(10*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int32(0), atomic.LoadInt32(&fired))
+}
@@ -12,12 +12,16 @@ import (
 	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/h264"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
 )
 
 const PC_TIMEOUT = time.Minute * 5
 
+const DefaultWHIPInactivityTimeout = 30 * time.Second
+
 type WHIPSource struct {
 	log     logrus.FieldLogger
 	config  WHIPSourceConfig
@@ -32,9 +36,17 @@ type WHIPSourceConfig struct {
 	Address   string
 	VideoFile string `mapstructure:"video_file"`
 	AudioFile string `mapstructure:"audio_file"`
+
+	// How long a connected broadcaster can go without sending any RTP before
+	// the stream is stopped, eg 30s
+	WHIPInactivityTimeout time.Duration `mapstructure:"whip_inactivity_timeout"`
 }
 
 func New(config WHIPSourceConfig) *WHIPSource {
+	if config.WHIPInactivityTimeout == 0 {
+		config.WHIPInactivityTimeout = DefaultWHIPInactivityTimeout
+	}
+
 	return &WHIPSource{
 		config:               config,
 		peerConnectionsMutex: sync.RWMutex{},
@@ -54,7 +66,7 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 	s.log.Infof("Registering WHIP http endpoints")
 
 	s.control.RegisterHandleFunc("/whip/endpoint/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		// This function allows for the channel ID to be passed in via the URL /whip/endpoint/1234
 		// or alternatively via the stream key 1234-somekey
@@ -108,7 +120,7 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 			return
 		}
 
-		stream, ctx, err := s.control.StartStream(channelID)
+		stream, ctx, err := s.control.StartStream(ctx, channelID, control.InputMetadata("whip"))
 		if err != nil {
 			s.log.Error(err)
 			errCustom(w, r, "Problem starting the stream")
@@ -117,7 +129,7 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 
 		ttl := time.Now().Add(PC_TIMEOUT)
 
-		peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		peerConnection, err := s.control.GetWebRTCAPI().NewPeerConnection(webrtc.Configuration{})
 		if err != nil {
 			s.log.Error(err)
 			errCustom(w, r, "Problem creating the peer connection")
@@ -157,8 +169,16 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 			return
 		}
 
+		watchdog := newInactivityWatchdog(s.config.WHIPInactivityTimeout, func() {
+			s.log.Infof("No RTP from %s for %s, stopping stream", channelID, s.config.WHIPInactivityTimeout)
+			s.sendGoodbye(peerConnection)
+			s.cleanupPeerConnection(channelID)
+			s.control.StopStream(channelID)
+		})
+
 		peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
 			codec := remoteTrack.Codec()
+			watchdog.reset()
 
 			if codec.MimeType == webrtc.MimeTypeOpus {
 				s.log.Info("Got Opus track, sending to audio track")
@@ -172,7 +192,9 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 						s.log.Error(err)
 						return
 					}
+					watchdog.reset()
 					audioTrack.WriteRTP(p)
+					stream.AddReceivedBytes(p.MarshalSize())
 					stream.ReportMetadata(control.AudioPacketsMetadata(len(p.Payload)))
 				}
 			} else if codec.MimeType == webrtc.MimeTypeH264 {
@@ -187,8 +209,13 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 						s.log.Error(err)
 						return
 					}
+					watchdog.reset()
 					videoTrack.WriteRTP(p)
+					stream.AddReceivedBytes(p.MarshalSize())
 					stream.ReportMetadata(control.VideoPacketsMetadata(len(p.Payload)))
+					if h264.IsAnyKeyframe(p.Payload) {
+						stream.ReportMetadata(control.KeyframeMetadata())
+					}
 				}
 			}
 		})
@@ -214,6 +241,7 @@ func (s *WHIPSource) Listen(ctx context.Context) {
 			}
 
 			if shouldClose {
+				watchdog.stop()
 				s.cleanupPeerConnection(channelID)
 				s.control.StopStream(channelID)
 			}
@@ -278,6 +306,23 @@ func (s *WHIPSource) startPeerConnectionTimeout(channelID control.ChannelID) {
 		}
 	}()
 }
+
+// sendGoodbye sends an RTCP BYE for every track the broadcaster is sending
+func (s *WHIPSource) sendGoodbye(pc *webrtc.PeerConnection) {
+	var ssrcs []uint32
+	for _, receiver := range pc.GetReceivers() {
+		if track := receiver.Track(); track != nil {
+			ssrcs = append(ssrcs, uint32(track.SSRC()))
+		}
+	}
+	if len(ssrcs) == 0 {
+		return
+	}
+
+	if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: ssrcs}}); err != nil {
+		s.log.Errorf("Failed to send RTCP BYE: %+v", err)
+	}
+}
 func (s *WHIPSource) cleanupPeerConnection(channelID control.ChannelID) {
 	s.peerConnectionsMutex.Lock()
 	defer s.peerConnectionsMutex.Unlock()
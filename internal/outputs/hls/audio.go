@@ -0,0 +1,195 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+)
+
+// Audio-only streams, eg radio style broadcasts, are packaged as raw Opus in
+// MPEG-TS and listed in the master playlist as an audio rendition only.
+
+const (
+	audioPlaylistName = "audio.m3u8"
+
+	// Audio segments are cut at the first Opus frame boundary past this
+	audioSegmentTarget = 2 * time.Second
+)
+
+var errInvalidOpusPacket = errors.New("invalid opus packet")
+
+type opusFrame struct {
+	data     []byte
+	duration time.Duration
+}
+
+// audioSegmenter collects Opus packets until there's enough for a segment
+type audioSegmenter struct {
+	channels int
+
+	frames    []opusFrame
+	duration  time.Duration
+	startedAt time.Time
+	// PTS of the next packet, carried across segments so they play back to back
+	pts time.Duration
+}
+
+// add queues an Opus packet, returning a finished segment once the target
+// duration has been reached
+func (a *audioSegmenter) add(packet []byte, now time.Time) (data []byte, duration float64, startedAt time.Time, err error) {
+	frameDuration, err := opusPacketDuration(packet)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	if len(a.frames) == 0 {
+		a.startedAt = now
+		if packet[0]&0x04 != 0 {
+			a.channels = 2
+		} else {
+			a.channels = 1
+		}
+	}
+
+	a.frames = append(a.frames, opusFrame{data: packet, duration: frameDuration})
+	a.duration += frameDuration
+	if a.duration < audioSegmentTarget {
+		return nil, 0, time.Time{}, nil
+	}
+
+	mux := newTSMuxer()
+	mux.writeTables(a.channels)
+	for _, frame := range a.frames {
+		mux.writePES(tsPIDAudio, tsStreamIDPrivate1, a.pts, opusAccessUnit(frame.data))
+		a.pts += frame.duration
+	}
+
+	data, duration, startedAt = mux.bytes(), a.duration.Seconds(), a.startedAt
+	a.frames = nil
+	a.duration = 0
+	return data, duration, startedAt, nil
+}
+
+// opusAccessUnit prefixes a packet with the opus_control_header, no trimming
+func opusAccessUnit(packet []byte) []byte {
+	au := []byte{0x7F, 0xE0}
+	size := len(packet)
+	for size >= 0xFF {
+		au = append(au, 0xFF)
+		size -= 0xFF
+	}
+	au = append(au, byte(size))
+	return append(au, packet...)
+}
+
+// opusPacketDuration reads how much audio a packet holds from its TOC byte,
+// see RFC 6716 section 3.1
+func opusPacketDuration(packet []byte) (time.Duration, error) {
+	if len(packet) < 1 {
+		return 0, errInvalidOpusPacket
+	}
+
+	config := packet[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12: // SILK
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // Hybrid
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errInvalidOpusPacket
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	duration := time.Duration(frames) * frame
+	if duration == 0 || duration > 120*time.Millisecond {
+		return 0, errInvalidOpusPacket
+	}
+	return duration, nil
+}
+
+// isAudioOnly checks with control whether a channel has no video, once the
+// input has added audio the answer is kept for the rest of the stream
+func (s *HLSServer) isAudioOnly(channelID control.ChannelID, pl *playlist) bool {
+	if pl.audioOnlyStream() {
+		return true
+	}
+
+	audioOnly, err := s.control.IsAudioOnly(channelID)
+	if err != nil || !audioOnly {
+		return false
+	}
+	pl.setAudioOnly()
+	return true
+}
+
+// writeAudio packages an Opus packet of an audio-only stream, streams with
+// video carry their audio in the video segments
+func (s *HLSServer) writeAudio(channelID control.ChannelID, packet []byte, now time.Time) error {
+	pl, err := s.getOrCreatePlaylist(channelID)
+	if err != nil {
+		return err
+	}
+	if !s.isAudioOnly(channelID, pl) {
+		return nil
+	}
+	if pl.cmaf() {
+		return errors.New("audio-only streams are only packaged as MPEG-TS")
+	}
+
+	data, duration, startedAt, err := pl.audio.add(packet, now)
+	if err != nil || data == nil {
+		return err
+	}
+
+	return pl.addSegment(data, duration, startedAt)
+}
+
+func (p *playlist) audioOnlyStream() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.audio != nil
+}
+
+func (p *playlist) setAudioOnly() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.audio == nil {
+		p.audio = &audioSegmenter{}
+	}
+}
+
+// renderAudioMaster renders the master playlist of an audio-only stream,
+// with the media playlist as the only audio rendition and no video variant
+func (p *playlist) renderAudioMaster() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	bandwidth := 0.0
+	for _, seg := range p.segments {
+		if seg.duration > 0 {
+			bandwidth = math.Max(bandwidth, float64(len(seg.data)*8)/seg.duration)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"Audio\",DEFAULT=YES,AUTOSELECT=YES,URI=%q\n", audioPlaylistName)
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"opus\",AUDIO=\"audio\"\n", int(math.Ceil(bandwidth)))
+	b.WriteString(audioPlaylistName + "\n")
+
+	return b.String()
+}
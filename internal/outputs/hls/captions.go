@@ -0,0 +1,200 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	captionsPlaylistName = "captions.m3u8"
+	masterPlaylistName   = "master.m3u8"
+	segmentExtVTT        = ".vtt"
+)
+
+// CEA-608 caption modes, see CTA-608-E section 9
+const (
+	captionModePopOn = iota
+	captionModeRollUp
+	captionModePaintOn
+)
+
+type captionCue struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+// captionTrack decodes the CC1 service of CEA-608 captions into WebVTT cues.
+// It only handles the basic character set and the common control codes,
+// positioning and styling are dropped.
+type captionTrack struct {
+	mutex sync.Mutex
+
+	// Cue times are relative to when the track was created
+	started time.Time
+
+	mode int
+	// Text being built up off screen in pop-on mode
+	memory strings.Builder
+	// Text currently on screen and when it appeared
+	display      string
+	displayStart time.Duration
+	// Roll-up and paint-on text is shown as it arrives
+	line      strings.Builder
+	lineStart time.Duration
+
+	lastControl [2]byte
+	cues        []captionCue
+}
+
+func newCaptionTrack() *captionTrack {
+	return &captionTrack{started: time.Now()}
+}
+
+// decode processes cc_data triplets received at now
+func (c *captionTrack) decode(ccData []byte, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	at := now.Sub(c.started)
+	for i := 0; i+2 < len(ccData); i += 3 {
+		ccValid := ccData[i]&0x04 != 0
+		ccType := ccData[i] & 0x03
+		// Only NTSC field 1 carries CC1
+		if !ccValid || ccType != 0 {
+			continue
+		}
+		c.decodePair(ccData[i+1]&0x7F, ccData[i+2]&0x7F, at)
+	}
+}
+
+func (c *captionTrack) decodePair(b1, b2 byte, at time.Duration) {
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+
+	if b1 >= 0x10 && b1 <= 0x1F {
+		// Control codes are sent twice for robustness, only act on the first
+		if c.lastControl == [2]byte{b1, b2} {
+			c.lastControl = [2]byte{}
+			return
+		}
+		c.lastControl = [2]byte{b1, b2}
+
+		// Codes for CC2 have bit 3 of the first byte set
+		if b1&0x08 != 0 {
+			return
+		}
+		c.control(b1, b2, at)
+		return
+	}
+	c.lastControl = [2]byte{}
+
+	for _, b := range []byte{b1, b2} {
+		if b >= 0x20 {
+			c.write(b, at)
+		}
+	}
+}
+
+func (c *captionTrack) control(b1, b2 byte, at time.Duration) {
+	switch {
+	case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2F:
+		switch b2 {
+		case 0x20: // Resume caption loading
+			c.mode = captionModePopOn
+		case 0x25, 0x26, 0x27: // Roll-up captions, 2-4 rows
+			c.mode = captionModeRollUp
+		case 0x29: // Resume direct captioning
+			c.mode = captionModePaintOn
+		case 0x2C: // Erase displayed memory
+			c.endDisplay(at)
+			c.endLine(at)
+		case 0x2D: // Carriage return
+			c.endLine(at)
+		case 0x2E: // Erase non-displayed memory
+			c.memory.Reset()
+		case 0x2F: // End of caption, flip memories
+			c.endDisplay(at)
+			c.display = strings.TrimSpace(c.memory.String())
+			c.displayStart = at
+			c.memory.Reset()
+		}
+	case b2 >= 0x40:
+		// Preamble address code, starts a new row
+		c.write('\n', at)
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2F:
+		// Mid-row style change, which takes up a space on screen
+		c.write(' ', at)
+	}
+}
+
+func (c *captionTrack) write(b byte, at time.Duration) {
+	if c.mode == captionModePopOn {
+		if b != '\n' || c.memory.Len() > 0 {
+			c.memory.WriteByte(b)
+		}
+		return
+	}
+
+	if c.line.Len() == 0 {
+		if b == '\n' {
+			return
+		}
+		c.lineStart = at
+	}
+	c.line.WriteByte(b)
+}
+
+func (c *captionTrack) endDisplay(at time.Duration) {
+	if c.display != "" {
+		c.cues = append(c.cues, captionCue{start: c.displayStart, end: at, text: c.display})
+	}
+	c.display = ""
+}
+
+func (c *captionTrack) endLine(at time.Duration) {
+	if text := strings.TrimSpace(c.line.String()); text != "" {
+		c.cues = append(c.cues, captionCue{start: c.lineStart, end: at, text: text})
+	}
+	c.line.Reset()
+}
+
+// segment renders the cues up to now as a WebVTT file. Captions still on
+// screen are split at the boundary so every segment lines up with its media.
+func (c *captionTrack) segment(now time.Time) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	at := now.Sub(c.started)
+	cues := c.cues
+	c.cues = nil
+
+	if c.display != "" {
+		cues = append(cues, captionCue{start: c.displayStart, end: at, text: c.display})
+		c.displayStart = at
+	}
+	if text := strings.TrimSpace(c.line.String()); text != "" {
+		cues = append(cues, captionCue{start: c.lineStart, end: at, text: text})
+		c.lineStart = at
+	}
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	b.WriteString("X-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n")
+	for _, cue := range cues {
+		if cue.end <= cue.start {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", vttTimestamp(cue.start), vttTimestamp(cue.end), cue.text)
+	}
+
+	return []byte(b.String())
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
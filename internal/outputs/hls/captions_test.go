@@ -0,0 +1,42 @@
+package hls
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptionSegmentsCutWithVideo(t *testing.T) {
+	assert := assert.New(t)
+
+	s := New(HLSConfig{ClosedCaptions: true})
+	pl, err := s.getOrCreatePlaylist(1)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Pop-on "HI": resume caption loading, the text, end of caption
+	pl.captions.decode([]byte{
+		0xFC, 0x14, 0x20,
+		0xFC, 'H', 'I',
+		0xFC, 0x14, 0x2F,
+	}, pl.captions.started)
+
+	for _, packet := range testVideoPackets(5) {
+		assert.NoError(s.writeVideo(1, packet, time.Now()))
+	}
+
+	captions := pl.renderCaptions()
+	assert.Contains(captions, "#EXTINF:2.000,\n0.vtt\n")
+	assert.Contains(captions, "#EXTINF:2.000,\n1.vtt\n")
+	assert.Contains(pl.renderMaster(), "SUBTITLES=\"subs\"")
+
+	// Still on screen when the first segment was cut, so it's split there
+	vtt, ok := pl.captionSegment(0)
+	if assert.True(ok) {
+		assert.Contains(string(vtt), "WEBVTT\n")
+		assert.Contains(string(vtt), "00:00:00.000 --> ")
+		assert.Contains(string(vtt), "\nHI\n")
+	}
+}
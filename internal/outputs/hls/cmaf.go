@@ -0,0 +1,352 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+const (
+	// Video timescale, matches the RTP clock rate so timestamps carry over as is
+	cmafTimescale = 90000
+	cmafTrackID   = 1
+
+	// trun sample flags, see ISO/IEC 14496-12 section 8.8.3.1
+	sampleFlagsKeyframe    = 0x02000000 // sample_depends_on=2
+	sampleFlagsNonKeyframe = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+var ErrAnnexB = errors.New("H.264 sample is Annex B, the MP4 container requires AVCC")
+var ErrInvalidAVCC = errors.New("H.264 sample is not valid length prefixed AVCC")
+
+// cmafSample is a single AVCC encoded H.264 access unit
+type cmafSample struct {
+	data              []byte
+	duration          uint32
+	compositionOffset int32
+	keyframe          bool
+}
+
+// validateAVCC checks that a sample is a sequence of 4 byte length prefixed NAL
+// units rather than Annex B start code delimited ones
+func validateAVCC(sample []byte) error {
+	for rest := sample; len(rest) > 0; {
+		var size uint32
+		if len(rest) >= 4 {
+			size = binary.BigEndian.Uint32(rest)
+		}
+		if size == 0 || uint64(size) > uint64(len(rest)-4) {
+			// 00 00 00 01 is also a valid length, so only blame Annex B once
+			// the sample fails to parse as AVCC
+			if isAnnexB(sample) {
+				return ErrAnnexB
+			}
+			return ErrInvalidAVCC
+		}
+		rest = rest[4+size:]
+	}
+
+	return nil
+}
+
+func isAnnexB(sample []byte) bool {
+	return bytes.HasPrefix(sample, []byte{0, 0, 1}) || bytes.HasPrefix(sample, []byte{0, 0, 0, 1})
+}
+
+// cmafInitSegment builds the init.mp4 for a single H.264 video track
+func cmafInitSegment(sps, pps []byte, width, height uint16) ([]byte, error) {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil, errors.New("missing SPS or PPS for the init segment")
+	}
+
+	buf := &seekBuffer{}
+	w := &boxWriter{w: mp4.NewWriter(buf)}
+
+	w.box(&mp4.Ftyp{
+		MajorBrand: [4]byte{'i', 's', 'o', '6'},
+		CompatibleBrands: []mp4.CompatibleBrandElem{
+			{CompatibleBrand: [4]byte{'i', 's', 'o', '6'}},
+			{CompatibleBrand: [4]byte{'c', 'm', 'f', 'c'}},
+			{CompatibleBrand: [4]byte{'m', 'p', '4', '1'}},
+		},
+	})
+
+	w.start(mp4.BoxTypeMoov())
+	w.box(&mp4.Mvhd{
+		Timescale:   1000,
+		Rate:        0x00010000,
+		Volume:      0x0100,
+		Matrix:      unityMatrix,
+		NextTrackID: cmafTrackID + 1,
+	})
+
+	w.start(mp4.BoxTypeTrak())
+	tkhd := &mp4.Tkhd{
+		TrackID: cmafTrackID,
+		Matrix:  unityMatrix,
+		Width:   uint32(width) << 16,
+		Height:  uint32(height) << 16,
+	}
+	tkhd.SetFlags(0x000003) // track_enabled | track_in_movie
+	w.box(tkhd)
+
+	w.start(mp4.BoxTypeMdia())
+	w.box(&mp4.Mdhd{
+		Timescale: cmafTimescale,
+		Language:  [3]byte{'u' - 0x60, 'n' - 0x60, 'd' - 0x60},
+	})
+	w.box(&mp4.Hdlr{
+		HandlerType: [4]byte{'v', 'i', 'd', 'e'},
+		Name:        "VideoHandler",
+	})
+
+	w.start(mp4.BoxTypeMinf())
+	vmhd := &mp4.Vmhd{}
+	vmhd.SetFlags(0x000001)
+	w.box(vmhd)
+
+	w.start(mp4.BoxTypeDinf())
+	w.start(mp4.BoxTypeDref())
+	w.marshal(&mp4.Dref{EntryCount: 1})
+	url := &mp4.Url{}
+	url.SetFlags(0x000001) // media is in the same file
+	w.box(url)
+	w.end() // dref
+	w.end() // dinf
+
+	w.start(mp4.BoxTypeStbl())
+	w.start(mp4.BoxTypeStsd())
+	w.marshal(&mp4.Stsd{EntryCount: 1})
+	w.start(mp4.BoxTypeAvc1())
+	w.marshal(&mp4.VisualSampleEntry{
+		SampleEntry: mp4.SampleEntry{
+			AnyTypeBox:         mp4.AnyTypeBox{Type: mp4.BoxTypeAvc1()},
+			DataReferenceIndex: 1,
+		},
+		Width:           width,
+		Height:          height,
+		Horizresolution: 0x00480000,
+		Vertresolution:  0x00480000,
+		FrameCount:      1,
+		Depth:           0x0018,
+		PreDefined3:     -1,
+	})
+	w.box(&mp4.AVCDecoderConfiguration{
+		AnyTypeBox:                 mp4.AnyTypeBox{Type: mp4.BoxTypeAvcC()},
+		ConfigurationVersion:       1,
+		Profile:                    sps[1],
+		ProfileCompatibility:       sps[2],
+		Level:                      sps[3],
+		LengthSizeMinusOne:         3,
+		NumOfSequenceParameterSets: 1,
+		SequenceParameterSets:      []mp4.AVCParameterSet{{Length: uint16(len(sps)), NALUnit: sps}},
+		NumOfPictureParameterSets:  1,
+		PictureParameterSets:       []mp4.AVCParameterSet{{Length: uint16(len(pps)), NALUnit: pps}},
+	})
+	w.end() // avc1
+	w.end() // stsd
+	// Fragmented files keep their samples in moof, the sample tables stay empty
+	w.box(&mp4.Stts{})
+	w.box(&mp4.Stsc{})
+	w.box(&mp4.Stsz{})
+	w.box(&mp4.Stco{})
+	w.end() // stbl
+	w.end() // minf
+	w.end() // mdia
+	w.end() // trak
+
+	w.start(mp4.BoxTypeMvex())
+	w.box(&mp4.Trex{
+		TrackID:                       cmafTrackID,
+		DefaultSampleDescriptionIndex: 1,
+	})
+	w.end() // mvex
+	w.end() // moov
+
+	if w.err != nil {
+		return nil, w.err
+	}
+	return buf.buf, nil
+}
+
+// cmafMuxer turns AVCC samples into .m4s media segments for one stream
+type cmafMuxer struct {
+	sequence   uint32
+	decodeTime uint64
+}
+
+// fragment builds the next media segment, returning it and its duration in seconds
+func (m *cmafMuxer) fragment(samples []cmafSample) ([]byte, float64, error) {
+	if len(samples) == 0 {
+		return nil, 0, errors.New("cannot build a fragment without samples")
+	}
+
+	var mdat []byte
+	var duration uint64
+	entries := make([]mp4.TrunEntry, len(samples))
+	for i, sample := range samples {
+		if err := validateAVCC(sample.data); err != nil {
+			return nil, 0, err
+		}
+
+		flags := uint32(sampleFlagsNonKeyframe)
+		if sample.keyframe {
+			flags = sampleFlagsKeyframe
+		}
+		entries[i] = mp4.TrunEntry{
+			SampleDuration:                sample.duration,
+			SampleSize:                    uint32(len(sample.data)),
+			SampleFlags:                   flags,
+			SampleCompositionTimeOffsetV1: sample.compositionOffset,
+		}
+		mdat = append(mdat, sample.data...)
+		duration += uint64(sample.duration)
+	}
+
+	m.sequence++
+
+	// The trun data offset depends on the size of moof itself, so build it
+	// once to measure and again with the real offset
+	moof, err := m.moof(entries, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	moof, err = m.moof(entries, int32(len(moof)+8))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := &seekBuffer{}
+	w := &boxWriter{w: mp4.NewWriter(buf)}
+	w.box(&mp4.Styp{
+		MajorBrand: [4]byte{'m', 's', 'd', 'h'},
+		CompatibleBrands: []mp4.CompatibleBrandElem{
+			{CompatibleBrand: [4]byte{'m', 's', 'd', 'h'}},
+			{CompatibleBrand: [4]byte{'m', 's', 'i', 'x'}},
+		},
+	})
+	if w.err != nil {
+		return nil, 0, w.err
+	}
+	buf.Write(moof)
+	w.box(&mp4.Mdat{Data: mdat})
+	if w.err != nil {
+		return nil, 0, w.err
+	}
+
+	m.decodeTime += duration
+
+	return buf.buf, float64(duration) / cmafTimescale, nil
+}
+
+func (m *cmafMuxer) moof(entries []mp4.TrunEntry, dataOffset int32) ([]byte, error) {
+	buf := &seekBuffer{}
+	w := &boxWriter{w: mp4.NewWriter(buf)}
+
+	w.start(mp4.BoxTypeMoof())
+	w.box(&mp4.Mfhd{SequenceNumber: m.sequence})
+
+	w.start(mp4.BoxTypeTraf())
+	tfhd := &mp4.Tfhd{TrackID: cmafTrackID}
+	tfhd.SetFlags(0x020000) // default-base-is-moof
+	w.box(tfhd)
+
+	tfdt := &mp4.Tfdt{BaseMediaDecodeTimeV1: m.decodeTime}
+	tfdt.SetVersion(1)
+	w.box(tfdt)
+
+	trun := &mp4.Trun{
+		SampleCount: uint32(len(entries)),
+		DataOffset:  dataOffset,
+		Entries:     entries,
+	}
+	// data-offset, sample duration, size, flags and composition time offset
+	trun.SetFlags(0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800)
+	// Version 1 allows negative composition offsets
+	trun.SetVersion(1)
+	w.box(trun)
+	w.end() // traf
+	w.end() // moof
+
+	if w.err != nil {
+		return nil, w.err
+	}
+	return buf.buf, nil
+}
+
+var unityMatrix = [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// boxWriter wraps mp4.Writer and keeps the first error, so the box tree
+// can be written without checking every call
+type boxWriter struct {
+	w   *mp4.Writer
+	err error
+}
+
+func (b *boxWriter) start(boxType mp4.BoxType) {
+	if b.err != nil {
+		return
+	}
+	_, b.err = b.w.StartBox(&mp4.BoxInfo{Type: boxType})
+}
+
+func (b *boxWriter) end() {
+	if b.err != nil {
+		return
+	}
+	_, b.err = b.w.EndBox()
+}
+
+// marshal writes the fields of box into the currently open box
+func (b *boxWriter) marshal(box mp4.IImmutableBox) {
+	if b.err != nil {
+		return
+	}
+	_, b.err = mp4.Marshal(b.w, box, mp4.Context{})
+}
+
+// box writes a complete box without children
+func (b *boxWriter) box(box mp4.IImmutableBox) {
+	b.start(box.GetType())
+	b.marshal(box)
+	b.end()
+}
+
+// seekBuffer is an in memory io.WriteSeeker, mp4.Writer seeks back to fill
+// in box sizes
+type seekBuffer struct {
+	buf []byte
+	pos int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if end := s.pos + len(p); end > len(s.buf) {
+		s.buf = append(s.buf, make([]byte, end-len(s.buf))...)
+	}
+	copy(s.buf[s.pos:], p)
+	s.pos += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(s.pos) + offset
+	case io.SeekEnd:
+		pos = int64(len(s.buf)) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("negative seek position")
+	}
+	s.pos = int(pos)
+	return pos, nil
+}
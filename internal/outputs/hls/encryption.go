@@ -0,0 +1,135 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const aesKeySize = 16
+
+// Number of keys kept around for players still fetching older segments. With
+// a rotation every segment each one in the playlist window has its own key,
+// plus one for players holding a playlist from just before the window moved.
+const retainedKeys = playlistWindow + 1
+
+type segmentKey struct {
+	index int
+	uri   string
+	key   []byte
+	// Per stream IV, XORed with the segment sequence number for each segment
+	iv [aes.BlockSize]byte
+}
+
+// encryptor implements HLS AES-128 segment encryption, see RFC 8216 section 5.2.
+type encryptor struct {
+	mutex sync.RWMutex
+
+	baseURI         string
+	rotateEvery     int
+	segmentsWritten int
+
+	current *segmentKey
+	keys    map[int]*segmentKey
+}
+
+func newEncryptor(key []byte, baseURI string, rotateEvery int) (*encryptor, error) {
+	if len(key) != aesKeySize {
+		return nil, fmt.Errorf("expected a %d byte AES key, got %d bytes", aesKeySize, len(key))
+	}
+
+	enc := &encryptor{
+		baseURI:     baseURI,
+		rotateEvery: rotateEvery,
+		keys:        make(map[int]*segmentKey),
+	}
+	if err := enc.useKey(0, key); err != nil {
+		return nil, err
+	}
+
+	return enc, nil
+}
+
+func (e *encryptor) useKey(index int, key []byte) error {
+	sk := &segmentKey{
+		index: index,
+		uri:   fmt.Sprintf("%s/%d.key", e.baseURI, index),
+		key:   key,
+	}
+	if _, err := rand.Read(sk.iv[:]); err != nil {
+		return err
+	}
+
+	e.current = sk
+	e.keys[index] = sk
+	delete(e.keys, index-retainedKeys)
+	e.segmentsWritten = 0
+
+	return nil
+}
+
+func (e *encryptor) rotate() error {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return e.useKey(e.current.index+1, key)
+}
+
+// encrypt returns the key used and the AES-128-CBC encrypted segment
+func (e *encryptor) encrypt(sequence uint64, data []byte) (*segmentKey, []byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.rotateEvery > 0 && e.segmentsWritten >= e.rotateEvery {
+		if err := e.rotate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	e.segmentsWritten++
+
+	block, err := aes.NewCipher(e.current.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := segmentIV(e.current.iv, sequence)
+	plaintext := pkcs7Pad(data, aes.BlockSize)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(ciphertext, plaintext)
+
+	return e.current, ciphertext, nil
+}
+
+func (e *encryptor) key(index int) ([]byte, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	sk, ok := e.keys[index]
+	if !ok {
+		return nil, false
+	}
+	return sk.key, true
+}
+
+func segmentIV(base [aes.BlockSize]byte, sequence uint64) [aes.BlockSize]byte {
+	var seq [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(seq[aes.BlockSize-8:], sequence)
+
+	iv := base
+	for i := range iv {
+		iv[i] ^= seq[i]
+	}
+	return iv
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padding := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data), len(data)+padding)
+	copy(padded, data)
+	return append(padded, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
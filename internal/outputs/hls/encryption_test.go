@@ -0,0 +1,170 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var keyTag = regexp.MustCompile(`#EXT-X-KEY:METHOD=AES-128,URI="([^"]*)/(\d+)\.key",IV=0x([0-9a-f]{32})\n#EXTINF:[0-9.]+,\n(\d+)\.ts`)
+
+func TestSegmentIV(t *testing.T) {
+	base := [aes.BlockSize]byte{0: 0xAA, 8: 0x01, 15: 0xF0}
+
+	tests := []struct {
+		sequence uint64
+		want     string
+	}{
+		{0, "aa0000000000000001000000000000f0"},
+		{1, "aa0000000000000001000000000000f1"},
+		{0x0F, "aa0000000000000001000000000000ff"},
+		{0x0100000000000000, "aa0000000000000000000000000000f0"},
+	}
+
+	for _, tt := range tests {
+		iv := segmentIV(base, tt.sequence)
+		assert.Equal(t, tt.want, hex.EncodeToString(iv[:]), "sequence %d", tt.sequence)
+	}
+
+	// The base isn't modified
+	assert.Equal(t, byte(0xF0), base[15])
+}
+
+func TestPKCS7Pad(t *testing.T) {
+	tests := []struct {
+		length  int
+		padding int
+	}{
+		{0, 16},
+		{1, 15},
+		{15, 1},
+		{16, 16},
+		{17, 15},
+	}
+
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte{0x42}, tt.length)
+		padded := pkcs7Pad(data, aes.BlockSize)
+
+		assert.Len(t, padded, tt.length+tt.padding, "%d bytes", tt.length)
+		assert.Equal(t, data, padded[:tt.length])
+		assert.Equal(t, bytes.Repeat([]byte{byte(tt.padding)}, tt.padding), padded[tt.length:])
+	}
+}
+
+// decryptSegments decrypts every segment in a rendered playlist with the key
+// and IV its EXT-X-KEY points at, as a player would
+func decryptSegments(t *testing.T, pl *playlist) map[uint64][]byte {
+	segments := map[uint64][]byte{}
+	for _, match := range keyTag.FindAllStringSubmatch(pl.render(), -1) {
+		index, _ := strconv.Atoi(match[2])
+		iv, _ := hex.DecodeString(match[3])
+		sequence, _ := strconv.ParseUint(match[4], 10, 64)
+
+		key, ok := pl.key(index)
+		if !assert.True(t, ok, "key %d", index) {
+			continue
+		}
+		ciphertext, ok := pl.segment(sequence)
+		if !assert.True(t, ok, "segment %d", sequence) || !assert.Zero(t, len(ciphertext)%aes.BlockSize) {
+			continue
+		}
+
+		block, err := aes.NewCipher(key)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+		padding := int(plaintext[len(plaintext)-1])
+		if !assert.True(t, padding > 0 && padding <= aes.BlockSize) {
+			continue
+		}
+		segments[sequence] = plaintext[:len(plaintext)-padding]
+	}
+	return segments
+}
+
+func segmentData(sequence int) []byte {
+	return []byte(strings.Repeat("segment "+strconv.Itoa(sequence)+" ", sequence+1))
+}
+
+func TestEncryptedSegmentsDecrypt(t *testing.T) {
+	assert := assert.New(t)
+	key := bytes.Repeat([]byte{0x11}, aesKeySize)
+	enc, err := newEncryptor(key, "https://example.com/hls/1", 0)
+	if !assert.NoError(err) {
+		return
+	}
+	pl := newPlaylist(false)
+	pl.encryptor = enc
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(pl.addSegment(segmentData(i), 2, time.Time{}))
+	}
+
+	segments := decryptSegments(t, pl)
+	assert.Len(segments, 3)
+	for i := 0; i < 3; i++ {
+		assert.Equal(segmentData(i), segments[uint64(i)])
+	}
+
+	// Without rotation everything uses the configured key
+	assert.Equal(3, strings.Count(pl.render(), `URI="https://example.com/hls/1/0.key"`))
+	served, ok := pl.key(0)
+	assert.True(ok)
+	assert.Equal(key, served)
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	key := bytes.Repeat([]byte{0x11}, aesKeySize)
+	enc, err := newEncryptor(key, "https://example.com/hls/1", 2)
+	if !assert.NoError(err) {
+		return
+	}
+	pl := newPlaylist(false)
+	pl.encryptor = enc
+
+	segments := 2 * (retainedKeys + 2)
+	for i := 0; i < segments; i++ {
+		assert.NoError(pl.addSegment(segmentData(i), 2, time.Time{}))
+	}
+
+	// Every segment still in the window decrypts with its own key and IV
+	decrypted := decryptSegments(t, pl)
+	assert.Len(decrypted, playlistWindow)
+	for sequence, data := range decrypted {
+		assert.Equal(segmentData(int(sequence)), data)
+	}
+
+	// A new key every two segments, the oldest ones are dropped
+	current := segments/2 - 1
+	for index := 0; index <= current; index++ {
+		served, ok := pl.key(index)
+		if index > current-retainedKeys {
+			assert.True(ok, "key %d", index)
+			assert.Len(served, aesKeySize)
+		} else {
+			assert.False(ok, "key %d", index)
+		}
+	}
+	first, _ := pl.key(current)
+	second, _ := pl.key(current - 1)
+	assert.NotEqual(first, second)
+	assert.NotEqual(key, first)
+}
+
+func TestNewEncryptorKeySize(t *testing.T) {
+	_, err := newEncryptor(make([]byte, 32), "https://example.com/hls/1", 0)
+	assert.Error(t, err)
+}
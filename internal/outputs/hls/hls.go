@@ -2,25 +2,117 @@ package hls
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/h264"
+	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
 )
 
+const DefaultSegmentCacheMaxAge = 3600
+
 type HLSConfig struct {
 	// Listen address of the HLS webserver
 	Address string
+	// Path prefix the playlists are served under, defaults to /hls, or
+	// /hls-cmaf with CMAF enabled so both can run in separate output blocks
+	Path string
+
+	// Produce fragmented MP4 (.m4s) segments with an init.mp4 instead of
+	// MPEG-TS, they only carry the video
+	CMAF bool `mapstructure:"cmaf"`
+
+	// Hex encoded 16 byte AES-128 key, enables segment encryption when set
+	EncryptionKey string `mapstructure:"encryption_key"`
+	// Base URL players fetch keys from, defaults to this servers /hls path
+	EncryptionKeyURL string `mapstructure:"encryption_key_url"`
+	// Number of segments encrypted with a key before a new one is generated, 0 never rotates
+	KeyRotationSegments int `mapstructure:"key_rotation_segments"`
+
+	// Serve CEA-608 captions from the input as WebVTT alongside the segments
+	ClosedCaptions bool `mapstructure:"closed_captions"`
+
+	// Seconds CDNs and players may cache segments for, they never change
+	// once written. Defaults to an hour.
+	SegmentCacheMaxAge int `mapstructure:"segment_cache_max_age"`
+	// Seconds playlists may be cached for, 0 sends no-cache. Should stay
+	// below the segment duration so viewers don't fall behind.
+	PlaylistCacheMaxAge int `mapstructure:"playlist_cache_max_age"`
+
+	// Tag every segment with EXT-X-PROGRAM-DATE-TIME, the wall clock time its
+	// first keyframe arrived
+	ProgramDateTime bool `mapstructure:"program_date_time"`
+
+	// ECDSA P-256 private key PEM file, when set segment URLs in playlists
+	// get ?sig=&exp= parameters a CDN can check with the public key
+	PlaylistSigningKeyPath string `mapstructure:"playlist_signing_key_path"`
+
+	// Mark ad breaks signalled by SCTE-35 in the input, eg RTMP onFI, with
+	// EXT-X-CUE-OUT and EXT-X-CUE-IN for server-side ad insertion
+	SCTE35Passthrough bool `mapstructure:"scte35_passthrough"`
+
+	// Only serve playlists and segments to requests carrying a token, players
+	// get one by being redirected on their first playlist request
+	PlaylistTokenRequired bool `mapstructure:"playlist_token_required"`
+	// Secret the playlist tokens are HMAC'd with
+	PlaylistTokenSecret string `mapstructure:"playlist_token_secret"`
+	// How long a playlist token is valid for, defaults to an hour
+	PlaylistTokenTTL time.Duration `mapstructure:"playlist_token_ttl"`
 }
 
 type HLSServer struct {
 	log     logrus.FieldLogger
 	config  HLSConfig
 	control *control.Control
+
+	encryptionKey []byte
+	signer        *urlSigner
+
+	playlistsMutex sync.RWMutex
+	playlists      map[control.ChannelID]*playlist
+
+	// Closed to stop reading captions when a stream ends
+	captionsMutex sync.Mutex
+	captionsDone  map[control.ChannelID]chan struct{}
+
+	// Closed to stop reading splice events when a stream ends
+	spliceMutex sync.Mutex
+	spliceDone  map[control.ChannelID]chan struct{}
+
+	// Closed to stop reading media when a stream ends
+	readersMutex sync.Mutex
+	readersDone  map[control.ChannelID]chan struct{}
 }
 
 func New(config HLSConfig) *HLSServer {
+	if config.Path == "" {
+		if config.CMAF {
+			config.Path = "/hls-cmaf"
+		} else {
+			config.Path = "/hls"
+		}
+	}
+	config.Path = "/" + strings.Trim(config.Path, "/")
+	if config.SegmentCacheMaxAge == 0 {
+		config.SegmentCacheMaxAge = DefaultSegmentCacheMaxAge
+	}
+	if config.PlaylistTokenTTL == 0 {
+		config.PlaylistTokenTTL = DefaultPlaylistTokenTTL
+	}
+
 	return &HLSServer{
-		config: config,
+		config:       config,
+		playlists:    make(map[control.ChannelID]*playlist),
+		captionsDone: make(map[control.ChannelID]chan struct{}),
+		spliceDone:   make(map[control.ChannelID]chan struct{}),
+		readersDone:  make(map[control.ChannelID]chan struct{}),
 	}
 }
 
@@ -35,17 +127,364 @@ func (s *HLSServer) SetLogger(log logrus.FieldLogger) {
 func (s *HLSServer) Listen(ctx context.Context) {
 	s.log.Infof("Starting HLS Server on %s", s.config.Address)
 
-	// Basically what the HLS server needs to do is:
-	// When a new stream is added:
-	//  0. create a new file
-	//  1. consume the video / audio from the stream
-	//  2. write that video / audio directly to the HLS file
+	if s.config.EncryptionKey != "" {
+		key, err := hex.DecodeString(s.config.EncryptionKey)
+		if err != nil || len(key) != aesKeySize {
+			s.log.Errorf("encryption_key must be %d hex encoded bytes", aesKeySize)
+			return
+		}
+		s.encryptionKey = key
+	}
+
+	if s.config.PlaylistSigningKeyPath != "" {
+		signer, err := newURLSigner(s.config.PlaylistSigningKeyPath)
+		if err != nil {
+			s.log.Errorf("Failed: %+v", err)
+			return
+		}
+		s.signer = signer
+	}
+
+	if s.config.PlaylistTokenRequired && s.config.PlaylistTokenSecret == "" {
+		s.log.Errorf("playlist_token_secret is required with playlist_token_required")
+		return
+	}
+
+	// /hls/{channelID}/index.m3u8, /hls/{channelID}/{sequence}.ts, /hls/{channelID}/{key}.key
+	// and with CMAF /hls-cmaf/{channelID}/init.mp4, /hls-cmaf/{channelID}/{sequence}.m4s
+	// and with closed captions /hls/{channelID}/master.m3u8, /hls/{channelID}/captions.m3u8, /hls/{channelID}/{sequence}.vtt
+	// and for audio-only streams /hls/{channelID}/master.m3u8, /hls/{channelID}/audio.m3u8
+	prefix := s.config.Path + "/"
+	s.control.RegisterHandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if len(parts) != 2 {
+			errNotFound(w, r)
+			return
+		}
+		channelID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			errNotFound(w, r)
+			return
+		}
+		tokenQuery, ok := s.checkPlaylistToken(w, r, parts[0], parts[1])
+		if !ok {
+			return
+		}
+		pl, ok := s.getPlaylist(control.ChannelID(channelID))
+		if !ok {
+			errNotFound(w, r)
+			return
+		}
+
+		file := parts[1]
+		switch {
+		case file == "index.m3u8":
+			s.writePlaylist(w, pl.render(), tokenQuery)
+		case file == masterPlaylistName && pl.audioOnlyStream():
+			s.writePlaylist(w, pl.renderAudioMaster(), tokenQuery)
+		case file == audioPlaylistName && pl.audioOnlyStream():
+			s.writePlaylist(w, pl.render(), tokenQuery)
+		case file == masterPlaylistName && pl.captions != nil:
+			s.writePlaylist(w, pl.renderMaster(), tokenQuery)
+		case file == captionsPlaylistName && pl.captions != nil:
+			s.writePlaylist(w, pl.renderCaptions(), tokenQuery)
+		case strings.HasSuffix(file, segmentExtVTT) && pl.captions != nil:
+			sequence, err := strconv.ParseUint(strings.TrimSuffix(file, segmentExtVTT), 10, 64)
+			if err != nil {
+				errNotFound(w, r)
+				return
+			}
+			data, ok := pl.captionSegment(sequence)
+			if !ok {
+				errNotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/vtt")
+			s.segmentCacheHeaders(w)
+			w.Write(data)
+		case file == initSegmentName && pl.cmaf():
+			data, ok := pl.init()
+			if !ok {
+				data, ok = s.initSegmentFromControl(control.ChannelID(channelID), pl)
+			}
+			if !ok {
+				errNotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "video/mp4")
+			s.segmentCacheHeaders(w)
+			w.Write(data)
+		case strings.HasSuffix(file, pl.segmentExt):
+			sequence, err := strconv.ParseUint(strings.TrimSuffix(file, pl.segmentExt), 10, 64)
+			if err != nil {
+				errNotFound(w, r)
+				return
+			}
+			data, ok := pl.segment(sequence)
+			if !ok {
+				errNotFound(w, r)
+				return
+			}
+			if pl.cmaf() {
+				w.Header().Set("Content-Type", "video/iso.segment")
+			} else {
+				w.Header().Set("Content-Type", "video/mp2t")
+			}
+			s.segmentCacheHeaders(w)
+			w.Write(data)
+		case strings.HasSuffix(file, ".key"):
+			index, err := strconv.Atoi(strings.TrimSuffix(file, ".key"))
+			if err != nil {
+				errNotFound(w, r)
+				return
+			}
+			key, ok := pl.key(index)
+			if !ok {
+				errNotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(key)
+		default:
+			errNotFound(w, r)
+		}
+	})
+}
+
+// writeSegment adds a finished MPEG-TS or fMP4 segment to the channels
+// playlist, encrypting it first if encryption is enabled. startedAt is when
+// the keyframe the segment starts with arrived, not when it was written.
+func (s *HLSServer) writeSegment(channelID control.ChannelID, data []byte, duration float64, startedAt time.Time) error {
+	pl, err := s.getOrCreatePlaylist(channelID)
+	if err != nil {
+		return err
+	}
+
+	return pl.addSegment(data, duration, startedAt)
+}
+
+// writeInitSegment builds the CMAF init.mp4 of a channel from its H.264
+// parameter sets, it has to be called again whenever they change.
+func (s *HLSServer) writeInitSegment(channelID control.ChannelID, sps, pps []byte, width, height uint16) error {
+	data, err := cmafInitSegment(sps, pps, width, height)
+	if err != nil {
+		return err
+	}
+
+	pl, err := s.getOrCreatePlaylist(channelID)
+	if err != nil {
+		return err
+	}
+	pl.setInitSegment(data, sps, pps)
+
+	return nil
+}
+
+// initSegmentFromControl builds init.mp4 from the parameter sets the input
+// gave control, for players asking before one has been written
+func (s *HLSServer) initSegmentFromControl(channelID control.ChannelID, pl *playlist) ([]byte, bool) {
+	sps, pps, err := s.control.GetDecoderConfig(channelID)
+	if err != nil {
+		return nil, false
+	}
+	width, height, err := h264.SPSResolution(sps)
+	if err != nil {
+		s.log.Debugf("Failed to parse SPS: %s", err)
+		return nil, false
+	}
+	if err := s.writeInitSegment(channelID, sps, pps, uint16(width), uint16(height)); err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return nil, false
+	}
+
+	return pl.init()
+}
+
+// SupportedCodecs lists what MPEG-TS segments can carry
+func (s *HLSServer) SupportedCodecs() []string {
+	return []string{webrtc.MimeTypeH264, control.MimeTypeAAC, webrtc.MimeTypeOpus}
+}
+
+// HandleStreamEvent starts and stops reading the media, captions and ad
+// break markers of streams, control delivers events to registered outputs
+func (s *HLSServer) HandleStreamEvent(event control.StreamEvent) error {
+	if s.config.ClosedCaptions {
+		if err := s.captionEvents(event); err != nil {
+			return err
+		}
+	}
+	if s.config.SCTE35Passthrough {
+		if err := s.spliceEvents(event); err != nil {
+			return err
+		}
+	}
+	return s.mediaEvents(event)
+}
+
+// Stop removes the HLS endpoints and drops every playlist
+func (s *HLSServer) Stop() {
+	s.control.DeregisterHandleFunc(s.config.Path + "/")
+
+	s.captionsMutex.Lock()
+	for channelID, done := range s.captionsDone {
+		close(done)
+		delete(s.captionsDone, channelID)
+	}
+	s.captionsMutex.Unlock()
+
+	s.spliceMutex.Lock()
+	for channelID, done := range s.spliceDone {
+		close(done)
+		delete(s.spliceDone, channelID)
+	}
+	s.spliceMutex.Unlock()
+
+	s.readersMutex.Lock()
+	for channelID, done := range s.readersDone {
+		close(done)
+		delete(s.readersDone, channelID)
+	}
+	s.readersMutex.Unlock()
+
+	s.playlistsMutex.Lock()
+	s.playlists = make(map[control.ChannelID]*playlist)
+	s.playlistsMutex.Unlock()
+}
+
+func (s *HLSServer) getOrCreatePlaylist(channelID control.ChannelID) (*playlist, error) {
+	s.playlistsMutex.Lock()
+	defer s.playlistsMutex.Unlock()
+
+	if pl, ok := s.playlists[channelID]; ok {
+		return pl, nil
+	}
+
+	pl := newPlaylist(s.config.CMAF)
+	if s.encryptionKey != nil {
+		enc, err := newEncryptor(s.encryptionKey, s.keyURL(channelID), s.config.KeyRotationSegments)
+		if err != nil {
+			return nil, err
+		}
+		pl.encryptor = enc
+	}
+	if s.config.ClosedCaptions {
+		pl.captions = newCaptionTrack()
+	}
+	pl.programDateTime = s.config.ProgramDateTime
+	if s.signer != nil {
+		pl.signURI = s.segmentURISigner(channelID)
+	}
+	s.playlists[channelID] = pl
+
+	return pl, nil
+}
+
+func (s *HLSServer) getPlaylist(channelID control.ChannelID) (*playlist, bool) {
+	s.playlistsMutex.RLock()
+	defer s.playlistsMutex.RUnlock()
+
+	pl, ok := s.playlists[channelID]
+	return pl, ok
+}
+
+func (s *HLSServer) removePlaylist(channelID control.ChannelID) {
+	s.playlistsMutex.Lock()
+	defer s.playlistsMutex.Unlock()
+
+	delete(s.playlists, channelID)
+}
+
+// captionEvents starts reading the captions of a stream when it starts, and
+// stops when it ends
+func (s *HLSServer) captionEvents(event control.StreamEvent) error {
+	switch event.Type {
+	case control.EventStreamStarted:
+		captions, err := s.control.ClosedCaptions(event.ChannelID)
+		if err != nil {
+			return err
+		}
+		pl, err := s.getOrCreatePlaylist(event.ChannelID)
+		if err != nil {
+			return err
+		}
+
+		done := make(chan struct{})
+		s.captionsMutex.Lock()
+		s.captionsDone[event.ChannelID] = done
+		s.captionsMutex.Unlock()
 
-	// var b bytes.Buffer
+		go s.readCaptions(pl, captions, done)
+	case control.EventStreamStopped:
+		s.captionsMutex.Lock()
+		if done, ok := s.captionsDone[event.ChannelID]; ok {
+			close(done)
+			delete(s.captionsDone, event.ChannelID)
+		}
+		s.captionsMutex.Unlock()
+	}
+
+	return nil
+}
 
-	// s.control.AddMediaHandler()
+func (s *HLSServer) readCaptions(pl *playlist, captions <-chan []byte, done chan struct{}) {
+	for {
+		select {
+		case ccData := <-captions:
+			pl.captions.decode(ccData, time.Now())
+		case <-done:
+			return
+		}
+	}
+}
 
-	// b.read
+func (s *HLSServer) segmentURISigner(channelID control.ChannelID) func(string) string {
+	prefix := fmt.Sprintf("%s/%d/", s.config.Path, channelID)
+	return func(file string) string {
+		signed, err := s.signer.sign(file, prefix+file, channelID.String(), time.Now().Add(signedURLLifetime))
+		if err != nil {
+			s.log.Errorf("Failed to sign %s: %+v", file, err)
+			return file
+		}
+		return signed
+	}
+}
+
+func (s *HLSServer) keyURL(channelID control.ChannelID) string {
+	base := s.config.EncryptionKeyURL
+	if base == "" {
+		base = s.control.HttpServerUrl() + s.config.Path
+	}
+	return fmt.Sprintf("%s/%d", strings.TrimSuffix(base, "/"), channelID)
+}
+
+// segmentCacheHeaders lets CDNs hold on to segments, they are immutable once written
+func (s *HLSServer) segmentCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", s.config.SegmentCacheMaxAge))
+	w.Header().Set("Surrogate-Control", fmt.Sprintf("max-age=%d", s.config.SegmentCacheMaxAge))
+}
+
+// writePlaylist serves a rendered playlist, carrying the viewer's playlist
+// token on to the URIs in it
+func (s *HLSServer) writePlaylist(w http.ResponseWriter, playlist string, tokenQuery string) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	s.playlistCacheHeaders(w)
+	fmt.Fprint(w, addPlaylistToken(playlist, tokenQuery))
+}
+
+// playlistCacheHeaders keeps live playlists fresh, they change with every segment
+func (s *HLSServer) playlistCacheHeaders(w http.ResponseWriter) {
+	if s.config.PlaylistCacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", s.config.PlaylistCacheMaxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Surrogate-Control", fmt.Sprintf("max-age=%d", s.config.PlaylistCacheMaxAge))
+}
 
-	// s.control.Add
+func errNotFound(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Header().Set("Content-Type", "plain/text")
+	w.Write([]byte("Not found"))
 }
@@ -0,0 +1,295 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+)
+
+// Number of segments kept in the live playlist window
+const playlistWindow = 6
+
+const (
+	segmentExtTS   = ".ts"
+	segmentExtCMAF = ".m4s"
+
+	initSegmentName = "init.mp4"
+)
+
+type segment struct {
+	sequence uint64
+	duration float64
+	data     []byte
+	// Wall clock time of the first keyframe in the segment
+	startedAt time.Time
+
+	// Only set when the segment is encrypted
+	key *segmentKey
+
+	// An ad break starts with this segment, cueOutDuration is zero when the
+	// input didn't give its length
+	cueOut         bool
+	cueOutDuration float64
+	// The segment is back from an ad break
+	cueIn bool
+}
+
+type playlist struct {
+	mutex sync.RWMutex
+
+	segments     []*segment
+	nextSequence uint64
+
+	// File extension of the segments, .ts or .m4s for CMAF
+	segmentExt string
+	// fMP4 initialization segment and the parameter sets it was built
+	// from, only used for CMAF
+	initSegment []byte
+	initSPS     []byte
+	initPPS     []byte
+	// Builds the fragments of the segments, only used by the video reader
+	cmafMuxer cmafMuxer
+
+	encryptor *encryptor
+
+	// WebVTT captions cut at the same boundaries as the media segments, only
+	// set with closed captions enabled
+	captions        *captionTrack
+	captionSegments []*segment
+
+	programDateTime bool
+
+	// Packages Opus into segments, only set once the stream turned out to
+	// be audio-only
+	audio *audioSegmenter
+	// Cuts H.264 into segments at keyframes, fed by a single reader
+	video videoSegmenter
+
+	// Signs segment URIs as the playlist is rendered, only set with playlist
+	// signing enabled
+	signURI func(file string) string
+
+	// SCTE-35 splice state, markers take effect at the next segment boundary
+	pendingCueOut   *control.SpliceEvent
+	pendingCueIn    bool
+	inBreak         bool
+	breakAutoReturn bool
+	breakRemaining  float64
+}
+
+func newPlaylist(cmaf bool) *playlist {
+	if cmaf {
+		return &playlist{segmentExt: segmentExtCMAF}
+	}
+	return &playlist{segmentExt: segmentExtTS}
+}
+
+func (p *playlist) cmaf() bool {
+	return p.segmentExt == segmentExtCMAF
+}
+
+// uri is how a file of the playlist is referenced from the playlist itself
+func (p *playlist) uri(file string) string {
+	if p.signURI == nil {
+		return file
+	}
+	return p.signURI(file)
+}
+
+func (p *playlist) setInitSegment(data, sps, pps []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.initSegment = data
+	p.initSPS = sps
+	p.initPPS = pps
+}
+
+// initFrom is whether the init segment was built from these parameter sets
+func (p *playlist) initFrom(sps, pps []byte) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.initSegment != nil && bytes.Equal(p.initSPS, sps) && bytes.Equal(p.initPPS, pps)
+}
+
+func (p *playlist) init() ([]byte, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.initSegment, p.initSegment != nil
+}
+
+func (p *playlist) addSegment(data []byte, duration float64, startedAt time.Time) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	seg := &segment{
+		sequence:  p.nextSequence,
+		duration:  duration,
+		data:      data,
+		startedAt: startedAt,
+	}
+
+	p.applyCues(seg)
+
+	if p.encryptor != nil {
+		key, ciphertext, err := p.encryptor.encrypt(seg.sequence, data)
+		if err != nil {
+			return err
+		}
+		seg.key = key
+		seg.data = ciphertext
+	}
+
+	p.segments = append(p.segments, seg)
+	if len(p.segments) > playlistWindow {
+		p.segments = p.segments[len(p.segments)-playlistWindow:]
+	}
+
+	if p.captions != nil {
+		p.captionSegments = append(p.captionSegments, &segment{
+			sequence:  seg.sequence,
+			duration:  duration,
+			data:      p.captions.segment(time.Now()),
+			startedAt: startedAt,
+		})
+		if len(p.captionSegments) > playlistWindow {
+			p.captionSegments = p.captionSegments[len(p.captionSegments)-playlistWindow:]
+		}
+	}
+	p.nextSequence++
+
+	return nil
+}
+
+func (p *playlist) segment(sequence uint64) ([]byte, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, seg := range p.segments {
+		if seg.sequence == sequence {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+func (p *playlist) captionSegment(sequence uint64) ([]byte, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, seg := range p.captionSegments {
+		if seg.sequence == sequence {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+func (p *playlist) key(index int) ([]byte, bool) {
+	if p.encryptor == nil {
+		return nil, false
+	}
+	return p.encryptor.key(index)
+}
+
+func (p *playlist) render() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if p.cmaf() {
+		// EXT-X-MAP outside of I-frame playlists needs version 6 or newer
+		b.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	writeSegmentHeader(&b, p.segments)
+	if p.cmaf() {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", p.uri(initSegmentName))
+	}
+
+	for _, seg := range p.segments {
+		if seg.cueIn {
+			b.WriteString("#EXT-X-CUE-IN\n")
+		}
+		if seg.cueOut {
+			if seg.cueOutDuration > 0 {
+				fmt.Fprintf(&b, "#EXT-X-CUE-OUT:DURATION=%.3f\n", seg.cueOutDuration)
+			} else {
+				b.WriteString("#EXT-X-CUE-OUT\n")
+			}
+		}
+		if seg.key != nil {
+			// The IV changes every segment, so the key tag has to be repeated
+			// for each one rather than only when the key rotates.
+			fmt.Fprintf(&b, "#EXT-X-KEY:METHOD=AES-128,URI=%q,IV=0x%x\n", seg.key.uri, segmentIV(seg.key.iv, seg.sequence))
+		}
+		if p.programDateTime && !seg.startedAt.IsZero() {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.startedAt.UTC().Format(time.RFC3339Nano))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.duration)
+		b.WriteString(p.uri(fmt.Sprintf("%d%s", seg.sequence, p.segmentExt)) + "\n")
+	}
+
+	return b.String()
+}
+
+// renderCaptions renders the WebVTT subtitle playlist
+func (p *playlist) renderCaptions() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	writeSegmentHeader(&b, p.captionSegments)
+	for _, seg := range p.captionSegments {
+		if p.programDateTime && !seg.startedAt.IsZero() {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.startedAt.UTC().Format(time.RFC3339Nano))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.duration)
+		b.WriteString(p.uri(fmt.Sprintf("%d%s", seg.sequence, segmentExtVTT)) + "\n")
+	}
+
+	return b.String()
+}
+
+// renderMaster renders the master playlist that ties the media playlist to
+// the in-band CEA-608 captions and the WebVTT rendition of them
+func (p *playlist) renderMaster() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	bandwidth := 0.0
+	for _, seg := range p.segments {
+		if seg.duration > 0 {
+			bandwidth = math.Max(bandwidth, float64(len(seg.data)*8)/seg.duration)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"English\",LANGUAGE=\"en\",INSTREAM-ID=\"CC1\",DEFAULT=YES,AUTOSELECT=YES\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"English\",LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES,URI=%q\n", captionsPlaylistName)
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CLOSED-CAPTIONS=\"cc\",SUBTITLES=\"subs\"\n", int(math.Ceil(bandwidth)))
+	b.WriteString("index.m3u8\n")
+
+	return b.String()
+}
+
+func writeSegmentHeader(b *strings.Builder, segments []*segment) {
+	targetDuration := 0.0
+	for _, seg := range segments {
+		targetDuration = math.Max(targetDuration, seg.duration)
+	}
+
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	if len(segments) > 0 {
+		fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].sequence)
+	}
+}
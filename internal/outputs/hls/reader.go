@@ -0,0 +1,222 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// How long a started stream has to add its tracks before segmenting
+	// starts with whatever there is
+	trackWaitTimeout  = 10 * time.Second
+	trackPollInterval = 500 * time.Millisecond
+
+	iceGatheringTimeout = 5 * time.Second
+)
+
+var errNoTracks = errors.New("no tracks that can be segmented")
+
+// mediaEvents starts reading the media of a stream when it starts, and stops
+// when it ends. The playlist is dropped once the reader has stopped, so
+// packets still on their way can't bring it back.
+func (s *HLSServer) mediaEvents(event control.StreamEvent) error {
+	switch event.Type {
+	case control.EventStreamStarted:
+		done := make(chan struct{})
+		s.readersMutex.Lock()
+		if previous, ok := s.readersDone[event.ChannelID]; ok {
+			close(previous)
+		}
+		s.readersDone[event.ChannelID] = done
+		s.readersMutex.Unlock()
+
+		go func() {
+			if err := s.readTracks(event.ChannelID, done); err != nil {
+				s.log.Errorf("Failed reading channel %d: %+v", event.ChannelID, err)
+			}
+			<-done
+
+			s.readersMutex.Lock()
+			defer s.readersMutex.Unlock()
+			// Unless the stream has started again in the meantime
+			if _, live := s.readersDone[event.ChannelID]; !live {
+				s.removePlaylist(event.ChannelID)
+			}
+		}()
+	case control.EventStreamStopped:
+		s.readersMutex.Lock()
+		if done, ok := s.readersDone[event.ChannelID]; ok {
+			close(done)
+			delete(s.readersDone, event.ChannelID)
+		}
+		s.readersMutex.Unlock()
+	}
+
+	return nil
+}
+
+// readTracks receives the tracks of a stream over a loopback peer
+// connection, which is the only way pion lets a TrackLocal be read, and
+// segments them until done is closed
+func (s *HLSServer) readTracks(channelID control.ChannelID, done chan struct{}) error {
+	tracks, err := s.waitForTracks(channelID, done)
+	if err != nil || tracks == nil {
+		return err
+	}
+
+	api := s.control.GetWebRTCAPI()
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	receiver, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer receiver.Close()
+
+	added := 0
+	for _, track := range tracks {
+		if !strings.EqualFold(track.Codec, webrtc.MimeTypeH264) && !strings.EqualFold(track.Codec, webrtc.MimeTypeOpus) {
+			continue
+		}
+		rtpSender, err := sender.AddTrack(track.Track)
+		if err != nil {
+			return err
+		}
+		go drainRTCP(rtpSender)
+		added++
+	}
+	if added == 0 {
+		return errNoTracks
+	}
+
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		s.readTrack(channelID, track, done)
+	})
+
+	if err := connectLoopback(sender, receiver); err != nil {
+		return err
+	}
+
+	<-done
+	return nil
+}
+
+// readTrack segments the RTP of a track until the stream stops
+func (s *HLSServer) readTrack(channelID control.ChannelID, track *webrtc.TrackRemote, done chan struct{}) {
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			err = s.writeVideo(channelID, packet, time.Now())
+		} else {
+			err = s.writeOpus(channelID, packet, time.Now())
+		}
+		if err != nil {
+			s.log.Debugf("Failed segmenting %s of channel %d: %s", track.Kind(), channelID, err)
+		}
+	}
+}
+
+// waitForTracks polls for the tracks of a stream, inputs add them some time
+// after the stream has started. There are no tracks if it stops first.
+func (s *HLSServer) waitForTracks(channelID control.ChannelID, done chan struct{}) ([]control.StreamTrack, error) {
+	timeout := time.NewTimer(trackWaitTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(trackPollInterval)
+	defer ticker.Stop()
+
+	for {
+		tracks, err := s.control.GetTracks(channelID)
+		if err == nil && hasTrack(tracks, webrtc.RTPCodecTypeVideo) && hasTrack(tracks, webrtc.RTPCodecTypeAudio) {
+			return tracks, nil
+		}
+
+		select {
+		case <-timeout.C:
+			// Not every stream has both, go with what there is
+			if err == nil && len(tracks) > 0 {
+				return tracks, nil
+			}
+			return nil, fmt.Errorf("waiting for tracks: %w", errNoTracks)
+		case <-done:
+			return nil, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func hasTrack(tracks []control.StreamTrack, kind webrtc.RTPCodecType) bool {
+	for _, track := range tracks {
+		if track.Type == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// connectLoopback negotiates a peer connection sending to another in the
+// same process
+func connectLoopback(sender, receiver *webrtc.PeerConnection) error {
+	offer, err := sender.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := setLocalDescription(sender, offer); err != nil {
+		return err
+	}
+	if err := receiver.SetRemoteDescription(*sender.LocalDescription()); err != nil {
+		return err
+	}
+
+	answer, err := receiver.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := setLocalDescription(receiver, answer); err != nil {
+		return err
+	}
+	return sender.SetRemoteDescription(*receiver.LocalDescription())
+}
+
+// setLocalDescription sets the description and waits for ICE gathering, there
+// is no trickling candidates between the two
+func setLocalDescription(pc *webrtc.PeerConnection, description webrtc.SessionDescription) error {
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(description); err != nil {
+		return err
+	}
+
+	select {
+	case <-gatherComplete:
+		return nil
+	case <-time.After(iceGatheringTimeout):
+		return errors.New("timed out gathering ICE candidates")
+	}
+}
+
+// drainRTCP reads RTCP until the sender stops, pion needs it read for its
+// interceptors to work
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
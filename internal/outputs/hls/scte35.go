@@ -0,0 +1,89 @@
+package hls
+
+import "github.com/Glimesh/waveguide/pkg/control"
+
+// addSpliceEvent queues an ad break marker for the next segment
+func (p *playlist) addSpliceEvent(event control.SpliceEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch {
+	case event.Cancel:
+		if p.pendingCueOut != nil && p.pendingCueOut.EventID == event.EventID {
+			p.pendingCueOut = nil
+		}
+	case event.OutOfNetwork:
+		p.pendingCueOut = &event
+	case p.pendingCueOut != nil:
+		// Back before the break made it into a segment
+		p.pendingCueOut = nil
+	case p.inBreak:
+		p.pendingCueIn = true
+	}
+}
+
+// applyCues marks seg with whatever splice markers are due, the caller has to
+// hold the playlist lock
+func (p *playlist) applyCues(seg *segment) {
+	if p.inBreak && (p.pendingCueIn || (p.breakAutoReturn && p.breakRemaining <= 0)) {
+		seg.cueIn = true
+		p.inBreak = false
+	}
+	p.pendingCueIn = false
+
+	if p.pendingCueOut != nil {
+		seg.cueOut = true
+		seg.cueOutDuration = p.pendingCueOut.Duration.Seconds()
+		p.inBreak = true
+		p.breakAutoReturn = p.pendingCueOut.AutoReturn && p.pendingCueOut.Duration > 0
+		p.breakRemaining = seg.cueOutDuration
+		p.pendingCueOut = nil
+	}
+
+	if p.inBreak && p.breakAutoReturn {
+		p.breakRemaining -= seg.duration
+	}
+}
+
+// spliceEvents starts reading the ad break markers of a stream when it
+// starts, and stops when it ends
+func (s *HLSServer) spliceEvents(event control.StreamEvent) error {
+	switch event.Type {
+	case control.EventStreamStarted:
+		events, err := s.control.SpliceEvents(event.ChannelID)
+		if err != nil {
+			return err
+		}
+		pl, err := s.getOrCreatePlaylist(event.ChannelID)
+		if err != nil {
+			return err
+		}
+
+		done := make(chan struct{})
+		s.spliceMutex.Lock()
+		s.spliceDone[event.ChannelID] = done
+		s.spliceMutex.Unlock()
+
+		go s.readSpliceEvents(pl, events, done)
+	case control.EventStreamStopped:
+		s.spliceMutex.Lock()
+		if done, ok := s.spliceDone[event.ChannelID]; ok {
+			close(done)
+			delete(s.spliceDone, event.ChannelID)
+		}
+		s.spliceMutex.Unlock()
+	}
+
+	return nil
+}
+
+func (s *HLSServer) readSpliceEvents(pl *playlist, events <-chan control.SpliceEvent, done chan struct{}) {
+	for {
+		select {
+		case event := <-events:
+			pl.addSpliceEvent(event)
+		case <-done:
+			return
+		}
+	}
+}
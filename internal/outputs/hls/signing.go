@@ -0,0 +1,81 @@
+package hls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// How long signed segment URLs stay valid for. Segments drop out of the
+// playlist window well before this, it only has to outlast slow players.
+const signedURLLifetime = 5 * time.Minute
+
+// urlSigner appends ECDSA P-256 signatures to segment URLs, so a CDN holding
+// the public key can refuse requests that didn't come from a playlist
+type urlSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func newURLSigner(keyPath string) (*urlSigner, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("playlist signing key is not PEM encoded")
+	}
+
+	var key *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+				err = errors.New("playlist signing key is not an ECDSA key")
+			}
+		}
+	default:
+		err = fmt.Errorf("unexpected PEM block %q in playlist signing key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("playlist signing key uses %s, expected P-256", key.Curve.Params().Name)
+	}
+
+	return &urlSigner{key: key}, nil
+}
+
+// sign returns uri with sig and exp query parameters, the signature covers
+// path:expiry:channelID where path is what the CDN sees requested
+func (s *urlSigner) sign(uri string, path string, channelID string, expiry time.Time) (string, error) {
+	exp := expiry.Unix()
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%s", path, exp, channelID)))
+
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// r||s, each padded to the 32 byte curve size
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	sig.FillBytes(raw[32:])
+
+	return fmt.Sprintf("%s?sig=%s&exp=%d", uri, base64.RawURLEncoding.EncodeToString(raw), exp), nil
+}
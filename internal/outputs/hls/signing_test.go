@@ -0,0 +1,125 @@
+package hls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSigningKey saves key as PEM in a temporary file, as SEC 1 or PKCS #8
+func writeSigningKey(t *testing.T, key *ecdsa.PrivateKey, pkcs8 bool) string {
+	var block *pem.Block
+	if pkcs8 {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// verifySignedURL checks a signed URL the way a CDN holding the public key
+// would, for a request to path
+func verifySignedURL(pub *ecdsa.PublicKey, signed string, path string, channelID string) bool {
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parsed.Query().Get("sig"))
+	if err != nil || len(raw) != 64 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parsed.Query().Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%s", path, exp, channelID)))
+	r := new(big.Int).SetBytes(raw[:32])
+	s := new(big.Int).SetBytes(raw[32:])
+	return ecdsa.Verify(pub, digest[:], r, s)
+}
+
+func TestURLSignerSign(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pkcs8 := range []bool{false, true} {
+		assert := assert.New(t)
+		signer, err := newURLSigner(writeSigningKey(t, key, pkcs8))
+		if !assert.NoError(err) {
+			return
+		}
+
+		expiry := time.Now().Add(signedURLLifetime)
+		signed, err := signer.sign("3.ts", "/hls/1/3.ts", "1", expiry)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.Regexp(`^3\.ts\?sig=[A-Za-z0-9_-]{86}&exp=`+strconv.FormatInt(expiry.Unix(), 10)+`$`, signed)
+
+		assert.True(verifySignedURL(&key.PublicKey, signed, "/hls/1/3.ts", "1"))
+		// Moved to another segment or channel it doesn't verify
+		assert.False(verifySignedURL(&key.PublicKey, signed, "/hls/1/4.ts", "1"))
+		assert.False(verifySignedURL(&key.PublicKey, signed, "/hls/2/3.ts", "2"))
+
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.False(verifySignedURL(&other.PublicKey, signed, "/hls/1/3.ts", "1"))
+	}
+}
+
+func TestURLSignerExpired(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, err := newURLSigner(writeSigningKey(t, key, false))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	signed, err := signer.sign("3.ts", "/hls/1/3.ts", "1", time.Now().Add(-time.Second))
+	assert.NoError(t, err)
+	assert.False(t, verifySignedURL(&key.PublicKey, signed, "/hls/1/3.ts", "1"))
+}
+
+func TestNewURLSignerRejectsKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err := newURLSigner(writeSigningKey(t, p384, false))
+	assert.ErrorContains(err, "expected P-256")
+
+	notPEM := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(notPEM, []byte("not a key"), 0600)
+	_, err = newURLSigner(notPEM)
+	assert.ErrorContains(err, "not PEM encoded")
+
+	_, err = newURLSigner(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(err)
+}
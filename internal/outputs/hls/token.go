@@ -0,0 +1,108 @@
+package hls
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playlist tokens are handed out by redirecting the first playlist request,
+// every later request for the channel has to carry a token that hasn't expired
+const DefaultPlaylistTokenTTL = time.Hour
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// playlistToken is the hex HMAC-SHA256 of channelID:exp
+func playlistToken(secret string, channelID string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d", channelID, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validPlaylistToken checks the token and exp query parameters of a request
+// against the channel it's for, returning the exp the token was made with.
+// Signed segment URLs carry an exp of their own, so every one is tried.
+func (s *HLSServer) validPlaylistToken(query url.Values, channelID string, now time.Time) (string, bool) {
+	token := query.Get("token")
+	for _, value := range query["exp"] {
+		exp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || now.Unix() > exp {
+			continue
+		}
+		expected := playlistToken(s.config.PlaylistTokenSecret, channelID, exp)
+		if hmac.Equal([]byte(token), []byte(expected)) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// checkPlaylistToken enforces PlaylistTokenRequired. Playlist requests
+// without a token are redirected to one that has it, anything else without a
+// valid token is refused. Returns the token query to carry over to the URIs
+// in playlists, or false when the request has been answered already.
+func (s *HLSServer) checkPlaylistToken(w http.ResponseWriter, r *http.Request, channelID string, file string) (string, bool) {
+	if !s.config.PlaylistTokenRequired {
+		return "", true
+	}
+
+	query := r.URL.Query()
+	if query.Get("token") == "" && strings.HasSuffix(file, ".m3u8") {
+		exp := time.Now().Add(s.config.PlaylistTokenTTL).Unix()
+		query.Set("token", playlistToken(s.config.PlaylistTokenSecret, channelID, exp))
+		query.Set("exp", strconv.FormatInt(exp, 10))
+
+		redirect := *r.URL
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+		return "", false
+	}
+
+	exp, valid := s.validPlaylistToken(query, channelID, time.Now())
+	if !valid {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return "", false
+	}
+
+	tokenQuery := url.Values{}
+	tokenQuery.Set("token", query.Get("token"))
+	tokenQuery.Set("exp", exp)
+	return tokenQuery.Encode(), true
+}
+
+// addPlaylistToken appends the token query to every URI in a rendered
+// playlist, both the URI lines and URI attributes of tags like EXT-X-KEY
+func addPlaylistToken(playlist string, tokenQuery string) string {
+	if tokenQuery == "" {
+		return playlist
+	}
+
+	withToken := func(uri string) string {
+		if strings.Contains(uri, "?") {
+			return uri + "&" + tokenQuery
+		}
+		return uri + "?" + tokenQuery
+	}
+
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			lines[i] = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + withToken(uriAttribute.FindStringSubmatch(attr)[1]) + `"`
+			})
+		default:
+			lines[i] = withToken(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
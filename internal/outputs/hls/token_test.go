@@ -0,0 +1,145 @@
+package hls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTokenTestServer() *HLSServer {
+	return New(HLSConfig{PlaylistTokenRequired: true, PlaylistTokenSecret: "secret"})
+}
+
+func TestPlaylistTokenRedirect(t *testing.T) {
+	assert := assert.New(t)
+	s := newTokenTestServer()
+
+	// Playlists without a token are sent to one that has it
+	w := httptest.NewRecorder()
+	_, ok := s.checkPlaylistToken(w, httptest.NewRequest(http.MethodGet, "/hls/1/index.m3u8", nil), "1", "index.m3u8")
+	assert.False(ok)
+	assert.Equal(http.StatusFound, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("/hls/1/index.m3u8", location.Path)
+	exp, err := strconv.ParseInt(location.Query().Get("exp"), 10, 64)
+	assert.NoError(err)
+	assert.InDelta(time.Now().Add(DefaultPlaylistTokenTTL).Unix(), exp, 5)
+	assert.Equal(playlistToken("secret", "1", exp), location.Query().Get("token"))
+
+	// Following it is let through, with the token to carry over to the URIs
+	w = httptest.NewRecorder()
+	tokenQuery, ok := s.checkPlaylistToken(w, httptest.NewRequest(http.MethodGet, location.String(), nil), "1", "index.m3u8")
+	assert.True(ok)
+	assert.Equal(location.Query().Encode(), tokenQuery)
+
+	// And so are the segments it lists
+	w = httptest.NewRecorder()
+	_, ok = s.checkPlaylistToken(w, httptest.NewRequest(http.MethodGet, "/hls/1/0.ts?"+tokenQuery, nil), "1", "0.ts")
+	assert.True(ok)
+}
+
+func TestPlaylistTokenRejected(t *testing.T) {
+	s := newTokenTestServer()
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	query := func(token string, exp int64) string {
+		return "?token=" + token + "&exp=" + strconv.FormatInt(exp, 10)
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		query string
+	}{
+		{"segment without token", "0.ts", ""},
+		{"key without token", "0.key", ""},
+		{"expired", "index.m3u8", query(playlistToken("secret", "1", past), past)},
+		{"other channel", "index.m3u8", query(playlistToken("secret", "2", future), future)},
+		{"other secret", "0.ts", query(playlistToken("other", "1", future), future)},
+		{"exp changed", "0.ts", query(playlistToken("secret", "1", past), future)},
+		{"bad exp", "0.ts", "?token=" + playlistToken("secret", "1", future) + "&exp=soon"},
+		{"no exp", "0.ts", "?token=" + playlistToken("secret", "1", future)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/hls/1/"+tt.file+tt.query, nil)
+			_, ok := s.checkPlaylistToken(w, r, "1", tt.file)
+			assert.False(t, ok)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+}
+
+func TestPlaylistTokenWithSignedURL(t *testing.T) {
+	assert := assert.New(t)
+	s := newTokenTestServer()
+	exp := time.Now().Add(time.Hour).Unix()
+	token := playlistToken("secret", "1", exp)
+
+	// Signed segment URLs have an exp of their own ahead of the token's
+	query := url.Values{
+		"sig":   {"abc"},
+		"exp":   {strconv.FormatInt(time.Now().Add(signedURLLifetime).Unix(), 10), strconv.FormatInt(exp, 10)},
+		"token": {token},
+	}
+	got, ok := s.validPlaylistToken(query, "1", time.Now())
+	assert.True(ok)
+	assert.Equal(strconv.FormatInt(exp, 10), got)
+
+	// Once past the exp it was made with, the other one doesn't save it
+	_, ok = s.validPlaylistToken(query, "1", time.Unix(exp+1, 0))
+	assert.False(ok)
+}
+
+func TestPlaylistTokenNotRequired(t *testing.T) {
+	assert := assert.New(t)
+	s := New(HLSConfig{})
+
+	w := httptest.NewRecorder()
+	tokenQuery, ok := s.checkPlaylistToken(w, httptest.NewRequest(http.MethodGet, "/hls/1/0.ts", nil), "1", "0.ts")
+	assert.True(ok)
+	assert.Empty(tokenQuery)
+}
+
+func TestAddPlaylistToken(t *testing.T) {
+	assert := assert.New(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	tokenQuery := url.Values{"token": {playlistToken("secret", "1", exp)}, "exp": {strconv.FormatInt(exp, 10)}}.Encode()
+
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://example.com/hls/1/0.key\",IV=0x01\n" +
+		"#EXTINF:2.000,\n" +
+		"0.ts\n" +
+		"#EXTINF:2.000,\n" +
+		"1.ts?sig=abc&exp=123\n"
+
+	assert.Equal("#EXTM3U\n"+
+		"#EXT-X-VERSION:3\n"+
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"https://example.com/hls/1/0.key?"+tokenQuery+"\",IV=0x01\n"+
+		"#EXTINF:2.000,\n"+
+		"0.ts?"+tokenQuery+"\n"+
+		"#EXTINF:2.000,\n"+
+		"1.ts?sig=abc&exp=123&"+tokenQuery+"\n", addPlaylistToken(playlist, tokenQuery))
+
+	// Every URI it adds passes the check
+	s := newTokenTestServer()
+	for _, uri := range []string{"0.ts?" + tokenQuery, "1.ts?sig=abc&exp=123&" + tokenQuery} {
+		parsed, _ := url.Parse(uri)
+		_, ok := s.validPlaylistToken(parsed.Query(), "1", time.Now())
+		assert.True(ok, uri)
+	}
+
+	assert.Equal(playlist, addPlaylistToken(playlist, ""))
+}
@@ -0,0 +1,225 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// A minimal MPEG-TS muxer for H.264 segments and audio-only segments, which
+// carry raw Opus as described in ETSI TS 102 366 Annex A. Every segment
+// starts with its own PAT and PMT so it can be decoded on its own.
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	tsPIDPAT   = 0x0000
+	tsPIDPMT   = 0x1000
+	tsPIDVideo = 0x0100
+	tsPIDAudio = 0x0101
+
+	tsStreamTypeH264       = 0x1B
+	tsStreamTypePrivatePES = 0x06
+	tsStreamIDVideo        = 0xE0
+	tsStreamIDPrivate1     = 0xBD
+
+	// 90kHz PTS clock
+	tsClockRate = 90000
+)
+
+type tsMuxer struct {
+	buf        bytes.Buffer
+	continuity map[uint16]uint8
+}
+
+func newTSMuxer() *tsMuxer {
+	return &tsMuxer{continuity: make(map[uint16]uint8)}
+}
+
+// writeTables writes the PAT and a PMT with a single Opus stream
+func (m *tsMuxer) writeTables(channels int) {
+	m.writePAT()
+	m.writePMT(tsPIDAudio, opusStreamInfo(channels))
+}
+
+// writeVideoTables writes the PAT and a PMT with an H.264 stream, and an Opus
+// one unless audioChannels is 0
+func (m *tsMuxer) writeVideoTables(audioChannels int) {
+	m.writePAT()
+	if audioChannels == 0 {
+		m.writePMT(tsPIDVideo, h264StreamInfo())
+		return
+	}
+	m.writePMT(tsPIDVideo, h264StreamInfo(), opusStreamInfo(audioChannels))
+}
+
+func (m *tsMuxer) writePAT() {
+	pat := []byte{
+		0x00,       // table id
+		0xB0, 0x0D, // section length
+		0x00, 0x01, // transport stream id
+		0xC1,       // version 0, current
+		0x00, 0x00, // section numbers
+		0x00, 0x01, // program number
+		0xE0 | byte(tsPIDPMT>>8), byte(tsPIDPMT & 0xFF),
+	}
+	m.writeSection(tsPIDPAT, pat)
+}
+
+// writePMT writes the PMT of the only program, listing the elementary streams
+func (m *tsMuxer) writePMT(pcrPID uint16, streams ...[]byte) {
+	pmt := []byte{
+		0x02,       // table id
+		0xB0, 0x00, // section length, filled in below
+		0x00, 0x01, // program number
+		0xC1,
+		0x00, 0x00,
+		0xE0 | byte(pcrPID>>8), byte(pcrPID & 0xFF), // PCR PID
+		0xF0, 0x00, // no program info
+	}
+	for _, stream := range streams {
+		pmt = append(pmt, stream...)
+	}
+	// Everything after the length field, including the CRC
+	binary.BigEndian.PutUint16(pmt[1:], 0xB000|uint16(len(pmt)-3+4))
+	m.writeSection(tsPIDPMT, pmt)
+}
+
+// opusStreamInfo is the PMT entry of an Opus stream
+func opusStreamInfo(channels int) []byte {
+	descriptors := []byte{
+		0x05, 0x04, 'O', 'p', 'u', 's', // registration descriptor
+		0x7F, 0x02, 0x80, byte(channels), // extension descriptor, channel config
+	}
+	info := []byte{
+		tsStreamTypePrivatePES,
+		0xE0 | byte(tsPIDAudio>>8), byte(tsPIDAudio & 0xFF),
+		0xF0, byte(len(descriptors)),
+	}
+	return append(info, descriptors...)
+}
+
+// h264StreamInfo is the PMT entry of an H.264 stream
+func h264StreamInfo() []byte {
+	return []byte{
+		tsStreamTypeH264,
+		0xE0 | byte(tsPIDVideo>>8), byte(tsPIDVideo & 0xFF),
+		0xF0, 0x00,
+	}
+}
+
+func (m *tsMuxer) writeSection(pid uint16, section []byte) {
+	payload := append([]byte{0x00}, section...) // pointer field
+	crc := crc32MPEG2(section)
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	m.writePackets(pid, payload, false, false, 0)
+}
+
+// writePES writes one PES packet, the first TS packet of it carries the PCR
+func (m *tsMuxer) writePES(pid uint16, streamID byte, pts time.Duration, data []byte) {
+	m.writePESTicks(pid, streamID, uint64(pts*tsClockRate/time.Second), data, true, true)
+}
+
+// writePESTicks writes one PES packet with a PTS in 90kHz ticks, only packets
+// on the PCR PID should carry the pcr. Only randomAccess packets are flagged
+// as somewhere decoding can start.
+func (m *tsMuxer) writePESTicks(pid uint16, streamID byte, ticks uint64, data []byte, pcr bool, randomAccess bool) {
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05}
+	if length := 3 + 5 + len(data); length <= 0xFFFF {
+		// Video PES packets are allowed to leave it 0 for unbounded
+		binary.BigEndian.PutUint16(header[4:], uint16(length))
+	}
+	header = append(header,
+		0x21|byte(ticks>>29)&0x0E,
+		byte(ticks>>22),
+		0x01|byte(ticks>>14),
+		byte(ticks>>7),
+		0x01|byte(ticks<<1),
+	)
+
+	m.writePackets(pid, append(header, data...), pcr, randomAccess, ticks)
+}
+
+// writePackets splits payload into TS packets, stuffing the last one with an
+// adaptation field
+func (m *tsMuxer) writePackets(pid uint16, payload []byte, pcr bool, randomAccess bool, ticks uint64) {
+	first := true
+	for len(payload) > 0 {
+		var adaptation []byte
+		if first && pcr {
+			// PCR, and the random access indicator
+			flags := byte(0x10)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = []byte{flags,
+				byte(ticks >> 25), byte(ticks >> 17), byte(ticks >> 9), byte(ticks >> 1),
+				byte(ticks<<7) | 0x7E, 0x00,
+			}
+		}
+
+		space := tsPacketSize - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		if len(payload) < space {
+			// Stuffing, an empty adaptation field still takes its length byte
+			stuffing := space - len(payload)
+			if adaptation == nil {
+				stuffing--
+				if stuffing > 0 {
+					adaptation = []byte{0x00}
+					stuffing--
+				} else {
+					adaptation = []byte{}
+				}
+			}
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xFF)
+			}
+			space = len(payload)
+		}
+
+		cc := m.continuity[pid]
+		m.continuity[pid] = (cc + 1) & 0x0F
+
+		b1 := byte(pid>>8) & 0x1F
+		if first {
+			b1 |= 0x40 // payload unit start
+		}
+		control := byte(0x10) | cc
+		if adaptation != nil {
+			control |= 0x20
+		}
+		m.buf.Write([]byte{tsSyncByte, b1, byte(pid), control})
+		if adaptation != nil {
+			m.buf.WriteByte(byte(len(adaptation)))
+			m.buf.Write(adaptation)
+		}
+		m.buf.Write(payload[:space])
+
+		payload = payload[space:]
+		first = false
+	}
+}
+
+func (m *tsMuxer) bytes() []byte {
+	return m.buf.Bytes()
+}
+
+// crc32MPEG2 is the CRC used by PSI sections, unreflected with no final xor
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
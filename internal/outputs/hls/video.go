@@ -0,0 +1,370 @@
+package hls
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/h264"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// Streams with video are cut into segments at keyframes, so every segment
+// starts with one and can be played on its own. Their Opus audio is muxed
+// into the same MPEG-TS segments, CMAF segments are video only as the init
+// segment only describes the video track.
+
+const (
+	// Video segments are cut at the first keyframe past this
+	videoSegmentTarget = 2 * time.Second
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+
+	opusClockRate = 48000
+)
+
+// Access unit delimiter, MPEG-TS wants one at the start of every H.264 PES
+var accessUnitDelimiter = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}
+
+type videoFrame struct {
+	// Annex B NAL units of one access unit
+	data []byte
+	// 90kHz, counted from the first frame of the stream
+	pts      uint64
+	keyframe bool
+}
+
+type audioFrame struct {
+	// Opus access unit, with the control header
+	data []byte
+	// 90kHz, on the same clock as the video
+	pts uint64
+}
+
+// videoSegment is a run of frames starting with a keyframe, and the audio
+// that goes with them
+type videoSegment struct {
+	frames    []videoFrame
+	duration  float64
+	startedAt time.Time
+	// pts of the keyframe starting the next segment
+	endPTS uint64
+
+	audio         []audioFrame
+	audioChannels int
+}
+
+// videoSegmenter puts H.264 access units back together from RTP and collects
+// them until there's enough for a segment. Video and audio are read by
+// their own goroutines, so everything is behind mutex.
+type videoSegmenter struct {
+	mutex sync.Mutex
+
+	depacketizer codecs.H264Packet
+
+	// Access unit being put back together, and its RTP timestamp
+	pending          []byte
+	pendingTimestamp uint32
+	hasPending       bool
+
+	// RTP timestamps are 90kHz like MPEG-TS, pts carries on past them wrapping
+	lastTimestamp uint32
+	pts           uint64
+	started       bool
+
+	frames    []videoFrame
+	startedAt time.Time
+
+	// Audio waiting for the segment it falls in. Its clock starts at the
+	// video pts when the first packet arrives, there's nothing better to
+	// line the two RTP clocks up with.
+	audio          []audioFrame
+	audioChannels  int
+	audioTimestamp uint32
+	audioPTS       uint64
+	audioStarted   bool
+}
+
+// add queues an RTP packet, returning a finished segment once a keyframe
+// arrives past the target duration. Frames before the first keyframe are
+// dropped, they can't be decoded.
+func (v *videoSegmenter) add(packet *rtp.Packet, now time.Time) (*videoSegment, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	var seg *videoSegment
+	// A lost marker bit, the timestamp moving on ends the access unit too
+	if v.hasPending && packet.Timestamp != v.pendingTimestamp {
+		seg = v.endFrame(now)
+	}
+
+	nalus, err := v.depacketizer.Unmarshal(packet.Payload)
+	if err != nil {
+		// The rest of the access unit is no good without this packet
+		v.pending = nil
+		v.hasPending = false
+		return seg, err
+	}
+	if !v.hasPending {
+		v.pendingTimestamp = packet.Timestamp
+		v.hasPending = true
+	}
+	v.pending = append(v.pending, nalus...)
+
+	if packet.Marker {
+		if cut := v.endFrame(now); cut != nil {
+			seg = cut
+		}
+	}
+	return seg, nil
+}
+
+func (v *videoSegmenter) endFrame(now time.Time) *videoSegment {
+	data, timestamp := v.pending, v.pendingTimestamp
+	v.pending = nil
+	v.hasPending = false
+	if len(data) == 0 {
+		return nil
+	}
+
+	if v.started {
+		// Signed, B-frames can go back in time. MPEG-TS timestamps wrap
+		// anyway so the unsigned overflow is fine.
+		v.pts += uint64(int32(timestamp - v.lastTimestamp))
+	}
+	v.lastTimestamp = timestamp
+	v.started = true
+
+	frame := videoFrame{data: data, pts: v.pts, keyframe: hasNALUType(data, naluTypeIDR)}
+	if len(v.frames) == 0 {
+		if !frame.keyframe {
+			return nil
+		}
+		v.frames = []videoFrame{frame}
+		v.startedAt = now
+		return nil
+	}
+
+	elapsed := frame.pts - v.frames[0].pts
+	if !frame.keyframe || elapsed < uint64(videoSegmentTarget*tsClockRate/time.Second) {
+		v.frames = append(v.frames, frame)
+		return nil
+	}
+
+	seg := &videoSegment{
+		frames:        v.frames,
+		duration:      float64(elapsed) / tsClockRate,
+		startedAt:     v.startedAt,
+		endPTS:        frame.pts,
+		audioChannels: v.audioChannels,
+	}
+	// Audio from before the keyframe goes with the segment it ends
+	split := 0
+	for split < len(v.audio) && int64(v.audio[split].pts-frame.pts) < 0 {
+		split++
+	}
+	seg.audio = v.audio[:split]
+	v.audio = append([]audioFrame{}, v.audio[split:]...)
+
+	v.frames = []videoFrame{frame}
+	v.startedAt = now
+	return seg
+}
+
+// addAudio queues an Opus RTP packet for the segment it falls in, audio
+// from before the first keyframe is dropped along with the video
+func (v *videoSegmenter) addAudio(packet *rtp.Packet) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if _, err := opusPacketDuration(packet.Payload); err != nil {
+		return err
+	}
+
+	if !v.audioStarted {
+		if len(v.frames) == 0 {
+			return nil
+		}
+		v.audioPTS = v.pts
+		v.audioStarted = true
+	} else {
+		delta := int64(int32(packet.Timestamp-v.audioTimestamp)) * tsClockRate / opusClockRate
+		v.audioPTS += uint64(delta)
+	}
+	v.audioTimestamp = packet.Timestamp
+
+	if packet.Payload[0]&0x04 != 0 {
+		v.audioChannels = 2
+	} else {
+		v.audioChannels = 1
+	}
+	v.audio = append(v.audio, audioFrame{data: opusAccessUnit(packet.Payload), pts: v.audioPTS})
+	return nil
+}
+
+// hasVideo is whether any video has arrived
+func (v *videoSegmenter) hasVideo() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.started
+}
+
+// ts muxes the segment as MPEG-TS, with the audio and video PES packets
+// interleaved in pts order
+func (seg *videoSegment) ts() []byte {
+	mux := newTSMuxer()
+	audioChannels := 0
+	if len(seg.audio) > 0 {
+		audioChannels = seg.audioChannels
+	}
+	mux.writeVideoTables(audioChannels)
+
+	audio := seg.audio
+	for _, frame := range seg.frames {
+		for len(audio) > 0 && int64(audio[0].pts-frame.pts) < 0 {
+			mux.writePESTicks(tsPIDAudio, tsStreamIDPrivate1, audio[0].pts, audio[0].data, false, false)
+			audio = audio[1:]
+		}
+		data := append(append([]byte{}, accessUnitDelimiter...), frame.data...)
+		mux.writePESTicks(tsPIDVideo, tsStreamIDVideo, frame.pts, data, true, frame.keyframe)
+	}
+	for _, frame := range audio {
+		mux.writePESTicks(tsPIDAudio, tsStreamIDPrivate1, frame.pts, frame.data, false, false)
+	}
+	return mux.bytes()
+}
+
+// cmafSamples converts the frames to AVCC samples for cmafMuxer, lasting
+// until the next one starts
+func (seg *videoSegment) cmafSamples() []cmafSample {
+	samples := make([]cmafSample, len(seg.frames))
+	for i, frame := range seg.frames {
+		next := seg.endPTS
+		if i+1 < len(seg.frames) {
+			next = seg.frames[i+1].pts
+		}
+		// Without decode timestamps B-frames would go backwards, they get
+		// no time of their own instead
+		duration := int64(next - frame.pts)
+		if duration < 0 {
+			duration = 0
+		}
+
+		var data []byte
+		for _, nalu := range annexBNALUs(frame.data) {
+			data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+			data = append(data, nalu...)
+		}
+		samples[i] = cmafSample{data: data, duration: uint32(duration), keyframe: frame.keyframe}
+	}
+	return samples
+}
+
+// writeVideo segments the H.264 RTP of a stream, adding a segment to the
+// playlist at every keyframe past videoSegmentTarget
+func (s *HLSServer) writeVideo(channelID control.ChannelID, packet *rtp.Packet, now time.Time) error {
+	pl, err := s.getOrCreatePlaylist(channelID)
+	if err != nil {
+		return err
+	}
+
+	seg, err := pl.video.add(packet, now)
+	if seg != nil {
+		if pl.cmaf() {
+			if err := s.writeCMAFSegment(channelID, pl, seg); err != nil {
+				return err
+			}
+		} else if err := s.writeSegment(channelID, seg.ts(), seg.duration, seg.startedAt); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// writeCMAFSegment adds a segment as an fMP4 fragment, first rebuilding
+// init.mp4 if its keyframe came with different parameter sets
+func (s *HLSServer) writeCMAFSegment(channelID control.ChannelID, pl *playlist, seg *videoSegment) error {
+	if sps, pps := parameterSets(seg.frames[0].data); sps != nil && pps != nil && !pl.initFrom(sps, pps) {
+		width, height, err := h264.SPSResolution(sps)
+		if err != nil {
+			return err
+		}
+		if err := s.writeInitSegment(channelID, sps, pps, uint16(width), uint16(height)); err != nil {
+			return err
+		}
+	}
+
+	data, duration, err := pl.cmafMuxer.fragment(seg.cmafSamples())
+	if err != nil {
+		return err
+	}
+	return s.writeSegment(channelID, data, duration, seg.startedAt)
+}
+
+// writeOpus packages the Opus RTP of a stream, into segments of its own for
+// audio-only streams and into the video segments otherwise
+func (s *HLSServer) writeOpus(channelID control.ChannelID, packet *rtp.Packet, now time.Time) error {
+	pl, err := s.getOrCreatePlaylist(channelID)
+	if err != nil {
+		return err
+	}
+	if !pl.video.hasVideo() && s.isAudioOnly(channelID, pl) {
+		return s.writeAudio(channelID, packet.Payload, now)
+	}
+	if pl.cmaf() {
+		return nil
+	}
+	return pl.video.addAudio(packet)
+}
+
+// annexBNALUs splits Annex B data on its start codes
+func annexBNALUs(data []byte) [][]byte {
+	var nalus [][]byte
+	for {
+		start := bytes.Index(data, []byte{0x00, 0x00, 0x01})
+		if start < 0 {
+			return nalus
+		}
+		data = data[start+3:]
+
+		end := bytes.Index(data, []byte{0x00, 0x00, 0x01})
+		if end < 0 {
+			if len(data) > 0 {
+				nalus = append(nalus, data)
+			}
+			return nalus
+		}
+		// A 4 byte start code leaves a zero on the end of the previous unit
+		nalu := bytes.TrimRight(data[:end], "\x00")
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+		data = data[end:]
+	}
+}
+
+// parameterSets returns the last SPS and PPS in Annex B data
+func parameterSets(data []byte) (sps, pps []byte) {
+	for _, nalu := range annexBNALUs(data) {
+		switch nalu[0] & 0x1F {
+		case naluTypeSPS:
+			sps = nalu
+		case naluTypePPS:
+			pps = nalu
+		}
+	}
+	return sps, pps
+}
+
+func hasNALUType(data []byte, naluType byte) bool {
+	for _, nalu := range annexBNALUs(data) {
+		if nalu[0]&0x1F == naluType {
+			return true
+		}
+	}
+	return false
+}
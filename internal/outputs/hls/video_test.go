@@ -0,0 +1,167 @@
+package hls
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+const testFrameTicks = 3000 // 30fps at 90kHz
+
+// Baseline profile 640x480
+var testSPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xD9, 0x00, 0xA0, 0x3D, 0xA1, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x3C, 0x8F, 0x16, 0x2E, 0x48}
+
+// testVideoPackets returns the RTP of seconds of 30fps H.264, with a
+// keyframe every 2 seconds sent as a STAP-A of the SPS and PPS then the IDR
+func testVideoPackets(seconds int) []*rtp.Packet {
+	var packets []*rtp.Packet
+	seq := uint16(65000)
+	packet := func(timestamp uint32, marker bool, payload ...byte) {
+		packets = append(packets, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp, Marker: marker},
+			Payload: payload,
+		})
+		seq++
+	}
+
+	// Starting close to the wrap around of the timestamps
+	timestamp := uint32(0xFFFFFFFF - 30*testFrameTicks)
+	for frame := 0; frame < seconds*30; frame++ {
+		if frame%60 == 0 {
+			stapA := append([]byte{0x18, 0x00, byte(len(testSPS))}, testSPS...)
+			packet(timestamp, false, append(stapA, 0x00, 0x02, 0x68, 0xCE)...)
+			packet(timestamp, true, 0x65, 0x88, 0x84, 0x00)
+		} else {
+			packet(timestamp, true, 0x41, 0x9A, 0x02, 0x00)
+		}
+		timestamp += testFrameTicks
+	}
+	return packets
+}
+
+func TestWriteVideoCutsSegmentsAtKeyframes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := New(HLSConfig{})
+	now := time.Now()
+	for _, packet := range testVideoPackets(5) {
+		assert.NoError(s.writeVideo(1, packet, now))
+	}
+
+	pl, ok := s.getPlaylist(1)
+	if !assert.True(ok) {
+		return
+	}
+	index := pl.render()
+	// The keyframes at 2s and 4s end the first two segments, the third is
+	// still being filled
+	assert.Contains(index, "#EXTINF:2.000,\n0.ts\n")
+	assert.Contains(index, "#EXTINF:2.000,\n1.ts\n")
+	assert.NotContains(index, "2.ts")
+
+	data, ok := pl.segment(0)
+	if !assert.True(ok) {
+		return
+	}
+	assert.Zero(len(data) % tsPacketSize)
+	for i := 0; i < len(data); i += tsPacketSize {
+		assert.Equal(byte(tsSyncByte), data[i])
+	}
+}
+
+func TestWriteVideoWaitsForKeyframe(t *testing.T) {
+	assert := assert.New(t)
+
+	s := New(HLSConfig{})
+	// Drop the first keyframe, the stream can't be decoded until the next
+	packets := testVideoPackets(5)[2:]
+	for _, packet := range packets {
+		assert.NoError(s.writeVideo(1, packet, time.Now()))
+	}
+
+	pl, _ := s.getPlaylist(1)
+	index := pl.render()
+	assert.Contains(index, "#EXTINF:2.000,\n0.ts\n")
+	assert.NotContains(index, "1.ts")
+}
+
+func TestWriteOpusMuxesAudioWithVideo(t *testing.T) {
+	assert := assert.New(t)
+
+	s := New(HLSConfig{})
+	audioTimestamp := uint32(1234)
+	for i, packet := range testVideoPackets(5) {
+		assert.NoError(s.writeVideo(1, packet, time.Now()))
+		// 20ms stereo CELT frames, about as often as the 30fps video
+		if packet.Marker && i%3 != 0 {
+			audio := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, Timestamp: audioTimestamp, Marker: true},
+				Payload: []byte{0xFC, 0x01, 0x02},
+			}
+			assert.NoError(s.writeOpus(1, audio, time.Now()))
+			audioTimestamp += 960
+		}
+	}
+
+	pl, _ := s.getPlaylist(1)
+	assert.False(pl.audioOnlyStream())
+	data, ok := pl.segment(0)
+	if !assert.True(ok) {
+		return
+	}
+
+	pids := map[uint16]int{}
+	for i := 0; i+tsPacketSize <= len(data); i += tsPacketSize {
+		pids[uint16(data[i+1]&0x1F)<<8|uint16(data[i+2])]++
+	}
+	assert.NotZero(pids[tsPIDVideo])
+	assert.NotZero(pids[tsPIDAudio])
+}
+
+func TestWriteOpusSegmentsAudioOnlyStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	s := New(HLSConfig{})
+	pl, err := s.getOrCreatePlaylist(1)
+	if !assert.NoError(err) {
+		return
+	}
+	// As if control said the stream had no video
+	pl.setAudioOnly()
+
+	for i := 0; i < 150; i++ {
+		audio := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, Timestamp: uint32(i * 960), Marker: true},
+			Payload: []byte{0xFC, 0x01, 0x02},
+		}
+		assert.NoError(s.writeOpus(1, audio, time.Now()))
+	}
+
+	assert.Contains(pl.render(), "#EXTINF:2.000,\n0.ts\n")
+}
+
+func TestWriteVideoCMAF(t *testing.T) {
+	assert := assert.New(t)
+
+	s := New(HLSConfig{CMAF: true})
+	for _, packet := range testVideoPackets(5) {
+		assert.NoError(s.writeVideo(1, packet, time.Now()))
+	}
+
+	pl, _ := s.getPlaylist(1)
+	index := pl.render()
+	assert.Contains(index, "#EXT-X-MAP:URI=\"init.mp4\"\n")
+	assert.Contains(index, "#EXTINF:2.000,\n0.m4s\n")
+	assert.Contains(index, "#EXTINF:2.000,\n1.m4s\n")
+
+	init, ok := pl.init()
+	if assert.True(ok) {
+		assert.Equal("ftyp", string(init[4:8]))
+	}
+	data, ok := pl.segment(1)
+	if assert.True(ok) {
+		assert.Equal("styp", string(data[4:8]))
+	}
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// How long a started stream has to add its tracks before the relay gives up
+	DefaultTrackWaitTimeout = 30 * time.Second
+	// How long the offer waits for ICE candidates before it's sent anyway
+	DefaultICEGatheringTimeout = 5 * time.Second
+	// Wait before connecting again after the first failure, doubling after
+	// every one after it
+	DefaultReconnectInterval = 2 * time.Second
+
+	// Upper bound for the exponential reconnect backoff
+	maxReconnectInterval = time.Minute
+
+	trackPollInterval  = 500 * time.Millisecond
+	whipRequestTimeout = 10 * time.Second
+)
+
+// RelayConfig forwards one channel to another waveguide instance, so an
+// ingest server can hand streams on to edge servers with viewer capacity
+type RelayConfig struct {
+	// WHIP endpoint of the waveguide instance to relay to, eg
+	// http://edge-1:8091/whip/endpoint
+	TargetURL string `mapstructure:"target_url"`
+	// Channel to relay, it's published under the same ID on the target
+	ChannelID control.ChannelID `mapstructure:"channel_id"`
+	// Stream key the target authenticates the channel with
+	StreamKey string `mapstructure:"stream_key"`
+
+	// How long to wait for the stream's tracks after it starts, defaults to 30s
+	TrackWaitTimeout time.Duration `mapstructure:"track_wait_timeout"`
+	// Defaults to 5s
+	ICEGatheringTimeout time.Duration `mapstructure:"ice_gathering_timeout"`
+	// Defaults to 2s, doubling with every failure in a row up to a minute
+	ReconnectInterval time.Duration `mapstructure:"reconnect_interval"`
+}
+
+type RelayOutput struct {
+	log     logrus.FieldLogger
+	config  RelayConfig
+	control *control.Control
+	client  *http.Client
+
+	// Set by Listen, which runs in its own goroutine, guarded by sessionMutex
+	ctx context.Context
+
+	// The session to the target while the channel is live
+	sessionMutex sync.Mutex
+	session      *whipSession
+}
+
+func New(config RelayConfig) *RelayOutput {
+	if config.TrackWaitTimeout == 0 {
+		config.TrackWaitTimeout = DefaultTrackWaitTimeout
+	}
+	if config.ICEGatheringTimeout == 0 {
+		config.ICEGatheringTimeout = DefaultICEGatheringTimeout
+	}
+	if config.ReconnectInterval == 0 {
+		config.ReconnectInterval = DefaultReconnectInterval
+	}
+	config.TargetURL = strings.TrimSuffix(config.TargetURL, "/")
+
+	return &RelayOutput{
+		config: config,
+		client: &http.Client{Timeout: whipRequestTimeout},
+	}
+}
+
+func (s *RelayOutput) SetControl(ctrl *control.Control) {
+	s.control = ctrl
+}
+
+func (s *RelayOutput) SetLogger(log logrus.FieldLogger) {
+	s.log = log
+}
+
+func (s *RelayOutput) Listen(ctx context.Context) {
+	if s.config.TargetURL == "" {
+		s.log.Errorf("target_url is required for the relay output")
+		return
+	}
+	if s.config.ChannelID == 0 {
+		s.log.Errorf("channel_id is required for the relay output")
+		return
+	}
+
+	s.log.Infof("Relaying channel %d to %s", s.config.ChannelID, s.config.TargetURL)
+	s.sessionMutex.Lock()
+	s.ctx = ctx
+	s.sessionMutex.Unlock()
+}
+
+// SupportedCodecs lists what the WHIP input on the target takes
+func (s *RelayOutput) SupportedCodecs() []string {
+	return []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+}
+
+func (s *RelayOutput) supportsCodec(codec string) bool {
+	for _, supported := range s.SupportedCodecs() {
+		if strings.EqualFold(supported, codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleStreamEvent connects to the target when the channel starts and
+// hangs up when it stops. Connecting waits for tracks and retries, so it
+// happens in the background rather than holding up other event handlers.
+func (s *RelayOutput) HandleStreamEvent(event control.StreamEvent) error {
+	s.sessionMutex.Lock()
+	parent := s.ctx
+	s.sessionMutex.Unlock()
+	if parent == nil || event.ChannelID != s.config.ChannelID {
+		return nil
+	}
+
+	switch event.Type {
+	case control.EventStreamStarted:
+		s.stopSession()
+
+		ctx, cancel := context.WithCancel(parent)
+		session := &whipSession{cancel: cancel}
+		s.sessionMutex.Lock()
+		s.session = session
+		s.sessionMutex.Unlock()
+
+		go s.run(ctx, session)
+	case control.EventStreamStopped:
+		s.stopSession()
+	}
+	return nil
+}
+
+// Stop hangs up on the target, the stream carries on locally
+func (s *RelayOutput) Stop() {
+	s.stopSession()
+}
+
+func (s *RelayOutput) stopSession() {
+	s.sessionMutex.Lock()
+	session := s.session
+	s.session = nil
+	s.sessionMutex.Unlock()
+
+	if session != nil {
+		s.closeSession(session)
+	}
+}
+
+// getTracks polls for the tracks of the channel, inputs add them some time
+// after the stream has started
+func (s *RelayOutput) getTracks(ctx context.Context) ([]control.StreamTrack, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.TrackWaitTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(trackPollInterval)
+	defer ticker.Stop()
+
+	for {
+		tracks, err := s.control.GetTracks(s.config.ChannelID)
+		if err == nil && hasTrack(tracks, webrtc.RTPCodecTypeVideo) && hasTrack(tracks, webrtc.RTPCodecTypeAudio) {
+			return tracks, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			// Audio only streams never get a video track, send what there is
+			if err == nil && len(tracks) > 0 {
+				return tracks, nil
+			}
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func hasTrack(tracks []control.StreamTrack, kind webrtc.RTPCodecType) bool {
+	for _, track := range tracks {
+		if track.Type == kind {
+			return true
+		}
+	}
+	return false
+}
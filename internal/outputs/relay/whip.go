@@ -0,0 +1,251 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+)
+
+var errNoTracks = errors.New("no tracks the target can take")
+
+// whipSession is a WHIP client publishing the channel to the target
+type whipSession struct {
+	cancel context.CancelFunc
+
+	mutex          sync.Mutex
+	peerConnection *webrtc.PeerConnection
+	// Where the target wants the DELETE ending the session sent
+	resourceURL string
+}
+
+// run keeps the channel published to the target until the stream stops,
+// connecting again after any failure with a backoff doubling up to
+// maxReconnectInterval
+func (s *RelayOutput) run(ctx context.Context, session *whipSession) {
+	failures := 0
+	for {
+		failed, err := s.connect(ctx, session)
+		if ctx.Err() != nil {
+			// closeSession may have hung up before the resource was created
+			s.hangUp(session)
+			return
+		}
+		if err != nil {
+			s.log.Errorf("Failed relaying channel %d: %+v", s.config.ChannelID, err)
+		} else {
+			failures = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-failed:
+				s.log.Warnf("Relay of channel %d to %s failed, reconnecting", s.config.ChannelID, s.config.TargetURL)
+			}
+		}
+		s.hangUp(session)
+
+		backoff := s.config.ReconnectInterval << failures
+		if backoff > maxReconnectInterval || backoff <= 0 {
+			backoff = maxReconnectInterval
+		}
+		failures++
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// connect publishes the local tracks to the target: POST an SDP offer, set
+// the answer that comes back and let pion send RTP from the tracks. The
+// returned channel is closed if the connection fails later on.
+func (s *RelayOutput) connect(ctx context.Context, session *whipSession) (<-chan struct{}, error) {
+	tracks, err := s.getTracks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for tracks: %w", err)
+	}
+
+	pc, err := s.control.GetWebRTCAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	session.mutex.Lock()
+	session.peerConnection = pc
+	session.mutex.Unlock()
+
+	failed, err := s.negotiate(ctx, session, pc, tracks)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return failed, nil
+}
+
+// negotiate sends the tracks over pc, the caller closes it on errors
+func (s *RelayOutput) negotiate(ctx context.Context, session *whipSession, pc *webrtc.PeerConnection, tracks []control.StreamTrack) (<-chan struct{}, error) {
+	// Stopped while we were setting up
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	added := 0
+	for _, track := range tracks {
+		if !s.supportsCodec(track.Codec) {
+			continue
+		}
+		transceiver, err := pc.AddTransceiverFromTrack(track.Track, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			return nil, err
+		}
+		go drainRTCP(transceiver.Sender())
+		added++
+	}
+	if added == 0 {
+		return nil, errNoTracks
+	}
+
+	failed := make(chan struct{})
+	var failedOnce sync.Once
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		s.log.Infof("Relay of channel %d to %s is %s", s.config.ChannelID, s.config.TargetURL, pcs)
+		if pcs == webrtc.PeerConnectionStateFailed {
+			failedOnce.Do(func() { close(failed) })
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	select {
+	case <-gatherComplete:
+	case <-time.After(s.config.ICEGatheringTimeout):
+		s.log.Warn("ICE gathering timed out, using partial candidates")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	answer, resourceURL, err := s.postOffer(ctx, pc.LocalDescription().SDP)
+	if err != nil {
+		return nil, err
+	}
+	session.mutex.Lock()
+	session.resourceURL = resourceURL
+	session.mutex.Unlock()
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// postOffer sends the offer to the target's WHIP endpoint, returning the
+// answer and the URL of the resource it created
+func (s *RelayOutput) postOffer(ctx context.Context, offer string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.TargetURL, bytes.NewBufferString(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("%s answered %s: %s", s.config.TargetURL, resp.Status, body)
+	}
+
+	resourceURL := s.config.TargetURL
+	if location := resp.Header.Get("Location"); location != "" {
+		if resolved, err := resp.Request.URL.Parse(location); err == nil {
+			resourceURL = resolved.String()
+		}
+	}
+	return string(body), resourceURL, nil
+}
+
+// authorize adds the stream key, prefixed with the channel ID so the target
+// knows which channel it's for whatever the endpoint path is
+func (s *RelayOutput) authorize(req *http.Request) {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %d-%s", s.config.ChannelID, s.config.StreamKey))
+}
+
+// closeSession stops reconnecting and hangs up on the target
+func (s *RelayOutput) closeSession(session *whipSession) {
+	session.cancel()
+	s.hangUp(session)
+}
+
+// hangUp tells the target the stream is over and closes the peer
+// connection. The target stops its stream when it sees either.
+func (s *RelayOutput) hangUp(session *whipSession) {
+	session.mutex.Lock()
+	pc := session.peerConnection
+	resourceURL := session.resourceURL
+	session.peerConnection = nil
+	session.resourceURL = ""
+	session.mutex.Unlock()
+
+	if resourceURL != "" {
+		if err := s.deleteResource(resourceURL); err != nil {
+			s.log.Warnf("Failed ending the relay session at %s: %s", resourceURL, err)
+		}
+	}
+	if pc != nil {
+		if err := pc.Close(); err != nil {
+			s.log.Errorf("Failed: %+v", err)
+		}
+	}
+}
+
+func (s *RelayOutput) deleteResource(resourceURL string) error {
+	req, err := http.NewRequest(http.MethodDelete, resourceURL, nil)
+	if err != nil {
+		return err
+	}
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", resourceURL, resp.Status)
+	}
+	return nil
+}
+
+// drainRTCP reads RTCP from the target until the sender stops, pion needs it
+// read for its interceptors to work
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
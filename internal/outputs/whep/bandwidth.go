@@ -0,0 +1,42 @@
+package whep
+
+import "github.com/Glimesh/waveguide/pkg/control"
+
+// Estimates moving by more than this share of the previous one are logged
+const bandwidthEstimateLogChange = 0.2
+
+// watchBandwidthEstimate keeps the estimated bandwidth to a viewer on their
+// session. The estimator is fed by the TWCC feedback read with the rest of
+// the RTCP from each sender.
+func (s *WHEPServer) watchBandwidthEstimate(peerID string, estimator control.BandwidthEstimator) {
+	if estimator == nil {
+		return
+	}
+
+	s.setBandwidthEstimate(peerID, estimator.GetTargetBitrate())
+	estimator.OnTargetBitrateChange(func(bitrate int) {
+		s.setBandwidthEstimate(peerID, bitrate)
+	})
+}
+
+func (s *WHEPServer) setBandwidthEstimate(peerID string, bitrate int) {
+	s.peerConnectionsMutex.Lock()
+	defer s.peerConnectionsMutex.Unlock()
+
+	// Already cleaned up, the gauge is gone with it
+	session, ok := s.sessions[peerID]
+	if !ok {
+		return
+	}
+	previous := session.bandwidthEstimate
+	session.bandwidthEstimate = bitrate
+	viewerBandwidthEstimate.WithLabelValues(peerID).Set(float64(bitrate))
+
+	change := bitrate - previous
+	if change < 0 {
+		change = -change
+	}
+	if previous > 0 && float64(change) > float64(previous)*bandwidthEstimateLogChange {
+		s.log.Debugf("Bandwidth estimate for peer %s went from %d to %d bps", peerID, previous, bitrate)
+	}
+}
@@ -0,0 +1,144 @@
+package whep
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	chatDataChannelLabel = "chat"
+	// Largest chat POST body, it's sent on to every viewer as is
+	maxChatBodyBytes = 4 * 1024
+)
+
+type chatMessage struct {
+	Message string `json:"message"`
+	Sender  string `json:"sender"`
+}
+
+// setupChatChannel adds the chat data channel to a peer connection. It has to
+// be created before the offer so it is negotiated with the media, but is only
+// sent messages once ICE and DTLS are done and it opens.
+func (s *WHEPServer) setupChatChannel(channelID control.ChannelID, peerID string, pc *webrtc.PeerConnection) error {
+	dc, err := pc.CreateDataChannel(chatDataChannelLabel, nil)
+	if err != nil {
+		return err
+	}
+
+	dc.OnOpen(func() {
+		s.log.Debugf("Chat data channel open for peer=%s", peerID)
+		s.addChatChannel(channelID, peerID, dc)
+	})
+	dc.OnClose(func() {
+		s.removeChatChannel(channelID, peerID)
+	})
+
+	return nil
+}
+
+func (s *WHEPServer) addChatChannel(channelID control.ChannelID, peerID string, dc *webrtc.DataChannel) {
+	s.viewersByChannelMutex.Lock()
+	defer s.viewersByChannelMutex.Unlock()
+
+	viewers, ok := s.viewersByChannel[channelID]
+	if !ok {
+		viewers = make(map[string]*webrtc.DataChannel)
+		s.viewersByChannel[channelID] = viewers
+	}
+	viewers[peerID] = dc
+}
+
+func (s *WHEPServer) removeChatChannel(channelID control.ChannelID, peerID string) {
+	s.viewersByChannelMutex.Lock()
+	defer s.viewersByChannelMutex.Unlock()
+
+	viewers, ok := s.viewersByChannel[channelID]
+	if !ok {
+		return
+	}
+	delete(viewers, peerID)
+	if len(viewers) == 0 {
+		delete(s.viewersByChannel, channelID)
+	}
+}
+
+// closeChatChannel closes and forgets the chat channel of a peer that went away
+func (s *WHEPServer) closeChatChannel(peerID string) {
+	var stale []*webrtc.DataChannel
+
+	s.viewersByChannelMutex.Lock()
+	for channelID, viewers := range s.viewersByChannel {
+		dc, ok := viewers[peerID]
+		if !ok {
+			continue
+		}
+		stale = append(stale, dc)
+		delete(viewers, peerID)
+		if len(viewers) == 0 {
+			delete(s.viewersByChannel, channelID)
+		}
+	}
+	s.viewersByChannelMutex.Unlock()
+
+	// Closing fires OnClose, which takes the lock again
+	for _, dc := range stale {
+		dc.Close()
+	}
+}
+
+// broadcastChat sends a chat message to every open chat channel of a stream,
+// returning how many viewers it was sent to
+func (s *WHEPServer) broadcastChat(channelID control.ChannelID, data []byte) int {
+	s.viewersByChannelMutex.RLock()
+	defer s.viewersByChannelMutex.RUnlock()
+
+	sent := 0
+	for peerID, dc := range s.viewersByChannel[channelID] {
+		if dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if err := dc.Send(data); err != nil {
+			s.log.Debugf("Failed sending chat to peer=%s: %s", peerID, err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// chatHandler serves POST /whep/chat/{channelID}, behind the API token
+func (s *WHEPServer) chatHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	channelID, err := strconv.Atoi(path.Base(r.URL.Path))
+	if err != nil {
+		errWrongParams(w, r)
+		return
+	}
+
+	var msg chatMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxChatBodyBytes)).Decode(&msg); err != nil || msg.Message == "" {
+		errWrongParams(w, r)
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		errCustom(w, r, "error encoding message")
+		return
+	}
+
+	sent := s.broadcastChat(control.ChannelID(channelID), data)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"viewers": sent})
+}
@@ -0,0 +1,55 @@
+package whep
+
+import (
+	"errors"
+	"net/http"
+)
+
+// validateCORS checks the CORS config at startup, browsers refuse a wildcard
+// origin on requests with credentials
+func (c WHEPConfig) validateCORS() error {
+	if !c.CORSAllowCredentials {
+		return nil
+	}
+	if len(c.CORSAllowedOrigins) == 0 {
+		return errors.New("cors_allowed_origins must list the origins allowed with cors_allow_credentials")
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			return errors.New("cors_allowed_origins can't contain \"*\" with cors_allow_credentials")
+		}
+	}
+	return nil
+}
+
+// setCORSHeaders allows cross origin requests from CORSAllowedOrigins, or
+// from anywhere when it's unset. With CORSAllowCredentials the origin is
+// echoed back, so cookies from a parent site are sent along.
+func (s *WHEPServer) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if !s.config.CORSAllowCredentials && s.originAllowed("*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || !s.originAllowed(origin) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if s.config.CORSAllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (s *WHEPServer) originAllowed(origin string) bool {
+	if len(s.config.CORSAllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range s.config.CORSAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package whep
+
+import (
+	_ "embed"
+
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The player page is built into the binary, so it doesn't depend on the
+// working directory
+
+//go:embed public/stream.html
+var streamTemplateContent string
+
+var streamTemplate = template.Must(template.New("stream.html").Parse(streamTemplateContent))
+
+// playerOptions are the ?autoplay=1&muted=1&controls=0 query parameters of
+// the player page, all of them on unless set to 0
+type playerOptions struct {
+	Autoplay bool
+	Muted    bool
+	Controls bool
+}
+
+func parsePlayerOptions(query url.Values) playerOptions {
+	enabled := func(name string) bool {
+		return query.Get(name) != "0"
+	}
+	return playerOptions{
+		Autoplay: enabled("autoplay"),
+		Muted:    enabled("muted"),
+		Controls: enabled("controls"),
+	}
+}
+
+func (o playerOptions) query() string {
+	values := url.Values{}
+	for name, enabled := range map[string]bool{"autoplay": o.Autoplay, "muted": o.Muted, "controls": o.Controls} {
+		if enabled {
+			values.Set(name, "1")
+		} else {
+			values.Set(name, "0")
+		}
+	}
+	return values.Encode()
+}
+
+// streamHandler serves the player page on /stream/{channelID}, and ways of
+// putting it on other sites on /stream/{channelID}/embed.js and
+// /stream/{channelID}/iframe
+func (s *WHEPServer) streamHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/stream/"), "/"), "/")
+	if _, err := strconv.ParseUint(parts[0], 10, 32); err != nil || len(parts) > 2 {
+		errCustom(w, r, "invalid channel id")
+		return
+	}
+	channelID := parts[0]
+	options := parsePlayerOptions(r.URL.Query())
+
+	if len(parts) == 1 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		streamTemplate.Execute(w, struct {
+			ChannelID   string
+			EndpointUrl template.HTML
+			playerOptions
+		}{channelID, template.HTML(s.endpointUrl(channelID)), options})
+		return
+	}
+
+	switch parts[1] {
+	case "iframe":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, s.iframeCode(channelID, options))
+	case "embed.js":
+		// Writes the iframe where the script tag is
+		code, _ := json.Marshal(s.iframeCode(channelID, options))
+		w.Header().Set("Content-Type", "application/javascript")
+		s.setCORSHeaders(w, r)
+		fmt.Fprintf(w, "(function () {\n\tvar script = document.currentScript;\n\tvar container = document.createElement(\"div\");\n\tcontainer.innerHTML = %s;\n\tscript.parentNode.insertBefore(container.firstChild, script);\n})();\n", code)
+	default:
+		errCustom(w, r, "not found")
+	}
+}
+
+func (s *WHEPServer) iframeCode(channelID string, options playerOptions) string {
+	src := fmt.Sprintf("%s/stream/%s?%s", s.serverUrl(), channelID, options.query())
+	return fmt.Sprintf(`<iframe src="%s" width="1280" height="720" frameborder="0" allow="autoplay; fullscreen" allowfullscreen></iframe>`, html.EscapeString(src))
+}
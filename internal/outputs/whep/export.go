@@ -0,0 +1,190 @@
+package whep
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+)
+
+const viewerExportPattern = "/api/v1/viewers/export"
+
+const (
+	// Exports call GetStats on every peer connection, so they can only be
+	// run this often
+	viewerExportInterval = 30 * time.Second
+	// Peers whose stats take longer than this are exported without them
+	viewerExportStatsTimeout = 10 * time.Second
+)
+
+var viewerExportColumns = []string{"peer_id", "channel_id", "connected_at", "state", "bytes_sent", "rtt_ms", "country"}
+
+// viewerSession is what we know about a peer connection beyond pion's state
+type viewerSession struct {
+	channelID control.ChannelID
+	country   string
+	// Unset until the peer first connects
+	connectedAt time.Time
+	// In bits per second, see watchBandwidthEstimate
+	bandwidthEstimate int
+}
+
+// viewerExportRow is one viewer session in /api/v1/viewers/export
+type viewerExportRow struct {
+	PeerID      string            `json:"peer_id"`
+	ChannelID   control.ChannelID `json:"channel_id"`
+	ConnectedAt *time.Time        `json:"connected_at"`
+	State       string            `json:"state"`
+	BytesSent   uint64            `json:"bytes_sent"`
+	RTTMs       float64           `json:"rtt_ms"`
+	Country     string            `json:"country"`
+}
+
+func (row viewerExportRow) csvRecord() []string {
+	connectedAt := ""
+	if row.ConnectedAt != nil {
+		connectedAt = row.ConnectedAt.Format(time.RFC3339)
+	}
+	return []string{
+		row.PeerID,
+		strconv.Itoa(int(row.ChannelID)),
+		connectedAt,
+		row.State,
+		strconv.FormatUint(row.BytesSent, 10),
+		strconv.FormatFloat(row.RTTMs, 'f', 1, 64),
+		row.Country,
+	}
+}
+
+func (s *WHEPServer) markConnected(uuid string) {
+	s.peerConnectionsMutex.Lock()
+	defer s.peerConnectionsMutex.Unlock()
+
+	if session, ok := s.sessions[uuid]; ok && session.connectedAt.IsZero() {
+		session.connectedAt = time.Now().UTC()
+	}
+}
+
+// allowExport rate limits exports. It doesn't go by the Authorization
+// header, without an api_token anyone could send a new one every time.
+func (s *WHEPServer) allowExport() bool {
+	return s.exportLimiter.Allow()
+}
+
+// viewerExportHandler handles GET /api/v1/viewers/export?format=json|csv,
+// every current viewer session across all channels
+func (s *WHEPServer) viewerExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		errCustom(w, r, "format must be json or csv")
+		return
+	}
+	if !s.allowExport() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(viewerExportInterval.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Viewers can be exported once every 30 seconds"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), viewerExportStatsTimeout)
+	defer cancel()
+	rows := s.exportViewers(ctx)
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+		return
+	}
+
+	filename := fmt.Sprintf("viewers-%s.csv", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writer := csv.NewWriter(w)
+	writer.Write(viewerExportColumns)
+	for _, row := range rows {
+		writer.Write(row.csvRecord())
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		s.log.Errorf("Failed: %+v", err)
+	}
+}
+
+// exportViewers snapshots every peer connection and fills in their stats in
+// parallel. Peers still gathering stats when ctx is done are left without.
+func (s *WHEPServer) exportViewers(ctx context.Context) []viewerExportRow {
+	s.peerConnectionsMutex.RLock()
+	rows := make([]viewerExportRow, 0, len(s.peerConnections))
+	pcs := make([]*webrtc.PeerConnection, 0, len(s.peerConnections))
+	for uuid, pc := range s.peerConnections {
+		row := viewerExportRow{PeerID: uuid, State: pc.ConnectionState().String()}
+		if session, ok := s.sessions[uuid]; ok {
+			row.ChannelID = session.channelID
+			row.Country = session.country
+			if !session.connectedAt.IsZero() {
+				connectedAt := session.connectedAt
+				row.ConnectedAt = &connectedAt
+			}
+		}
+		rows = append(rows, row)
+		pcs = append(pcs, pc)
+	}
+	s.peerConnectionsMutex.RUnlock()
+
+	type peerStats struct {
+		index     int
+		bytesSent uint64
+		rttMs     float64
+	}
+	// Buffered so stats arriving after the timeout don't block anyone
+	results := make(chan peerStats, len(pcs))
+	for i, pc := range pcs {
+		go func(i int, pc *webrtc.PeerConnection) {
+			bytesSent, rttMs := exportStats(pc.GetStats())
+			results <- peerStats{index: i, bytesSent: bytesSent, rttMs: rttMs}
+		}(i, pc)
+	}
+
+	for remaining := len(pcs); remaining > 0; remaining-- {
+		select {
+		case stats := <-results:
+			rows[stats.index].BytesSent = stats.bytesSent
+			rows[stats.index].RTTMs = stats.rttMs
+		case <-ctx.Done():
+			s.log.Warnf("Exporting viewers without stats for %d peers: %s", remaining, ctx.Err())
+			return rows
+		}
+	}
+	return rows
+}
+
+// exportStats adds up the bytes sent on every outbound stream and takes the
+// round trip time of the nominated candidate pair
+func exportStats(report webrtc.StatsReport) (uint64, float64) {
+	var bytesSent uint64
+	var rttMs float64
+	for _, stats := range report {
+		switch stats := stats.(type) {
+		case webrtc.OutboundRTPStreamStats:
+			bytesSent += stats.BytesSent
+		case webrtc.ICECandidatePairStats:
+			if stats.Nominated {
+				rttMs = stats.CurrentRoundTripTime * 1000
+			}
+		}
+	}
+	return bytesSent, rttMs
+}
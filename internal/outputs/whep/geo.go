@@ -0,0 +1,103 @@
+package whep
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Glimesh/waveguide/pkg/geoip"
+)
+
+// How often whep_viewers_by_country is refreshed from viewersByCountry
+const viewerGeoRefreshInterval = 30 * time.Second
+
+// viewerIP returns the IP to geolocate a viewer by, preferring the first
+// public address in X-Forwarded-For when we're behind a proxy
+func viewerIP(r *http.Request) net.IP {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		for _, addr := range strings.Split(forwarded, ",") {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				continue
+			}
+			return ip
+		}
+	}
+
+	return geoip.HostIP(r.RemoteAddr)
+}
+
+// addViewer counts a connected peer towards its country
+func (s *WHEPServer) addViewer(peerID string, country string) {
+	if country == "" {
+		country = "unknown"
+	}
+
+	s.viewersMutex.Lock()
+	defer s.viewersMutex.Unlock()
+
+	if _, ok := s.viewerCountries[peerID]; ok {
+		return
+	}
+	s.viewerCountries[peerID] = country
+	s.viewersByCountry[country]++
+}
+
+func (s *WHEPServer) removeViewer(peerID string) {
+	s.viewersMutex.Lock()
+	defer s.viewersMutex.Unlock()
+
+	country, ok := s.viewerCountries[peerID]
+	if !ok {
+		return
+	}
+	delete(s.viewerCountries, peerID)
+	s.viewersByCountry[country]--
+	if s.viewersByCountry[country] <= 0 {
+		delete(s.viewersByCountry, country)
+	}
+}
+
+func (s *WHEPServer) viewersGeo() map[string]int {
+	s.viewersMutex.RLock()
+	defer s.viewersMutex.RUnlock()
+
+	viewers := make(map[string]int, len(s.viewersByCountry))
+	for country, count := range s.viewersByCountry {
+		viewers[country] = count
+	}
+	return viewers
+}
+
+func (s *WHEPServer) viewersGeoHandler(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.viewersGeo())
+}
+
+// refreshViewerMetrics keeps whep_viewers_by_country up to date until ctx is done
+func (s *WHEPServer) refreshViewerMetrics(ctx context.Context) {
+	ticker := time.NewTicker(viewerGeoRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Reset so countries without viewers drop out of the metric
+			viewersByCountry.Reset()
+			for country, count := range s.viewersGeo() {
+				viewersByCountry.WithLabelValues(country).Set(float64(count))
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package whep
+
+import (
+	"net"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// logICECandidates logs every candidate gathered for a peer and counts them
+// by type, then records whether the pair it connected over needed STUN or
+// TURN at all. Addresses are logged with their host bits masked.
+func (s *WHEPServer) logICECandidates(peerID string, peerConnection *webrtc.PeerConnection) {
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		// nil marks the end of gathering
+		if candidate == nil {
+			return
+		}
+
+		iceCandidatesGathered.WithLabelValues(candidate.Typ.String()).Inc()
+		s.log.Debugf("ICE candidate: peer=%s type=%s protocol=%s address=%s", peerID, candidate.Typ, candidate.Protocol, redactAddress(candidate.Address))
+	})
+
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state != webrtc.ICEConnectionStateConnected {
+			return
+		}
+		sctp := peerConnection.SCTP()
+		if sctp == nil {
+			return
+		}
+		pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+		if err != nil || pair == nil {
+			return
+		}
+
+		s.log.Debugf("ICE connected: peer=%s local=%s remote=%s", peerID, pair.Local.Typ, pair.Remote.Typ)
+		switch {
+		case pair.Local.Typ == webrtc.ICECandidateTypeHost && pair.Remote.Typ == webrtc.ICECandidateTypeHost:
+			// STUN wasn't needed
+			peersWithOnlyHostCandidates.Inc()
+		case pair.Local.Typ == webrtc.ICECandidateTypeRelay || pair.Remote.Typ == webrtc.ICECandidateTypeRelay:
+			// Nothing got through without TURN
+			peersWithOnlyRelayCandidates.Inc()
+		}
+	})
+}
+
+// redactAddress masks an IP to its /24, or /48 for IPv6, leaving hostnames
+// such as mDNS candidates as they are
+func redactAddress(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
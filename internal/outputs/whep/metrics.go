@@ -0,0 +1,46 @@
+package whep
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	iceGatheringDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "whep_ice_gathering_duration_seconds",
+		Help:    "Time spent gathering ICE candidates for a WHEP offer",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	})
+	iceNoSrflx = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_ice_no_srflx_total",
+		Help: "WHEP offers that only had host candidates, no STUN or TURN candidates were gathered",
+	})
+	iceCandidatesGathered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whep_ice_candidates_gathered_total",
+		Help: "ICE candidates gathered for WHEP peers with ice_candidate_logging on, by type",
+	}, []string{"type"})
+	peersWithOnlyHostCandidates = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_peers_with_only_host_candidates_total",
+		Help: "WHEP peers that connected over a host to host pair, so STUN wasn't needed",
+	})
+	peersWithOnlyRelayCandidates = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_peers_with_only_relay_candidates_total",
+		Help: "WHEP peers that connected over a relay candidate, so TURN was required",
+	})
+	viewerBandwidthEstimate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "whep_viewer_bandwidth_estimate_bps",
+		Help: "Bandwidth to each WHEP viewer estimated with Google Congestion Control from their TWCC feedback",
+	}, []string{"peer_id"})
+	viewersByCountry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "whep_viewers_by_country",
+		Help: "Connected WHEP viewers by country",
+	}, []string{"country"})
+	poolHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_pool_hit_total",
+		Help: "WHEP endpoint requests served a peer connection from the pool",
+	})
+	poolMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_pool_miss_total",
+		Help: "WHEP endpoint requests that found the peer connection pool empty",
+	})
+)
@@ -0,0 +1,91 @@
+package whep
+
+import (
+	"context"
+
+	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultPeerConnectionPoolSize = 5
+
+// pooledPeerConnection is a peer connection along with the estimator of the
+// bandwidth to its peer, which can be nil
+type pooledPeerConnection struct {
+	pc        *webrtc.PeerConnection
+	estimator control.BandwidthEstimator
+}
+
+// peerConnectionPool keeps peer connections created ahead of time, setting
+// one up is slow enough to be noticeable on the first viewer request
+type peerConnectionPool struct {
+	log         logrus.FieldLogger
+	control     *control.Control
+	connections chan pooledPeerConnection
+}
+
+func newPeerConnectionPool(size int, ctrl *control.Control, log logrus.FieldLogger) *peerConnectionPool {
+	if size < 0 {
+		size = 0
+	}
+	return &peerConnectionPool{
+		log:         log,
+		control:     ctrl,
+		connections: make(chan pooledPeerConnection, size),
+	}
+}
+
+// run fills the pool, then closes whatever is left in it once ctx is done
+func (p *peerConnectionPool) run(ctx context.Context) {
+	for i := 0; i < cap(p.connections); i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		p.add()
+	}
+
+	<-ctx.Done()
+	for {
+		select {
+		case pooled := <-p.connections:
+			pooled.pc.Close()
+		default:
+			return
+		}
+	}
+}
+
+// get takes a connection from the pool and replaces it in the background,
+// creating one on the spot if the pool is empty
+func (p *peerConnectionPool) get() (pooledPeerConnection, error) {
+	select {
+	case pooled := <-p.connections:
+		poolHits.Inc()
+		go p.add()
+		return pooled, nil
+	default:
+		poolMisses.Inc()
+		return p.create()
+	}
+}
+
+func (p *peerConnectionPool) create() (pooledPeerConnection, error) {
+	pc, estimator, err := p.control.NewBandwidthEstimatedPeerConnection(webrtc.Configuration{})
+	return pooledPeerConnection{pc: pc, estimator: estimator}, err
+}
+
+func (p *peerConnectionPool) add() {
+	pooled, err := p.create()
+	if err != nil {
+		p.log.Errorf("Failed to create pooled peer connection: %+v", err)
+		return
+	}
+
+	select {
+	case p.connections <- pooled:
+	default:
+		// Already full
+		pooled.pc.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package whep
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// ice-char is ALPHA / DIGIT / "+" / "/", with the lengths from RFC 8839 section 5.4
+var (
+	iceUfragRegex = regexp.MustCompile(`^[A-Za-z0-9+/]{4,256}$`)
+	icePwdRegex   = regexp.MustCompile(`^[A-Za-z0-9+/]{22,256}$`)
+)
+
+var directions = []string{"sendrecv", "sendonly", "recvonly", "inactive"}
+
+// Directions an answer may use for each offered direction, RFC 3264 section 6.1
+var compatibleDirections = map[string][]string{
+	"sendrecv": {"sendrecv", "sendonly", "recvonly", "inactive"},
+	"sendonly": {"recvonly", "inactive"},
+	"recvonly": {"sendonly", "inactive"},
+	"inactive": {"inactive"},
+}
+
+// validateSDPAnswer checks a viewer's answer lines up with the offer we sent
+// them before it goes to pion, whose errors don't say much about what the
+// client got wrong
+func validateSDPAnswer(offer, answer webrtc.SessionDescription) error {
+	var parsedOffer, parsedAnswer sdp.SessionDescription
+	if err := parsedOffer.Unmarshal([]byte(offer.SDP)); err != nil {
+		return fmt.Errorf("invalid offer: %w", err)
+	}
+	if err := parsedAnswer.Unmarshal([]byte(answer.SDP)); err != nil {
+		return fmt.Errorf("invalid answer: %w", err)
+	}
+
+	if len(parsedAnswer.MediaDescriptions) != len(parsedOffer.MediaDescriptions) {
+		return fmt.Errorf("answer has %d m-lines, the offer has %d", len(parsedAnswer.MediaDescriptions), len(parsedOffer.MediaDescriptions))
+	}
+
+	for i, answerMedia := range parsedAnswer.MediaDescriptions {
+		offerMedia := parsedOffer.MediaDescriptions[i]
+		if answerMedia.MediaName.Media != offerMedia.MediaName.Media {
+			return fmt.Errorf("m-line %d is %s in the answer but %s in the offer", i, answerMedia.MediaName.Media, offerMedia.MediaName.Media)
+		}
+		// Rejected m-lines don't need anything else
+		if answerMedia.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		offerDirection := mediaDirection(&parsedOffer, offerMedia)
+		answerDirection := mediaDirection(&parsedAnswer, answerMedia)
+		if !containsString(compatibleDirections[offerDirection], answerDirection) {
+			return fmt.Errorf("m-line %d answers %s with %s", i, offerDirection, answerDirection)
+		}
+
+		ufrag, _ := mediaAttribute(&parsedAnswer, answerMedia, "ice-ufrag")
+		if !iceUfragRegex.MatchString(ufrag) {
+			return fmt.Errorf("m-line %d has a missing or malformed ice-ufrag", i)
+		}
+		pwd, _ := mediaAttribute(&parsedAnswer, answerMedia, "ice-pwd")
+		if !icePwdRegex.MatchString(pwd) {
+			return fmt.Errorf("m-line %d has a missing or malformed ice-pwd", i)
+		}
+		if fingerprint, ok := mediaAttribute(&parsedAnswer, answerMedia, "fingerprint"); !ok || fingerprint == "" {
+			return fmt.Errorf("m-line %d has no DTLS fingerprint", i)
+		}
+	}
+
+	return nil
+}
+
+// mediaAttribute looks for an attribute on an m-line, falling back to the
+// session level
+func mediaAttribute(session *sdp.SessionDescription, media *sdp.MediaDescription, key string) (string, bool) {
+	if value, ok := media.Attribute(key); ok {
+		return value, true
+	}
+	return session.Attribute(key)
+}
+
+// mediaDirection is the direction attribute of an m-line, sendrecv if unset
+func mediaDirection(session *sdp.SessionDescription, media *sdp.MediaDescription) string {
+	for _, direction := range directions {
+		if _, ok := media.Attribute(direction); ok {
+			return direction
+		}
+	}
+	for _, direction := range directions {
+		if _, ok := session.Attribute(direction); ok {
+			return direction
+		}
+	}
+	return "sendrecv"
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package whep
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUfrag       = "Fq3b"
+	testPwd         = "k7pXo2ZHRtM9vVqa1yQxWcLd"
+	testFingerprint = "sha-256 2E:73:5A:1B:0C:6F:7E:91:AA:4D:38:55:F2:10:D9:61:0B:3C:7E:42:99:8A:1D:E6:55:04:2F:C0:B3:71:88:6A"
+)
+
+// sessionSDP joins a session header and its m-lines into an SDP
+func sessionSDP(session []string, media ...[]string) string {
+	lines := append([]string{"v=0", "o=- 4215775240449105457 2 IN IP4 127.0.0.1", "s=-", "t=0 0"}, session...)
+	for _, m := range media {
+		lines = append(lines, m...)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func offerMedia(kind string) []string {
+	return []string{
+		"m=" + kind + " 9 UDP/TLS/RTP/SAVPF 96",
+		"c=IN IP4 0.0.0.0",
+		"a=sendonly",
+		"a=ice-ufrag:ServerUfrag",
+		"a=ice-pwd:ServerPasswordServerPassword",
+		"a=fingerprint:" + testFingerprint,
+	}
+}
+
+// answerMedia is a valid answer m-line without the attributes skipped
+func answerMedia(kind string, skip ...string) []string {
+	lines := []string{"m=" + kind + " 9 UDP/TLS/RTP/SAVPF 96", "c=IN IP4 0.0.0.0"}
+	for _, attribute := range []string{"a=recvonly", "a=ice-ufrag:" + testUfrag, "a=ice-pwd:" + testPwd, "a=fingerprint:" + testFingerprint} {
+		skipped := false
+		for _, s := range skip {
+			if strings.HasPrefix(attribute, "a="+s) {
+				skipped = true
+			}
+		}
+		if !skipped {
+			lines = append(lines, attribute)
+		}
+	}
+	return lines
+}
+
+func TestValidateSDPAnswer(t *testing.T) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sessionSDP(nil, offerMedia("audio"), offerMedia("video"))}
+
+	tests := []struct {
+		name   string
+		answer string
+		err    string
+	}{
+		{"valid", sessionSDP(nil, answerMedia("audio"), answerMedia("video")), ""},
+		{
+			"ice and fingerprint at the session level",
+			sessionSDP([]string{"a=ice-ufrag:" + testUfrag, "a=ice-pwd:" + testPwd, "a=fingerprint:" + testFingerprint},
+				answerMedia("audio", "ice-", "fingerprint"), answerMedia("video", "ice-", "fingerprint")),
+			"",
+		},
+		{"rejected m-line", sessionSDP(nil, []string{"m=audio 0 UDP/TLS/RTP/SAVPF 96"}, answerMedia("video")), ""},
+		{"missing m-line", sessionSDP(nil, answerMedia("audio")), "answer has 1 m-lines, the offer has 2"},
+		{"extra m-line", sessionSDP(nil, answerMedia("audio"), answerMedia("video"), answerMedia("video")), "answer has 3 m-lines, the offer has 2"},
+		{"m-lines swapped", sessionSDP(nil, answerMedia("video"), answerMedia("audio")), "m-line 0 is video in the answer but audio in the offer"},
+		{"missing ice-ufrag", sessionSDP(nil, answerMedia("audio"), answerMedia("video", "ice-ufrag")), "m-line 1 has a missing or malformed ice-ufrag"},
+		{"short ice-ufrag", sessionSDP(nil, answerMedia("audio"), append(answerMedia("video", "ice-ufrag"), "a=ice-ufrag:abc")), "m-line 1 has a missing or malformed ice-ufrag"},
+		{"missing ice-pwd", sessionSDP(nil, answerMedia("audio", "ice-pwd"), answerMedia("video")), "m-line 0 has a missing or malformed ice-pwd"},
+		{"malformed ice-pwd", sessionSDP(nil, append(answerMedia("audio", "ice-pwd"), "a=ice-pwd:short"), answerMedia("video")), "m-line 0 has a missing or malformed ice-pwd"},
+		{"missing fingerprint", sessionSDP(nil, answerMedia("audio"), answerMedia("video", "fingerprint")), "m-line 1 has no DTLS fingerprint"},
+		{"sending back", sessionSDP(nil, append(answerMedia("audio", "recvonly"), "a=sendonly"), answerMedia("video")), "m-line 0 answers sendonly with sendonly"},
+		{"not sdp", "v=0\r\no=bogus\r\n", "invalid answer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSDPAnswer(offer, webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: tt.answer})
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateSDPAnswerInvalidOffer(t *testing.T) {
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sessionSDP(nil, answerMedia("audio"))}
+	assert.ErrorContains(t, validateSDPAnswer(webrtc.SessionDescription{SDP: "v=0\r\no=bogus\r\n"}, answer), "invalid offer")
+}
@@ -0,0 +1,83 @@
+package whep
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// handle registers a WHEP handler on the dedicated server when there is one,
+// or on the control http server otherwise
+func (s *WHEPServer) handle(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	if s.mux != nil {
+		s.mux.HandleFunc(pattern, handler)
+		return
+	}
+	s.control.RegisterHandleFunc(pattern, handler)
+	s.patterns = append(s.patterns, pattern)
+}
+
+// Stop removes the WHEP endpoints and disconnects every viewer, the
+// dedicated server and peer connection pool stop with the Listen context
+func (s *WHEPServer) Stop() {
+	s.control.DeregisterTrackReplacer(s)
+	for _, pattern := range s.patterns {
+		s.control.DeregisterHandleFunc(pattern)
+	}
+	s.patterns = nil
+	if s.mux != nil {
+		s.control.SetWHEPEndpoint("")
+	}
+
+	s.peerConnectionsMutex.RLock()
+	peers := make([]string, 0, len(s.peerConnections))
+	for uuid := range s.peerConnections {
+		peers = append(peers, uuid)
+	}
+	s.peerConnectionsMutex.RUnlock()
+
+	for _, uuid := range peers {
+		s.cleanupPeerConnection(uuid)
+	}
+}
+
+// serverUrl is the base URL players reach the WHEP endpoints on
+func (s *WHEPServer) serverUrl() string {
+	if s.mux == nil {
+		return s.control.HttpServerUrl()
+	}
+	if s.config.Https {
+		return fmt.Sprintf("https://%s", s.config.HttpsHostname)
+	}
+	return fmt.Sprintf("http://%s", s.config.ListenAddress)
+}
+
+// serve runs the dedicated WHEP http server until ctx is done
+func (s *WHEPServer) serve(ctx context.Context) {
+	srv := &http.Server{
+		Addr:    s.config.ListenAddress,
+		Handler: logRequest(s.log, s.mux),
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if s.config.Https {
+		s.log.Infof("Starting WHEP https server on %s", s.config.ListenAddress)
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		err = srv.ListenAndServeTLS(s.config.HttpsCert, s.config.HttpsKey)
+	} else {
+		s.log.Infof("Starting WHEP http server on %s", s.config.ListenAddress)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		s.log.Errorf("Failed: %+v", err)
+	}
+}
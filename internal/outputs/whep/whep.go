@@ -1,29 +1,36 @@
 package whep
 
 import (
-	_ "embed"
-
 	"context"
 	"fmt"
-	"html/template"
 	"io"
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
+	"github.com/Glimesh/waveguide/pkg/geoip"
 	"github.com/google/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
+// Default lifetime of a WHEP resource, see WHEPConfig.ResourceTTL
 const PC_TIMEOUT = time.Minute * 5
 
-//go:embed public/stream.html
-var streamTemplateContent string
+const (
+	DefaultWaitTimeout         = 30 * time.Second
+	DefaultICEGatheringTimeout = 5 * time.Second
+
+	// How often tracks are checked for while waiting for a stream to start
+	waitPollInterval = 500 * time.Millisecond
+)
 
 type WHEPConfig struct {
 	// Listen address of the webserver
@@ -33,6 +40,51 @@ type WHEPConfig struct {
 	HttpsHostname string `mapstructure:"https_hostname"`
 	HttpsCert     string `mapstructure:"https_cert"`
 	HttpsKey      string `mapstructure:"https_key"`
+
+	// Serve the WHEP endpoints from their own http server on this address,
+	// eg a public CDN facing interface, instead of the control http server.
+	// Https, HttpsHostname, HttpsCert and HttpsKey configure its TLS.
+	ListenAddress string `mapstructure:"listen_address"`
+
+	// Hold endpoint requests for channels that are not live yet open until
+	// the stream starts or WaitTimeout passes, instead of returning a 404
+	WaitForStream bool          `mapstructure:"wait_for_stream"`
+	WaitTimeout   time.Duration `mapstructure:"wait_timeout"`
+
+	// Longest to wait for ICE candidates before sending the offer with what we have
+	ICEGatheringTimeout time.Duration `mapstructure:"ice_gathering_timeout"`
+
+	// Optional MaxMind GeoLite2 City or Country database used to locate viewers
+	GeoIPDatabasePath string `mapstructure:"geoip_database_path"`
+
+	// Open a "chat" data channel to every viewer that chat messages posted
+	// to /whep/chat/{channelID} with the control api_token are pushed down
+	DataChannelChat bool `mapstructure:"data_channel_chat"`
+
+	// Require a ?token= from /api/v1/viewer-token on endpoint requests, the
+	// secret has to match control.viewer_token_secret
+	SessionTokenRequired bool   `mapstructure:"session_token_required"`
+	SessionTokenSecret   string `mapstructure:"session_token_secret"`
+
+	// Peer connections created ahead of time for endpoint requests, a
+	// negative size turns the pool off
+	PeerConnectionPoolSize int `mapstructure:"peer_connection_pool_size"`
+
+	// Log every ICE candidate gathered for viewers with its address masked,
+	// and count candidates and connections by type for diagnosing STUN/TURN
+	ICECandidateLogging bool `mapstructure:"ice_candidate_logging"`
+
+	// Origins allowed to make cross origin requests, any when unset
+	CORSAllowedOrigins []string `mapstructure:"cors_allowed_origins"`
+	// Let browsers send cookies along, eg a session set by a parent site.
+	// The requesting origin is echoed back, so CORSAllowedOrigins has to list
+	// them rather than use "*".
+	CORSAllowCredentials bool `mapstructure:"cors_allow_credentials"`
+
+	// How long a viewer has to connect before their peer connection is
+	// dropped, sent as the Expire header. POST /whep/resource/{id}/refresh
+	// extends it by as much again. Defaults to 5 minutes.
+	ResourceTTL time.Duration `mapstructure:"resource_ttl"`
 }
 
 type WHEPServer struct {
@@ -43,14 +95,57 @@ type WHEPServer struct {
 	peerConnectionsMutex sync.RWMutex
 	peerConnections      map[string]*webrtc.PeerConnection
 	debugChannels        map[string]*webrtc.DataChannel
+	// When each peer connection was created or last refreshed, its resource
+	// expires ResourceTTL after that
+	lastRefreshed map[string]time.Time
+	// Who each peer connection is for, see /api/v1/viewers/export
+	sessions map[string]*viewerSession
+
+	geo              *geoip.Reader
+	viewersMutex     sync.RWMutex
+	viewersByCountry map[string]int
+	viewerCountries  map[string]string
+
+	viewersByChannelMutex sync.RWMutex
+	viewersByChannel      map[control.ChannelID]map[string]*webrtc.DataChannel
+
+	pool *peerConnectionPool
+
+	// Only set when ListenAddress is, otherwise handlers go on the control mux
+	mux *http.ServeMux
+	// Patterns registered on the control mux, removed again by Stop
+	patterns []string
+
+	// Shared by every caller, there's only the one API token. See
+	// viewerExportHandler.
+	exportLimiter *rate.Limiter
 }
 
 func New(config WHEPConfig) *WHEPServer {
+	if config.WaitTimeout == 0 {
+		config.WaitTimeout = DefaultWaitTimeout
+	}
+	if config.ICEGatheringTimeout == 0 {
+		config.ICEGatheringTimeout = DefaultICEGatheringTimeout
+	}
+	if config.PeerConnectionPoolSize == 0 {
+		config.PeerConnectionPoolSize = DefaultPeerConnectionPoolSize
+	}
+	if config.ResourceTTL == 0 {
+		config.ResourceTTL = PC_TIMEOUT
+	}
+
 	return &WHEPServer{
 		config:               config,
 		peerConnectionsMutex: sync.RWMutex{},
 		peerConnections:      make(map[string]*webrtc.PeerConnection),
+		lastRefreshed:        make(map[string]time.Time),
+		sessions:             make(map[string]*viewerSession),
 		debugChannels:        make(map[string]*webrtc.DataChannel),
+		viewersByCountry:     make(map[string]int),
+		viewerCountries:      make(map[string]string),
+		viewersByChannel:     make(map[control.ChannelID]map[string]*webrtc.DataChannel),
+		exportLimiter:        rate.NewLimiter(rate.Every(viewerExportInterval), 1),
 	}
 }
 
@@ -65,14 +160,44 @@ func (s *WHEPServer) SetLogger(log logrus.FieldLogger) {
 func (s *WHEPServer) Listen(ctx context.Context) {
 	s.log.Infof("Registering WHEP http endpoints")
 
-	// Todo: Find better way of fetching this path
-	streamTemplate := template.Must(template.New("stream.html").Parse(streamTemplateContent))
+	if s.config.SessionTokenRequired && s.config.SessionTokenSecret == "" {
+		s.log.Errorf("session_token_secret is required with session_token_required")
+		return
+	}
+	if s.config.SessionTokenRequired && !s.control.HasAPIToken() {
+		// Otherwise anyone could ask /api/v1/viewer-token for a session token
+		s.log.Errorf("control api_token is required with session_token_required")
+		return
+	}
+	if err := s.config.validateCORS(); err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+
+	geo, err := geoip.Open(s.config.GeoIPDatabasePath)
+	if err != nil {
+		s.log.Errorf("Failed: %+v", err)
+		return
+	}
+	s.geo = geo
+	go s.refreshViewerMetrics(ctx)
+
+	if s.config.ListenAddress != "" {
+		s.mux = http.NewServeMux()
+		s.control.SetWHEPEndpoint(s.serverUrl() + "/whep/endpoint")
+		go s.serve(ctx)
+	}
+
+	s.control.RegisterTrackReplacer(s)
+
+	s.pool = newPeerConnectionPool(s.config.PeerConnectionPoolSize, s.control, s.log)
+	go s.pool.run(ctx)
 
 	// Player (Nothing) => Endpoint (Offer) => Player (Answer)
-	s.control.RegisterHandleFunc("/whep/endpoint/", func(w http.ResponseWriter, r *http.Request) {
+	s.handle("/whep/endpoint/", func(w http.ResponseWriter, r *http.Request) {
 		strChannelID := path.Base(r.URL.Path)
 
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		s.setCORSHeaders(w, r)
 
 		channelID, err := strconv.Atoi(strChannelID)
 		if err != nil {
@@ -80,27 +205,65 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 			return
 		}
 
+		if s.config.SessionTokenRequired {
+			if err := control.ValidateViewerToken(s.config.SessionTokenSecret, control.ChannelID(channelID), r.URL.Query().Get("token")); err != nil {
+				s.log.Debugf("Rejected viewer for %d: %s", channelID, err)
+				errUnauthorized(w, r)
+				return
+			}
+		}
+
+		// Importantly, the track needs to be added before the offer (duh!)
+		tracks, err := s.getTracks(r.Context(), control.ChannelID(channelID))
+		if err != nil {
+			errNotFound(w, r)
+			return
+		}
+
 		peerID := uuid.New().String()
 		s.log.Infof("WHEP Negotiation: peer=%s status=started offer=none answer=none", peerID)
 
-		ttl := time.Now().Add(PC_TIMEOUT)
+		country := s.geo.Lookup(viewerIP(r)).Country
 
-		peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		ttl := time.Now().Add(s.config.ResourceTTL)
+
+		pooled, err := s.pool.get()
 		if err != nil {
 			s.log.Error(err)
 			errCustom(w, r, "error establishing webrtc connection")
 			return
 		}
+		peerConnection := pooled.pc
+		// Viewers are audited once each way, however many states they go through
+		sourceIP := viewerIP(r).String()
+		var viewerConnected, viewerDisconnected int32
+		auditViewer := func(event string) {
+			s.control.Audit(control.AuditEntry{Event: event, ChannelID: control.ChannelID(channelID), SourceIP: sourceIP})
+		}
+		auditDisconnect := func() {
+			if atomic.LoadInt32(&viewerConnected) == 1 && atomic.CompareAndSwapInt32(&viewerDisconnected, 0, 1) {
+				auditViewer(control.AuditViewerDisconnect)
+			}
+		}
 		peerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
 			// Clean up our peer connection state
 			// Maybe we don't really worry about the cleanup happening since its a no-op
 
 			switch pcs {
+			case webrtc.PeerConnectionStateConnected:
+				s.addViewer(peerID, country)
+				s.markConnected(peerID)
+				if atomic.CompareAndSwapInt32(&viewerConnected, 0, 1) {
+					auditViewer(control.AuditViewerConnect)
+				}
 			case webrtc.PeerConnectionStateClosed:
+				auditDisconnect()
 				s.cleanupPeerConnection(peerID)
 			case webrtc.PeerConnectionStateDisconnected:
+				auditDisconnect()
 				s.cleanupPeerConnection(peerID)
 			case webrtc.PeerConnectionStateFailed:
+				auditDisconnect()
 				s.cleanupPeerConnection(peerID)
 			}
 		})
@@ -129,7 +292,19 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 		// 		fmt.Printf("Message from DataChannel '%s': '%s'\n", d.Label(), string(msg.Data))
 		// 	})
 		// })
+		if s.config.ICECandidateLogging {
+			s.logICECandidates(peerID, peerConnection)
+		}
 		peerConnection.CreateDataChannel("debug", nil)
+		if s.config.DataChannelChat {
+			if err := s.setupChatChannel(control.ChannelID(channelID), peerID, peerConnection); err != nil {
+				s.log.Error(err)
+				// Not tracked yet, nothing else would close it
+				peerConnection.Close()
+				errCustom(w, r, "error creating chat data channel")
+				return
+			}
+		}
 		peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
 			d.OnOpen(func() {
 				s.log.Debugf("Debug data channel '%s'-'%d' open", d.Label(), d.ID())
@@ -147,13 +322,11 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 			})
 		})
 
-		// Importantly, the track needs to be added before the offer (duh!)
-		tracks, err := s.control.GetTracks(control.ChannelID(channelID))
-		if err != nil {
-			errNotFound(w, r)
-			return
-		}
 		for _, track := range tracks {
+			// Tracks meant for other outputs, eg passed through AAC
+			if !s.supportsCodec(track.Codec) {
+				continue
+			}
 			rtpSender, _ := peerConnection.AddTrack(track.Track)
 			go func() {
 				// _ := s.log.WithField("peer", peerID)
@@ -198,25 +371,37 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 			}()
 		}
 
-		s.addPeerConnection(peerID, peerConnection)
+		s.addPeerConnection(peerID, peerConnection, &viewerSession{channelID: control.ChannelID(channelID), country: country})
+		s.watchBandwidthEstimate(peerID, pooled.estimator)
 		s.startPeerConnectionTimeout(peerID)
 
 		// Used for SDP offer generated by the WHEP endpoint
 		offer, err := peerConnection.CreateOffer(nil)
 		if err != nil {
 			s.log.Error(err)
+			s.cleanupPeerConnection(peerID)
 			errCustom(w, r, "error creating offer")
 			return
 		}
 		gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+		gatherStarted := time.Now()
 		if err = peerConnection.SetLocalDescription(offer); err != nil {
 			s.log.Error(err)
+			s.cleanupPeerConnection(peerID)
 			errCustom(w, r, "error setting local description")
 			return
 		}
-		<-gatherComplete
+		select {
+		case <-gatherComplete:
+		case <-time.After(s.config.ICEGatheringTimeout):
+			s.log.Warn("ICE gathering timed out, using partial candidates")
+		}
+		iceGatheringDuration.Observe(time.Since(gatherStarted).Seconds())
 
 		localDescription := peerConnection.LocalDescription()
+		if !hasNonHostCandidate(localDescription.SDP) {
+			iceNoSrflx.Inc()
+		}
 		s.log.Infof("WHEP Negotiation: peer=%s status=negotiating offer=created answer=none", peerID)
 
 		w.Header().Add("Access-Control-Expose-Headers", "location, expire")
@@ -233,14 +418,18 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 	// Player (Nothing) => Endpoint (Offer) => Player (Answer)
 	// This function actually finishes the SDP handshake
 	// After this the WebRTC connection should be established
-	s.control.RegisterHandleFunc("/whep/resource/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+	s.handle("/whep/resource/", func(w http.ResponseWriter, r *http.Request) {
+		s.setCORSHeaders(w, r)
 		if r.Method == http.MethodOptions {
-			w.Header().Add("Access-Control-Allow-Methods", "PATCH")
-			w.Header().Add("Allow", "PATCH")
+			w.Header().Add("Access-Control-Allow-Methods", "PATCH, POST")
+			w.Header().Add("Allow", "PATCH, POST")
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
+		if strings.HasSuffix(r.URL.Path, "/refresh") {
+			s.refreshResource(w, r)
+			return
+		}
 		unsafePcID := path.Base(r.URL.Path)
 
 		body, err := io.ReadAll(r.Body)
@@ -259,6 +448,17 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 			return
 		}
 
+		offer := pc.LocalDescription()
+		if offer == nil {
+			errCustom(w, r, "peer connection has no offer")
+			return
+		}
+		if err := validateSDPAnswer(*offer, answer); err != nil {
+			s.log.Debugf("Rejected answer from peer %s: %s", unsafePcID, err)
+			errCustom(w, r, err.Error())
+			return
+		}
+
 		if err = pc.SetRemoteDescription(answer); err != nil {
 			s.log.Error(err)
 			errCustom(w, r, "error setting remote description")
@@ -277,22 +477,54 @@ func (s *WHEPServer) Listen(ctx context.Context) {
 		fmt.Fprintf(w, "")
 	})
 
-	s.control.RegisterHandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
-		channelID := path.Base(r.URL.Path)
-		data := struct {
-			ChannelID   string
-			EndpointUrl template.HTML
-		}{ChannelID: channelID, EndpointUrl: template.HTML(s.endpointUrl(channelID))}
+	s.handle("/whep/viewers/geo", s.viewersGeoHandler)
+	// An API endpoint, so it stays on the control server behind the API token
+	s.control.RegisterHandleFunc(viewerExportPattern, s.control.RequireAPIToken(s.viewerExportHandler))
+	s.patterns = append(s.patterns, viewerExportPattern)
+	if s.config.DataChannelChat {
+		if !s.control.HasAPIToken() {
+			s.log.Warnf("data_channel_chat is on without a control api_token, anyone can message viewers")
+		}
+		s.handle("/whep/chat/", s.control.RequireAPIToken(s.chatHandler))
+	}
 
-		streamTemplate.Execute(w, data)
-	})
+	s.handle("/stream/", s.streamHandler)
 }
 
-func (s *WHEPServer) addPeerConnection(uuid string, pc *webrtc.PeerConnection) {
+// getTracks returns the tracks of a channel, waiting for the stream to start
+// if WaitForStream is enabled. The wait ends early if the client goes away.
+func (s *WHEPServer) getTracks(ctx context.Context, channelID control.ChannelID) ([]control.StreamTrack, error) {
+	tracks, err := s.control.GetTracks(channelID)
+	if !s.config.WaitForStream || (err == nil && len(tracks) > 0) {
+		return tracks, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.WaitTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+			tracks, err = s.control.GetTracks(channelID)
+			if err == nil && len(tracks) > 0 {
+				return tracks, nil
+			}
+		}
+	}
+}
+
+func (s *WHEPServer) addPeerConnection(uuid string, pc *webrtc.PeerConnection, session *viewerSession) {
 	s.peerConnectionsMutex.Lock()
 	defer s.peerConnectionsMutex.Unlock()
 
 	s.peerConnections[uuid] = pc
+	s.lastRefreshed[uuid] = time.Now()
+	s.sessions[uuid] = session
 }
 func (s *WHEPServer) getPeerConnection(uuid string) (*webrtc.PeerConnection, bool) {
 	s.peerConnectionsMutex.RLock()
@@ -301,17 +533,97 @@ func (s *WHEPServer) getPeerConnection(uuid string) (*webrtc.PeerConnection, boo
 	val, ok := s.peerConnections[uuid]
 	return val, ok
 }
+
+// SupportedCodecs lists what browsers can be sent over WebRTC
+func (s *WHEPServer) SupportedCodecs() []string {
+	return []string{webrtc.MimeTypeH264, webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeAV1, webrtc.MimeTypeOpus}
+}
+
+func (s *WHEPServer) supportsCodec(codec string) bool {
+	for _, supported := range s.SupportedCodecs() {
+		if strings.EqualFold(supported, codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceTrack swaps a track on every peer connection sending it, so viewers
+// stay connected through codec or quality changes
+func (s *WHEPServer) ReplaceTrack(channelID control.ChannelID, oldTrack, newTrack control.StreamTrack) error {
+	s.peerConnectionsMutex.RLock()
+	defer s.peerConnectionsMutex.RUnlock()
+
+	failed := 0
+	for uuid, pc := range s.peerConnections {
+		for _, sender := range pc.GetSenders() {
+			if sender.Track() != oldTrack.Track {
+				continue
+			}
+			if err := sender.ReplaceTrack(newTrack.Track); err != nil {
+				s.log.Warnf("Failed to replace track for peer %s: %s", uuid, err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to replace the %s track on %d peer connections", newTrack.Type, failed)
+	}
+
+	return nil
+}
+
 func (s *WHEPServer) startPeerConnectionTimeout(uuid string) {
 	go func() {
-		time.Sleep(PC_TIMEOUT)
+		for {
+			s.peerConnectionsMutex.RLock()
+			pc, ok := s.peerConnections[uuid]
+			expiry := s.lastRefreshed[uuid].Add(s.config.ResourceTTL)
+			s.peerConnectionsMutex.RUnlock()
+			if !ok {
+				return
+			}
 
-		pc, ok := s.getPeerConnection(uuid)
-		if ok && pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
-			s.log.Infof("Peer %s took too long to connect, rejecting peer.", uuid)
-			s.cleanupPeerConnection(uuid)
+			// Refreshed while we were asleep
+			if wait := time.Until(expiry); wait > 0 {
+				time.Sleep(wait)
+				continue
+			}
+
+			if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+				s.log.Infof("Peer %s took too long to connect, rejecting peer.", uuid)
+				s.cleanupPeerConnection(uuid)
+			}
+			return
 		}
 	}()
 }
+
+// refreshResource handles POST /whep/resource/{id}/refresh, extending the
+// resource by another ResourceTTL for as long as the peer is still around
+func (s *WHEPServer) refreshResource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	uuid := path.Base(strings.TrimSuffix(r.URL.Path, "/refresh"))
+
+	s.peerConnectionsMutex.Lock()
+	_, ok := s.peerConnections[uuid]
+	now := time.Now()
+	if ok {
+		s.lastRefreshed[uuid] = now
+	}
+	s.peerConnectionsMutex.Unlock()
+	if !ok {
+		errNotFound(w, r)
+		return
+	}
+
+	w.Header().Add("Access-Control-Expose-Headers", "expire")
+	w.Header().Add("Expire", now.Add(s.config.ResourceTTL).Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
 func (s *WHEPServer) cleanupPeerConnection(uuid string) {
 	s.peerConnectionsMutex.Lock()
 	defer s.peerConnectionsMutex.Unlock()
@@ -321,13 +633,32 @@ func (s *WHEPServer) cleanupPeerConnection(uuid string) {
 	}
 
 	delete(s.peerConnections, uuid)
+	delete(s.lastRefreshed, uuid)
+	delete(s.sessions, uuid)
+	viewerBandwidthEstimate.DeleteLabelValues(uuid)
+	s.removeViewer(uuid)
+	s.closeChatChannel(uuid)
+}
+
+// hasNonHostCandidate reports whether an SDP has any server reflexive or relay
+// candidates, without them only clients on the same network can connect
+func hasNonHostCandidate(sdp string) bool {
+	for _, line := range strings.Split(sdp, "\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		if strings.Contains(line, " typ srflx") || strings.Contains(line, " typ relay") {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *WHEPServer) endpointUrl(channelID string) string {
-	return fmt.Sprintf("%s/whep/endpoint/%s", s.control.HttpServerUrl(), channelID)
+	return fmt.Sprintf("%s/whep/endpoint/%s", s.serverUrl(), channelID)
 }
 func (s *WHEPServer) resourceUrl(uuid string) string {
-	return fmt.Sprintf("%s/whep/resource/%s", s.control.HttpServerUrl(), uuid)
+	return fmt.Sprintf("%s/whep/resource/%s", s.serverUrl(), uuid)
 }
 
 func logRequest(log logrus.FieldLogger, handler http.Handler) http.Handler {
@@ -347,6 +678,11 @@ func errWrongParams(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text")
 	w.Write([]byte("Invalid Parameters"))
 }
+func errUnauthorized(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "plain/text")
+	w.Write([]byte("Unauthorized"))
+}
 func errNotFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	w.Header().Set("Content-Type", "plain/text")
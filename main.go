@@ -2,30 +2,42 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/Glimesh/waveguide/internal/config"
 	"github.com/Glimesh/waveguide/internal/inputs/fs"
 	"github.com/Glimesh/waveguide/internal/inputs/ftl"
 	"github.com/Glimesh/waveguide/internal/inputs/janus"
+	"github.com/Glimesh/waveguide/internal/inputs/mpegts"
 	"github.com/Glimesh/waveguide/internal/inputs/rtmp"
+	"github.com/Glimesh/waveguide/internal/inputs/rtsp"
 	"github.com/Glimesh/waveguide/internal/inputs/whip"
 	"github.com/Glimesh/waveguide/internal/outputs/hls"
+	"github.com/Glimesh/waveguide/internal/outputs/relay"
 	"github.com/Glimesh/waveguide/internal/outputs/whep"
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/Glimesh/waveguide/pkg/orchestrators/dummy_orchestrator"
 	"github.com/Glimesh/waveguide/pkg/orchestrators/rt_orchestrator"
 	"github.com/Glimesh/waveguide/pkg/services/dummy_service"
 	"github.com/Glimesh/waveguide/pkg/services/glimesh"
+	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// How long to wait for streams to stop after receiving a signal, on top of
+// the time in-flight http requests get to finish
+const shutdownTimeout = control.HTTPShutdownTimeout + 10*time.Second
+
 func main() {
+	configPath := flag.String("config", "", "path to the config file, overrides WAVEGUIDE_CONFIG_FILE")
+	flag.Parse()
+
 	log := logrus.New()
 
 	hostname, err := os.Hostname()
@@ -35,19 +47,31 @@ func main() {
 	}
 	log.Debugf("Server Hostname: %s", hostname)
 
-	viper.SetConfigName("config")
-	viper.SetConfigType("toml")
-	viper.AddConfigPath(".")
+	if *configPath == "" {
+		*configPath = os.Getenv("WAVEGUIDE_CONFIG_FILE")
+	}
+	if *configPath != "" {
+		viper.SetConfigFile(*configPath)
+	} else {
+		// config.toml in the working directory, then the system and user configs
+		viper.SetConfigName("config")
+		viper.SetConfigType("toml")
+		viper.AddConfigPath(".")
+		viper.AddConfigPath("/etc/waveguide")
+		viper.AddConfigPath("$HOME/.waveguide")
+	}
 	viper.SetDefault("control.log_level", "info")
 	err = viper.ReadInConfig()
 	if err != nil {
 		log.Fatal(fmt.Errorf("fatal error config file: %w", err))
 	}
-
-	// Temporary for debugging
-	go func() {
-		log.Println(http.ListenAndServe(":6060", nil))
-	}()
+	log.Infof("Loaded config from %s", viper.ConfigFileUsed())
+	if errs := config.Validate(viper.GetViper()); len(errs) > 0 {
+		for _, err := range errs {
+			log.Errorf("invalid config: %s", err)
+		}
+		os.Exit(1)
+	}
 
 	level, err := logrus.ParseLevel(viper.GetString("control.log_level"))
 	if err != nil {
@@ -55,6 +79,10 @@ func main() {
 	}
 	log.SetLevel(level)
 
+	var controlConfig control.Config
+	unmarshalConfig("control", &controlConfig)
+	controlConfig.Hostname = hostname
+
 	var service control.Service
 	switch viper.GetString("control.service") {
 	case "dummy":
@@ -64,36 +92,52 @@ func main() {
 		unmarshalConfig("service.glimesh", &glimeshConfig)
 		service = glimesh.New(glimeshConfig)
 	}
+	if viper.IsSet("control.service_retry") {
+		var retryConfig control.RetryServiceConfig
+		unmarshalConfig("control.service_retry", &retryConfig)
+		service = control.NewRetryService(service, retryConfig)
+	}
 	service.SetLogger(log.WithFields(logrus.Fields{
 		"service": service.Name(),
 	}))
-	service.Connect()
+	if err := control.ConnectService(service, log, controlConfig.MaxConnectDuration); err != nil {
+		log.Fatal(err)
+	}
 
 	var orchestrator control.Orchestrator
 	switch viper.GetString("control.orchestrator") {
-	case "dummy":
-		orchestrator = dummy_orchestrator.New(dummy_orchestrator.Config{}, hostname)
-	case "rt":
-		var rtConfig rt_orchestrator.Config
-		unmarshalConfig("orchestrator.rtrouter", &rtConfig)
-		orchestrator = rt_orchestrator.New(rtConfig, hostname)
+	case "chain":
+		// Ordered by priority, eg orchestrators = ["rt", "dummy"]
+		var chain []control.Orchestrator
+		for _, orchestratorType := range viper.GetStringSlice("orchestrator.chain.orchestrators") {
+			chain = append(chain, newOrchestrator(log, orchestratorType, hostname))
+		}
+		orchestrator = control.NewChainOrchestrator(chain)
+	default:
+		orchestrator = newOrchestrator(log, viper.GetString("control.orchestrator"), hostname)
 	}
 	orchestrator.SetLogger(log.WithFields(logrus.Fields{
 		"orchestrator": orchestrator.Name(),
 	}))
-	orchestrator.Connect()
 
-	var controlConfig control.Config
-	unmarshalConfig("control", &controlConfig)
-	controlConfig.Hostname = hostname
+	if err := control.ConnectOrchestrator(orchestrator, log, controlConfig.MaxConnectDuration); err != nil {
+		log.Fatal(err)
+	}
 	ctrl := control.New(controlConfig)
 	ctrl.SetService(service)
 	ctrl.SetOrchestrator(orchestrator)
 	ctrl.SetLogger(log.WithFields(logrus.Fields{
 		"control": "waveguide",
 	}))
+	go ctrl.StartPProfServer()
+	ctrl.RecoverOrchestratorStreams()
+	ctrl.EndRecoveredStreams()
+
+	// Cancelled on SIGINT/SIGTERM, which stops every stream started from it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	ctx := context.Background()
+	go ctrl.MonitorOrchestrator(ctx)
 	for inputName := range viper.GetStringMap("input") {
 		inputType := viper.GetString(fmt.Sprintf("input.%s.type", inputName))
 		configKey := fmt.Sprintf("input.%s", inputName)
@@ -119,48 +163,121 @@ func main() {
 			input = ftl.New(ftlConfig)
 		case "whip":
 			var whipConfig whip.WHIPSourceConfig
-			unmarshalConfig(configKey, whipConfig)
+			unmarshalConfig(configKey, &whipConfig)
 			input = whip.New(whipConfig)
+		case "mpegts":
+			var mpegtsConfig mpegts.MPEGTSSourceConfig
+			unmarshalConfig(configKey, &mpegtsConfig)
+			input = mpegts.New(mpegtsConfig)
+		case "rtsp":
+			var rtspConfig rtsp.RTSPSourceConfig
+			unmarshalConfig(configKey, &rtspConfig)
+			input = rtsp.New(rtspConfig)
 		default:
 			log.Fatalf("could not find input type %s", inputType)
 		}
 		input.SetControl(ctrl)
-		input.SetLogger(log.WithFields(logrus.Fields{"input": inputType}))
+		input.SetLogger(ctrl.ComponentLogger("input."+inputType, logrus.Fields{"input": inputType}))
 		go input.Listen(ctx)
 	}
 
+	// Outputs can also be added and removed later through /api/v1/outputs
+	ctrl.SetOutputFactory(func(outputType string, config map[string]interface{}) (control.Output, error) {
+		return newOutput(outputType, func(c interface{}) error {
+			return decodeConfig(config, c)
+		})
+	})
 	for outputName := range viper.GetStringMap("output") {
-		outputType := viper.Get(fmt.Sprintf("output.%s.type", outputName))
+		outputType := viper.GetString(fmt.Sprintf("output.%s.type", outputName))
 		configKey := fmt.Sprintf("output.%s", outputName)
 
-		var output control.Output
-
-		switch outputType {
-		case "hls":
-			var hlsConfig hls.HLSConfig
-			unmarshalConfig(configKey, &hlsConfig)
-			output = hls.New(hlsConfig)
-		case "whep":
-			var whepConfig whep.WHEPConfig
-			unmarshalConfig(configKey, &whepConfig)
-			output = whep.New(whepConfig)
+		output, err := newOutput(outputType, func(c interface{}) error {
+			return viper.UnmarshalKey(configKey, c)
+		})
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		output.SetControl(ctrl)
-		output.SetLogger(log.WithFields(logrus.Fields{"output": outputName}))
-		go output.Listen(ctx)
+		output.SetLogger(ctrl.ComponentLogger(fmt.Sprintf("output.%s", outputType), logrus.Fields{"output": outputName}))
+		if err := ctrl.RegisterOutput(outputName, output); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
 	go func() {
-		<-c
+		defer close(shutdownDone)
+		<-ctx.Done()
 		log.Info("Exiting Waveguide and cleaning up")
-		ctrl.Shutdown()
-		os.Exit(0)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := ctrl.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Streams did not stop cleanly: %+v", err)
+		}
 	}()
 
+	// Returns as soon as Shutdown stops the http server, streams are still
+	// being stopped after that
 	ctrl.StartHTTPServer()
+	<-shutdownDone
+}
+
+func newOrchestrator(log logrus.FieldLogger, orchestratorType string, hostname string) control.Orchestrator {
+	switch orchestratorType {
+	case "dummy":
+		return dummy_orchestrator.New(dummy_orchestrator.Config{}, hostname)
+	case "rt":
+		var rtConfig rt_orchestrator.Config
+		unmarshalConfig("orchestrator.rtrouter", &rtConfig)
+		return rt_orchestrator.New(rtConfig, hostname)
+	}
+
+	log.Fatalf("could not find orchestrator type %s", orchestratorType)
+	return nil
+}
+
+func newOutput(outputType string, decode func(config interface{}) error) (control.Output, error) {
+	switch outputType {
+	case "hls":
+		var hlsConfig hls.HLSConfig
+		if err := decode(&hlsConfig); err != nil {
+			return nil, err
+		}
+		return hls.New(hlsConfig), nil
+	case "whep":
+		var whepConfig whep.WHEPConfig
+		if err := decode(&whepConfig); err != nil {
+			return nil, err
+		}
+		return whep.New(whepConfig), nil
+	case "relay":
+		var relayConfig relay.RelayConfig
+		if err := decode(&relayConfig); err != nil {
+			return nil, err
+		}
+		return relay.New(relayConfig), nil
+	}
+
+	return nil, fmt.Errorf("could not find output type %s", outputType)
+}
+
+// decodeConfig fills a component config from plain values, eg a JSON body,
+// the same way viper does from the config file
+func decodeConfig(input map[string]interface{}, config interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           config,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
 }
 
 func unmarshalConfig(configKey string, config interface{}) {
@@ -0,0 +1,65 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const abuseReportTimeout = 5 * time.Second
+
+type abuseReport struct {
+	ChannelID ChannelID `json:"channel_id"`
+	StreamID  StreamID  `json:"stream_id"`
+	SourceIP  string    `json:"source_ip"`
+	Reason    string    `json:"reason"`
+}
+
+// ReportAbuse tells AbuseReportURL, when it's configured, that an input is
+// cutting a stream off and why, eg bandwidth_limit. It doesn't block.
+func (mgr *Control) ReportAbuse(channelID ChannelID, reason string) {
+	if mgr.config.AbuseReportURL == "" {
+		return
+	}
+
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		mgr.log.Warnf("Not sending %s abuse report for %s: %s", reason, channelID, err)
+		return
+	}
+	report := abuseReport{
+		ChannelID: stream.ChannelID,
+		StreamID:  stream.StreamID,
+		SourceIP:  stream.sourceIP,
+		Reason:    reason,
+	}
+
+	go func() {
+		if err := mgr.sendAbuseReport(report); err != nil {
+			stream.log.Errorf("Failed sending %s abuse report: %+v", reason, err)
+			return
+		}
+		stream.log.Infof("Sent %s abuse report for %s", reason, report.SourceIP)
+	}()
+}
+
+func (mgr *Control) sendAbuseReport(report abuseReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: abuseReportTimeout}
+	resp, err := client.Post(mgr.config.AbuseReportURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("abuse report returned status %d", resp.StatusCode)
+	}
+	return nil
+}
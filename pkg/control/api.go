@@ -0,0 +1,107 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type streamHandlerFunc func(w http.ResponseWriter, r *http.Request, stream *Stream)
+
+// registerAPIHandlers registers the control API on the shared http mux
+func (mgr *Control) registerAPIHandlers() {
+	// Metadata has the broadcaster's IP and whereabouts, and thumbnails are
+	// decoded and can be uploaded to the service on request, so they need the
+	// api_token
+	streamHandlers := map[string]streamHandlerFunc{
+		"bandwidth":        mgr.apiStreamBandwidth,
+		"health":           mgr.apiStreamHealth,
+		"metadata":         mgr.requireAPIToken(mgr.apiStreamMetadata),
+		"metadata/history": mgr.requireAPIToken(mgr.apiStreamMetadataHistory),
+		"ssrc":             mgr.apiStreamSSRC,
+		"thumbnail":        mgr.requireAPIToken(mgr.apiStreamThumbnail),
+	}
+
+	// /api/v1/streams/{channelID}/{resource}
+	mgr.httpMux.HandleFunc("/api/v1/streams/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/streams/"), "/"), "/", 2)
+		if len(parts) != 2 {
+			apiError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		channelID, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid channel id")
+			return
+		}
+
+		handler, ok := streamHandlers[parts[1]]
+		if !ok {
+			apiError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		stream, err := mgr.getStream(ChannelID(channelID))
+		if err != nil {
+			apiError(w, http.StatusNotFound, "stream not found")
+			return
+		}
+
+		handler(w, r, stream)
+	})
+
+	mgr.httpMux.HandleFunc("/api/v1/log_level", mgr.RequireAPIToken(mgr.apiLogLevel))
+	mgr.httpMux.HandleFunc("/api/v1/outputs", mgr.RequireAPIToken(mgr.apiOutputs))
+	mgr.httpMux.HandleFunc("/api/v1/outputs/", mgr.RequireAPIToken(mgr.apiOutputs))
+	mgr.httpMux.HandleFunc("/api/v1/viewer-token/", mgr.RequireAPIToken(mgr.apiViewerToken))
+}
+
+// requireAPIToken is RequireAPIToken for the handlers under /api/v1/streams/
+func (mgr *Control) requireAPIToken(handler streamHandlerFunc) streamHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, stream *Stream) {
+		mgr.RequireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, stream)
+		})(w, r)
+	}
+}
+
+func (mgr *Control) apiStreamHealth(w http.ResponseWriter, r *http.Request, stream *Stream) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	score, dimensions := stream.health.get()
+	apiJSON(w, http.StatusOK, struct {
+		Score      int              `json:"score"`
+		Dimensions HealthDimensions `json:"dimensions"`
+	}{score, dimensions})
+}
+
+func (mgr *Control) apiStreamMetadata(w http.ResponseWriter, r *http.Request, stream *Stream) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	metadata := mgr.streamMetadata(stream)
+	if !mgr.HasAPIToken() {
+		// Anyone can read it without a token
+		metadata = metadata.public()
+	}
+	apiJSON(w, http.StatusOK, metadata)
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	apiJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
@@ -0,0 +1,101 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// apiRequest sends a request to the control API, with token as the bearer
+// token if it's set
+func apiRequest(mgr *Control, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mgr.httpMux.ServeHTTP(w, req)
+	return w
+}
+
+func newMetadataTestControl(t *testing.T, apiToken string) *Control {
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+	mgr.config.APIToken = apiToken
+
+	stream, err := mgr.newStream(context.Background(), 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.ReportMetadata(SourceIPMetadata(net.ParseIP("203.0.113.7")))
+	stream.sourceCity = "Springfield"
+	stream.sourceASN = 64496
+	mgr.recordMetadataHistory(stream)
+	return mgr
+}
+
+func TestStreamMetadataRequiresAPIToken(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newMetadataTestControl(t, "secret")
+
+	for _, path := range []string{"/api/v1/streams/1/metadata", "/api/v1/streams/1/metadata/history"} {
+		assert.Equal(http.StatusUnauthorized, apiRequest(mgr, http.MethodGet, path, "").Code, path)
+		assert.Equal(http.StatusUnauthorized, apiRequest(mgr, http.MethodGet, path, "wrong").Code, path)
+	}
+
+	w := apiRequest(mgr, http.MethodGet, "/api/v1/streams/1/metadata", "secret")
+	assert.Equal(http.StatusOK, w.Code)
+	var metadata StreamMetadata
+	assert.NoError(json.NewDecoder(w.Body).Decode(&metadata))
+	assert.Equal("203.0.113.7", metadata.SourceIP)
+	assert.Equal("Springfield", metadata.SourceCity)
+
+	w = apiRequest(mgr, http.MethodGet, "/api/v1/streams/1/metadata/history", "secret")
+	assert.Equal(http.StatusOK, w.Code)
+	var history []TimestampedMetadata
+	assert.NoError(json.NewDecoder(w.Body).Decode(&history))
+	if assert.Len(history, 1) {
+		assert.Equal("203.0.113.7", history[0].SourceIP)
+	}
+}
+
+func TestStreamMetadataWithoutAPIToken(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newMetadataTestControl(t, "")
+
+	w := apiRequest(mgr, http.MethodGet, "/api/v1/streams/1/metadata", "")
+	assert.Equal(http.StatusOK, w.Code)
+	var metadata StreamMetadata
+	assert.NoError(json.NewDecoder(w.Body).Decode(&metadata))
+	assert.Empty(metadata.SourceIP)
+	assert.Empty(metadata.SourceCity)
+	assert.Zero(metadata.SourceASN)
+
+	w = apiRequest(mgr, http.MethodGet, "/api/v1/streams/1/metadata/history", "")
+	assert.Equal(http.StatusOK, w.Code)
+	var history []TimestampedMetadata
+	assert.NoError(json.NewDecoder(w.Body).Decode(&history))
+	if assert.Len(history, 1) {
+		assert.Empty(history[0].SourceIP)
+		assert.Empty(history[0].SourceCity)
+	}
+
+	// The stored history keeps them for the service
+	stream, _ := mgr.getStream(1)
+	assert.Equal("203.0.113.7", stream.MetadataHistory(0)[0].SourceIP)
+}
+
+func TestStreamThumbnailRequiresAPIToken(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newMetadataTestControl(t, "secret")
+
+	assert.Equal(http.StatusUnauthorized, apiRequest(mgr, http.MethodPost, "/api/v1/streams/1/thumbnail?upload=true", "").Code)
+	assert.Equal(http.StatusUnauthorized, apiRequest(mgr, http.MethodPost, "/api/v1/streams/1/thumbnail", "wrong").Code)
+
+	// There's no keyframe to decode yet
+	assert.Equal(http.StatusNoContent, apiRequest(mgr, http.MethodPost, "/api/v1/streams/1/thumbnail", "secret").Code)
+}
@@ -0,0 +1,199 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events written to the audit log
+const (
+	AuditStreamStart      = "stream.start"
+	AuditStreamStop       = "stream.stop"
+	AuditAuthFail         = "auth.fail"
+	AuditThumbnailSent    = "thumbnail.sent"
+	AuditHeartbeatFail    = "heartbeat.fail"
+	AuditViewerConnect    = "viewer.connect"
+	AuditViewerDisconnect = "viewer.disconnect"
+)
+
+const (
+	DefaultAuditLogMaxSizeMB = 100
+
+	auditLogFlushInterval = time.Second
+)
+
+// AuditEntry is one line of the audit log, empty fields are left out
+type AuditEntry struct {
+	Time      time.Time `json:"ts"`
+	Event     string    `json:"event"`
+	ChannelID ChannelID `json:"channel_id,omitempty"`
+	StreamID  StreamID  `json:"stream_id,omitempty"`
+	SourceIP  string    `json:"source_ip,omitempty"`
+	Input     string    `json:"input,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// auditLog writes JSON lines to a file, buffered and flushed every second.
+// Once the file grows past maxSize it's renamed with a timestamp suffix and
+// a new one is started.
+type auditLog struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	done    chan struct{}
+}
+
+func newAuditLog(path string, maxSizeMB int) (*auditLog, error) {
+	a := &auditLog{
+		path:    path,
+		maxSize: int64(maxSizeMB) * 1024 * 1024,
+		done:    make(chan struct{}),
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	go a.flushLoop()
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.writer = bufio.NewWriter(file)
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		return os.ErrClosed
+	}
+	if a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.writer.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one, the caller has
+// to hold the lock
+func (a *auditLog) rotate() error {
+	if err := a.writer.Flush(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", a.path, time.Now().UTC().Format("20060102T150405.000"))
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) flushLoop() {
+	ticker := time.NewTicker(auditLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.mutex.Lock()
+			if a.writer != nil {
+				a.writer.Flush()
+			}
+			a.mutex.Unlock()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *auditLog) close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	close(a.done)
+	a.writer.Flush()
+	err := a.file.Close()
+	a.file = nil
+	a.writer = nil
+	return err
+}
+
+// Audit writes an entry to the audit log, if one is configured. The time is
+// filled in when it's left unset.
+func (mgr *Control) Audit(entry AuditEntry) {
+	if mgr.auditLog == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if err := mgr.auditLog.write(entry); err != nil {
+		mgr.log.Errorf("Failed writing audit log: %+v", err)
+	}
+}
+
+// auditEvents records streams starting and stopping in the audit log
+func (mgr *Control) auditEvents(event StreamEvent) error {
+	entry := AuditEntry{
+		ChannelID: event.ChannelID,
+		StreamID:  event.StreamID,
+		SourceIP:  event.Metadata["source_ip"],
+		Input:     event.Metadata["input"],
+	}
+	switch event.Type {
+	case EventStreamStarted:
+		entry.Event = AuditStreamStart
+	case EventStreamStopped:
+		entry.Event = AuditStreamStop
+	default:
+		return nil
+	}
+
+	mgr.Audit(entry)
+	return nil
+}
+
+// auditMetadata is what the audit log wants to know about a stream, passed
+// along with its events
+func auditMetadata(stream *Stream) map[string]string {
+	return map[string]string{
+		"source_ip": stream.sourceIP,
+		"input":     stream.input,
+	}
+}
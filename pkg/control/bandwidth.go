@@ -0,0 +1,117 @@
+package control
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Seconds of received bandwidth kept for each stream
+const bandwidthHistorySeconds = 60
+
+// BandwidthSampler counts the bytes an input receives per second, keeping
+// the last minute in a ring buffer indexed by the unix second
+type BandwidthSampler struct {
+	mutex sync.Mutex
+	bytes [bandwidthHistorySeconds]int64
+	// The second each slot was last written in, so slots left over from a
+	// minute ago read as nothing received
+	seconds [bandwidthHistorySeconds]int64
+}
+
+type BandwidthSample struct {
+	Timestamp     int64 `json:"timestamp"`
+	BitsPerSecond int64 `json:"bps"`
+}
+
+type BandwidthHistory struct {
+	Samples []BandwidthSample `json:"samples"`
+	AvgBps  int64             `json:"avg_bps"`
+	MaxBps  int64             `json:"max_bps"`
+	MinBps  int64             `json:"min_bps"`
+	P95Bps  int64             `json:"p95_bps"`
+}
+
+// Add counts bytes received now
+func (b *BandwidthSampler) Add(n int) {
+	now := time.Now().Unix()
+	i := now % bandwidthHistorySeconds
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.seconds[i] != now {
+		b.seconds[i] = now
+		b.bytes[i] = 0
+	}
+	b.bytes[i] += int64(n)
+}
+
+// History returns the last minute of complete seconds, oldest first, along
+// with their statistics
+func (b *BandwidthSampler) History() BandwidthHistory {
+	now := time.Now().Unix()
+
+	b.mutex.Lock()
+	samples := make([]BandwidthSample, 0, bandwidthHistorySeconds)
+	for second := now - bandwidthHistorySeconds; second < now; second++ {
+		i := second % bandwidthHistorySeconds
+		sample := BandwidthSample{Timestamp: second}
+		if b.seconds[i] == second {
+			sample.BitsPerSecond = b.bytes[i] * 8
+		}
+		samples = append(samples, sample)
+	}
+	b.mutex.Unlock()
+
+	history := BandwidthHistory{Samples: samples}
+	sorted := make([]int64, len(samples))
+	var total int64
+	for i, sample := range samples {
+		sorted[i] = sample.BitsPerSecond
+		total += sample.BitsPerSecond
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	history.AvgBps = total / int64(len(sorted))
+	history.MinBps = sorted[0]
+	history.MaxBps = sorted[len(sorted)-1]
+	history.P95Bps = sorted[(len(sorted)*95+99)/100-1]
+	return history
+}
+
+// averageBps is the bitrate over the last few complete seconds, up to a minute
+func (b *BandwidthSampler) averageBps(seconds int64) int64 {
+	if seconds <= 0 || seconds > bandwidthHistorySeconds {
+		seconds = bandwidthHistorySeconds
+	}
+	now := time.Now().Unix()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var total int64
+	for second := now - seconds; second < now; second++ {
+		i := second % bandwidthHistorySeconds
+		if b.seconds[i] == second {
+			total += b.bytes[i]
+		}
+	}
+	return total * 8 / seconds
+}
+
+// AddReceivedBytes counts media received from the broadcaster towards the
+// stream's bandwidth history and its category's MaxBitrate
+func (s *Stream) AddReceivedBytes(n int) {
+	s.bandwidth.Add(n)
+}
+
+// apiStreamBandwidth serves the bitrate of every second in the last minute
+func (mgr *Control) apiStreamBandwidth(w http.ResponseWriter, r *http.Request, stream *Stream) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	apiJSON(w, http.StatusOK, stream.bandwidth.History())
+}
@@ -0,0 +1,87 @@
+package control
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+// Where GCC starts from before any feedback has come in, in bits per second
+const initialBandwidthEstimate = 1_000_000
+
+// BandwidthEstimator works out how much can be sent to a peer with Google
+// Congestion Control, from the transport-wide congestion control feedback
+// the peer sends
+type BandwidthEstimator = cc.BandwidthEstimator
+
+// estimatingAPI creates peer connections with a GCC interceptor. The
+// interceptor only hands its estimator over through a callback, so peer
+// connections are created one at a time to know whose it is.
+type estimatingAPI struct {
+	mutex     sync.Mutex
+	api       *webrtc.API
+	estimator cc.BandwidthEstimator
+}
+
+func newEstimatingAPI() (*estimatingAPI, error) {
+	m, err := newMediaEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	// Numbers outgoing packets with the TWCC header extension, the peer's
+	// feedback refers to them by it
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, err
+	}
+
+	a := &estimatingAPI{}
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// Only estimating, media goes out as it comes in rather than paced
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBandwidthEstimate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		a.estimator = estimator
+	})
+	i.Add(congestionController)
+
+	a.api = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	return a, nil
+}
+
+func (a *estimatingAPI) newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, BandwidthEstimator, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.estimator = nil
+	pc, err := a.api.NewPeerConnection(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, a.estimator, nil
+}
+
+// NewBandwidthEstimatedPeerConnection creates a peer connection with the
+// same codecs as GetWebRTCAPI, along with an estimate of the bandwidth to
+// the peer. The estimate only moves while RTCP is read from the senders.
+// The estimator is nil if bandwidth estimation couldn't be set up.
+func (mgr *Control) NewBandwidthEstimatedPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, BandwidthEstimator, error) {
+	if mgr.estimatingAPI == nil {
+		pc, err := mgr.webrtcAPI.NewPeerConnection(config)
+		return pc, nil, err
+	}
+	return mgr.estimatingAPI.newPeerConnection(config)
+}
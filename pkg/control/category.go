@@ -0,0 +1,99 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrCategoryLimitExceeded = errors.New("channel category limit exceeded")
+
+// CategoryConfig limits the streams of channels in a category, eg a free
+// tier. Unset (0) limits aren't enforced.
+type CategoryConfig struct {
+	// Combined audio and video bits per second, averaged over a heartbeat
+	MaxBitrate           int64 `mapstructure:"max_bitrate"`
+	MaxConcurrentStreams int   `mapstructure:"max_concurrent_streams"`
+	MaxResolutionHeight  int   `mapstructure:"max_resolution_height"`
+}
+
+// channelCategory looks up the category of a channel about to go live, it's
+// "" when there are no categories configured
+func (mgr *Control) channelCategory(channelID ChannelID) (string, error) {
+	if len(mgr.config.ChannelCategories) == 0 {
+		return "", nil
+	}
+
+	return mgr.service.GetChannelCategory(channelID)
+}
+
+// maxConcurrentStreams is how many live streams a category allows, 0 for any
+// number. Channels in categories without a config are left alone.
+func (mgr *Control) maxConcurrentStreams(category string) int {
+	if category == "" {
+		return 0
+	}
+	return mgr.config.ChannelCategories[category].MaxConcurrentStreams
+}
+
+// checkCategoryConcurrency refuses a stream when its category already has as
+// many streams live on this node as it allows. It's called with
+// streamsMutex held, so the count can't change before the stream is added.
+func (mgr *Control) checkCategoryConcurrency(category string) error {
+	max := mgr.maxConcurrentStreams(category)
+	if max <= 0 {
+		return nil
+	}
+
+	live := 0
+	for _, stream := range mgr.streams {
+		if stream.category == category {
+			live++
+		}
+	}
+	if live >= max {
+		return categoryConcurrencyError(category, max)
+	}
+	return nil
+}
+
+// reserveCategorySlot counts a stream towards its category across every node
+// sharing redis, refusing it when the category is full
+func (mgr *Control) reserveCategorySlot(stream *Stream) error {
+	max := mgr.maxConcurrentStreams(stream.category)
+	if mgr.redis == nil || max <= 0 {
+		return nil
+	}
+
+	reserved, err := mgr.redis.reserveCategorySlot(stream.ChannelID, stream.category, max)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return categoryConcurrencyError(stream.category, max)
+	}
+	return nil
+}
+
+func categoryConcurrencyError(category string, max int) error {
+	return fmt.Errorf("%w: category %q allows %d concurrent streams", ErrCategoryLimitExceeded, category, max)
+}
+
+// checkCategoryLimits compares what a live stream is sending against the
+// limits of its category
+func (mgr *Control) checkCategoryLimits(stream *Stream) error {
+	limits, ok := mgr.config.ChannelCategories[stream.category]
+	if stream.category == "" || !ok {
+		return nil
+	}
+
+	// What the input received over the last heartbeat, see AddReceivedBytes
+	bitrate := stream.bandwidth.averageBps(int64(heartbeatInterval / time.Second))
+	if limits.MaxBitrate > 0 && bitrate > limits.MaxBitrate {
+		return fmt.Errorf("%w: category %q allows %d bps, stream is sending %d bps", ErrCategoryLimitExceeded, stream.category, limits.MaxBitrate, bitrate)
+	}
+	if limits.MaxResolutionHeight > 0 && stream.videoHeight > limits.MaxResolutionHeight {
+		return fmt.Errorf("%w: category %q allows up to %dp, stream is %dp", ErrCategoryLimitExceeded, stream.category, limits.MaxResolutionHeight, stream.videoHeight)
+	}
+	return nil
+}
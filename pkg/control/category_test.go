@@ -0,0 +1,133 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCategoryTestControl(service Service, categories map[string]CategoryConfig) *Control {
+	mgr := newTestControl(service, &failingOrchestrator{})
+	mgr.config.ChannelCategories = categories
+	return mgr
+}
+
+func TestCategoryMaxConcurrentStreams(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newCategoryTestControl(&mockService{}, map[string]CategoryConfig{
+		"free": {MaxConcurrentStreams: 2},
+	})
+
+	// Publishes in one category racing each other only get as many as it allows
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = mgr.newStream(context.Background(), ChannelID(i+1), "free")
+		}(i)
+	}
+	wg.Wait()
+
+	started := 0
+	for _, err := range errs {
+		if err == nil {
+			started++
+		} else {
+			assert.ErrorIs(err, ErrCategoryLimitExceeded)
+		}
+	}
+	assert.Equal(2, started)
+	assert.Len(mgr.streams, 2)
+
+	// Other categories, and ones without limits, aren't affected
+	_, err := mgr.newStream(context.Background(), 100, "paid")
+	assert.NoError(err)
+	_, err = mgr.newStream(context.Background(), 101, "")
+	assert.NoError(err)
+
+	// Stopping a stream makes room for another
+	for channelID, stream := range mgr.streams {
+		if stream.category == "free" {
+			assert.NoError(mgr.removeStream(channelID))
+			break
+		}
+	}
+	_, err = mgr.newStream(context.Background(), 200, "free")
+	assert.NoError(err)
+	_, err = mgr.newStream(context.Background(), 201, "free")
+	assert.ErrorIs(err, ErrCategoryLimitExceeded)
+}
+
+func TestStartStreamCategoryFull(t *testing.T) {
+	assert := assert.New(t)
+	service := &mockService{categories: map[ChannelID]string{1: "free", 2: "free"}}
+	mgr := newCategoryTestControl(service, map[string]CategoryConfig{
+		"free": {MaxConcurrentStreams: 1},
+	})
+
+	_, err := mgr.newStream(context.Background(), 1, "free")
+	assert.NoError(err)
+
+	_, ctx, err := mgr.StartStream(context.Background(), 2)
+	assert.ErrorIs(err, ErrCategoryLimitExceeded)
+	assert.Error(ctx.Err())
+	assert.Len(mgr.streams, 1)
+	assert.Empty(service.ended)
+}
+
+// setBandwidth records bytesPerSecond for each of the last few seconds
+func setBandwidth(stream *Stream, seconds int64, bytesPerSecond int64) {
+	now := time.Now().Unix()
+	for second := now - seconds; second < now; second++ {
+		i := second % bandwidthHistorySeconds
+		stream.bandwidth.seconds[i] = second
+		stream.bandwidth.bytes[i] = bytesPerSecond
+	}
+}
+
+func TestCategoryMaxBitrate(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newCategoryTestControl(&mockService{}, map[string]CategoryConfig{
+		"free": {MaxBitrate: 1000000},
+	})
+
+	stream, err := mgr.newStream(context.Background(), 1, "free")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(mgr.checkCategoryLimits(stream))
+
+	// 800kbps
+	setBandwidth(stream, bandwidthHistorySeconds, 100000)
+	assert.NoError(mgr.checkCategoryLimits(stream))
+
+	// 2Mbps
+	setBandwidth(stream, bandwidthHistorySeconds, 250000)
+	assert.ErrorIs(mgr.checkCategoryLimits(stream), ErrCategoryLimitExceeded)
+
+	// Streams in other categories can send what they like
+	other, err := mgr.newStream(context.Background(), 2, "paid")
+	if !assert.NoError(err) {
+		return
+	}
+	setBandwidth(other, bandwidthHistorySeconds, 250000)
+	assert.NoError(mgr.checkCategoryLimits(other))
+}
+
+func TestBandwidthSamplerAverageBps(t *testing.T) {
+	assert := assert.New(t)
+	var sampler BandwidthSampler
+
+	assert.Equal(int64(0), sampler.averageBps(15))
+
+	// Off by a second's worth if the clock ticks over in between
+	stream := &Stream{}
+	setBandwidth(stream, 15, 1000)
+	assert.InDelta(8000, stream.bandwidth.averageBps(10), 800)
+	assert.InDelta(2000, stream.bandwidth.averageBps(bandwidthHistorySeconds), 150)
+}
@@ -0,0 +1,204 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ChainOrchestrator tries a list of orchestrators in priority order, falling
+// back to the next one whenever a call fails. A stream stays with the
+// orchestrator that accepted it, the others have never heard of it.
+type ChainOrchestrator struct {
+	orchestrators []Orchestrator
+	log           logrus.FieldLogger
+
+	mutex       sync.Mutex
+	activeIndex int
+	// Whether each orchestrator connected, the rest are skipped
+	connected []bool
+	// Index of the orchestrator that accepted each channel's stream
+	streams map[ChannelID]int
+}
+
+func NewChainOrchestrator(orchestrators []Orchestrator) *ChainOrchestrator {
+	return &ChainOrchestrator{
+		orchestrators: orchestrators,
+		log:           logrus.StandardLogger(),
+		connected:     make([]bool, len(orchestrators)),
+		streams:       make(map[ChannelID]int),
+	}
+}
+
+func (c *ChainOrchestrator) Name() string {
+	names := make([]string, len(c.orchestrators))
+	for i, orch := range c.orchestrators {
+		names[i] = orch.Name()
+	}
+	return fmt.Sprintf("chain(%s)", strings.Join(names, ","))
+}
+
+func (c *ChainOrchestrator) SetLogger(log logrus.FieldLogger) {
+	c.log = log
+	for _, orch := range c.orchestrators {
+		orch.SetLogger(log.WithField("orchestrator", orch.Name()))
+	}
+}
+
+// Connect connects to every orchestrator in parallel, it only fails if none of them connect
+func (c *ChainOrchestrator) Connect() error {
+	errs := make([]error, len(c.orchestrators))
+
+	var wg sync.WaitGroup
+	for i, orch := range c.orchestrators {
+		wg.Add(1)
+		go func(i int, orch Orchestrator) {
+			defer wg.Done()
+			errs[i] = orch.Connect()
+		}(i, orch)
+	}
+	wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	connected := 0
+	for i, err := range errs {
+		c.connected[i] = err == nil
+		if err != nil {
+			c.log.Warnf("Failed to connect to orchestrator %s: %s", c.orchestrators[i].Name(), err)
+			continue
+		}
+		connected++
+	}
+	if connected == 0 && len(c.orchestrators) > 0 {
+		return errors.New("could not connect to any orchestrator in the chain")
+	}
+
+	return nil
+}
+
+func (c *ChainOrchestrator) Close() error {
+	var firstErr error
+	for _, orch := range c.orchestrators {
+		if err := orch.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Ping succeeds as long as one connected orchestrator in the chain is reachable
+func (c *ChainOrchestrator) Ping() error {
+	var err error
+	for i, orch := range c.orchestrators {
+		if !c.isConnected(i) {
+			continue
+		}
+		if err = orch.Ping(); err == nil {
+			return nil
+		}
+	}
+
+	if err == nil {
+		return errors.New("no orchestrator in the chain is connected")
+	}
+	return fmt.Errorf("no orchestrator in the chain is reachable, last error: %w", err)
+}
+
+func (c *ChainOrchestrator) StartStream(channelID ChannelID, streamID StreamID) error {
+	index, err := c.try("StartStream", func(orch Orchestrator) error {
+		return orch.StartStream(channelID, streamID)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.streams[channelID] = index
+	c.mutex.Unlock()
+	return nil
+}
+
+// StopStream goes to the orchestrator that accepted the stream, only streams
+// started before it was tracked are stopped wherever will take it
+func (c *ChainOrchestrator) StopStream(channelID ChannelID, streamID StreamID) error {
+	c.mutex.Lock()
+	index, ok := c.streams[channelID]
+	delete(c.streams, channelID)
+	c.mutex.Unlock()
+
+	if ok {
+		return c.orchestrators[index].StopStream(channelID, streamID)
+	}
+	_, err := c.try("StopStream", func(orch Orchestrator) error {
+		return orch.StopStream(channelID, streamID)
+	})
+	return err
+}
+
+// Heartbeat goes to the orchestrator that accepted the stream, like StopStream
+func (c *ChainOrchestrator) Heartbeat(channelID ChannelID) error {
+	c.mutex.Lock()
+	index, ok := c.streams[channelID]
+	c.mutex.Unlock()
+
+	if ok {
+		return c.orchestrators[index].Heartbeat(channelID)
+	}
+	_, err := c.try("Heartbeat", func(orch Orchestrator) error {
+		return orch.Heartbeat(channelID)
+	})
+	return err
+}
+
+func (c *ChainOrchestrator) ListActiveStreams() ([]ActiveStreamInfo, error) {
+	var active []ActiveStreamInfo
+	_, err := c.try("ListActiveStreams", func(orch Orchestrator) (err error) {
+		active, err = orch.ListActiveStreams()
+		return err
+	})
+	return active, err
+}
+
+// try calls fn on each connected orchestrator in order until one succeeds,
+// returning the index of that one. Every call starts from the top, so the
+// chain moves back to a recovered primary.
+func (c *ChainOrchestrator) try(name string, fn func(Orchestrator) error) (int, error) {
+	var err error
+	for i, orch := range c.orchestrators {
+		if !c.isConnected(i) {
+			continue
+		}
+		if err = fn(orch); err == nil {
+			c.setActive(i)
+			return i, nil
+		}
+		c.log.Warnf("Orchestrator %s failed %s, trying the next one: %s", orch.Name(), name, err)
+	}
+
+	if err == nil {
+		return 0, errors.New("no orchestrator in the chain is connected")
+	}
+	return 0, fmt.Errorf("all orchestrators failed %s, last error: %w", name, err)
+}
+
+func (c *ChainOrchestrator) isConnected(index int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected[index]
+}
+
+func (c *ChainOrchestrator) setActive(index int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if index != c.activeIndex {
+		c.log.Infof("Orchestrator %s is now primary", c.orchestrators[index].Name())
+	}
+	c.activeIndex = index
+	orchestratorActiveIndex.Set(float64(index))
+}
@@ -0,0 +1,51 @@
+package control
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMaxConnectDuration = 5 * time.Minute
+
+	connectBaseDelay = time.Second
+	connectMaxDelay  = time.Minute
+)
+
+// ConnectService connects service, retrying with exponential backoff until
+// it succeeds or maxDuration has passed, so a restarting service doesn't
+// take waveguide down with it
+func ConnectService(service Service, log logrus.FieldLogger, maxDuration time.Duration) error {
+	return connectWithBackoff("service "+service.Name(), service.Connect, log, maxDuration)
+}
+
+// connectWithBackoff calls connect until it succeeds, waiting 1s, 2s, 4s and
+// so on up to a minute between attempts. It gives up once the next attempt
+// would start after maxDuration, 5 minutes when unset.
+func connectWithBackoff(name string, connect func() error, log logrus.FieldLogger, maxDuration time.Duration) error {
+	if maxDuration == 0 {
+		maxDuration = DefaultMaxConnectDuration
+	}
+	deadline := time.Now().Add(maxDuration)
+
+	delay := connectBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("could not connect to %s after %d attempts: %w", name, attempt, err)
+		}
+		log.Warnf("Failed to connect to %s, retrying in %s: %s", name, delay, err)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > connectMaxDelay {
+			delay = connectMaxDelay
+		}
+	}
+}
@@ -4,17 +4,23 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"image"
 	"image/jpeg"
 	"net/http"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/Glimesh/waveguide/pkg/h264"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
+const heartbeatInterval = 15 * time.Second
+
 type Pipe struct {
 	Input        string
 	Output       string
@@ -22,15 +28,70 @@ type Pipe struct {
 }
 
 type Control struct {
-	log                logrus.FieldLogger
-	service            Service
-	orchestrator       Orchestrator
+	log          logrus.FieldLogger
+	service      Service
+	orchestrator Orchestrator
+
+	// Guards streams and metadataCollectors, streams are started and stopped
+	// from inputs, timers and http handlers at once
+	streamsMutex       sync.RWMutex
 	streams            map[ChannelID]*Stream
 	metadataCollectors map[ChannelID]chan bool
 
 	config Config
 
 	httpMux *http.ServeMux
+	// Set once StartHTTPServer is running, so Shutdown can stop it
+	httpServer *http.Server
+	// Run as the http server starts shutting down, see RegisterOnHTTPShutdown
+	httpShutdownFuncsMutex sync.Mutex
+	httpShutdownFuncs      []func()
+	// Wrapped around httpMux in the order they were added, see Use
+	middlewares []Middleware
+	// Handlers registered through RegisterHandleFunc, a nil handler was
+	// deregistered but stays on httpMux, which can't remove patterns
+	routesMutex sync.RWMutex
+	routes      map[string]http.HandlerFunc
+
+	// Tracks the goroutines started for each stream, so Shutdown can wait on them
+	streamRoutines sync.WaitGroup
+
+	shutdownHooksMutex sync.Mutex
+	shutdownHooks      []ShutdownHook
+
+	eventBus           chan StreamEvent
+	eventHandlersMutex sync.RWMutex
+	eventHandlers      []EventHandler
+
+	trackReplacersMutex sync.RWMutex
+	trackReplacers      []TrackReplacer
+
+	// Outputs started through RegisterOutput, by name
+	outputsMutex  sync.RWMutex
+	outputs       map[string]*registeredOutput
+	outputFactory OutputFactory
+
+	componentLoggers componentLoggers
+
+	// Reused for thumbnails, creating decoders is slow
+	h264DecoderPool sync.Pool
+
+	// Shared by every peer connection, see GetWebRTCAPI
+	webrtcAPI *webrtc.API
+	// Only for peer connections that want a bandwidth estimate, see
+	// NewBandwidthEstimatedPeerConnection. Unset if it failed to set up.
+	estimatingAPI *estimatingAPI
+
+	// Where the thumbnailer finds WHEP when it isn't on the control http
+	// server, see SetWHEPEndpoint
+	whepEndpoint string
+
+	// Only set when AuditLogPath is configured
+	auditLog *auditLog
+
+	// Only set when RedisURL is configured
+	redis            *redisState
+	recoveredStreams []recoveredStream
 }
 
 type Config struct {
@@ -41,21 +102,197 @@ type Config struct {
 	HttpsHostname  string `mapstructure:"https_hostname"`
 	HttpsCert      string `mapstructure:"https_cert"`
 	HttpsKey       string `mapstructure:"https_key"`
+
+	// Optional webhook notified when a stream's health score drops below
+	// HealthAlertThreshold, and again when it recovers
+	HealthAlertWebhookURL string `mapstructure:"health_alert_webhook_url"`
+	HealthAlertThreshold  int    `mapstructure:"health_alert_threshold"`
+	// Signs webhook bodies with HMAC-SHA256 in the X-Waveguide-Signature header
+	HealthAlertWebhookSecret string `mapstructure:"health_alert_webhook_secret"`
+
+	// Per component log levels, eg "input.rtmp" = "debug", falling back to log_level
+	LogLevels map[string]string `mapstructure:"log_levels"`
+
+	// Signs viewer tokens handed out by /api/v1/viewer-token, outputs that
+	// check them need the same secret
+	ViewerTokenSecret string `mapstructure:"viewer_token_secret"`
+	// Longest ?ttl= a viewer token can be requested with, defaults to 1 hour
+	ViewerTokenMaxTTL time.Duration `mapstructure:"viewer_token_max_ttl"`
+
+	// How long to keep retrying the service and orchestrator at startup
+	// before giving up, defaults to 5 minutes
+	MaxConnectDuration time.Duration `mapstructure:"max_connect_duration"`
+
+	// Optional redis://host:port/db shared by every node, used to track which
+	// node each stream is live on
+	RedisURL string `mapstructure:"redis_url"`
+
+	// Optional URL POSTed the channel, stream, source IP and reason whenever
+	// an input cuts a stream off, eg for going over the bandwidth limit
+	AbuseReportURL string `mapstructure:"abuse_report_url"`
+
+	// Heartbeat metadata snapshots kept per stream for
+	// /api/v1/streams/{channelID}/metadata/history, defaults to 60
+	MetadataHistorySize int `mapstructure:"metadata_history_size"`
+
+	// Optional file every stream start and stop, failed auth, thumbnail,
+	// failed heartbeat and viewer (dis)connect is written to as a JSON line.
+	// It's rotated once it grows past AuditLogMaxSizeMB, 100 by default.
+	AuditLogPath      string `mapstructure:"audit_log_path"`
+	AuditLogMaxSizeMB int    `mapstructure:"audit_log_max_size_mb"`
+
+	// Serves /debug/pprof/ on its own address, eg localhost:6060, disabled
+	// when unset. Set PProfToken to require it as a bearer token.
+	PProfAddress string `mapstructure:"pprof_address"`
+	PProfToken   string `mapstructure:"pprof_token"`
+
+	// Bearer token required by API endpoints wrapped in RequireAPIToken,
+	// they're open when unset
+	APIToken string `mapstructure:"api_token"`
+
+	// Seconds from the start of a stream to send extra thumbnails at, eg
+	// [5, 30, 60], whatever the heartbeat is doing
+	ThumbnailAtOffsets []int `mapstructure:"thumbnail_at_offsets"`
+
+	// Limits for channels by the category the service puts them in, eg
+	// [control.channel_categories.free] max_concurrent_streams = 1
+	ChannelCategories map[string]CategoryConfig `mapstructure:"channel_categories"`
+
+	// Cross origin requests to the control http server, eg from a dashboard
+	// on another domain
+	CORS CORSConfig `mapstructure:"cors"`
 }
 
 func New(config Config) *Control {
-	return &Control{
+	if config.HealthAlertThreshold == 0 {
+		config.HealthAlertThreshold = defaultHealthAlertThreshold
+	}
+	if config.MetadataHistorySize <= 0 {
+		config.MetadataHistorySize = DefaultMetadataHistorySize
+	}
+	if config.AuditLogMaxSizeMB == 0 {
+		config.AuditLogMaxSizeMB = DefaultAuditLogMaxSizeMB
+	}
+	if config.ViewerTokenMaxTTL <= 0 {
+		config.ViewerTokenMaxTTL = DefaultViewerTokenMaxTTL
+	}
+
+	ctrl := &Control{
 		config:             config,
 		streams:            make(map[ChannelID]*Stream),
 		metadataCollectors: make(map[ChannelID]chan bool),
 		httpMux:            http.NewServeMux(),
+		routes:             make(map[string]http.HandlerFunc),
+		outputs:            make(map[string]*registeredOutput),
+		eventBus:           make(chan StreamEvent, eventBusSize),
+		componentLoggers: componentLoggers{
+			loggers: make(map[string][]*logrus.Logger),
+		},
+	}
+	ctrl.h264DecoderPool.New = newPooledH264Decoder
+
+	api, err := newWebRTCAPI()
+	if err != nil {
+		// The logger isn't set yet, so problems go to the standard logger
+		logrus.Errorf("Failed to set up the WebRTC API, using the default codecs: %+v", err)
+		api = defaultWebRTCAPI()
+	}
+	ctrl.webrtcAPI = api
+	if ctrl.estimatingAPI, err = newEstimatingAPI(); err != nil {
+		logrus.Errorf("Failed to set up WebRTC bandwidth estimation: %+v", err)
 	}
+
+	if config.RedisURL != "" {
+		// The logger isn't set yet, so problems go to the standard logger
+		state, err := newRedisState(config.RedisURL, config.Hostname)
+		if err != nil {
+			logrus.Errorf("Failed to set up redis stream state: %+v", err)
+		} else {
+			ctrl.redis = state
+			ctrl.recoveredStreams, err = state.recover()
+			if err != nil {
+				logrus.Warnf("Failed to recover streams from redis: %+v", err)
+			}
+		}
+	}
+
+	if config.AuditLogPath != "" {
+		// The logger isn't set yet, so problems go to the standard logger
+		auditLog, err := newAuditLog(config.AuditLogPath, config.AuditLogMaxSizeMB)
+		if err != nil {
+			logrus.Errorf("Failed to open the audit log: %+v", err)
+		} else {
+			ctrl.auditLog = auditLog
+			ctrl.RegisterEventHandler(EventHandlerFunc(ctrl.auditEvents))
+		}
+	}
+
+	ctrl.RegisterEventHandler(EventHandlerFunc(ctrl.serviceEvents))
+	ctrl.RegisterEventHandler(EventHandlerFunc(ctrl.orchestratorEvents))
+	go ctrl.dispatchEvents()
+
+	ctrl.httpMux.Handle("/metrics", promhttp.Handler())
+	if len(config.CORS.AllowedOrigins) > 0 {
+		ctrl.Use(CORSMiddleware(config.CORS))
+	}
+	ctrl.registerAPIHandlers()
+
+	return ctrl
 }
 
-func (mgr *Control) Shutdown() {
+// Shutdown lets in-flight http requests finish, then stops all streams and
+// outputs and blocks until the stream goroutines have exited, or until ctx
+// is done
+func (mgr *Control) Shutdown(ctx context.Context) error {
+	mgr.shutdownHTTPServer()
+
+	mgr.streamsMutex.RLock()
+	channelIDs := make([]ChannelID, 0, len(mgr.streams))
 	for c := range mgr.streams {
+		channelIDs = append(channelIDs, c)
+	}
+	mgr.streamsMutex.RUnlock()
+
+	for _, c := range channelIDs {
 		mgr.StopStream(c)
 	}
+	mgr.cancelOutputs()
+
+	mgr.shutdownHooksMutex.Lock()
+	hooks := mgr.shutdownHooks
+	mgr.shutdownHooksMutex.Unlock()
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			mgr.log.Warnf("Shutdown hook failed: %+v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mgr.streamRoutines.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if mgr.auditLog != nil {
+		return mgr.auditLog.close()
+	}
+	return nil
+}
+
+// ShutdownHook is run by Shutdown once streams have been stopped, eg for an
+// input to disconnect its clients and wait for them to go
+type ShutdownHook func(ctx context.Context) error
+
+func (mgr *Control) RegisterShutdownHook(hook ShutdownHook) {
+	mgr.shutdownHooksMutex.Lock()
+	defer mgr.shutdownHooksMutex.Unlock()
+	mgr.shutdownHooks = append(mgr.shutdownHooks, hook)
 }
 
 func (mgr *Control) SetLogger(logger logrus.FieldLogger) {
@@ -69,6 +306,39 @@ func (mgr *Control) SetOrchestrator(orch Orchestrator) {
 	mgr.orchestrator = orch
 }
 
+// ClosedCaptions returns the CEA-608 cc_data reported by the input for a
+// channel, the channel is never closed so readers should stop with the stream
+func (mgr *Control) ClosedCaptions(channelID ChannelID) (<-chan []byte, error) {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.closedCaptions, nil
+}
+
+// SpliceEvents returns the ad break markers reported by the input for a
+// channel, like ClosedCaptions the channel is never closed
+func (mgr *Control) SpliceEvents(channelID ChannelID) (<-chan SpliceEvent, error) {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.spliceEvents, nil
+}
+
+// IsAudioOnly reports whether the input has only added audio tracks to a
+// channel so far, outputs can skip video packaging for it
+func (mgr *Control) IsAudioOnly(channelID ChannelID) (bool, error) {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return false, err
+	}
+
+	return stream.isAudioOnly(), nil
+}
+
 func (mgr *Control) GetTracks(channelID ChannelID) ([]StreamTrack, error) {
 	stream, err := mgr.getStream(channelID)
 	if err != nil {
@@ -99,34 +369,93 @@ func (mgr *Control) Authenticate(channelID ChannelID, streamKey StreamKey) error
 	return nil
 }
 
-func (mgr *Control) StartStream(channelID ChannelID) (*Stream, context.Context, error) {
-	stream, err := mgr.newStream(channelID)
-	if err != nil {
-		return &Stream{}, stream.ctx, err
+// LookupChannel finds the channel a stream key belongs to, if the service supports it
+func (mgr *Control) LookupChannel(streamKey StreamKey) (ChannelID, error) {
+	lookup, ok := mgr.service.(ChannelLookupService)
+	if !ok {
+		return 0, fmt.Errorf("service %s does not support looking up channels by stream key", mgr.service.Name())
 	}
 
-	mgr.log.Infof("Starting stream for %s", channelID)
+	return lookup.GetChannelIDByStreamKey(streamKey)
+}
+
+// StartStream registers a new stream with the service and orchestrator. The
+// returned context is cancelled when the stream stops, or when ctx is cancelled.
+// Metadata already known about the stream, eg its input and source IP, is
+// applied before anyone hears about it.
+func (mgr *Control) StartStream(ctx context.Context, channelID ChannelID, metadata ...Metadata) (*Stream, context.Context, error) {
+	if mgr.redis != nil {
+		unlock, err := mgr.redis.lock(channelID)
+		if err != nil {
+			return &Stream{}, ctx, err
+		}
+		defer unlock()
+
+		owner, err := mgr.redis.ownedElsewhere(channelID)
+		if err != nil {
+			return &Stream{}, ctx, err
+		}
+		if owner != "" {
+			return &Stream{}, ctx, errors.Wrap(ErrStreamOwnedElsewhere, owner)
+		}
+	}
 
-	streamID, err := mgr.service.StartStream(channelID)
+	category, err := mgr.channelCategory(channelID)
 	if err != nil {
-		mgr.removeStream(channelID)
-		return &Stream{}, stream.ctx, err
+		return &Stream{}, ctx, err
 	}
 
-	stream.StreamID = streamID
+	recovered := mgr.takeRecoveredStream(channelID)
 
-	err = mgr.orchestrator.StartStream(stream.ChannelID, stream.StreamID)
+	stream, err := mgr.newStream(ctx, channelID, category)
 	if err != nil {
-		mgr.StopStream(channelID)
 		return &Stream{}, stream.ctx, err
 	}
 
-	go mgr.setupHeartbeat(channelID)
+	if recovered != nil {
+		// The service never saw the stream end, so it carries on as it was
+		mgr.log.Infof("Resuming stream %d for %s", recovered.StreamID, channelID)
+		stream.StreamID = recovered.StreamID
+		stream.startTime = recovered.startTime
+	} else {
+		mgr.log.Infof("Starting stream for %s", channelID)
+
+		streamID, err := mgr.service.StartStream(channelID)
+		if err != nil {
+			mgr.removeStream(channelID)
+			return &Stream{}, stream.ctx, err
+		}
+		stream.StreamID = streamID
+	}
+	stream.ReportMetadata(metadata...)
+
+	// The orchestrator is told synchronously as well, so a failure can be
+	// rolled back before the input starts sending media
+	if err := mgr.orchestrator.StartStream(channelID, stream.StreamID); err != nil {
+		return &Stream{}, stream.ctx, mgr.rollbackStream(stream, err)
+	}
+	mgr.saveStreamState(stream)
+
+	mgr.publishEvent(StreamEvent{
+		Type:      EventStreamStarted,
+		ChannelID: stream.ChannelID,
+		StreamID:  stream.StreamID,
+		Metadata:  auditMetadata(stream),
+	})
+
+	mgr.setupHeartbeat(channelID)
+	mgr.scheduleThumbnails(stream)
 
 	// Really gross, I'm sorry.
-	whepEndpoint := fmt.Sprintf("%s/whep/endpoint", mgr.HttpServerUrl())
+	whepEndpoint := mgr.whepEndpoint
+	if whepEndpoint == "" {
+		whepEndpoint = fmt.Sprintf("%s/whep/endpoint", mgr.HttpServerUrl())
+	}
+	mgr.streamRoutines.Add(1)
 	go func() {
-		err := stream.thumbnailer(whepEndpoint)
+		defer mgr.streamRoutines.Done()
+
+		err := stream.thumbnailer(mgr.GetWebRTCAPI(), whepEndpoint)
 		if err != nil {
 			stream.log.Error(err)
 			mgr.StopStream(channelID)
@@ -136,6 +465,46 @@ func (mgr *Control) StartStream(channelID ChannelID) (*Stream, context.Context,
 	return stream, stream.ctx, err
 }
 
+// ReattachStream hands a running stream back to an input whose broadcaster
+// dropped and reconnected. The stream keeps its StreamID, tracks and viewers,
+// the service and orchestrator aren't told anything happened.
+func (mgr *Control) ReattachStream(channelID ChannelID) (*Stream, error) {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return &Stream{}, err
+	}
+	if err := stream.ctx.Err(); err != nil {
+		return &Stream{}, err
+	}
+
+	stream.log.Infof("Reattaching stream %d", stream.StreamID)
+
+	return stream, nil
+}
+
+// rollbackStream undoes a stream the orchestrator refused to start. The
+// service and state are cleaned up directly rather than through StopStream,
+// which would also tell the orchestrator to stop a stream it never started.
+func (mgr *Control) rollbackStream(stream *Stream, cause error) error {
+	stream.log.Warnf("Rolling back stream %d: %s", stream.StreamID, cause)
+
+	var rollbackErrs []string
+	if err := mgr.service.EndStream(stream.StreamID); err != nil {
+		stream.log.Errorf("Failed to end stream on the service during rollback: %+v", err)
+		rollbackErrs = append(rollbackErrs, fmt.Sprintf("ending stream: %s", err))
+	}
+	if err := mgr.removeStream(stream.ChannelID); err != nil {
+		stream.log.Errorf("Failed to remove stream during rollback: %+v", err)
+		rollbackErrs = append(rollbackErrs, fmt.Sprintf("removing stream: %s", err))
+	}
+	stream.cancel()
+
+	if len(rollbackErrs) > 0 {
+		return fmt.Errorf("%w, rollback failed: %s", cause, strings.Join(rollbackErrs, "; "))
+	}
+	return cause
+}
+
 func (mgr *Control) StopStream(channelID ChannelID) (err error) {
 	stream, err := mgr.getStream(channelID)
 	if err != nil {
@@ -143,29 +512,35 @@ func (mgr *Control) StopStream(channelID ChannelID) (err error) {
 	}
 	stream.log.Infof("Stopping stream")
 
+	if mgr.redis != nil {
+		// Stopping carries on without the lock, the stream is going away either way
+		if unlock, err := mgr.redis.lock(channelID); err != nil {
+			stream.log.Warnf("Stopping stream without the redis lock: %s", err)
+		} else {
+			defer unlock()
+		}
+	}
+
 	// Cancel the context
 	// stream.cancel()
 
+	stream.cancelScheduledThumbnails()
 	stream.stopHeartbeat <- true
 	stream.stopPeersnap <- true
-	mgr.metadataCollectors[channelID] <- true
-
-	// Make sure we send stop commands to everyone, and don't return until they've all been sent
-	serviceErr := mgr.service.EndStream(stream.StreamID)
-	orchestratorErr := mgr.orchestrator.StopStream(stream.ChannelID, stream.StreamID)
+	mgr.metadataCollector(channelID) <- true
+
+	// The service and orchestrator are told about the stop through the event bus
+	mgr.publishEvent(StreamEvent{
+		Type:      EventStreamStopped,
+		ChannelID: stream.ChannelID,
+		StreamID:  stream.StreamID,
+		Metadata:  auditMetadata(stream),
+	})
 	controlErr := mgr.removeStream(channelID)
 
 	// Cancel stream context to tell the video ingestor to stop work
 	stream.cancel()
 
-	if serviceErr != nil {
-		stream.log.Error(serviceErr)
-		return serviceErr
-	}
-	if orchestratorErr != nil {
-		stream.log.Error(orchestratorErr)
-		return orchestratorErr
-	}
 	if controlErr != nil {
 		stream.log.Error(controlErr)
 		return controlErr
@@ -174,13 +549,18 @@ func (mgr *Control) StopStream(channelID ChannelID) (err error) {
 	return nil
 }
 
+var ErrStreamAlreadyExists = errors.New("stream already exists in stream manager state")
+
 var ErrHeartbeatThumbnail = errors.New("error sending thumbnail")
 var ErrHeartbeatSendMetadata = errors.New("error sending metadata")
 var ErrHeartbeatOrchestratorHeartbeat = errors.New("error sending orchestrator heartbeat")
 
 func (mgr *Control) setupHeartbeat(channelID ChannelID) {
-	ticker := time.NewTicker(15 * time.Second)
+	ticker := time.NewTicker(heartbeatInterval)
+	stopCollecting := mgr.metadataCollector(channelID)
+	mgr.streamRoutines.Add(1)
 	go func() {
+		defer mgr.streamRoutines.Done()
 		tickFailed := 0
 
 		stream, err := mgr.getStream(channelID)
@@ -214,6 +594,11 @@ func (mgr *Control) setupHeartbeat(channelID ChannelID) {
 				}
 
 				if hasErrors {
+					mgr.Audit(AuditEntry{
+						Event:     AuditHeartbeatFail,
+						ChannelID: channelID,
+						StreamID:  stream.StreamID,
+					})
 					tickFailed += 1
 				} else {
 					if tickFailed > 0 {
@@ -221,6 +606,20 @@ func (mgr *Control) setupHeartbeat(channelID ChannelID) {
 					}
 				}
 
+				if err := mgr.checkCategoryLimits(stream); err != nil {
+					stream.log.Warnf("Stopping stream: %s", err)
+					mgr.StopStream(channelID)
+					ticker.Stop()
+					return
+				}
+
+				mgr.recordMetadataHistory(stream)
+				mgr.saveStreamState(stream)
+
+				score := mgr.updateHealth(stream, tickFailed)
+				streamHealthScore.WithLabelValues(channelID.String()).Set(float64(score))
+				mgr.checkHealthAlert(stream)
+
 				// Look for 3 consecutive failures
 				if tickFailed >= 5 {
 					stream.log.Warn("Stopping stream due to excessive heartbeat errors")
@@ -229,7 +628,7 @@ func (mgr *Control) setupHeartbeat(channelID ChannelID) {
 					return
 				}
 
-			case <-mgr.metadataCollectors[channelID]:
+			case <-stopCollecting:
 				ticker.Stop()
 				return
 			}
@@ -237,6 +636,17 @@ func (mgr *Control) setupHeartbeat(channelID ChannelID) {
 	}()
 }
 
+func (mgr *Control) updateHealth(stream *Stream, tickFailed int) int {
+	sample := healthSample{
+		videoPackets: stream.totalVideoPackets - stream.lastVideoPackets,
+		audioPackets: stream.totalAudioPackets - stream.lastAudioPackets,
+	}
+	stream.lastVideoPackets = stream.totalVideoPackets
+	stream.lastAudioPackets = stream.totalAudioPackets
+
+	return stream.health.update(sample, tickFailed, stream.hasSomeVideo, stream.hasSomeAudio, heartbeatInterval)
+}
+
 func (mgr *Control) sendMetadata(channelID ChannelID) error {
 	stream, err := mgr.getStream(channelID)
 	if err != nil {
@@ -245,11 +655,15 @@ func (mgr *Control) sendMetadata(channelID ChannelID) error {
 
 	stream.lastTime = time.Now().Unix()
 
-	return mgr.service.UpdateStreamMetadata(stream.StreamID, StreamMetadata{
+	return mgr.service.UpdateStreamMetadata(stream.StreamID, mgr.streamMetadata(stream))
+}
+
+func (mgr *Control) streamMetadata(stream *Stream) StreamMetadata {
+	return StreamMetadata{
 		AudioCodec:        stream.audioCodec,
 		IngestServer:      mgr.config.Hostname,
 		IngestViewers:     0,
-		LostPackets:       0, // Don't exist
+		LostPackets:       stream.lostPackets,
 		NackPackets:       0, // Don't exist
 		RecvPackets:       stream.totalAudioPackets + stream.totalVideoPackets,
 		SourceBitrate:     0, // Likely just need to calculate the bytes between two 5s snapshots?
@@ -260,7 +674,15 @@ func (mgr *Control) sendMetadata(channelID ChannelID) error {
 		VideoCodec:        stream.videoCodec,
 		VideoHeight:       stream.videoHeight,
 		VideoWidth:        stream.videoWidth,
-	})
+		SourceCountry:     stream.sourceCountry,
+		SourceCity:        stream.sourceCity,
+		SourceASN:         stream.sourceASN,
+		SourceIP:          stream.sourceIP,
+		AudioGaps:         stream.audioGaps,
+		FractionLost:      stream.fractionLost,
+		JitterMs:          stream.jitterMs,
+		VideoFrameRate:    stream.videoFrameRate,
+	}
 }
 
 func (mgr *Control) sendThumbnail(channelID ChannelID) (err error) {
@@ -279,13 +701,7 @@ func (mgr *Control) sendThumbnail(channelID ChannelID) (err error) {
 		return nil
 	}
 
-	var img image.Image
-	h264dec, err := h264.NewH264Decoder()
-	if err != nil {
-		return err
-	}
-	defer h264dec.Close()
-	img, err = h264dec.Decode(data)
+	img, err := mgr.encodeThumbnail(stream, data)
 	if err != nil {
 		return err
 	}
@@ -294,30 +710,72 @@ func (mgr *Control) sendThumbnail(channelID ChannelID) (err error) {
 		return nil
 	}
 
-	buff := new(bytes.Buffer)
-	err = jpeg.Encode(buff, img, &jpeg.Options{
-		Quality: 75,
-	})
+	err = mgr.service.SendJpegPreviewImage(stream.StreamID, img)
 	if err != nil {
 		return err
 	}
 
-	err = mgr.service.SendJpegPreviewImage(stream.StreamID, buff.Bytes())
+	mgr.log.WithField("channel_id", channelID).Debug("Got screenshot!")
+	mgr.Audit(AuditEntry{
+		Event:     AuditThumbnailSent,
+		ChannelID: channelID,
+		StreamID:  stream.StreamID,
+	})
+
+	return nil
+}
+
+// encodeThumbnail decodes an H264 keyframe into a JPEG, updating the stream
+// dimensions on the way. It returns nil when the decoder has no picture yet.
+func (mgr *Control) encodeThumbnail(stream *Stream, keyframe []byte) ([]byte, error) {
+	h264dec, ok := mgr.h264DecoderPool.Get().(*h264.H264Decoder)
+	if !ok {
+		return nil, errors.New("failed to create H264 decoder")
+	}
+	// img points into the decoders frame buffer, so it can only go back in
+	// the pool once we're done with it
+	defer func() {
+		h264dec.Reset()
+		mgr.h264DecoderPool.Put(h264dec)
+	}()
+	img, err := h264dec.Decode(keyframe)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if img == nil {
+		return nil, nil
 	}
 
-	mgr.log.WithField("channel_id", channelID).Debug("Got screenshot!")
+	buff := new(bytes.Buffer)
+	err = jpeg.Encode(buff, img, &jpeg.Options{
+		Quality: 75,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Also update our metadata
 	stream.videoWidth = img.Bounds().Dx()
 	stream.videoHeight = img.Bounds().Dy()
 
-	return nil
+	return buff.Bytes(), nil
+}
+
+// newPooledH264Decoder creates decoders for h264DecoderPool. The pool drops
+// idle decoders on GC without telling us, so the finalizer frees the C side.
+func newPooledH264Decoder() interface{} {
+	dec, err := h264.NewH264Decoder()
+	if err != nil {
+		return nil
+	}
+	runtime.SetFinalizer(dec, (*h264.H264Decoder).Close)
+	return dec
 }
 
-func (mgr *Control) newStream(channelID ChannelID) (*Stream, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+// newStream adds a stream for a channel that isn't live yet, counting it
+// towards category's MaxConcurrentStreams
+func (mgr *Control) newStream(parent context.Context, channelID ChannelID, category string) (*Stream, error) {
+	ctx, cancel := context.WithCancel(parent)
 	stream := &Stream{
 		ctx:    ctx,
 		cancel: cancel,
@@ -331,36 +789,96 @@ func (mgr *Control) newStream(channelID ChannelID) (*Stream, error) {
 		stopPeersnap:  make(chan bool, 1),
 		// 10 keyframes in 5 seconds is probably a bit extreme
 		lastThumbnail:       make(chan []byte, 10),
+		thumbnailLimiter:    newThumbnailLimiter(),
+		closedCaptions:      make(chan []byte, closedCaptionsBuffer),
+		spliceEvents:        make(chan SpliceEvent, spliceEventsBuffer),
+		health:              newStreamHealth(),
+		metadataHistory:     make([]*TimestampedMetadata, 0, mgr.config.MetadataHistorySize),
 		startTime:           time.Now().Unix(),
 		totalAudioPackets:   0,
 		totalVideoPackets:   0,
 		clientVendorName:    "",
 		clientVendorVersion: "",
+		category:            category,
 	}
 
+	mgr.streamsMutex.Lock()
 	if _, exists := mgr.streams[channelID]; exists {
-		return stream, errors.New("stream already exists in stream manager state")
+		mgr.streamsMutex.Unlock()
+		// Nothing will ever stop this one, so its context is done already
+		cancel()
+		return stream, ErrStreamAlreadyExists
+	}
+	if err := mgr.checkCategoryConcurrency(category); err != nil {
+		mgr.streamsMutex.Unlock()
+		cancel()
+		return stream, err
 	}
 	mgr.streams[channelID] = stream
 	mgr.metadataCollectors[channelID] = make(chan bool, 1)
+	mgr.streamsMutex.Unlock()
+
+	// Other nodes are only counted once this node's count allowed the stream
+	if err := mgr.reserveCategorySlot(stream); err != nil {
+		mgr.removeStream(channelID)
+		cancel()
+		return stream, err
+	}
+
+	mgr.saveStreamState(stream)
 
 	return stream, nil
 }
 
+// saveStreamState writes the stream to redis, if it's configured
+func (mgr *Control) saveStreamState(stream *Stream) {
+	if mgr.redis == nil {
+		return
+	}
+	if err := mgr.redis.saveStream(stream); err != nil {
+		stream.log.Warnf("Failed to save stream state to redis: %s", err)
+	}
+}
+
 func (mgr *Control) removeStream(id ChannelID) error {
+	mgr.streamsMutex.Lock()
 	if _, exists := mgr.streams[id]; !exists {
+		mgr.streamsMutex.Unlock()
 		return errors.New("RemoveStream stream does not exist in state")
 	}
 
+	category := mgr.streams[id].category
 	delete(mgr.streams, id)
 	delete(mgr.metadataCollectors, id)
+	mgr.streamsMutex.Unlock()
+
+	streamHealthScore.DeleteLabelValues(id.String())
+
+	if mgr.redis != nil {
+		if err := mgr.redis.deleteStream(id, category); err != nil {
+			mgr.log.Warnf("Failed to delete stream state from redis: %s", err)
+		}
+	}
 
 	return nil
 }
 
 func (mgr *Control) getStream(id ChannelID) (*Stream, error) {
-	if _, exists := mgr.streams[id]; !exists {
+	mgr.streamsMutex.RLock()
+	defer mgr.streamsMutex.RUnlock()
+
+	stream, exists := mgr.streams[id]
+	if !exists {
 		return &Stream{}, errors.New("GetStream stream does not exist in state")
 	}
-	return mgr.streams[id], nil
+	return stream, nil
+}
+
+// metadataCollector is the channel stopping a stream's heartbeat, nil once
+// the stream is gone
+func (mgr *Control) metadataCollector(id ChannelID) chan bool {
+	mgr.streamsMutex.RLock()
+	defer mgr.streamsMutex.RUnlock()
+
+	return mgr.metadataCollectors[id]
 }
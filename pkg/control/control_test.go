@@ -0,0 +1,184 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	errOrchestratorDown = errors.New("orchestrator is down")
+	errServiceDown      = errors.New("service is down")
+)
+
+type mockService struct {
+	endStreamErr error
+	ended        []StreamID
+	categories   map[ChannelID]string
+}
+
+func (s *mockService) SetLogger(log logrus.FieldLogger)               {}
+func (s *mockService) Name() string                                   { return "mock" }
+func (s *mockService) Connect() error                                 { return nil }
+func (s *mockService) GetHmacKey(channelID ChannelID) ([]byte, error) { return []byte("key"), nil }
+func (s *mockService) StartStream(channelID ChannelID) (StreamID, error) {
+	return 42, nil
+}
+func (s *mockService) EndStream(streamID StreamID) error {
+	s.ended = append(s.ended, streamID)
+	return s.endStreamErr
+}
+func (s *mockService) UpdateStreamMetadata(streamID StreamID, metadata StreamMetadata) error {
+	return nil
+}
+func (s *mockService) SendJpegPreviewImage(streamID StreamID, img []byte) error { return nil }
+func (s *mockService) GetChannelCategory(channelID ChannelID) (string, error) {
+	return s.categories[channelID], nil
+}
+
+// failingOrchestrator refuses every stream
+type failingOrchestrator struct {
+	stopped int
+}
+
+func (o *failingOrchestrator) Name() string                        { return "failing" }
+func (o *failingOrchestrator) Connect() error                      { return nil }
+func (o *failingOrchestrator) Close() error                        { return nil }
+func (o *failingOrchestrator) Ping() error                         { return nil }
+func (o *failingOrchestrator) SetLogger(logrus.FieldLogger)        {}
+func (o *failingOrchestrator) Heartbeat(channelID ChannelID) error { return nil }
+func (o *failingOrchestrator) StartStream(channelID ChannelID, streamID StreamID) error {
+	return errOrchestratorDown
+}
+func (o *failingOrchestrator) StopStream(channelID ChannelID, streamID StreamID) error {
+	o.stopped++
+	return nil
+}
+func (o *failingOrchestrator) ListActiveStreams() ([]ActiveStreamInfo, error) {
+	return nil, nil
+}
+
+func newTestControl(service Service, orchestrator Orchestrator) *Control {
+	mgr := New(Config{})
+	mgr.SetLogger(logrus.New())
+	mgr.SetService(service)
+	mgr.SetOrchestrator(orchestrator)
+	return mgr
+}
+
+func TestStartStreamRollsBackOrchestratorFailure(t *testing.T) {
+	assert := assert.New(t)
+	service := &mockService{}
+	orchestrator := &failingOrchestrator{}
+	mgr := newTestControl(service, orchestrator)
+
+	_, ctx, err := mgr.StartStream(context.Background(), 1)
+	assert.ErrorIs(err, errOrchestratorDown)
+
+	assert.Equal([]StreamID{42}, service.ended)
+	assert.Empty(mgr.streams)
+	assert.Empty(mgr.metadataCollectors)
+	assert.Error(ctx.Err())
+
+	// Nothing was published, so the orchestrator isn't asked to stop it
+	assert.NoError(mgr.Shutdown(context.Background()))
+	assert.Equal(0, orchestrator.stopped)
+}
+
+func TestStartStreamRollbackFailure(t *testing.T) {
+	assert := assert.New(t)
+	service := &mockService{endStreamErr: errServiceDown}
+	mgr := newTestControl(service, &failingOrchestrator{})
+
+	_, _, err := mgr.StartStream(context.Background(), 1)
+	assert.ErrorIs(err, errOrchestratorDown)
+	assert.Contains(err.Error(), errServiceDown.Error())
+	assert.Empty(mgr.streams)
+
+	// The channel can start again once the orchestrator is back
+	_, _, err = mgr.StartStream(context.Background(), 1)
+	assert.ErrorIs(err, errOrchestratorDown)
+}
+
+// recordingReplacer remembers every replacement it's told about
+type recordingReplacer struct {
+	replaced [][2]StreamTrack
+}
+
+func (r *recordingReplacer) ReplaceTrack(channelID ChannelID, oldTrack, newTrack StreamTrack) error {
+	r.replaced = append(r.replaced, [2]StreamTrack{oldTrack, newTrack})
+	return nil
+}
+
+func newTestTrack(t *testing.T, mimeType string) StreamTrack {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return StreamTrack{Type: webrtc.RTPCodecTypeVideo, Codec: mimeType, Track: track}
+}
+
+func TestReplaceTrackSequentially(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+	replacer := &recordingReplacer{}
+	mgr.RegisterTrackReplacer(replacer)
+
+	stream, err := mgr.newStream(context.Background(), 1, "")
+	assert.NoError(err)
+	h264 := newTestTrack(t, webrtc.MimeTypeH264)
+	vp8 := newTestTrack(t, webrtc.MimeTypeVP8)
+	vp9 := newTestTrack(t, webrtc.MimeTypeVP9)
+	assert.NoError(stream.AddTrack(h264.Track, h264.Codec))
+
+	assert.NoError(mgr.ReplaceTrack(1, h264, vp8))
+	tracks, _ := mgr.GetTracks(1)
+	assert.Equal([]StreamTrack{vp8}, tracks)
+	assert.Equal(webrtc.MimeTypeVP8, stream.videoCodec)
+
+	// The old track is gone, so it can't be replaced again
+	assert.ErrorIs(mgr.ReplaceTrack(1, h264, vp9), ErrTrackNotFound)
+
+	assert.NoError(mgr.ReplaceTrack(1, vp8, vp9))
+	tracks, _ = mgr.GetTracks(1)
+	assert.Equal([]StreamTrack{vp9}, tracks)
+	assert.Equal([][2]StreamTrack{{h264, vp8}, {vp8, vp9}}, replacer.replaced)
+}
+
+func TestShutdownRunsHTTPShutdownFuncs(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+
+	// Stands in for an event stream, which only ends when it's told to
+	closing := make(chan struct{})
+	mgr.RegisterHandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-closing
+	})
+	mgr.RegisterOnHTTPShutdown(func() { close(closing) })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	mgr.httpServer = &http.Server{Handler: mgr.handler()}
+	go mgr.httpServer.Serve(listener)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/events")
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	started := time.Now()
+	mgr.shutdownHTTPServer()
+	assert.Less(time.Since(started), time.Second)
+}
@@ -0,0 +1,87 @@
+package control
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig allows browsers on other origins to call the control http
+// server, it's off unless AllowedOrigins is set
+type CORSConfig struct {
+	// Origins allowed to make requests, "*" allows any
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// Defaults to DefaultCORSMethods
+	AllowedMethods []string `mapstructure:"allowed_methods"`
+	// Defaults to DefaultCORSHeaders
+	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	// Seconds browsers may cache a preflight response for, unset leaves it
+	// up to the browser
+	MaxAge int `mapstructure:"max_age"`
+	// Lets browsers send cookies and auth, eg for WHEP sessions. The request's
+	// Origin is sent back instead of "*", so AllowedOrigins has to list the
+	// origins, with "*" credentials are never allowed.
+	AllowCredentials bool `mapstructure:"allow_credentials"`
+}
+
+var (
+	DefaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORSMiddleware answers OPTIONS preflight requests for every path and adds
+// Access-Control-Allow-Origin to everything else from an allowed origin.
+// Routes never see preflights, so their credentials are set here with
+// AllowCredentials.
+func CORSMiddleware(config CORSConfig) Middleware {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = DefaultCORSMethods
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = DefaultCORSHeaders
+	}
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowOrigin, ok := corsAllowOrigin(config.AllowedOrigins, r.Header.Get("Origin")); ok {
+				if config.AllowCredentials && allowOrigin != "*" {
+					allowOrigin = r.Header.Get("Origin")
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+				w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			}
+			w.Header().Add("Vary", "Origin")
+
+			if r.Method != http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			if config.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin for a request's
+// Origin, if it's allowed at all
+func corsAllowOrigin(allowed []string, origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, a := range allowed {
+		if a == "*" {
+			return "*", true
+		}
+		if a == origin {
+			return origin, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,44 @@
+package control
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func corsRequest(config CORSConfig, origin string) http.Header {
+	handler := CORSMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/outputs", nil)
+	req.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Header()
+}
+
+func TestCORSMiddlewareCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      CORSConfig
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{"wildcard", CORSConfig{AllowedOrigins: []string{"*"}}, "https://evil.example", "*", ""},
+		{"listed origin", CORSConfig{AllowedOrigins: []string{"https://dash.example"}, AllowCredentials: true}, "https://dash.example", "https://dash.example", "true"},
+		{"unlisted origin", CORSConfig{AllowedOrigins: []string{"https://dash.example"}, AllowCredentials: true}, "https://evil.example", "", ""},
+		// Config validation refuses this, but the origin still mustn't be echoed
+		{"wildcard with credentials", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, "https://evil.example", "*", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			header := corsRequest(test.config, test.origin)
+			assert.Equal(test.allowOrigin, header.Get("Access-Control-Allow-Origin"))
+			assert.Equal(test.credentials, header.Get("Access-Control-Allow-Credentials"))
+		})
+	}
+}
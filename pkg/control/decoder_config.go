@@ -0,0 +1,31 @@
+package control
+
+import "errors"
+
+var errNoDecoderConfig = errors.New("no decoder config received yet")
+
+// SetDecoderConfig stores the H264 SPS and PPS of a stream, inputs call it
+// whenever the broadcaster sends new ones so outputs can set up decoders
+// for viewers joining late
+func (s *Stream) SetDecoderConfig(sps, pps []byte) {
+	s.decoderConfigMutex.Lock()
+	defer s.decoderConfigMutex.Unlock()
+	s.sps = append([]byte(nil), sps...)
+	s.pps = append([]byte(nil), pps...)
+}
+
+// GetDecoderConfig returns the latest H264 SPS and PPS the input has seen
+// for a channel
+func (mgr *Control) GetDecoderConfig(channelID ChannelID) (sps, pps []byte, err error) {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream.decoderConfigMutex.RLock()
+	defer stream.decoderConfigMutex.RUnlock()
+	if len(stream.sps) == 0 || len(stream.pps) == 0 {
+		return nil, nil, errNoDecoderConfig
+	}
+	return stream.sps, stream.pps, nil
+}
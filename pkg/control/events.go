@@ -0,0 +1,77 @@
+package control
+
+const (
+	EventStreamStarted = "stream_started"
+	EventStreamStopped = "stream_stopped"
+
+	eventBusSize = 64
+)
+
+// StreamEvent describes something that happened to a stream. Events are
+// delivered to every registered EventHandler, in the order they were published.
+type StreamEvent struct {
+	Type      string
+	ChannelID ChannelID
+	StreamID  StreamID
+	Metadata  map[string]string
+}
+
+type EventHandler interface {
+	HandleStreamEvent(event StreamEvent) error
+}
+
+// EventHandlerFunc lets plain functions be used as an EventHandler
+type EventHandlerFunc func(event StreamEvent) error
+
+func (f EventHandlerFunc) HandleStreamEvent(event StreamEvent) error {
+	return f(event)
+}
+
+// RegisterEventHandler adds a handler that receives all future stream events
+func (mgr *Control) RegisterEventHandler(handler EventHandler) {
+	mgr.eventHandlersMutex.Lock()
+	defer mgr.eventHandlersMutex.Unlock()
+
+	mgr.eventHandlers = append(mgr.eventHandlers, handler)
+}
+
+func (mgr *Control) publishEvent(event StreamEvent) {
+	// Counted so Shutdown can wait for pending events to be delivered
+	mgr.streamRoutines.Add(1)
+	mgr.eventBus <- event
+}
+
+func (mgr *Control) dispatchEvents() {
+	for event := range mgr.eventBus {
+		mgr.eventHandlersMutex.RLock()
+		handlers := mgr.eventHandlers
+		mgr.eventHandlersMutex.RUnlock()
+		handlers = append(handlers[:len(handlers):len(handlers)], mgr.outputEventHandlers()...)
+
+		for _, handler := range handlers {
+			if err := handler.HandleStreamEvent(event); err != nil {
+				mgr.log.WithField("channel_id", event.ChannelID).Errorf("Failed handling %s event: %+v", event.Type, err)
+			}
+		}
+
+		mgr.streamRoutines.Done()
+	}
+}
+
+// serviceEvents tells the service about streams ending. Starting a stream is
+// still done synchronously, since the service assigns the StreamID.
+func (mgr *Control) serviceEvents(event StreamEvent) error {
+	if event.Type == EventStreamStopped {
+		return mgr.service.EndStream(event.StreamID)
+	}
+	return nil
+}
+
+// orchestratorEvents tells the orchestrator about streams ending. Like the
+// service, starting is synchronous so StartStream can roll back a failure.
+func (mgr *Control) orchestratorEvents(event StreamEvent) error {
+	if event.Type == EventStreamStopped {
+		return mgr.orchestrator.StopStream(event.ChannelID, event.StreamID)
+	}
+	return nil
+}
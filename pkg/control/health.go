@@ -0,0 +1,180 @@
+package control
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of heartbeat ticks used when judging the health of a stream
+	healthWindow = 8
+	// Number of keyframes kept to judge the keyframe interval
+	healthKeyframes = 16
+	// Maximum points each health dimension can contribute to the score
+	healthDimensionPoints = 25
+	// Matches the number of failed ticks before setupHeartbeat stops a stream
+	maxTickFailures = 5
+)
+
+type HealthDimensions struct {
+	Keyframe  int `json:"keyframe"`
+	Heartbeat int `json:"heartbeat"`
+	Bitrate   int `json:"bitrate"`
+	Audio     int `json:"audio"`
+}
+
+type healthSample struct {
+	videoPackets int
+	audioPackets int
+}
+
+type streamHealth struct {
+	mutex sync.RWMutex
+
+	samples   []healthSample
+	keyframes []time.Time
+
+	score      int
+	dimensions HealthDimensions
+
+	// Webhook alert state, see alertEvent
+	ticksBelowThreshold int
+	alerted             bool
+}
+
+func newStreamHealth() *streamHealth {
+	return &streamHealth{
+		score: 100,
+		dimensions: HealthDimensions{
+			Keyframe:  healthDimensionPoints,
+			Heartbeat: healthDimensionPoints,
+			Bitrate:   healthDimensionPoints,
+			Audio:     healthDimensionPoints,
+		},
+	}
+}
+
+func (h *streamHealth) addKeyframe(t time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.keyframes = append(h.keyframes, t)
+	if len(h.keyframes) > healthKeyframes {
+		h.keyframes = h.keyframes[len(h.keyframes)-healthKeyframes:]
+	}
+}
+
+// update records a heartbeat tick and recalculates the health score
+func (h *streamHealth) update(sample healthSample, tickFailed int, hasVideo, hasAudio bool, interval time.Duration) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.samples = append(h.samples, sample)
+	if len(h.samples) > healthWindow {
+		h.samples = h.samples[len(h.samples)-healthWindow:]
+	}
+
+	h.dimensions = HealthDimensions{
+		Keyframe:  h.keyframeScore(hasVideo, interval),
+		Heartbeat: heartbeatScore(tickFailed),
+		Bitrate:   h.bitrateScore(),
+		Audio:     h.audioScore(hasAudio),
+	}
+	h.score = h.dimensions.Keyframe + h.dimensions.Heartbeat + h.dimensions.Bitrate + h.dimensions.Audio
+
+	return h.score
+}
+
+func (h *streamHealth) get() (int, HealthDimensions) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.score, h.dimensions
+}
+
+// keyframeScore rewards a steady keyframe interval, and punishes streams that stopped sending keyframes
+func (h *streamHealth) keyframeScore(hasVideo bool, interval time.Duration) int {
+	if !hasVideo {
+		return healthDimensionPoints
+	}
+	if len(h.keyframes) == 0 {
+		// Give the input a couple of ticks to send the first keyframe
+		if len(h.samples) > 2 {
+			return 0
+		}
+		return healthDimensionPoints
+	}
+	if time.Since(h.keyframes[len(h.keyframes)-1]) > 2*interval {
+		return 0
+	}
+	if len(h.keyframes) < 3 {
+		return healthDimensionPoints
+	}
+
+	intervals := make([]float64, 0, len(h.keyframes)-1)
+	for i := 1; i < len(h.keyframes); i++ {
+		intervals = append(intervals, h.keyframes[i].Sub(h.keyframes[i-1]).Seconds())
+	}
+	return scaledPoints(1 - coefficientOfVariation(intervals))
+}
+
+func heartbeatScore(tickFailed int) int {
+	return scaledPoints(1 - float64(tickFailed)/maxTickFailures)
+}
+
+// bitrateScore rewards a stable amount of packets between ticks
+func (h *streamHealth) bitrateScore() int {
+	if len(h.samples) < 3 {
+		return healthDimensionPoints
+	}
+
+	packets := make([]float64, 0, len(h.samples))
+	for _, s := range h.samples {
+		packets = append(packets, float64(s.videoPackets+s.audioPackets))
+	}
+	return scaledPoints(1 - coefficientOfVariation(packets))
+}
+
+// audioScore punishes ticks where no audio packets arrived at all
+func (h *streamHealth) audioScore(hasAudio bool) int {
+	if !hasAudio || len(h.samples) == 0 {
+		return healthDimensionPoints
+	}
+
+	gaps := 0
+	for _, s := range h.samples {
+		if s.audioPackets == 0 {
+			gaps++
+		}
+	}
+	return scaledPoints(1 - float64(gaps)/float64(len(h.samples)))
+}
+
+func scaledPoints(ratio float64) int {
+	ratio = math.Max(0, math.Min(1, ratio))
+	return int(math.Round(ratio * healthDimensionPoints))
+}
+
+func coefficientOfVariation(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	if mean == 0 {
+		return 1
+	}
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(values))
+
+	return math.Sqrt(variance) / mean
+}
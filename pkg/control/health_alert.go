@@ -0,0 +1,133 @@
+package control
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	healthEventDegraded  = "health_degraded"
+	healthEventRecovered = "health_recovered"
+
+	// Consecutive ticks below the threshold before we alert
+	healthAlertTicks = 2
+	// Used when a webhook is configured without a threshold
+	defaultHealthAlertThreshold = 50
+
+	healthAlertTimeout = 5 * time.Second
+)
+
+type healthAlert struct {
+	Event     string    `json:"event"`
+	ChannelID ChannelID `json:"channel_id"`
+	Score     int       `json:"score"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// alertEvent tracks the score against the threshold, returning the event that
+// should be sent for this tick, if any. Degraded alerts are only sent once
+// until the stream recovers.
+func (h *streamHealth) alertEvent(threshold int) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.score >= threshold {
+		h.ticksBelowThreshold = 0
+		if h.alerted {
+			h.alerted = false
+			return healthEventRecovered
+		}
+		return ""
+	}
+
+	h.ticksBelowThreshold++
+	if h.ticksBelowThreshold >= healthAlertTicks && !h.alerted {
+		h.alerted = true
+		return healthEventDegraded
+	}
+	return ""
+}
+
+// degradedReason names the dimension that lost the most points
+func degradedReason(d HealthDimensions) string {
+	reason, lowest := "low_keyframe_rate", d.Keyframe
+	if d.Heartbeat < lowest {
+		reason, lowest = "heartbeat_failures", d.Heartbeat
+	}
+	if d.Bitrate < lowest {
+		reason, lowest = "unstable_bitrate", d.Bitrate
+	}
+	if d.Audio < lowest {
+		reason = "audio_gaps"
+	}
+	return reason
+}
+
+func (mgr *Control) checkHealthAlert(stream *Stream) {
+	if mgr.config.HealthAlertWebhookURL == "" {
+		return
+	}
+
+	event := stream.health.alertEvent(mgr.config.HealthAlertThreshold)
+	if event == "" {
+		return
+	}
+
+	score, dimensions := stream.health.get()
+	alert := healthAlert{
+		Event:     event,
+		ChannelID: stream.ChannelID,
+		Score:     score,
+	}
+	if event == healthEventDegraded {
+		alert.Reason = degradedReason(dimensions)
+	}
+
+	go func() {
+		if err := mgr.sendHealthAlert(alert); err != nil {
+			stream.log.Errorf("Failed sending %s webhook: %+v", event, err)
+		}
+	}()
+}
+
+func (mgr *Control) sendHealthAlert(alert healthAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, mgr.config.HealthAlertWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if mgr.config.HealthAlertWebhookSecret != "" {
+		req.Header.Set("X-Waveguide-Signature", "sha256="+signPayload([]byte(mgr.config.HealthAlertWebhookSecret), body))
+	}
+
+	client := &http.Client{Timeout: healthAlertTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of body, so receivers can
+// verify webhooks came from us
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,9 +1,11 @@
 package control
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/acme/autocert"
@@ -11,37 +13,132 @@ import (
 
 // This http server should combine any of the inputs / outputs http endpoints into a singular server
 
+// How long Shutdown waits for in-flight http requests before stopping streams
+const HTTPShutdownTimeout = 30 * time.Second
+
 func (ctrl *Control) StartHTTPServer() {
+	var err error
 	switch ctrl.config.HttpServerType {
 	case "acme":
 		ctrl.log.Infof("Starting ACME http server on %s:443", ctrl.config.HttpsHostname)
-		ctrl.log.Fatal(http.Serve(
-			autocert.NewListener(ctrl.config.HttpsHostname),
-			logRequest(ctrl.log, ctrl.httpMux),
-		))
+		ctrl.httpServer = &http.Server{Handler: logRequest(ctrl.log, ctrl.handler())}
+		err = ctrl.httpServer.Serve(autocert.NewListener(ctrl.config.HttpsHostname))
 	case "https":
 		ctrl.log.Infof("Starting https server on %s", ctrl.config.HttpAddress)
-		ctrl.log.Fatal(httpsServer(
-			ctrl.config.HttpAddress,
-			ctrl.config.HttpsCert,
-			ctrl.config.HttpsKey,
-			ctrl.log,
-			ctrl.httpMux,
-		))
+		ctrl.httpServer = httpsServer(ctrl.config.HttpAddress, ctrl.log, ctrl.handler())
+		err = ctrl.httpServer.ListenAndServeTLS(ctrl.config.HttpsCert, ctrl.config.HttpsKey)
 	case "http":
 		ctrl.log.Infof("Starting http server on %s", ctrl.config.HttpAddress)
-		ctrl.log.Fatal(httpServer(
-			ctrl.config.HttpAddress,
-			ctrl.log,
-			ctrl.httpMux,
-		))
+		ctrl.httpServer = httpServer(ctrl.config.HttpAddress, ctrl.log, ctrl.handler())
+		err = ctrl.httpServer.ListenAndServe()
 	default:
 		ctrl.log.Fatalf("unknown http_server_type server option %s", ctrl.config.HttpServerType)
 	}
+
+	// Shutdown makes the server return straight away, in-flight requests are
+	// still being finished
+	if err != http.ErrServerClosed {
+		ctrl.log.Fatal(err)
+	}
+}
+
+// RegisterOnHTTPShutdown adds a function run once the http server starts
+// shutting down, for long lived requests like event streams that would
+// otherwise hold it up for HTTPShutdownTimeout. It shouldn't block.
+func (ctrl *Control) RegisterOnHTTPShutdown(f func()) {
+	ctrl.httpShutdownFuncsMutex.Lock()
+	defer ctrl.httpShutdownFuncsMutex.Unlock()
+	ctrl.httpShutdownFuncs = append(ctrl.httpShutdownFuncs, f)
+}
+
+// shutdownHTTPServer stops accepting requests and waits for in-flight ones,
+// like thumbnail uploads and API calls, to finish
+func (ctrl *Control) shutdownHTTPServer() {
+	if ctrl.httpServer == nil {
+		return
+	}
+
+	ctrl.log.Info("Shutting down http server")
+	ctrl.httpShutdownFuncsMutex.Lock()
+	for _, f := range ctrl.httpShutdownFuncs {
+		ctrl.httpServer.RegisterOnShutdown(f)
+	}
+	ctrl.httpShutdownFuncs = nil
+	ctrl.httpShutdownFuncsMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), HTTPShutdownTimeout)
+	defer cancel()
+	if err := ctrl.httpServer.Shutdown(ctx); err != nil {
+		ctrl.log.Warnf("Http server did not shut down cleanly: %+v", err)
+	}
+}
+
+// Middleware wraps every request to the control http server
+type Middleware func(http.Handler) http.Handler
+
+// Use adds middleware to the control http server, the first added sees
+// requests first. It has to be called before StartHTTPServer.
+func (ctrl *Control) Use(middleware ...Middleware) {
+	ctrl.middlewares = append(ctrl.middlewares, middleware...)
+}
+
+// handler is httpMux wrapped in the middleware
+func (ctrl *Control) handler() http.Handler {
+	var handler http.Handler = ctrl.httpMux
+	for i := len(ctrl.middlewares) - 1; i >= 0; i-- {
+		handler = ctrl.middlewares[i](handler)
+	}
+	return handler
 }
 
+// RegisterHandleFunc adds a handler to the shared http server. Registering a
+// pattern again replaces its handler, so outputs can be added at runtime.
 func (ctrl *Control) RegisterHandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	ctrl.httpMux.HandleFunc(pattern, handler)
+	ctrl.routesMutex.Lock()
+	defer ctrl.routesMutex.Unlock()
+
+	if _, exists := ctrl.routes[pattern]; !exists {
+		ctrl.httpMux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			ctrl.routesMutex.RLock()
+			handler := ctrl.routes[pattern]
+			ctrl.routesMutex.RUnlock()
+
+			if handler == nil {
+				http.NotFound(w, r)
+				return
+			}
+			handler(w, r)
+		})
+	}
+	ctrl.routes[pattern] = handler
+}
+
+// DeregisterHandleFunc removes a handler added with RegisterHandleFunc,
+// requests to it get a 404 from then on
+func (ctrl *Control) DeregisterHandleFunc(pattern string) {
+	ctrl.routesMutex.Lock()
+	defer ctrl.routesMutex.Unlock()
+
+	if _, exists := ctrl.routes[pattern]; exists {
+		ctrl.routes[pattern] = nil
+	}
+}
+
+// RequireAPIToken wraps a handler so requests to it need the api_token as an
+// Authorization: Bearer token
+func (ctrl *Control) RequireAPIToken(handler http.HandlerFunc) http.HandlerFunc {
+	return requireBearerToken(ctrl.config.APIToken, handler).ServeHTTP
+}
+
+// HasAPIToken is whether api_token is set, without it RequireAPIToken lets
+// every request through
+func (ctrl *Control) HasAPIToken() bool {
+	return ctrl.config.APIToken != ""
+}
+
+// SetWHEPEndpoint points the thumbnailer at a WHEP output serving from its
+// own http server, it has to be set before any stream starts
+func (ctrl *Control) SetWHEPEndpoint(url string) {
+	ctrl.whepEndpoint = url
 }
 
 func (ctrl *Control) HttpServerUrl() string {
@@ -58,14 +155,13 @@ func (ctrl *Control) HttpServerUrl() string {
 	return fmt.Sprintf("%s://%s", protocol, host)
 }
 
-func httpServer(address string, log logrus.FieldLogger, mux *http.ServeMux) error {
-	srv := &http.Server{
+func httpServer(address string, log logrus.FieldLogger, mux http.Handler) *http.Server {
+	return &http.Server{
 		Addr:    address,
 		Handler: logRequest(log, mux),
 	}
-	return srv.ListenAndServe()
 }
-func httpsServer(address, cert, key string, log logrus.FieldLogger, mux *http.ServeMux) error {
+func httpsServer(address string, log logrus.FieldLogger, mux http.Handler) *http.Server {
 	cfg := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -77,13 +173,12 @@ func httpsServer(address, cert, key string, log logrus.FieldLogger, mux *http.Se
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		},
 	}
-	srv := &http.Server{
+	return &http.Server{
 		Addr:         address,
 		Handler:      logRequest(log, mux),
 		TLSConfig:    cfg,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
-	return srv.ListenAndServeTLS(cert, key)
 }
 
 func logRequest(log logrus.FieldLogger, handler http.Handler) http.Handler {
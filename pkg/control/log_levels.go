@@ -0,0 +1,106 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// componentLoggers hands each input and output its own logrus.Logger, so the
+// level can be changed per component without touching everyone else. Two
+// outputs of the same type are the same component, so they share a level.
+type componentLoggers struct {
+	mutex   sync.Mutex
+	loggers map[string][]*logrus.Logger
+}
+
+// ComponentLogger returns a logger for the named component, eg input.rtmp,
+// cloned from the control logger with the level from control.log_levels
+func (mgr *Control) ComponentLogger(component string, fields logrus.Fields) *logrus.Entry {
+	logger := cloneLogger(mgr.rootLogger())
+
+	if name, ok := mgr.config.LogLevels[component]; ok {
+		level, err := logrus.ParseLevel(name)
+		if err != nil {
+			mgr.log.Warnf("Ignoring log level for %s: %s", component, err)
+		} else {
+			logger.SetLevel(level)
+		}
+	}
+
+	mgr.componentLoggers.mutex.Lock()
+	mgr.componentLoggers.loggers[component] = append(mgr.componentLoggers.loggers[component], logger)
+	mgr.componentLoggers.mutex.Unlock()
+
+	return logger.WithFields(fields)
+}
+
+// SetComponentLogLevel changes the level of every logger for a component at
+// runtime
+func (mgr *Control) SetComponentLogLevel(component string, level logrus.Level) bool {
+	mgr.componentLoggers.mutex.Lock()
+	defer mgr.componentLoggers.mutex.Unlock()
+
+	loggers, ok := mgr.componentLoggers.loggers[component]
+	if !ok {
+		return false
+	}
+	for _, logger := range loggers {
+		logger.SetLevel(level)
+	}
+	return true
+}
+
+func (mgr *Control) rootLogger() *logrus.Logger {
+	switch log := mgr.log.(type) {
+	case *logrus.Entry:
+		return log.Logger
+	case *logrus.Logger:
+		return log
+	}
+	return logrus.StandardLogger()
+}
+
+func cloneLogger(base *logrus.Logger) *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = base.Out
+	logger.Hooks = base.Hooks
+	logger.Formatter = base.Formatter
+	logger.ReportCaller = base.ReportCaller
+	logger.ExitFunc = base.ExitFunc
+	logger.SetLevel(base.GetLevel())
+	return logger
+}
+
+func (mgr *Control) apiLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		Component string `json:"component"`
+		Level     string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	level, err := logrus.ParseLevel(req.Level)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !mgr.SetComponentLogLevel(req.Component, level) {
+		apiError(w, http.StatusNotFound, "unknown component")
+		return
+	}
+
+	mgr.log.Infof("Log level for %s set to %s", req.Component, level)
+	req.Level = level.String()
+	apiJSON(w, http.StatusOK, req)
+}
@@ -1,5 +1,10 @@
 package control
 
+import (
+	"net"
+	"time"
+)
+
 type Metadata func(*Stream)
 
 func AudioPacketsMetadata(packets int) Metadata {
@@ -14,6 +19,60 @@ func VideoPacketsMetadata(packets int) Metadata {
 	}
 }
 
+// LostPacketsMetadata sets the total packets lost, as reported by the client
+func LostPacketsMetadata(lost int) Metadata {
+	return func(s *Stream) {
+		s.lostPackets = lost
+	}
+}
+
+// FractionLostMetadata sets the share of packets lost since the client's
+// previous report
+func FractionLostMetadata(fraction float64) Metadata {
+	return func(s *Stream) {
+		s.fractionLost = fraction
+	}
+}
+
+// JitterMetadata sets the interarrival jitter, as reported by the client
+func JitterMetadata(jitter time.Duration) Metadata {
+	return func(s *Stream) {
+		s.jitterMs = int(jitter.Milliseconds())
+	}
+}
+
+// AudioGapMetadata counts a gap in the audio from the client
+func AudioGapMetadata() Metadata {
+	return func(s *Stream) {
+		s.audioGaps++
+	}
+}
+
+// SourceLocationMetadata sets where the broadcaster is connecting from
+func SourceLocationMetadata(country, city string, asn uint) Metadata {
+	return func(s *Stream) {
+		s.sourceCountry = country
+		s.sourceCity = city
+		s.sourceASN = asn
+	}
+}
+
+// SourceIPMetadata sets the address the broadcaster is connecting from
+func SourceIPMetadata(ip net.IP) Metadata {
+	return func(s *Stream) {
+		if ip != nil {
+			s.sourceIP = ip.String()
+		}
+	}
+}
+
+// InputMetadata is the type of input the stream came in on, eg rtmp
+func InputMetadata(input string) Metadata {
+	return func(s *Stream) {
+		s.input = input
+	}
+}
+
 func ClientVendorNameMetadata(name string) Metadata {
 	return func(s *Stream) {
 		s.clientVendorName = name
@@ -47,3 +106,17 @@ func VideoWidthMetadata(width int) Metadata {
 		s.videoWidth = width
 	}
 }
+
+// VideoFrameRateMetadata is the frame rate the client declared, it may not be
+// what it actually sends
+func VideoFrameRateMetadata(frameRate float64) Metadata {
+	return func(s *Stream) {
+		s.videoFrameRate = frameRate
+	}
+}
+
+func KeyframeMetadata() Metadata {
+	return func(s *Stream) {
+		s.health.addKeyframe(time.Now())
+	}
+}
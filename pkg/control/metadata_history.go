@@ -0,0 +1,82 @@
+package control
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 15 minutes of history at one snapshot per heartbeat
+const DefaultMetadataHistorySize = 60
+
+type TimestampedMetadata struct {
+	Timestamp int64 `json:"timestamp"`
+	StreamMetadata
+}
+
+// recordMetadataHistory snapshots the stream metadata, overwriting the oldest
+// snapshot once the history is full
+func (mgr *Control) recordMetadataHistory(stream *Stream) {
+	entry := &TimestampedMetadata{
+		Timestamp:      time.Now().Unix(),
+		StreamMetadata: mgr.streamMetadata(stream),
+	}
+
+	stream.metadataHistoryMutex.Lock()
+	defer stream.metadataHistoryMutex.Unlock()
+
+	if len(stream.metadataHistory) < cap(stream.metadataHistory) {
+		stream.metadataHistory = append(stream.metadataHistory, entry)
+		return
+	}
+	if len(stream.metadataHistory) == 0 {
+		return
+	}
+	stream.metadataHistory[stream.metadataHistoryNext] = entry
+	stream.metadataHistoryNext = (stream.metadataHistoryNext + 1) % len(stream.metadataHistory)
+}
+
+// MetadataHistory returns up to the last n snapshots, oldest first
+func (s *Stream) MetadataHistory(n int) []*TimestampedMetadata {
+	s.metadataHistoryMutex.RLock()
+	defer s.metadataHistoryMutex.RUnlock()
+
+	ordered := make([]*TimestampedMetadata, 0, len(s.metadataHistory))
+	ordered = append(ordered, s.metadataHistory[s.metadataHistoryNext:]...)
+	ordered = append(ordered, s.metadataHistory[:s.metadataHistoryNext]...)
+
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// apiStreamMetadataHistory serves the metadata snapshots, ?limit=N only
+// returns the last N of them
+func (mgr *Control) apiStreamMetadataHistory(w http.ResponseWriter, r *http.Request, stream *Stream) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	history := stream.MetadataHistory(limit)
+	if !mgr.HasAPIToken() {
+		// Anyone can read it without a token
+		for i, entry := range history {
+			history[i] = &TimestampedMetadata{
+				Timestamp:      entry.Timestamp,
+				StreamMetadata: entry.StreamMetadata.public(),
+			}
+		}
+	}
+	apiJSON(w, http.StatusOK, history)
+}
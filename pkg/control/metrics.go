@@ -0,0 +1,23 @@
+package control
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	streamHealthScore = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stream_health_score",
+		Help: "Health score of the stream between 0 and 100",
+	}, []string{"channel_id"})
+
+	orchestratorActiveIndex = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "orchestrator_active_index",
+		Help: "Position in the orchestrator chain of the orchestrator currently in use, 0 is the primary",
+	})
+
+	orchestratorConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "orchestrator_connected_bool",
+		Help: "1 if the orchestrator answered the last connect or ping, 0 otherwise",
+	})
+)
@@ -1,6 +1,26 @@
 package control
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	orchestratorPingInterval = 30 * time.Second
+
+	// How long a stream recovered from the orchestrator waits for its
+	// broadcaster to come back before it's ended
+	recoveredStreamTimeout = 2 * time.Minute
+)
+
+// ActiveStreamInfo is a stream the orchestrator has live on this node
+type ActiveStreamInfo struct {
+	ChannelID ChannelID
+	StreamID  StreamID
+	StartTime time.Time
+}
 
 type Orchestrator interface {
 	// Name of the service, eg: Glimesh
@@ -9,6 +29,8 @@ type Orchestrator interface {
 	Connect() error
 	// Close the service connection
 	Close() error
+	// Ping checks the orchestrator is still reachable
+	Ping() error
 
 	SetLogger(logrus.FieldLogger)
 
@@ -18,6 +40,9 @@ type Orchestrator interface {
 	StartStream(channelID ChannelID, streamID StreamID) error
 	StopStream(channelID ChannelID, streamID StreamID) error
 	Heartbeat(channelID ChannelID) error
+	// ListActiveStreams returns the streams the orchestrator still has live
+	// on this node, eg after a crash
+	ListActiveStreams() ([]ActiveStreamInfo, error)
 
 	// TODO: Be less specific to the FTL Orchestrator
 	// SendIntro(message interface{})
@@ -27,3 +52,107 @@ type Orchestrator interface {
 	// SendStreamPublishing(message interface{})
 	// SendStreamRelaying(message interface{})
 }
+
+// ConnectOrchestrator connects orch, retrying with exponential backoff until
+// it succeeds or maxDuration has passed
+func ConnectOrchestrator(orch Orchestrator, log logrus.FieldLogger, maxDuration time.Duration) error {
+	return connectWithBackoff("orchestrator "+orch.Name(), func() error {
+		if err := orch.Connect(); err != nil {
+			orchestratorConnected.Set(0)
+			return err
+		}
+		orchestratorConnected.Set(1)
+		return nil
+	}, log, maxDuration)
+}
+
+// MonitorOrchestrator pings the orchestrator until ctx is done, keeping
+// orchestrator_connected_bool up to date
+func (mgr *Control) MonitorOrchestrator(ctx context.Context) {
+	ticker := time.NewTicker(orchestratorPingInterval)
+	defer ticker.Stop()
+
+	connected := true
+	for {
+		select {
+		case <-ticker.C:
+			err := mgr.orchestrator.Ping()
+			if err != nil {
+				orchestratorConnected.Set(0)
+				if connected {
+					mgr.log.Warnf("Orchestrator %s is unreachable: %s", mgr.orchestrator.Name(), err)
+				}
+			} else {
+				orchestratorConnected.Set(1)
+				if !connected {
+					mgr.log.Infof("Orchestrator %s is reachable again", mgr.orchestrator.Name())
+				}
+			}
+			connected = err == nil
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RecoverOrchestratorStreams puts the streams the orchestrator still has live
+// on this node back into the stream state, keeping their StreamID and start
+// time. A broadcaster reconnecting takes its stream over, any that don't come
+// back within recoveredStreamTimeout are ended. It needs the orchestrator and
+// logger to be set, so it's called after New rather than from it.
+func (mgr *Control) RecoverOrchestratorStreams() {
+	active, err := mgr.orchestrator.ListActiveStreams()
+	if err != nil {
+		mgr.log.Warnf("Failed to list active streams from orchestrator %s: %s", mgr.orchestrator.Name(), err)
+		return
+	}
+
+	for _, info := range active {
+		if mgr.endingRecoveredStream(info.ChannelID) {
+			// Redis has it too, EndRecoveredStreams takes care of it
+			continue
+		}
+
+		stream, err := mgr.newStream(context.Background(), info.ChannelID, "")
+		if err != nil {
+			mgr.log.Warnf("Failed to recover stream for channel %s: %s", info.ChannelID, err)
+			continue
+		}
+		stream.StreamID = info.StreamID
+		stream.startTime = info.StartTime.Unix()
+		stream.recovered = true
+		mgr.saveStreamState(stream)
+
+		stream.log.Infof("Recovered stream %d from orchestrator %s", stream.StreamID, mgr.orchestrator.Name())
+		time.AfterFunc(recoveredStreamTimeout, func() {
+			if current, err := mgr.getStream(stream.ChannelID); err != nil || current != stream {
+				// Taken over by a broadcaster, or already stopped
+				return
+			}
+			stream.log.Infof("Broadcaster didn't come back, ending recovered stream %d", stream.StreamID)
+			mgr.StopStream(stream.ChannelID)
+		})
+	}
+}
+
+// takeRecoveredStream removes a stream recovered from the orchestrator so a
+// reconnecting broadcaster can start it again, it returns nil if there isn't one
+func (mgr *Control) takeRecoveredStream(channelID ChannelID) *Stream {
+	stream, err := mgr.getStream(channelID)
+	if err != nil || !stream.recovered {
+		return nil
+	}
+
+	mgr.removeStream(channelID)
+	stream.cancel()
+	return stream
+}
+
+func (mgr *Control) endingRecoveredStream(channelID ChannelID) bool {
+	for _, stream := range mgr.recoveredStreams {
+		if stream.ChannelID == channelID {
+			return true
+		}
+	}
+	return false
+}
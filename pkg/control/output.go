@@ -2,7 +2,12 @@ package control
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -10,5 +15,216 @@ type Output interface {
 	SetControl(ctrl *Control)
 	SetLogger(log logrus.FieldLogger)
 
+	// Listen is run in its own goroutine, ctx is cancelled when the output
+	// is deregistered or waveguide shuts down
 	Listen(ctx context.Context)
+	// SupportedCodecs lists the mime types of the tracks the output can
+	// use, inputs skip transcoding when nothing needs it
+	SupportedCodecs() []string
+	// Stop releases everything the output holds once it's deregistered, its
+	// Listen context is cancelled as well
+	Stop()
+}
+
+// MimeTypeAAC is for tracks carrying AAC as ADTS frames, the way MPEG-TS
+// does, rather than RTP
+const MimeTypeAAC = "audio/aac"
+
+// OutputFactory builds an output from its type and config fields, main
+// provides one so outputs can be added through /api/v1/outputs
+type OutputFactory func(outputType string, config map[string]interface{}) (Output, error)
+
+var (
+	ErrOutputExists   = errors.New("an output with this name is already registered")
+	ErrOutputNotFound = errors.New("no output with this name is registered")
+)
+
+type registeredOutput struct {
+	output Output
+	cancel context.CancelFunc
+}
+
+func (mgr *Control) SetOutputFactory(factory OutputFactory) {
+	mgr.outputFactory = factory
+}
+
+// RegisterOutput starts an output, either at boot or while streams are
+// already running. Outputs that handle stream events are told about every
+// stream that's live once their Listen returns, as if it had just started.
+func (mgr *Control) RegisterOutput(name string, output Output) error {
+	mgr.outputsMutex.Lock()
+	if _, exists := mgr.outputs[name]; exists {
+		mgr.outputsMutex.Unlock()
+		return ErrOutputExists
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	mgr.outputs[name] = &registeredOutput{output: output, cancel: cancel}
+	mgr.outputsMutex.Unlock()
+
+	go func() {
+		output.Listen(ctx)
+		// Outputs that run until ctx is done have nothing to catch up on
+		if handler, ok := output.(EventHandler); ok && ctx.Err() == nil {
+			mgr.announceLiveStreams(name, handler)
+		}
+	}()
+
+	return nil
+}
+
+// announceLiveStreams sends a started event for every live stream to an
+// output registered after they started
+func (mgr *Control) announceLiveStreams(name string, handler EventHandler) {
+	for _, stream := range mgr.liveStreams() {
+		event := StreamEvent{
+			Type:      EventStreamStarted,
+			ChannelID: stream.ChannelID,
+			StreamID:  stream.StreamID,
+		}
+		if err := handler.HandleStreamEvent(event); err != nil {
+			mgr.log.WithField("output", name).Errorf("Failed handling %s event: %+v", event.Type, err)
+		}
+	}
+}
+
+// DeregisterOutput stops an output and removes it, live streams carry on
+// without it
+func (mgr *Control) DeregisterOutput(name string) error {
+	mgr.outputsMutex.Lock()
+	registered, exists := mgr.outputs[name]
+	delete(mgr.outputs, name)
+	mgr.outputsMutex.Unlock()
+	if !exists {
+		return ErrOutputNotFound
+	}
+
+	registered.cancel()
+	registered.output.Stop()
+	return nil
+}
+
+// cancelOutputs cancels the Listen context of every registered output,
+// Shutdown does once the streams they serve have stopped
+func (mgr *Control) cancelOutputs() {
+	mgr.outputsMutex.RLock()
+	defer mgr.outputsMutex.RUnlock()
+
+	for _, registered := range mgr.outputs {
+		registered.cancel()
+	}
+}
+
+// OutputCodecSupport reports whether any registered output supports a mime
+// type, and whether all of them do
+func (mgr *Control) OutputCodecSupport(mimeType string) (some bool, all bool) {
+	mgr.outputsMutex.RLock()
+	defer mgr.outputsMutex.RUnlock()
+
+	all = len(mgr.outputs) > 0
+	for _, registered := range mgr.outputs {
+		supported := false
+		for _, codec := range registered.output.SupportedCodecs() {
+			if strings.EqualFold(codec, mimeType) {
+				supported = true
+				break
+			}
+		}
+		some = some || supported
+		all = all && supported
+	}
+	return some, all
+}
+
+// outputEventHandlers are the registered outputs that want stream events
+func (mgr *Control) outputEventHandlers() []EventHandler {
+	mgr.outputsMutex.RLock()
+	defer mgr.outputsMutex.RUnlock()
+
+	var handlers []EventHandler
+	for _, registered := range mgr.outputs {
+		if handler, ok := registered.output.(EventHandler); ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+// liveStreams is a snapshot of the streams currently running
+func (mgr *Control) liveStreams() []*Stream {
+	mgr.streamsMutex.RLock()
+	defer mgr.streamsMutex.RUnlock()
+
+	streams := make([]*Stream, 0, len(mgr.streams))
+	for _, stream := range mgr.streams {
+		if !stream.recovered {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// apiOutputs adds outputs with POST /api/v1/outputs, taking a JSON body with
+// the name and type of the output next to its config fields, and removes
+// them with DELETE /api/v1/outputs/{name}
+func (mgr *Control) apiOutputs(w http.ResponseWriter, r *http.Request) {
+	if !mgr.HasAPIToken() {
+		// RequireAPIToken lets everything through without a token, and this
+		// starts outputs with whatever config it's sent
+		apiError(w, http.StatusForbidden, "outputs can only be changed at runtime with api_token set")
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/outputs"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && name == "":
+		mgr.apiRegisterOutput(w, r)
+	case r.Method == http.MethodDelete && name != "":
+		if err := mgr.DeregisterOutput(name); err != nil {
+			apiError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		mgr.log.Infof("Deregistered output %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (mgr *Control) apiRegisterOutput(w http.ResponseWriter, r *http.Request) {
+	if mgr.outputFactory == nil {
+		apiError(w, http.StatusNotImplemented, "outputs can't be added at runtime")
+		return
+	}
+
+	var config map[string]interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&config); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	name, _ := config["name"].(string)
+	outputType, _ := config["type"].(string)
+	if name == "" || outputType == "" {
+		apiError(w, http.StatusBadRequest, "name and type are required")
+		return
+	}
+
+	output, err := mgr.outputFactory(outputType, config)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	output.SetControl(mgr)
+	output.SetLogger(mgr.ComponentLogger(fmt.Sprintf("output.%s", outputType), logrus.Fields{"output": name}))
+
+	if err := mgr.RegisterOutput(name, output); err != nil {
+		apiError(w, http.StatusConflict, err.Error())
+		return
+	}
+	mgr.log.Infof("Registered %s output %s", outputType, name)
+
+	apiJSON(w, http.StatusCreated, struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}{name, outputType})
 }
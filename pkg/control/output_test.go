@@ -0,0 +1,107 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingOutput runs until its Listen context is done, and records the
+// stream events it gets
+type blockingOutput struct {
+	listening chan context.Context
+	stopped   chan struct{}
+
+	eventsMutex sync.Mutex
+	events      []StreamEvent
+}
+
+func newBlockingOutput() *blockingOutput {
+	return &blockingOutput{
+		listening: make(chan context.Context, 1),
+		stopped:   make(chan struct{}),
+	}
+}
+
+func (o *blockingOutput) SetControl(ctrl *Control)         {}
+func (o *blockingOutput) SetLogger(log logrus.FieldLogger) {}
+func (o *blockingOutput) SupportedCodecs() []string        { return nil }
+func (o *blockingOutput) Stop()                            {}
+
+func (o *blockingOutput) Listen(ctx context.Context) {
+	o.listening <- ctx
+	<-ctx.Done()
+	close(o.stopped)
+}
+
+func (o *blockingOutput) HandleStreamEvent(event StreamEvent) error {
+	o.eventsMutex.Lock()
+	defer o.eventsMutex.Unlock()
+	o.events = append(o.events, event)
+	return nil
+}
+
+// readyOutput sets itself up in Listen and returns
+type readyOutput struct {
+	blockingOutput
+}
+
+func (o *readyOutput) Listen(ctx context.Context) {
+	o.listening <- ctx
+}
+
+func TestRegisterOutputListensInBackground(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+
+	output := newBlockingOutput()
+	// Doesn't wait for Listen, which runs until shutdown
+	assert.NoError(mgr.RegisterOutput("blocking", output))
+	assert.ErrorIs(mgr.RegisterOutput("blocking", newBlockingOutput()), ErrOutputExists)
+
+	var ctx context.Context
+	select {
+	case ctx = <-output.listening:
+	case <-time.After(time.Second):
+		t.Fatal("Listen wasn't called")
+	}
+	assert.NoError(ctx.Err())
+
+	assert.NoError(mgr.Shutdown(context.Background()))
+	select {
+	case <-output.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't cancel the output")
+	}
+}
+
+func TestRegisterOutputAnnouncesLiveStreams(t *testing.T) {
+	assert := assert.New(t)
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+
+	stream, err := mgr.newStream(context.Background(), 1, "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	output := &readyOutput{blockingOutput{listening: make(chan context.Context, 1)}}
+	assert.NoError(mgr.RegisterOutput("ready", output))
+	ctx := <-output.listening
+
+	assert.Eventually(func() bool {
+		output.eventsMutex.Lock()
+		defer output.eventsMutex.Unlock()
+		return len(output.events) == 1
+	}, time.Second, 10*time.Millisecond)
+	output.eventsMutex.Lock()
+	assert.Equal(StreamEvent{Type: EventStreamStarted, ChannelID: 1, StreamID: stream.StreamID}, output.events[0])
+	output.eventsMutex.Unlock()
+
+	assert.NoError(mgr.DeregisterOutput("ready"))
+	assert.Error(ctx.Err())
+	assert.ErrorIs(mgr.DeregisterOutput("ready"), ErrOutputNotFound)
+}
@@ -0,0 +1,53 @@
+package control
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// StartPProfServer serves the Go profiler on PProfAddress, it's disabled
+// when that's unset. Requests need PProfToken as a bearer token if it's set.
+func (mgr *Control) StartPProfServer() {
+	if mgr.config.PProfAddress == "" {
+		return
+	}
+	if mgr.config.PProfToken == "" {
+		mgr.log.Warnf("pprof is listening on %s without pprof_token, anyone who can reach it can profile this process", mgr.config.PProfAddress)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mgr.log.Infof("Starting pprof server on %s", mgr.config.PProfAddress)
+	srv := &http.Server{
+		Addr:    mgr.config.PProfAddress,
+		Handler: requireBearerToken(mgr.config.PProfToken, mux),
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		mgr.log.Errorf("Failed: %+v", err)
+	}
+}
+
+// requireBearerToken only lets requests with an Authorization: Bearer token
+// through, an empty token lets everything through
+func requireBearerToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,256 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	redisStreamKeyPrefix   = "waveguide:stream:"
+	redisLockKeyPrefix     = "waveguide:lock:"
+	redisCategoryKeyPrefix = "waveguide:category:"
+
+	// Stream state outlives a few missed heartbeats, then expires so a dead
+	// node can't hold on to its channels forever
+	redisStreamTTL   = 3 * heartbeatInterval
+	redisLockTTL     = 30 * time.Second
+	redisCallTimeout = 2 * time.Second
+)
+
+var ErrStreamOwnedElsewhere = errors.New("stream is live on another node")
+
+// Only deletes the lock if we still hold it, so an expired lock taken over by
+// another process is left alone
+var redisUnlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Adds a channel to its category's sorted set, scored by when it expires, if
+// the category has room once expired channels are dropped. Returns 1 if the
+// channel was added.
+var redisReserveCategoryScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) and redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[4], ARGV[1])
+return 1
+`)
+
+// redisState mirrors mgr.streams into Redis hashes, so nodes sharing a Redis
+// can see which of them owns a channel and recover after a crash
+type redisState struct {
+	client   *redis.Client
+	hostname string
+	// Random for every process, several can run on one host and must not
+	// take each other's streams or locks for their own
+	token string
+	log   logrus.FieldLogger
+}
+
+func newRedisState(url string, hostname string) (*redisState, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid redis_url")
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, errors.Wrap(err, "generating redis owner token")
+	}
+
+	return &redisState{
+		client:   redis.NewClient(opts),
+		hostname: hostname,
+		token:    hex.EncodeToString(token),
+		log:      logrus.StandardLogger(),
+	}, nil
+}
+
+// recoveredStream is a stream this node had in Redis before it restarted
+type recoveredStream struct {
+	ChannelID ChannelID
+	StreamID  StreamID
+}
+
+func redisStreamKey(channelID ChannelID) string {
+	return redisStreamKeyPrefix + channelID.String()
+}
+
+func redisLockKey(channelID ChannelID) string {
+	return redisLockKeyPrefix + channelID.String()
+}
+
+func redisCategoryKey(category string) string {
+	return redisCategoryKeyPrefix + category
+}
+
+// saveStream writes the state of a stream, leaving out the tracks and other
+// things that only make sense in this process
+func (r *redisState) saveStream(stream *Stream) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	key := redisStreamKey(stream.ChannelID)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, map[string]interface{}{
+			"node":                r.hostname,
+			"owner":               r.token,
+			"channel_id":          uint32(stream.ChannelID),
+			"stream_id":           uint32(stream.StreamID),
+			"start_time":          stream.startTime,
+			"last_time":           stream.lastTime,
+			"audio_codec":         stream.audioCodec,
+			"video_codec":         stream.videoCodec,
+			"video_width":         stream.videoWidth,
+			"video_height":        stream.videoHeight,
+			"client_vendor_name":  stream.clientVendorName,
+			"total_audio_packets": stream.totalAudioPackets,
+			"total_video_packets": stream.totalVideoPackets,
+		})
+		pipe.Expire(ctx, key, redisStreamTTL)
+		if stream.category != "" {
+			// Keeps the stream counted towards its category until it expires
+			pipe.ZAdd(ctx, redisCategoryKey(stream.category), redis.Z{
+				Score:  float64(time.Now().Add(redisStreamTTL).Unix()),
+				Member: stream.ChannelID.String(),
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisState) deleteStream(channelID ChannelID, category string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisStreamKey(channelID))
+		if category != "" {
+			pipe.ZRem(ctx, redisCategoryKey(category), channelID.String())
+		}
+		return nil
+	})
+	return err
+}
+
+// reserveCategorySlot counts a channel towards the streams live in its
+// category on every node, returning false if there are max already. Nodes
+// that die without removing their streams stop counting once they expire.
+func (r *redisState) reserveCategorySlot(channelID ChannelID, category string, max int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	now := time.Now()
+	reserved, err := redisReserveCategoryScript.Run(ctx, r.client, []string{redisCategoryKey(category)},
+		channelID.String(), max, now.Unix(), now.Add(redisStreamTTL).Unix()).Int()
+	if err != nil {
+		return false, err
+	}
+	return reserved == 1, nil
+}
+
+// ownedElsewhere returns the node a channel is live on when that isn't this
+// process, or "" if it isn't live anywhere else
+func (r *redisState) ownedElsewhere(channelID ChannelID) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	values, err := r.client.HMGet(ctx, redisStreamKey(channelID), "node", "owner").Result()
+	if err != nil {
+		return "", err
+	}
+	node, _ := values[0].(string)
+	owner, _ := values[1].(string)
+	if node == "" || owner == r.token {
+		return "", nil
+	}
+	return node, nil
+}
+
+// lock takes the start/stop lock for a channel, returning a func to release it
+func (r *redisState) lock(channelID ChannelID) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	key := redisLockKey(channelID)
+	ok, err := r.client.SetNX(ctx, key, r.token, redisLockTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("channel %s is being started or stopped on another node", channelID)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+		defer cancel()
+
+		if err := redisUnlockScript.Run(ctx, r.client, []string{key}, r.token).Err(); err != nil {
+			r.log.Warnf("Failed to release redis lock for %s: %s", channelID, err)
+		}
+	}, nil
+}
+
+// recover returns the streams this node left behind in Redis and removes
+// them, the publishers went away with the process. A previous run is only
+// known by its hostname, so processes sharing a host need a hostname each
+// for this to leave the others' streams alone.
+func (r *redisState) recover() ([]recoveredStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	var recovered []recoveredStream
+	iter := r.client.Scan(ctx, 0, redisStreamKeyPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		values, err := r.client.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return recovered, err
+		}
+		if values["node"] != r.hostname {
+			continue
+		}
+
+		channelID, err := strconv.ParseUint(values["channel_id"], 10, 32)
+		if err != nil {
+			continue
+		}
+		streamID, _ := strconv.ParseUint(values["stream_id"], 10, 32)
+		recovered = append(recovered, recoveredStream{
+			ChannelID: ChannelID(channelID),
+			StreamID:  StreamID(streamID),
+		})
+
+		if err := r.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return recovered, err
+		}
+	}
+
+	return recovered, iter.Err()
+}
+
+// EndRecoveredStreams tells the service and orchestrator that the streams
+// this node had live before it crashed are over. It needs both to be set.
+func (mgr *Control) EndRecoveredStreams() {
+	for _, stream := range mgr.recoveredStreams {
+		mgr.log.Infof("Ending stream %d for channel %s left over from a previous run", stream.StreamID, stream.ChannelID)
+		mgr.publishEvent(StreamEvent{
+			Type:      EventStreamStopped,
+			ChannelID: stream.ChannelID,
+			StreamID:  stream.StreamID,
+		})
+	}
+	mgr.recoveredStreams = nil
+}
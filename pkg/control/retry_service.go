@@ -0,0 +1,231 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrServiceUnavailable = errors.New("service unavailable, circuit breaker is open")
+
+const (
+	DefaultRetryMaxRetries         = 3
+	DefaultRetryBaseDelay          = 200 * time.Millisecond
+	DefaultCircuitBreakerThreshold = 5
+	DefaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type RetryServiceConfig struct {
+	// Retries after the first attempt for retriable errors
+	MaxRetries int `mapstructure:"max_retries"`
+	// Delay before the first retry, doubled after each attempt
+	BaseDelay time.Duration `mapstructure:"base_delay"`
+	// Consecutive failed calls before the circuit opens
+	CircuitBreakerThreshold int `mapstructure:"circuit_breaker_threshold"`
+	// How long calls fail fast once the circuit is open
+	CircuitBreakerCooldown time.Duration `mapstructure:"circuit_breaker_cooldown"`
+}
+
+// RetryService wraps a Service, retrying calls that failed for transient
+// reasons and failing fast while the service looks to be down
+type RetryService struct {
+	service Service
+	config  RetryServiceConfig
+	log     logrus.FieldLogger
+
+	mutex    sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func NewRetryService(service Service, config RetryServiceConfig) *RetryService {
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultRetryMaxRetries
+	}
+	if config.BaseDelay == 0 {
+		config.BaseDelay = DefaultRetryBaseDelay
+	}
+	if config.CircuitBreakerThreshold == 0 {
+		config.CircuitBreakerThreshold = DefaultCircuitBreakerThreshold
+	}
+	if config.CircuitBreakerCooldown == 0 {
+		config.CircuitBreakerCooldown = DefaultCircuitBreakerCooldown
+	}
+
+	return &RetryService{
+		service: service,
+		config:  config,
+		log:     logrus.StandardLogger(),
+	}
+}
+
+func (s *RetryService) SetLogger(log logrus.FieldLogger) {
+	s.log = log
+	s.service.SetLogger(log)
+}
+
+func (s *RetryService) Name() string {
+	return s.service.Name()
+}
+
+func (s *RetryService) Connect() error {
+	return s.service.Connect()
+}
+
+func (s *RetryService) GetHmacKey(channelID ChannelID) (key []byte, err error) {
+	err = s.call("GetHmacKey", func() error {
+		key, err = s.service.GetHmacKey(channelID)
+		return err
+	})
+	return key, err
+}
+
+func (s *RetryService) StartStream(channelID ChannelID) (streamID StreamID, err error) {
+	err = s.call("StartStream", func() error {
+		streamID, err = s.service.StartStream(channelID)
+		return err
+	})
+	return streamID, err
+}
+
+func (s *RetryService) EndStream(streamID StreamID) error {
+	return s.call("EndStream", func() error {
+		return s.service.EndStream(streamID)
+	})
+}
+
+func (s *RetryService) UpdateStreamMetadata(streamID StreamID, metadata StreamMetadata) error {
+	return s.call("UpdateStreamMetadata", func() error {
+		return s.service.UpdateStreamMetadata(streamID, metadata)
+	})
+}
+
+func (s *RetryService) SendJpegPreviewImage(streamID StreamID, img []byte) error {
+	return s.call("SendJpegPreviewImage", func() error {
+		return s.service.SendJpegPreviewImage(streamID, img)
+	})
+}
+
+func (s *RetryService) GetChannelCategory(channelID ChannelID) (category string, err error) {
+	err = s.call("GetChannelCategory", func() error {
+		category, err = s.service.GetChannelCategory(channelID)
+		return err
+	})
+	return category, err
+}
+
+// GetChannelIDByStreamKey passes lookups through when the wrapped service supports them
+func (s *RetryService) GetChannelIDByStreamKey(streamKey StreamKey) (channelID ChannelID, err error) {
+	lookup, ok := s.service.(ChannelLookupService)
+	if !ok {
+		return 0, fmt.Errorf("service %s does not support looking up channels by stream key", s.service.Name())
+	}
+
+	err = s.call("GetChannelIDByStreamKey", func() error {
+		channelID, err = lookup.GetChannelIDByStreamKey(streamKey)
+		return err
+	})
+	return channelID, err
+}
+
+// call runs fn, retrying with exponential backoff while it returns retriable errors
+func (s *RetryService) call(name string, fn func() error) error {
+	if !s.allow() {
+		return ErrServiceUnavailable
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !retriable(err) {
+			break
+		}
+		if attempt >= s.config.MaxRetries {
+			break
+		}
+
+		delay := s.config.BaseDelay << attempt
+		s.log.Debugf("%s failed, retrying in %s: %s", name, delay, err)
+		time.Sleep(delay)
+	}
+
+	// Only transient failures count towards the breaker, a rejected stream
+	// key says nothing about the health of the service
+	s.record(err == nil || !retriable(err))
+
+	return err
+}
+
+// allow reports whether a call may go through, moving an open circuit to
+// half open once the cooldown has passed
+func (s *RetryService) allow() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case circuitOpen:
+		if time.Since(s.openedAt) < s.config.CircuitBreakerCooldown {
+			return false
+		}
+		s.state = circuitHalfOpen
+		s.log.Infof("Service %s circuit half open, trying a request", s.service.Name())
+		return true
+	case circuitHalfOpen:
+		// Only the trial request goes through until we know how it went
+		return false
+	}
+	return true
+}
+
+func (s *RetryService) record(success bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if success {
+		if s.state != circuitClosed {
+			s.log.Infof("Service %s circuit closed", s.service.Name())
+		}
+		s.state = circuitClosed
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.state == circuitHalfOpen || s.failures >= s.config.CircuitBreakerThreshold {
+		if s.state != circuitOpen {
+			s.log.Warnf("Service %s circuit open after %d failures, failing fast for %s", s.service.Name(), s.failures, s.config.CircuitBreakerCooldown)
+		}
+		s.state = circuitOpen
+		s.openedAt = time.Now()
+	}
+}
+
+// Non 200 responses are reported as "<status>; body: ..." by the GraphQL client
+var serverErrorPattern = regexp.MustCompile(`(^|\W)5\d\d\s`)
+
+// retriable reports whether err looks transient: network errors, timeouts or 5xx responses
+func retriable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode() >= 500
+	}
+	return serverErrorPattern.MatchString(err.Error())
+}
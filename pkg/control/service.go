@@ -19,4 +19,14 @@ type Service interface {
 	UpdateStreamMetadata(streamID StreamID, metadata StreamMetadata) error
 	// SendJpegPreviewImage Sends a JPEG preview image of a stream to the service
 	SendJpegPreviewImage(streamID StreamID, img []byte) error
+	// GetChannelCategory Get the category a channel is in, eg its plan, for
+	// the limits in Config.ChannelCategories
+	GetChannelCategory(channelID ChannelID) (string, error)
+}
+
+// ChannelLookupService is implemented by services that can find a channel by
+// its stream key alone, for inputs where the client only sends the key
+type ChannelLookupService interface {
+	// GetChannelIDByStreamKey Get the channel ID a stream key belongs to
+	GetChannelIDByStreamKey(streamKey StreamKey) (ChannelID, error)
 }
@@ -0,0 +1,31 @@
+package control
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// SetVideoSSRC records the SSRC an input sends video RTP with, so packet
+// captures can be matched up with the stream
+func (s *Stream) SetVideoSSRC(ssrc uint32) {
+	atomic.StoreUint32(&s.videoSSRC, ssrc)
+}
+
+// SetAudioSSRC records the SSRC an input sends audio RTP with
+func (s *Stream) SetAudioSSRC(ssrc uint32) {
+	atomic.StoreUint32(&s.audioSSRC, ssrc)
+}
+
+// apiStreamSSRC returns the RTP SSRCs of a stream, zero for inputs that
+// don't report them
+func (mgr *Control) apiStreamSSRC(w http.ResponseWriter, r *http.Request, stream *Stream) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	apiJSON(w, http.StatusOK, struct {
+		VideoSSRC uint32 `json:"video_ssrc"`
+		AudioSSRC uint32 `json:"audio_ssrc"`
+	}{atomic.LoadUint32(&stream.videoSSRC), atomic.LoadUint32(&stream.audioSSRC)})
+}
@@ -3,11 +3,34 @@ package control
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
+// Caption packets buffered for outputs before new ones are dropped
+const closedCaptionsBuffer = 100
+
+// Splice events buffered for outputs before new ones are dropped
+const spliceEventsBuffer = 10
+
+// SpliceEvent marks the start or end of an ad break, signalled by SCTE-35
+// splice_insert commands in the input
+type SpliceEvent struct {
+	EventID uint32
+	// Cancels an earlier event with the same EventID
+	Cancel bool
+	// Set at the start of a break, unset when returning from one
+	OutOfNetwork bool
+	// Length of the break, zero if the input didn't say
+	Duration time.Duration
+	// The break ends by itself after Duration, without another event
+	AutoReturn bool
+}
+
 type StreamTrack struct {
 	Type  webrtc.RTPCodecType
 	Codec string
@@ -23,6 +46,9 @@ type Stream struct {
 	authenticated bool
 	// mediaStarted is set after media bytes have come in from the client
 	mediaStarted bool
+	// recovered is set for streams put back from the orchestrator at startup,
+	// until their broadcaster reconnects
+	recovered    bool
 	hasSomeAudio bool
 	hasSomeVideo bool
 
@@ -30,6 +56,30 @@ type Stream struct {
 	stopPeersnap  chan bool
 
 	lastThumbnail chan []byte
+	// The newest keyframe, kept for on demand thumbnails since the heartbeat
+	// drains lastThumbnail
+	lastKeyframeMutex sync.Mutex
+	lastKeyframe      []byte
+	thumbnailLimiter  *rate.Limiter
+
+	// H264 parameter sets from the input, see SetDecoderConfig
+	decoderConfigMutex sync.RWMutex
+	sps                []byte
+	pps                []byte
+
+	// RTP SSRCs the input sends with, see SetVideoSSRC and SetAudioSSRC.
+	// Accessed atomically.
+	videoSSRC uint32
+	audioSSRC uint32
+
+	// Timers for Config.ThumbnailAtOffsets, stopped with the stream
+	scheduledThumbnailsMutex sync.Mutex
+	scheduledThumbnails      []*time.Timer
+
+	// CEA-608 cc_data triplets extracted from the video by the input
+	closedCaptions chan []byte
+	// Ad breaks signalled by the input
+	spliceEvents chan SpliceEvent
 
 	ChannelID ChannelID
 	StreamID  StreamID
@@ -37,6 +87,11 @@ type Stream struct {
 
 	tracks []StreamTrack
 
+	health *streamHealth
+
+	// Bytes received from the broadcaster over the last minute
+	bandwidth BandwidthSampler
+
 	// Raw Metadata
 	startTime           int64
 	lastTime            int64 // Last time the metadata collector ran
@@ -46,12 +101,31 @@ type Stream struct {
 	totalVideoPackets   int
 	lastAudioPackets    int
 	lastVideoPackets    int
+	lostPackets         int
+	fractionLost        float64
+	jitterMs            int
+	audioGaps           int
 	clientVendorName    string
 	clientVendorVersion string
 	videoCodec          string
 	audioCodec          string
 	videoHeight         int
+	videoFrameRate      float64
 	videoWidth          int
+	// Where the broadcaster is connecting from, when the input can tell
+	sourceCountry string
+	sourceCity    string
+	sourceASN     uint
+	sourceIP      string
+	input         string
+	// Service category of the channel, see Config.ChannelCategories
+	category string
+
+	// Ring buffer of metadata snapshots taken every heartbeat, the next one
+	// overwrites metadataHistoryNext once it's full
+	metadataHistoryMutex sync.RWMutex
+	metadataHistory      []*TimestampedMetadata
+	metadataHistoryNext  int
 }
 
 func (s *Stream) AddTrack(track webrtc.TrackLocal, codec string) error {
@@ -75,6 +149,39 @@ func (s *Stream) AddTrack(track webrtc.TrackLocal, codec string) error {
 	return nil
 }
 
+// isAudioOnly is set once the input has added audio without any video, eg
+// a radio style stream
+func (s *Stream) isAudioOnly() bool {
+	return s.hasSomeAudio && !s.hasSomeVideo
+}
+
+// Context is cancelled when the stream stops
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// WriteClosedCaptions hands caption data to outputs, dropping it if nobody is reading
+func (s *Stream) WriteClosedCaptions(ccData []byte) {
+	select {
+	case s.closedCaptions <- ccData:
+	default:
+	}
+}
+
+// WriteSpliceEvent hands an ad break marker to outputs, dropping it if nobody is reading
+func (s *Stream) WriteSpliceEvent(event SpliceEvent) {
+	select {
+	case s.spliceEvents <- event:
+	default:
+	}
+}
+
+// HealthScore returns a 0-100 score of the stream health, calculated every heartbeat
+func (s *Stream) HealthScore() int {
+	score, _ := s.health.get()
+	return score
+}
+
 func (s *Stream) ReportMetadata(metadatas ...Metadata) error {
 	for _, metadata := range metadatas {
 		metadata(s)
@@ -84,18 +191,38 @@ func (s *Stream) ReportMetadata(metadatas ...Metadata) error {
 }
 
 type StreamMetadata struct {
-	AudioCodec        string
-	IngestServer      string
-	IngestViewers     int
-	LostPackets       int
-	NackPackets       int
-	RecvPackets       int
-	SourceBitrate     int
-	SourcePing        int
-	StreamTimeSeconds int
-	VendorName        string
-	VendorVersion     string
-	VideoCodec        string
-	VideoHeight       int
-	VideoWidth        int
+	AudioCodec        string `json:"audio_codec"`
+	IngestServer      string `json:"ingest_server"`
+	IngestViewers     int    `json:"ingest_viewers"`
+	LostPackets       int    `json:"lost_packets"`
+	NackPackets       int    `json:"nack_packets"`
+	RecvPackets       int    `json:"recv_packets"`
+	SourceBitrate     int    `json:"source_bitrate"`
+	SourcePing        int    `json:"source_ping"`
+	StreamTimeSeconds int    `json:"stream_time_seconds"`
+	VendorName        string `json:"vendor_name"`
+	VendorVersion     string `json:"vendor_version"`
+	VideoCodec        string `json:"video_codec"`
+	VideoHeight       int    `json:"video_height"`
+	VideoWidth        int    `json:"video_width"`
+
+	// Custom fields, not every service stores these
+	SourceCountry string `json:"source_country"`
+	SourceCity    string `json:"source_city"`
+	SourceASN     uint   `json:"source_asn"`
+	SourceIP      string `json:"source_ip"`
+	AudioGaps     int    `json:"audio_gaps"`
+
+	VideoFrameRate float64 `json:"video_frame_rate"`
+	FractionLost   float64 `json:"fraction_lost"`
+	JitterMs       int     `json:"jitter_ms"`
+}
+
+// public leaves out who the broadcaster is and where they are, for APIs
+// anyone can read
+func (m StreamMetadata) public() StreamMetadata {
+	m.SourceIP = ""
+	m.SourceCity = ""
+	m.SourceASN = 0
+	return m
 }
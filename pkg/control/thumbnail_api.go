@@ -0,0 +1,80 @@
+package control
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// On demand thumbnails decode a keyframe each, so they're limited per channel
+const thumbnailRequestInterval = 5 * time.Second
+
+var errNoKeyframe = errors.New("no keyframe received yet")
+
+func newThumbnailLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Every(thumbnailRequestInterval), 1)
+}
+
+func (s *Stream) setLastKeyframe(keyframe []byte) {
+	s.lastKeyframeMutex.Lock()
+	defer s.lastKeyframeMutex.Unlock()
+	s.lastKeyframe = keyframe
+}
+
+// GetLastKeyframe returns the newest H264 keyframe the thumbnailer has seen
+// for a channel
+func (mgr *Control) GetLastKeyframe(channelID ChannelID) ([]byte, error) {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream.lastKeyframeMutex.Lock()
+	defer stream.lastKeyframeMutex.Unlock()
+	if len(stream.lastKeyframe) == 0 {
+		return nil, errNoKeyframe
+	}
+	return stream.lastKeyframe, nil
+}
+
+// apiStreamThumbnail decodes the latest keyframe and returns it as a JPEG
+// straight away, rather than waiting for the next heartbeat. With
+// ?upload=true it's also sent to the service.
+func (mgr *Control) apiStreamThumbnail(w http.ResponseWriter, r *http.Request, stream *Stream) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !stream.thumbnailLimiter.Allow() {
+		apiError(w, http.StatusTooManyRequests, "thumbnails can be requested once every 5 seconds")
+		return
+	}
+
+	keyframe, err := mgr.GetLastKeyframe(stream.ChannelID)
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	img, err := mgr.encodeThumbnail(stream, keyframe)
+	if err != nil {
+		mgr.log.Errorf("Failed: %+v", err)
+		apiError(w, http.StatusInternalServerError, "failed to decode keyframe")
+		return
+	}
+	if img == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.URL.Query().Get("upload") == "true" {
+		if err := mgr.service.SendJpegPreviewImage(stream.StreamID, img); err != nil {
+			mgr.log.Errorf("Failed: %+v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.WriteHeader(http.StatusOK)
+	w.Write(img)
+}
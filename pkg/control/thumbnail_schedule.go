@@ -0,0 +1,39 @@
+package control
+
+import "time"
+
+// scheduleThumbnails sends extra thumbnails at ThumbnailAtOffsets seconds
+// into the stream, on top of the heartbeat ones, eg for preview strips.
+// Offsets a resumed stream is already past are skipped.
+func (mgr *Control) scheduleThumbnails(stream *Stream) {
+	started := time.Unix(stream.startTime, 0)
+
+	stream.scheduledThumbnailsMutex.Lock()
+	defer stream.scheduledThumbnailsMutex.Unlock()
+
+	for _, offset := range mgr.config.ThumbnailAtOffsets {
+		delay := time.Until(started.Add(time.Duration(offset) * time.Second))
+		if delay < 0 {
+			continue
+		}
+
+		offset := offset
+		timer := time.AfterFunc(delay, func() {
+			if err := mgr.sendThumbnail(stream.ChannelID); err != nil {
+				stream.log.Warnf("Failed sending thumbnail at %ds: %+v", offset, err)
+			}
+		})
+		stream.scheduledThumbnails = append(stream.scheduledThumbnails, timer)
+	}
+}
+
+// cancelScheduledThumbnails stops any scheduled thumbnails yet to be sent
+func (s *Stream) cancelScheduledThumbnails() {
+	s.scheduledThumbnailsMutex.Lock()
+	defer s.scheduledThumbnailsMutex.Unlock()
+
+	for _, timer := range s.scheduledThumbnails {
+		timer.Stop()
+	}
+	s.scheduledThumbnails = nil
+}
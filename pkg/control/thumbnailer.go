@@ -11,12 +11,12 @@ import (
 
 // Note: This type of functionality will be common in Waveguide
 // However we should not do it like this :D
-func (s *Stream) thumbnailer(whepEndpoint string) error {
+func (s *Stream) thumbnailer(api *webrtc.API, whepEndpoint string) error {
 	log := s.log.WithField("app", "peersnap")
 
 	log.Info("Started Thumbnailer")
 	// Create a new PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
 		return err
 	}
@@ -44,6 +44,7 @@ func (s *Stream) thumbnailer(whepEndpoint string) error {
 					// fmt.Printf("!!! PEER KEYFRAME !!! %s\n\n", kfer)
 					// saveImage(int(p.SequenceNumber), keyframe)
 					// os.WriteFile(fmt.Sprintf("%d-peer.h264", p.SequenceNumber), keyframe, 0666)
+					s.setLastKeyframe(keyframe)
 					s.lastThumbnail <- keyframe
 					kfer.Reset()
 				}
@@ -0,0 +1,91 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pkg/errors"
+)
+
+var ErrTrackNotFound = errors.New("track is not part of the stream")
+
+// TrackReplacer is implemented by outputs holding on to stream tracks, eg
+// WHEP peer connections, so they can swap them without dropping viewers
+type TrackReplacer interface {
+	ReplaceTrack(channelID ChannelID, oldTrack, newTrack StreamTrack) error
+}
+
+// RegisterTrackReplacer adds an output that is told about every ReplaceTrack
+func (mgr *Control) RegisterTrackReplacer(replacer TrackReplacer) {
+	mgr.trackReplacersMutex.Lock()
+	defer mgr.trackReplacersMutex.Unlock()
+
+	mgr.trackReplacers = append(mgr.trackReplacers, replacer)
+}
+
+// DeregisterTrackReplacer stops telling an output about replaced tracks
+func (mgr *Control) DeregisterTrackReplacer(replacer TrackReplacer) {
+	mgr.trackReplacersMutex.Lock()
+	defer mgr.trackReplacersMutex.Unlock()
+
+	for i, registered := range mgr.trackReplacers {
+		if registered == replacer {
+			mgr.trackReplacers = append(mgr.trackReplacers[:i:i], mgr.trackReplacers[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReplaceTrack swaps oldTrack for newTrack in a stream mid-stream, eg for a
+// codec change from H.264 to VP8, and has every registered output do the
+// same. Outputs that fail are logged and reported in the returned error, the
+// stream itself keeps the new track either way.
+func (mgr *Control) ReplaceTrack(channelID ChannelID, oldTrack, newTrack StreamTrack) error {
+	stream, err := mgr.getStream(channelID)
+	if err != nil {
+		return err
+	}
+	if newTrack.Type != oldTrack.Type {
+		return fmt.Errorf("cannot replace a %s track with a %s track", oldTrack.Type, newTrack.Type)
+	}
+	if err := stream.replaceTrack(oldTrack, newTrack); err != nil {
+		return err
+	}
+	stream.log.Infof("Replaced %s track %s with %s", newTrack.Type, oldTrack.Codec, newTrack.Codec)
+
+	mgr.trackReplacersMutex.RLock()
+	replacers := mgr.trackReplacers
+	mgr.trackReplacersMutex.RUnlock()
+
+	var failures []string
+	for _, replacer := range replacers {
+		if err := replacer.ReplaceTrack(channelID, oldTrack, newTrack); err != nil {
+			stream.log.Errorf("Failed replacing track: %+v", err)
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("replacing track in outputs: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+func (s *Stream) replaceTrack(oldTrack, newTrack StreamTrack) error {
+	for i, track := range s.tracks {
+		if track.Track != oldTrack.Track {
+			continue
+		}
+
+		s.tracks[i] = newTrack
+		if newTrack.Type == webrtc.RTPCodecTypeVideo {
+			s.videoCodec = newTrack.Codec
+		} else {
+			s.audioCodec = newTrack.Codec
+		}
+		return nil
+	}
+
+	return ErrTrackNotFound
+}
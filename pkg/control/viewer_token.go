@@ -0,0 +1,107 @@
+package control
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultViewerTokenTTL    = 5 * time.Minute
+	DefaultViewerTokenMaxTTL = time.Hour
+)
+
+var (
+	ErrViewerTokenSecret  = errors.New("viewer_token_secret is not configured")
+	ErrViewerTokenInvalid = errors.New("viewer token is invalid")
+	ErrViewerTokenExpired = errors.New("viewer token has expired")
+)
+
+// GenerateViewerToken signs a short lived token that lets a viewer watch
+// channelID, checked by outputs with ValidateViewerToken
+func (mgr *Control) GenerateViewerToken(channelID ChannelID, ttl time.Duration) (string, error) {
+	if mgr.config.ViewerTokenSecret == "" {
+		return "", ErrViewerTokenSecret
+	}
+
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	mac := viewerTokenMAC(mgr.config.ViewerTokenSecret, channelID, expiry)
+
+	return base64.RawURLEncoding.EncodeToString(append(mac, []byte(":"+expiry)...)), nil
+}
+
+// ValidateViewerToken checks a token from GenerateViewerToken was signed with
+// secret for channelID and has not expired
+func ValidateViewerToken(secret string, channelID ChannelID, token string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < sha256.Size+2 || raw[sha256.Size] != ':' {
+		return ErrViewerTokenInvalid
+	}
+
+	mac, expiry := raw[:sha256.Size], string(raw[sha256.Size+1:])
+	if !hmac.Equal(mac, viewerTokenMAC(secret, channelID, expiry)) {
+		return ErrViewerTokenInvalid
+	}
+
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return ErrViewerTokenInvalid
+	}
+	if time.Now().Unix() > expiresAt {
+		return ErrViewerTokenExpired
+	}
+
+	return nil
+}
+
+func viewerTokenMAC(secret string, channelID ChannelID, expiry string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d:%s", channelID, expiry)
+	return mac.Sum(nil)
+}
+
+// apiViewerToken serves GET /api/v1/viewer-token/{channelID}, with an
+// optional ?ttl= duration up to viewer_token_max_ttl
+func (mgr *Control) apiViewerToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	channelID, err := strconv.ParseUint(path.Base(strings.TrimSuffix(r.URL.Path, "/")), 10, 32)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid channel id")
+		return
+	}
+
+	ttl := DefaultViewerTokenTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		if ttl > mgr.config.ViewerTokenMaxTTL {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("ttl is longer than the maximum of %s", mgr.config.ViewerTokenMaxTTL))
+			return
+		}
+	}
+
+	token, err := mgr.GenerateViewerToken(ChannelID(channelID), ttl)
+	if err != nil {
+		apiError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	apiJSON(w, http.StatusOK, struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expires_at"`
+	}{token, time.Now().Add(ttl).Unix()})
+}
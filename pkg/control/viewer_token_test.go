@@ -0,0 +1,71 @@
+package control
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// viewerToken builds a token the way GenerateViewerToken does, with any
+// expiry
+func viewerToken(secret string, channelID ChannelID, expiry string) string {
+	mac := viewerTokenMAC(secret, channelID, expiry)
+	return base64.RawURLEncoding.EncodeToString(append(mac, []byte(":"+expiry)...))
+}
+
+func TestValidateViewerToken(t *testing.T) {
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+	mgr.config.ViewerTokenSecret = "secret"
+	valid, err := mgr.GenerateViewerToken(1, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(valid)
+	tampered := append([]byte{}, raw...)
+	tampered[0] ^= 0xFF
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		secret    string
+		channelID ChannelID
+		token     string
+		err       error
+	}{
+		{"valid", "secret", 1, valid, nil},
+		{"tampered mac", "secret", 1, base64.RawURLEncoding.EncodeToString(tampered), ErrViewerTokenInvalid},
+		{"other channel", "secret", 2, valid, ErrViewerTokenInvalid},
+		{"other secret", "other", 1, valid, ErrViewerTokenInvalid},
+		{"expired", "secret", 1, viewerToken("secret", 1, past), ErrViewerTokenExpired},
+		{"expiry changed", "secret", 1, base64.RawURLEncoding.EncodeToString(append(raw[:32:32], []byte(":"+future)...)), ErrViewerTokenInvalid},
+		{"expiry not a number", "secret", 1, viewerToken("secret", 1, "soon"), ErrViewerTokenInvalid},
+		{"malformed base64", "secret", 1, "not*base64!", ErrViewerTokenInvalid},
+		{"padded base64", "secret", 1, base64.URLEncoding.EncodeToString([]byte("x")), ErrViewerTokenInvalid},
+		{"too short", "secret", 1, base64.RawURLEncoding.EncodeToString([]byte("abc:1")), ErrViewerTokenInvalid},
+		{"no separator", "secret", 1, base64.RawURLEncoding.EncodeToString(append(viewerTokenMAC("secret", 1, future), []byte(future)...)), ErrViewerTokenInvalid},
+		{"empty", "secret", 1, "", ErrViewerTokenInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateViewerToken(tt.secret, tt.channelID, tt.token)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestGenerateViewerTokenWithoutSecret(t *testing.T) {
+	mgr := newTestControl(&mockService{}, &failingOrchestrator{})
+
+	_, err := mgr.GenerateViewerToken(1, time.Minute)
+	assert.ErrorIs(t, err, ErrViewerTokenSecret)
+}
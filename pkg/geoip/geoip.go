@@ -0,0 +1,92 @@
+// Package geoip resolves IP addresses to a location using MaxMind GeoLite2
+// databases. Databases are opened once per path and shared between inputs
+// and outputs.
+package geoip
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type Location struct {
+	// ISO 3166-1 country code, eg US
+	Country string `json:"country"`
+	City    string `json:"city"`
+	ASN     uint   `json:"asn"`
+}
+
+type Reader struct {
+	readers []*geoip2.Reader
+}
+
+var (
+	openMutex sync.Mutex
+	opened    = make(map[string]*geoip2.Reader)
+)
+
+// Open loads the given GeoLite2 City, Country or ASN databases, empty paths are skipped
+func Open(paths ...string) (*Reader, error) {
+	openMutex.Lock()
+	defer openMutex.Unlock()
+
+	r := &Reader{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		db, ok := opened[path]
+		if !ok {
+			var err error
+			db, err = geoip2.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			opened[path] = db
+		}
+		r.readers = append(r.readers, db)
+	}
+
+	return r, nil
+}
+
+// Lookup returns everything the databases know about ip, missing fields are left empty
+func (r *Reader) Lookup(ip net.IP) Location {
+	var loc Location
+	if r == nil || ip == nil {
+		return loc
+	}
+
+	for _, db := range r.readers {
+		dbType := db.Metadata().DatabaseType
+		switch {
+		case strings.Contains(dbType, "ASN"):
+			if asn, err := db.ASN(ip); err == nil {
+				loc.ASN = asn.AutonomousSystemNumber
+			}
+		case strings.Contains(dbType, "City"):
+			if city, err := db.City(ip); err == nil {
+				loc.Country = city.Country.IsoCode
+				loc.City = city.City.Names["en"]
+			}
+		case strings.Contains(dbType, "Country"):
+			if country, err := db.Country(ip); err == nil {
+				loc.Country = country.Country.IsoCode
+			}
+		}
+	}
+
+	return loc
+}
+
+// HostIP parses the IP out of an ip:port address
+func HostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
@@ -67,6 +67,12 @@ func NewH264Decoder() (*H264Decoder, error) {
 	}, nil
 }
 
+// Reset drops any frames buffered in the decoder so it can be reused for
+// another stream, keeping its allocations.
+func (d *H264Decoder) Reset() {
+	C.avcodec_flush_buffers(d.codecCtx)
+}
+
 // close closes the decoder.
 func (d *H264Decoder) Close() {
 	if d.dstFrame != nil {
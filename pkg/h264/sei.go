@@ -0,0 +1,98 @@
+package h264
+
+import "bytes"
+
+const (
+	naluTypeSEI = 6
+
+	seiPayloadTypeUserDataRegistered = 4
+)
+
+// ATSC A/53 header of user_data_registered_itu_t_t35 caption payloads:
+// country code, provider code, user identifier and user_data_type_code
+var a53CaptionHeader = []byte{0xB5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03}
+
+// CaptionData returns the cc_data triplets of the CEA-608/708 captions carried
+// in an SEI NAL unit, or nil if it carries none. Each triplet is the
+// cc_valid/cc_type byte followed by the two caption bytes.
+func CaptionData(nalu []byte) []byte {
+	if len(nalu) < 2 || nalu[0]&0x1F != naluTypeSEI {
+		return nil
+	}
+
+	rbsp := unescapeRBSP(nalu[1:])
+
+	var captions []byte
+	// 0x80 is the rbsp_trailing_bits after the last message
+	for len(rbsp) > 0 && rbsp[0] != 0x80 {
+		payloadType, n := seiValue(rbsp)
+		rbsp = rbsp[n:]
+		payloadSize, n := seiValue(rbsp)
+		rbsp = rbsp[n:]
+		if n == 0 || payloadSize > len(rbsp) {
+			break
+		}
+
+		if payloadType == seiPayloadTypeUserDataRegistered {
+			captions = append(captions, a53CaptionData(rbsp[:payloadSize])...)
+		}
+		rbsp = rbsp[payloadSize:]
+	}
+
+	return captions
+}
+
+// a53CaptionData returns the cc_data triplets of an A/53 caption payload
+func a53CaptionData(payload []byte) []byte {
+	if !bytes.HasPrefix(payload, a53CaptionHeader) || len(payload) < len(a53CaptionHeader)+2 {
+		return nil
+	}
+	payload = payload[len(a53CaptionHeader):]
+
+	// process_em_data_flag, process_cc_data_flag, additional_data_flag, cc_count(5)
+	flags := payload[0]
+	if flags&0x40 == 0 {
+		return nil
+	}
+	ccCount := int(flags & 0x1F)
+
+	// Skip the flags and em_data bytes
+	data := payload[2:]
+	if len(data) < ccCount*3 {
+		ccCount = len(data) / 3
+	}
+	return data[:ccCount*3]
+}
+
+// seiValue reads an SEI payload type or size, which is coded as a run of 0xFF
+// bytes followed by a final byte that are all added together
+func seiValue(data []byte) (value int, n int) {
+	for n < len(data) {
+		b := data[n]
+		n++
+		value += int(b)
+		if b != 0xFF {
+			return value, n
+		}
+	}
+	return 0, 0
+}
+
+// unescapeRBSP removes the emulation prevention bytes from a NAL unit payload
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
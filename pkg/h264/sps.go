@@ -0,0 +1,176 @@
+package h264
+
+import "errors"
+
+const naluTypeSPS = 7
+
+var ErrInvalidSPS = errors.New("invalid H.264 SPS")
+
+// SPSResolution returns the picture size in pixels described by an SPS NAL
+// unit, after cropping. See ITU-T H.264 section 7.3.2.1.1.
+func SPSResolution(nalu []byte) (width int, height int, err error) {
+	if len(nalu) < 4 || nalu[0]&0x1F != naluTypeSPS {
+		return 0, 0, ErrInvalidSPS
+	}
+
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+
+	profileIdc := r.bits(8)
+	r.skip(16) // constraint flags, reserved bits and level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	separateColourPlane := false
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.ue()
+		if chromaFormatIdc == 3 {
+			separateColourPlane = r.flag()
+		}
+		r.ue()        // bit_depth_luma_minus8
+		r.ue()        // bit_depth_chroma_minus8
+		r.skip(1)     // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				r.scalingList(size)
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint32(0); i < cycle && r.err == nil; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+
+	picWidthInMbs := int(r.ue()) + 1
+	picHeightInMapUnits := int(r.ue()) + 1
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.flag() { // frame_cropping_flag
+		cropLeft = int(r.ue())
+		cropRight = int(r.ue())
+		cropTop = int(r.ue())
+		cropBottom = int(r.ue())
+	}
+	if r.err != nil {
+		return 0, 0, ErrInvalidSPS
+	}
+
+	frameHeightInMbs := picHeightInMapUnits
+	if !frameMbsOnly {
+		frameHeightInMbs *= 2
+	}
+
+	// Crop offsets are in chroma sample units
+	cropUnitX, cropUnitY := 1, 1
+	if chromaFormatIdc != 0 && !separateColourPlane {
+		if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormatIdc == 1 {
+			cropUnitY = 2
+		}
+	}
+	if !frameMbsOnly {
+		cropUnitY *= 2
+	}
+
+	width = picWidthInMbs*16 - (cropLeft+cropRight)*cropUnitX
+	height = frameHeightInMbs*16 - (cropTop+cropBottom)*cropUnitY
+	if width <= 0 || height <= 0 {
+		return 0, 0, ErrInvalidSPS
+	}
+
+	return width, height, nil
+}
+
+// bitReader reads the Exp-Golomb coded fields of an RBSP, remembering the
+// first error so a whole structure can be read before checking it
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var value uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = ErrInvalidSPS
+			return 0
+		}
+		bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+		value = value<<1 | uint32(bit)
+		r.pos++
+	}
+	return value
+}
+
+func (r *bitReader) skip(n int) {
+	r.bits(n)
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+// ue reads an unsigned Exp-Golomb value
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros > 31 {
+			r.err = ErrInvalidSPS
+			return 0
+		}
+		zeros++
+	}
+	return (1<<zeros - 1) + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb value
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) scalingList(size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
@@ -31,6 +31,43 @@ func IsAnyKeyframe(data []byte) bool {
 	return false
 }
 
+// ParameterSets returns any SPS and PPS in an RTP payload, either sent on
+// their own or aggregated in a STAP-A
+func ParameterSets(packetPayload []byte) (sps, pps []byte) {
+	const (
+		typeSTAPA = 24
+		typeSPS   = 7
+		typePPS   = 8
+	)
+	if len(packetPayload) < 1 {
+		return nil, nil
+	}
+
+	nalus := [][]byte{packetPayload}
+	if packetPayload[0]&0x1F == typeSTAPA {
+		nalus = nil
+		// See https://tools.ietf.org/html/rfc6184#section-5.7.1
+		for rest := packetPayload[1:]; len(rest) > 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || len(rest) < 2+size {
+				break
+			}
+			nalus = append(nalus, rest[2:2+size])
+			rest = rest[2+size:]
+		}
+	}
+
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1F {
+		case typeSPS:
+			sps = nalu
+		case typePPS:
+			pps = nalu
+		}
+	}
+	return sps, pps
+}
+
 func IsKeyframePart(packetPayload []byte) bool {
 	// Thank you Hayden :)
 	// Is this packet part of a keyframe?
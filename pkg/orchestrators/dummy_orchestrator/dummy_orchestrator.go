@@ -1,6 +1,8 @@
 package dummy_orchestrator
 
 import (
+	"errors"
+
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/sirupsen/logrus"
 )
@@ -66,6 +68,13 @@ func (client *Client) Close() error {
 	return nil
 }
 
+func (client *Client) Ping() error {
+	if !client.connected {
+		return errors.New("not connected to Dummy Orchestrator")
+	}
+	return nil
+}
+
 func (client *Client) StartStream(channelID control.ChannelID, streamID control.StreamID) error {
 	return nil
 }
@@ -75,3 +84,6 @@ func (client *Client) StopStream(channelID control.ChannelID, streamID control.S
 func (client *Client) Heartbeat(channelID control.ChannelID) error {
 	return nil
 }
+func (client *Client) ListActiveStreams() ([]control.ActiveStreamInfo, error) {
+	return []control.ActiveStreamInfo{}, nil
+}
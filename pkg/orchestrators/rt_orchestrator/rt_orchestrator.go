@@ -1,20 +1,27 @@
 package rt_orchestrator
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/sirupsen/logrus"
 )
 
+// RTRouter calls taking longer than this fail, so a hung router can't hold
+// up startup, readiness checks or streams
+const requestTimeout = 10 * time.Second
+
 type Client struct {
 	hostname string
 
-	config *Config
-	log    logrus.FieldLogger
+	config     *Config
+	log        logrus.FieldLogger
+	httpClient *http.Client
 
 	connected bool
 }
@@ -31,8 +38,9 @@ type Config struct {
 
 func New(config Config, hostname string) *Client {
 	return &Client{
-		hostname: hostname,
-		config:   &config,
+		hostname:   hostname,
+		config:     &config,
+		httpClient: &http.Client{Timeout: requestTimeout},
 	}
 }
 
@@ -61,9 +69,25 @@ func (client *Client) Close() error {
 	return nil
 }
 
+// Ping checks RTRouter answers HTTP requests, any response short of a server
+// error means it is up
+func (client *Client) Ping() error {
+	resp, err := client.httpClient.Get(client.config.Endpoint)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("RTRouter returned status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
 func (client *Client) StartStream(channelID control.ChannelID, streamID control.StreamID) error {
 	form := url.Values{}
 	form.Add("channel_id", fmt.Sprint(channelID))
+	form.Add("stream_id", fmt.Sprint(streamID))
 	form.Add("endpoint", client.channelEndpoint(channelID))
 
 	req, err := http.NewRequest("POST", client.routerEndpoint("v1/state/start_stream"), strings.NewReader(form.Encode()))
@@ -73,7 +97,7 @@ func (client *Client) StartStream(channelID control.ChannelID, streamID control.
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Authorization", client.config.Key)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -95,7 +119,7 @@ func (client *Client) StopStream(channelID control.ChannelID, streamID control.S
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Authorization", client.config.Key)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -118,7 +142,7 @@ func (client *Client) Heartbeat(channelID control.ChannelID) error {
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Authorization", client.config.Key)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -130,6 +154,53 @@ func (client *Client) Heartbeat(channelID control.ChannelID) error {
 	return nil
 }
 
+// activeStream is a stream as RTRouter lists it
+type activeStream struct {
+	ChannelID control.ChannelID `json:"channel_id"`
+	StreamID  control.StreamID  `json:"stream_id"`
+	Endpoint  string            `json:"endpoint"`
+	StartedAt time.Time         `json:"started_at"`
+}
+
+// ListActiveStreams asks RTRouter for every live stream, keeping the ones
+// whose endpoint is on this node
+func (client *Client) ListActiveStreams() ([]control.ActiveStreamInfo, error) {
+	req, err := http.NewRequest("GET", client.routerEndpoint("v1/state/streams"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", client.config.Key)
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if status := resp.StatusCode; status != http.StatusOK {
+		return nil, fmt.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var streams []activeStream
+	if err := json.NewDecoder(resp.Body).Decode(&streams); err != nil {
+		return nil, err
+	}
+
+	active := []control.ActiveStreamInfo{}
+	for _, stream := range streams {
+		if stream.Endpoint != client.channelEndpoint(stream.ChannelID) {
+			continue
+		}
+		active = append(active, control.ActiveStreamInfo{
+			ChannelID: stream.ChannelID,
+			StreamID:  stream.StreamID,
+			StartTime: stream.StartedAt,
+		})
+	}
+
+	return active, nil
+}
+
 func (client *Client) routerEndpoint(path string) string {
 	return fmt.Sprintf("%s/%s", client.config.Endpoint, path)
 }
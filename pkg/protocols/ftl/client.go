@@ -3,7 +3,6 @@ package ftl
 import (
 	"bufio"
 	"crypto/hmac"
-	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -105,14 +104,25 @@ func (conn *Conn) sendAuthentication(channelID ChannelID, streamKey []byte) (err
 		return err
 	}
 	split := strings.Split(resp, " ")
+	if len(split) < 2 {
+		return ErrUnexpectedArguments
+	}
 
-	hmacHexString := split[1]
+	// 200 <hex-payload>, or 200 <algorithm> <hex-payload> for anything but sha512
+	algorithm, hmacHexString := DefaultHmacAlgorithm, split[1]
+	if len(split) > 2 {
+		algorithm, hmacHexString = split[1], split[2]
+	}
+	hashFunc := hmacHash(algorithm)
+	if hashFunc == nil {
+		return ErrUnsupportedHmacAlgorithm
+	}
 	decoded, err := hex.DecodeString(hmacHexString)
 	if err != nil {
 		return err
 	}
 
-	hash := hmac.New(sha512.New, streamKey)
+	hash := hmac.New(hashFunc, streamKey)
 	hash.Write(decoded)
 
 	hmacPayload := hash.Sum(nil)
@@ -224,7 +234,7 @@ func (conn *Conn) sendControlMessage(message string, needResponse bool) (resp st
 
 func (conn *Conn) writeControlMessage(message string) error {
 	final := message + "\r\n\r\n"
-	log.Printf("FTL SEND: %q", final)
+	log.Printf("FTL SEND: %q", redactHmac(final))
 	_, err := conn.controlConn.Write([]byte(final))
 	return err
 }
@@ -12,3 +12,11 @@ var ErrConnectBeforeAuth = errors.New("control connection attempted command befo
 var ErrMultipleConnect = errors.New("control connection attempted multiple CONNECT handshakes")
 var ErrInvalidHmacHash = errors.New("client provided invalid HMAC hash")
 var ErrInvalidHmacHex = errors.New("client provided HMAC hash that could not be hex decoded")
+var ErrUnsupportedHmacAlgorithm = errors.New("unsupported HMAC algorithm")
+var ErrHmacNotRequested = errors.New("control connection attempted CONNECT before requesting HMAC")
+var ErrChannelInUse = errors.New("channel is already streaming")
+var ErrInvalidTransition = errors.New("invalid connection state transition")
+var ErrNoPortAvailable = errors.New("no UDP port available in the media port range")
+var ErrOversizedAttribute = errors.New("control connection sent an oversized attribute")
+var ErrInvalidAttribute = errors.New("control connection sent an attribute containing null bytes")
+var ErrUnsupportedVersion = errors.New("control connection sent an unsupported protocol version")
@@ -6,8 +6,16 @@ var (
 	connectRegex         = regexp.MustCompile(`CONNECT ([0-9]+) \$([0-9a-f]+)`)
 	clientMediaPortRegex = regexp.MustCompile(`200 hi\. Use UDP port (\d+)`)
 	attributeRegex       = regexp.MustCompile(`(.+): (.+)`)
+
+	// Protocol versions accepted when ConnConfig.SupportedVersions is unset
+	DefaultSupportedVersions = []string{"0.9", "1.0"}
 )
 
+// redactHmac hides the HMAC hash in a CONNECT command, so it never ends up in logs
+func redactHmac(command string) string {
+	return connectRegex.ReplaceAllString(command, "CONNECT $1 $$[REDACTED]")
+}
+
 // Custom Types
 type ChannelID uint32
 type StreamID uint32
@@ -15,7 +23,12 @@ type StreamID uint32
 const (
 	DefaultPort  = 8084
 	VersionMajor = 0
-	VersionMinor = 2
+	VersionMinor = 9
+
+	// Custom attributes kept per connection, the rest are dropped
+	maxCustomAttributes = 16
+	// Clients announcing older versions can't send custom attributes
+	customAttributesVersion = "1.0"
 
 	allowedHeartbeatFailures = 5
 	hmacPayloadSize          = 128
@@ -47,10 +60,19 @@ const (
 	// Server Responses
 	// Should consider removing the new lines and stripping it out from the responses since it's a protocol default
 	responseHmacPayload         = "200 %s"
+	responseHmacAlgorithm       = "200 %s %s"
 	responseOk                  = "200"
 	responsePong                = "201"
 	responseMediaPort           = "200. Use UDP port %d"
 	responseServerTerminate     = "410"
 	responseInvalidStreamKey    = "405"
 	responseInternalServerError = "500"
+	responseUnsupportedVersion  = "400 Unsupported Protocol Version"
+
+	// Disconnect Reasons
+	// Sent with DISCONNECT so the client can tell the broadcaster why they were dropped
+	DisconnectAuthFailed     = "AUTH_FAILED"
+	DisconnectChannelInUse   = "CHANNEL_IN_USE"
+	DisconnectServerShutdown = "SERVER_SHUTDOWN"
+	DisconnectInvalidCommand = "INVALID_COMMAND"
 )
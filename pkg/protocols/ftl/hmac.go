@@ -0,0 +1,33 @@
+package ftl
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+)
+
+// HMAC algorithms the server can ask clients to authenticate with
+const (
+	HmacSHA256 = "sha256"
+	HmacSHA512 = "sha512"
+
+	// What every FTL client implements, the HMAC response only names the
+	// algorithm when it's something else so existing clients keep working
+	DefaultHmacAlgorithm = HmacSHA512
+)
+
+// hmacHash returns the hash function for an algorithm, or nil if it's unknown
+func hmacHash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case HmacSHA256:
+		return sha256.New
+	case HmacSHA512:
+		return sha512.New
+	}
+	return nil
+}
+
+// ValidHmacAlgorithm reports whether an algorithm can be used for ConnConfig.HMACAlgorithm
+func ValidHmacAlgorithm(algorithm string) bool {
+	return algorithm == "" || hmacHash(algorithm) != nil
+}
@@ -0,0 +1,28 @@
+package ftl
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	mediaPortsAllocated = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ftl_media_ports_allocated",
+		Help: "Number of UDP ports currently allocated to FTL media connections",
+	})
+
+	mediaPortsAvailable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ftl_media_ports_available",
+		Help: "Number of unused UDP ports left in the configured FTL media port range",
+	})
+
+	protocolVersionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ftl_protocol_versions_total",
+		Help: "FTL connections by the protocol version they announced, unsupported versions are counted together",
+	}, []string{"version"})
+
+	rateLimitedPacketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ftl_rate_limited_packets_total",
+		Help: "FTL media packets dropped for going over media_rate_limit_mbps",
+	}, []string{"channel_id"})
+)
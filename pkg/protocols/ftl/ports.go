@@ -0,0 +1,142 @@
+package ftl
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+const (
+	// Below this share of the media port range left, every allocation logs an error
+	mediaPortsLowFraction = 0.1
+	// Without a range, how many ephemeral ports are tried for one with the
+	// port above it free
+	ephemeralPortAttempts = 10
+)
+
+// mediaPorts tracks which media ports are in use, so we can report how many
+// are left
+var mediaPorts = struct {
+	sync.Mutex
+	inUse map[int]bool
+}{inUse: make(map[int]bool)}
+
+// MediaPortStats is the allocation of FTL media ports. Without a configured
+// range only Allocated is set.
+type MediaPortStats struct {
+	Allocated int `json:"allocated"`
+	Available int `json:"available,omitempty"`
+	Total     int `json:"total,omitempty"`
+	PortMin   int `json:"port_min,omitempty"`
+	PortMax   int `json:"port_max,omitempty"`
+}
+
+// low reports whether less than mediaPortsLowFraction of the range is left
+func (stats MediaPortStats) low() bool {
+	return stats.Total > 0 && float64(stats.Available) < float64(stats.Total)*mediaPortsLowFraction
+}
+
+// listenMediaPorts listens on a random free UDP port between min and max
+// inclusive, and on the port above it for RTCP as is convention. Both ports
+// come out of the range. Without a range any ephemeral port is used.
+func listenMediaPorts(min, max int) (media, rtcp *net.UDPConn, err error) {
+	if min == 0 && max == 0 {
+		for i := 0; i < ephemeralPortAttempts; i++ {
+			media, err := net.ListenUDP("udp", &net.UDPAddr{})
+			if err != nil {
+				return nil, nil, err
+			}
+			port := media.LocalAddr().(*net.UDPAddr).Port
+			rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+			if err != nil {
+				media.Close()
+				continue
+			}
+
+			allocateMediaPorts(min, max, port, port+1)
+			return media, rtcp, nil
+		}
+		return nil, nil, ErrNoPortAvailable
+	}
+	if min <= 0 || max > 65535 || min >= max {
+		return nil, nil, fmt.Errorf("invalid media port range %d-%d, it needs room for a media and RTCP port", min, max)
+	}
+
+	// The last port in the range has no room for RTCP above it
+	for _, offset := range rand.Perm(max - min) {
+		port := min + offset
+		media, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			media.Close()
+			continue
+		}
+
+		allocateMediaPorts(min, max, port, port+1)
+		return media, rtcp, nil
+	}
+
+	return nil, nil, ErrNoPortAvailable
+}
+
+func allocateMediaPorts(min, max int, ports ...int) {
+	mediaPorts.Lock()
+	defer mediaPorts.Unlock()
+
+	for _, port := range ports {
+		mediaPorts.inUse[port] = true
+	}
+	updateMediaPortMetrics(min, max)
+}
+
+func releaseMediaPorts(min, max int, ports ...int) {
+	mediaPorts.Lock()
+	defer mediaPorts.Unlock()
+
+	for _, port := range ports {
+		delete(mediaPorts.inUse, port)
+	}
+	updateMediaPortMetrics(min, max)
+}
+
+// MediaPortUsage returns how many media ports are allocated, and with a range
+// how many of it are left
+func MediaPortUsage(min, max int) MediaPortStats {
+	mediaPorts.Lock()
+	defer mediaPorts.Unlock()
+
+	return mediaPortUsage(min, max)
+}
+
+// mediaPortUsage must be called with mediaPorts locked
+func mediaPortUsage(min, max int) MediaPortStats {
+	stats := MediaPortStats{Allocated: len(mediaPorts.inUse)}
+	if min == 0 && max == 0 {
+		return stats
+	}
+
+	used := 0
+	for port := range mediaPorts.inUse {
+		if port >= min && port <= max {
+			used++
+		}
+	}
+	stats.PortMin = min
+	stats.PortMax = max
+	stats.Total = max - min + 1
+	stats.Available = stats.Total - used
+	return stats
+}
+
+// updateMediaPortMetrics must be called with mediaPorts locked
+func updateMediaPortMetrics(min, max int) {
+	stats := mediaPortUsage(min, max)
+	mediaPortsAllocated.Set(float64(stats.Allocated))
+	if stats.Total > 0 {
+		mediaPortsAvailable.Set(float64(stats.Available))
+	}
+}
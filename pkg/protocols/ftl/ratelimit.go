@@ -0,0 +1,48 @@
+package ftl
+
+import (
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// How often a throttled connection logs that it's being throttled
+const rateLimitLogInterval = 10 * time.Second
+
+// mediaRateLimiter drops media packets past MediaRateLimitMbps, so a
+// misbehaving client can't flood the server. It's only touched by the media
+// goroutine.
+type mediaRateLimiter struct {
+	limiter *rate.Limiter
+	dropped int
+	lastLog time.Time
+}
+
+// newMediaRateLimiter returns nil, no limit, when mbps isn't positive
+func newMediaRateLimiter(mbps float64) *mediaRateLimiter {
+	if mbps <= 0 {
+		return nil
+	}
+	return &mediaRateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(mbps*1e6/8), packetMtu*10),
+	}
+}
+
+// allowMedia reports whether a media packet of n bytes is within the rate
+// limit, counting and occasionally logging the ones that aren't
+func (conn *FtlConnection) allowMedia(n int) bool {
+	limiter := conn.mediaRateLimiter
+	if limiter == nil || limiter.limiter.AllowN(time.Now(), n) {
+		return true
+	}
+
+	limiter.dropped++
+	rateLimitedPacketsTotal.WithLabelValues(strconv.Itoa(conn.channelID)).Inc()
+	if time.Since(limiter.lastLog) >= rateLimitLogInterval {
+		conn.log.Warnf("Media over the rate limit, dropped %d packets since the last warning", limiter.dropped)
+		limiter.dropped = 0
+		limiter.lastLog = time.Now()
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package ftl
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+)
+
+// RTCPStats are the reception statistics from the latest RTCP receiver report
+type RTCPStats struct {
+	// Fraction of packets lost since the previous report, out of 256
+	FractionLost uint8
+	// Total packets lost since the start of the stream
+	TotalLost uint32
+	// Extended highest sequence number received
+	LastSequenceNumber uint32
+	// Interarrival jitter in RTP timestamp units
+	Jitter uint32
+	// Of the RTP the report is about, for the jitter
+	ClockRate uint32
+}
+
+// JitterDuration is the interarrival jitter in time
+func (stats RTCPStats) JitterDuration() time.Duration {
+	if stats.ClockRate == 0 {
+		return 0
+	}
+	return time.Duration(stats.Jitter) * time.Second / time.Duration(stats.ClockRate)
+}
+
+// FractionLostRatio is the share of packets lost since the previous report
+func (stats RTCPStats) FractionLostRatio() float64 {
+	return float64(stats.FractionLost) / 256
+}
+
+// readRTCP reads receiver reports from the port above the media port, as is
+// convention for RTCP
+func (conn *FtlConnection) readRTCP() {
+	rtcpConn := conn.rtcpTransport
+	conn.goTracked(func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, _, err := rtcpConn.ReadFrom(buffer)
+			if err != nil {
+				// Closed along with the connection
+				return
+			}
+
+			packets, err := rtcp.Unmarshal(buffer[:n])
+			if err != nil {
+				conn.log.Debugf("RTCP: Invalid packet: %+v", err)
+				continue
+			}
+
+			for _, packet := range packets {
+				report, ok := packet.(*rtcp.ReceiverReport)
+				if !ok || len(report.Reports) == 0 {
+					continue
+				}
+
+				reception := report.Reports[0]
+				stats := RTCPStats{
+					FractionLost:       reception.FractionLost,
+					TotalLost:          reception.TotalLost,
+					LastSequenceNumber: reception.LastSequenceNumber,
+					Jitter:             reception.Jitter,
+					ClockRate:          audioClockRate,
+				}
+				conn.metadataMutex.Lock()
+				if reception.SSRC == uint32(conn.Metadata.VideoIngestSsrc) {
+					stats.ClockRate = videoClockRate
+				}
+				conn.Metadata.RTCPStats = stats
+				conn.metadataMutex.Unlock()
+				conn.handler.OnRTCPStats(stats)
+			}
+		}
+	})
+}
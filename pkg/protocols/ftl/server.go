@@ -3,15 +3,16 @@ package ftl
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pion/interceptor"
@@ -40,12 +41,32 @@ const (
 	MaxLineLenBytes  = 1024
 	ReadWriteTimeout = time.Minute
 
+	// Attributes are much shorter than other lines, and are kept in memory
+	maxAttributeMessageBytes = 512
+	maxAttributeValueBytes   = 256
+
 	FTL_PAYLOAD_TYPE_SENDER_REPORT = 200
 	FTL_PAYLOAD_TYPE_PING          = 250
 )
 
 type ConnConfig struct {
 	Handler Handler
+
+	// Optional inclusive UDP port range for media, for firewalls that only
+	// open specific ports. Unset uses any ephemeral port. RTCP takes the port
+	// above the media port, out of the same range.
+	MediaPortMin int
+	MediaPortMax int
+
+	// Protocol versions clients may announce, DefaultSupportedVersions if unset
+	SupportedVersions []string
+
+	// Media packets past this rate are dropped, unset (0) for no limit
+	MediaRateLimitMbps float64
+
+	// HMAC algorithm clients authenticate with, HmacSHA256 or HmacSHA512.
+	// Defaults to DefaultHmacAlgorithm.
+	HMACAlgorithm string
 }
 
 type Handler interface {
@@ -55,6 +76,8 @@ type Handler interface {
 	OnPlay(FtlConnectionMetadata) error
 	OnVideo(*rtp.Packet) error
 	OnAudio(*rtp.Packet) error
+	OnRTCPStats(RTCPStats)
+	// OnClose is only called for connections OnConnect accepted
 	OnClose()
 }
 
@@ -77,6 +100,13 @@ type Server struct {
 	log    logrus.FieldLogger
 
 	listener net.Listener
+
+	connectionsMutex sync.Mutex
+	connections      map[*FtlConnection]bool
+	shuttingDown     bool
+
+	// Every control, media and RTCP read loop, so Shutdown can wait on them
+	routines sync.WaitGroup
 }
 
 func (srv *Server) Serve(listener net.Listener) error {
@@ -86,22 +116,51 @@ func (srv *Server) Serve(listener net.Listener) error {
 		// Each client
 		socket, err := listener.Accept()
 		if err != nil {
+			srv.connectionsMutex.Lock()
+			shuttingDown := srv.shuttingDown
+			srv.connectionsMutex.Unlock()
+			if shuttingDown {
+				return nil
+			}
+
 			srv.log.Error(err)
 			continue
 		}
 
 		conn, clientConfig := srv.config.OnNewConnect(socket)
 
-		ftlConn := FtlConnection{
-			log:            srv.log,
-			transport:      conn,
-			handler:        clientConfig.Handler,
-			connected:      true,
-			mediaConnected: false,
-			Metadata:       &FtlConnectionMetadata{},
+		ftlConn := &FtlConnection{
+			log:       srv.log,
+			transport: conn,
+			handler:   clientConfig.Handler,
+			state:     StateNew,
+			Metadata: &FtlConnectionMetadata{
+				CustomAttributes: make(map[string]string),
+			},
+
+			mediaPortMin: clientConfig.MediaPortMin,
+			mediaPortMax: clientConfig.MediaPortMax,
+
+			supportedVersions: clientConfig.SupportedVersions,
+
+			mediaRateLimiter: newMediaRateLimiter(clientConfig.MediaRateLimitMbps),
+
+			hmacAlgorithm: clientConfig.HMACAlgorithm,
+
+			routines: &srv.routines,
 		}
+		if len(ftlConn.supportedVersions) == 0 {
+			ftlConn.supportedVersions = DefaultSupportedVersions
+		}
+		if ftlConn.hmacAlgorithm == "" {
+			ftlConn.hmacAlgorithm = DefaultHmacAlgorithm
+		}
+
+		srv.track(ftlConn)
+
+		ftlConn.goTracked(func() {
+			defer srv.untrack(ftlConn)
 
-		go func() {
 			lim := &io.LimitedReader{
 				R: ftlConn.transport,
 				N: MaxLineLenBytes,
@@ -114,7 +173,7 @@ func (srv *Server) Serve(listener net.Listener) error {
 
 			for scanner.Scan() {
 				// A previous read could have disconnected us already
-				if !ftlConn.connected {
+				if ftlConn.State() == StateClosed {
 					return
 				}
 
@@ -139,17 +198,128 @@ func (srv *Server) Serve(listener net.Listener) error {
 				ftlConn.Close()
 				return
 			}
-		}()
+		})
 	}
 }
 
+func (srv *Server) track(conn *FtlConnection) {
+	srv.connectionsMutex.Lock()
+	defer srv.connectionsMutex.Unlock()
+
+	if srv.connections == nil {
+		srv.connections = make(map[*FtlConnection]bool)
+	}
+	srv.connections[conn] = true
+}
+
+func (srv *Server) untrack(conn *FtlConnection) {
+	srv.connectionsMutex.Lock()
+	defer srv.connectionsMutex.Unlock()
+
+	delete(srv.connections, conn)
+}
+
+// ConnectionInfo describes a connected client for the connections API
+type ConnectionInfo struct {
+	ChannelID        ChannelID         `json:"channel_id"`
+	RemoteAddr       string            `json:"remote_addr"`
+	State            string            `json:"state"`
+	ProtocolVersion  string            `json:"protocol_version"`
+	VendorName       string            `json:"vendor_name"`
+	VendorVersion    string            `json:"vendor_version"`
+	CustomAttributes map[string]string `json:"custom_attributes"`
+}
+
+// Connections lists every client currently connected
+func (srv *Server) Connections() []ConnectionInfo {
+	srv.connectionsMutex.Lock()
+	connections := make([]*FtlConnection, 0, len(srv.connections))
+	for conn := range srv.connections {
+		connections = append(connections, conn)
+	}
+	srv.connectionsMutex.Unlock()
+
+	infos := make([]ConnectionInfo, 0, len(connections))
+	for _, conn := range connections {
+		infos = append(infos, conn.info())
+	}
+	return infos
+}
+
+func (conn *FtlConnection) info() ConnectionInfo {
+	conn.metadataMutex.RLock()
+	defer conn.metadataMutex.RUnlock()
+
+	custom := make(map[string]string, len(conn.Metadata.CustomAttributes))
+	for key, value := range conn.Metadata.CustomAttributes {
+		custom[key] = value
+	}
+
+	return ConnectionInfo{
+		ChannelID:        ChannelID(conn.channelID),
+		RemoteAddr:       conn.transport.RemoteAddr().String(),
+		State:            conn.State().String(),
+		ProtocolVersion:  conn.Metadata.ProtocolVersion,
+		VendorName:       conn.Metadata.VendorName,
+		VendorVersion:    conn.Metadata.VendorVersion,
+		CustomAttributes: custom,
+	}
+}
+
+// Shutdown stops accepting new connections, disconnects every client with a
+// SERVER_SHUTDOWN reason and waits for their read loops to exit, or returns
+// ctx.Err() if ctx is done first
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.connectionsMutex.Lock()
+	srv.shuttingDown = true
+	connections := make([]*FtlConnection, 0, len(srv.connections))
+	for conn := range srv.connections {
+		connections = append(connections, conn)
+	}
+	srv.connectionsMutex.Unlock()
+
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+
+	for _, conn := range connections {
+		if disconnectErr := conn.SendDisconnect(DisconnectServerShutdown); disconnectErr != nil {
+			srv.log.Debugf("Failed sending disconnect: %+v", disconnectErr)
+		}
+		conn.Close()
+	}
+	if len(connections) > 0 {
+		srv.log.Infof("Closed %d FTL connections for shutdown", len(connections))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.routines.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
+
 type FtlConnection struct {
 	log logrus.FieldLogger
 
 	transport      net.Conn
 	mediaTransport *net.UDPConn
-	connected      bool
-	mediaConnected bool
+	rtcpTransport  *net.UDPConn
+
+	// Guards state, which is read from both the control and media goroutines
+	stateMutex sync.Mutex
+	state      FtlState
+	// Set once Handler.OnConnect succeeded, Handler.OnClose is only called
+	// for connections it accepted
+	handlerConnected bool
 
 	handler Handler
 
@@ -157,16 +327,27 @@ type FtlConnection struct {
 	channelID int
 	//streamKey         string
 	assignedMediaPort int
+	mediaPortMin      int
+	mediaPortMax      int
+
+	supportedVersions []string
+
+	// Only set with ConnConfig.MediaRateLimitMbps
+	mediaRateLimiter *mediaRateLimiter
+
+	// Algorithm the client has to hash hmacPayload with
+	hmacAlgorithm string
+	// The server's, see goTracked
+	routines *sync.WaitGroup
 
 	// Pre-calculated hash we expect the client to return
 	hmacPayload []byte
 	// Hash the client has actually returned
 	clientHmacHash []byte
 
-	hasAuthenticated bool
-	hmacRequested    bool
-
-	Metadata *FtlConnectionMetadata
+	// Guards Metadata, which the connections API reads
+	metadataMutex sync.RWMutex
+	Metadata      *FtlConnectionMetadata
 }
 
 type FtlConnectionMetadata struct {
@@ -185,6 +366,20 @@ type FtlConnectionMetadata struct {
 	AudioCodec       string
 	AudioPayloadType uint8
 	AudioIngestSsrc  uint
+
+	// Non-standard attributes sent by the client, eg by custom OBS plugins
+	CustomAttributes map[string]string
+
+	RTCPStats RTCPStats
+}
+
+// goTracked runs a read loop in a goroutine the server waits for on Shutdown
+func (conn *FtlConnection) goTracked(f func()) {
+	conn.routines.Add(1)
+	go func() {
+		defer conn.routines.Done()
+		f()
+	}()
 }
 
 func (conn *FtlConnection) SendMessage(message string) error {
@@ -194,22 +389,48 @@ func (conn *FtlConnection) SendMessage(message string) error {
 	return err
 }
 
+// SendDisconnect tells the client why we're dropping them before closing the connection
+func (conn *FtlConnection) SendDisconnect(reason string) error {
+	if conn.State() == StateClosed {
+		return nil
+	}
+
+	conn.log.Debugf("FTL SEND: %s %s", requestDisconnect, reason)
+	_, writeErr := conn.transport.Write([]byte(fmt.Sprintf("%s %s\r\n", requestDisconnect, reason)))
+	closeErr := conn.Close()
+
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
+
 func (conn *FtlConnection) Close() error {
+	if err := conn.transitionTo(StateClosed); err != nil {
+		// Already closed by the other goroutine
+		return nil
+	}
+
 	err := conn.transport.Close()
-	conn.connected = false
 
-	if conn.mediaConnected {
+	if conn.mediaTransport != nil {
 		conn.mediaTransport.Close()
-		conn.mediaConnected = false
+		conn.rtcpTransport.Close()
+		releaseMediaPorts(conn.mediaPortMin, conn.mediaPortMax, conn.assignedMediaPort, conn.assignedMediaPort+1)
 	}
 
-	conn.handler.OnClose()
+	conn.stateMutex.Lock()
+	handlerConnected := conn.handlerConnected
+	conn.stateMutex.Unlock()
+	if handlerConnected {
+		conn.handler.OnClose()
+	}
 
 	return err
 }
 
 func (conn *FtlConnection) ProcessCommand(command string) error {
-	conn.log.Debugf("FTL RECV: %s", command)
+	conn.log.Debugf("FTL RECV: %s", redactHmac(command))
 	if command == "HMAC" {
 		return conn.processHmacCommand()
 	} else if strings.Contains(command, "DISCONNECT") {
@@ -232,12 +453,22 @@ func (conn *FtlConnection) ProcessCommand(command string) error {
 }
 
 func (conn *FtlConnection) processHmacCommand() error {
+	if hmacHash(conn.hmacAlgorithm) == nil {
+		return ErrUnsupportedHmacAlgorithm
+	}
+	if err := conn.transitionTo(StateHmacSent); err != nil {
+		return err
+	}
+
 	conn.hmacPayload = make([]byte, hmacPayloadSize)
 	rand.Read(conn.hmacPayload)
 
 	encodedPayload := hex.EncodeToString(conn.hmacPayload)
 
-	return conn.SendMessage(fmt.Sprintf(responseHmacPayload, encodedPayload))
+	if conn.hmacAlgorithm == DefaultHmacAlgorithm {
+		return conn.SendMessage(fmt.Sprintf(responseHmacPayload, encodedPayload))
+	}
+	return conn.SendMessage(fmt.Sprintf(responseHmacAlgorithm, conn.hmacAlgorithm, encodedPayload))
 }
 
 func (conn *FtlConnection) processDisconnectCommand(message string) error {
@@ -247,12 +478,13 @@ func (conn *FtlConnection) processDisconnectCommand(message string) error {
 }
 
 func (conn *FtlConnection) processConnectCommand(message string) error {
-	if conn.hmacRequested {
+	switch conn.State() {
+	case StateNew:
+		return ErrHmacNotRequested
+	case StateAuthenticated, StateStreaming:
 		return ErrMultipleConnect
 	}
 
-	conn.hmacRequested = true
-
 	matches := connectRegex.FindAllStringSubmatch(message, 3)
 	if len(matches) < 1 {
 		return ErrUnexpectedArguments
@@ -274,15 +506,23 @@ func (conn *FtlConnection) processConnectCommand(message string) error {
 	conn.channelID = channelId
 
 	if err := conn.handler.OnConnect(ChannelID(conn.channelID)); err != nil {
+		if errors.Is(err, ErrChannelInUse) {
+			conn.SendDisconnect(DisconnectChannelInUse)
+		}
 		return err
 	}
+	if !conn.setHandlerConnected() {
+		// Closed while OnConnect was running, Close didn't know to call OnClose
+		conn.handler.OnClose()
+		return ErrClosed
+	}
 
 	hmacKey, err := conn.handler.GetHmacKey()
 	if err != nil {
 		return err
 	}
 
-	hash := hmac.New(sha512.New, []byte(hmacKey))
+	hash := hmac.New(hmacHash(conn.hmacAlgorithm), []byte(hmacKey))
 	hash.Write(conn.hmacPayload)
 	conn.hmacPayload = hash.Sum(nil)
 
@@ -291,39 +531,79 @@ func (conn *FtlConnection) processConnectCommand(message string) error {
 		return ErrInvalidHmacHex
 	}
 
-	conn.hasAuthenticated = true
 	conn.clientHmacHash = hmacBytes
 
 	if !hmac.Equal(conn.clientHmacHash, conn.hmacPayload) {
+		conn.SendDisconnect(DisconnectAuthFailed)
 		return ErrInvalidHmacHash
 	}
 
+	if err := conn.transitionTo(StateAuthenticated); err != nil {
+		return err
+	}
+
 	return conn.SendMessage(responseOk)
 }
 
+// setHandlerConnected records that OnConnect succeeded, unless the
+// connection was closed in the meantime
+func (conn *FtlConnection) setHandlerConnected() bool {
+	conn.stateMutex.Lock()
+	defer conn.stateMutex.Unlock()
+
+	if conn.state == StateClosed {
+		return false
+	}
+	conn.handlerConnected = true
+	return true
+}
+
 func (conn *FtlConnection) processAttributeCommand(message string) error {
-	if !conn.hasAuthenticated {
+	if state := conn.State(); state != StateAuthenticated && state != StateStreaming {
+		conn.SendDisconnect(DisconnectAuthFailed)
 		return ErrConnectBeforeAuth
 	}
 
+	if len(message) > maxAttributeMessageBytes {
+		conn.SendDisconnect(DisconnectInvalidCommand)
+		return ErrOversizedAttribute
+	}
+
 	matches := attributeRegex.FindAllStringSubmatch(message, 3)
 	if len(matches) < 1 || len(matches[0]) < 3 {
+		conn.SendDisconnect(DisconnectInvalidCommand)
 		return ErrUnexpectedArguments
 	}
 	key, value := matches[0][1], matches[0][2]
 
+	// Connections are listed by the API while attributes come in
+	conn.metadataMutex.Lock()
+	err := conn.setAttribute(key, value)
+	conn.metadataMutex.Unlock()
+	if err != nil {
+		conn.SendDisconnect(DisconnectInvalidCommand)
+		return err
+	}
+
+	if key == "ProtocolVersion" {
+		return conn.negotiateVersion()
+	}
+	return nil
+}
+
+func (conn *FtlConnection) setAttribute(key, value string) (err error) {
 	switch key {
 	case "ProtocolVersion":
-		conn.Metadata.ProtocolVersion = value
+		conn.Metadata.ProtocolVersion, err = sanitizeAttribute(value)
 	case "VendorName":
-		conn.Metadata.VendorName = value
+		conn.Metadata.VendorName, err = sanitizeAttribute(value)
 	case "VendorVersion":
-		conn.Metadata.VendorVersion = value
+		conn.Metadata.VendorVersion, err = sanitizeAttribute(value)
 	// Video
 	case "Video":
 		conn.Metadata.HasVideo = parseAttributeToBool(value)
 	case "VideoCodec":
-		conn.Metadata.VideoCodec = value
+		conn.Metadata.VideoCodec, err = sanitizeAttribute(value)
 	case "VideoHeight":
 		conn.Metadata.VideoHeight = parseAttributeToUint(value)
 	case "VideoWidth":
@@ -336,18 +616,79 @@ func (conn *FtlConnection) processAttributeCommand(message string) error {
 	case "Audio":
 		conn.Metadata.HasAudio = parseAttributeToBool(value)
 	case "AudioCodec":
-		conn.Metadata.AudioCodec = value
+		conn.Metadata.AudioCodec, err = sanitizeAttribute(value)
 	case "AudioPayloadType":
 		conn.Metadata.AudioPayloadType = parseAttributeToUint8(value)
 	case "AudioIngestSSRC":
 		conn.Metadata.AudioIngestSsrc = parseAttributeToUint(value)
 	default:
-		conn.log.Infof("Unexpected Attribute: %q", message)
+		err = conn.addCustomAttribute(key, value)
+	}
+
+	return err
+}
+
+// negotiateVersion turns away clients announcing a version we don't speak
+func (conn *FtlConnection) negotiateVersion() error {
+	version := conn.Metadata.ProtocolVersion
+	for _, supported := range conn.supportedVersions {
+		if version == supported {
+			protocolVersionsTotal.WithLabelValues(version).Inc()
+			return nil
+		}
+	}
+
+	protocolVersionsTotal.WithLabelValues("unsupported").Inc()
+	conn.log.Warnf("Unsupported protocol version %q", version)
+	conn.transport.Write([]byte(responseUnsupportedVersion + "\r\n"))
+	conn.Close()
+	return ErrUnsupportedVersion
+}
+
+// addCustomAttribute keeps an attribute that's not part of the protocol, so
+// clients with their own extensions can pass extra information along. Only
+// clients that negotiated 1.0 can, anything else is ignored like before.
+func (conn *FtlConnection) addCustomAttribute(key, value string) error {
+	key, err := sanitizeAttribute(key)
+	if err != nil {
+		return err
+	}
+	if conn.Metadata.ProtocolVersion != customAttributesVersion {
+		conn.log.Debugf("Ignoring custom attribute %q from protocol version %q", key, conn.Metadata.ProtocolVersion)
+		return nil
+	}
+	value, err = sanitizeAttribute(value)
+	if err != nil {
+		return err
+	}
+
+	if _, exists := conn.Metadata.CustomAttributes[key]; !exists && len(conn.Metadata.CustomAttributes) >= maxCustomAttributes {
+		conn.log.Infof("Dropping custom attribute %q, too many custom attributes", key)
+		return nil
 	}
+	conn.log.Debugf("Custom attribute %q: %q", key, value)
+	conn.Metadata.CustomAttributes[key] = value
 
 	return nil
 }
 
+// sanitizeAttribute strips anything but printable ASCII from client provided
+// strings and caps their length, rejecting values with null bytes outright
+func sanitizeAttribute(value string) (string, error) {
+	if strings.IndexByte(value, 0) >= 0 {
+		return "", ErrInvalidAttribute
+	}
+
+	sanitized := make([]byte, 0, len(value))
+	for i := 0; i < len(value) && len(sanitized) < maxAttributeValueBytes; i++ {
+		if value[i] >= 0x20 && value[i] <= 0x7E {
+			sanitized = append(sanitized, value[i])
+		}
+	}
+
+	return string(sanitized), nil
+}
+
 func parseAttributeToUint(input string) uint {
 	u, _ := strconv.ParseUint(input, 10, 32)
 	return uint(u)
@@ -361,9 +702,12 @@ func parseAttributeToBool(input string) bool {
 }
 
 func (conn *FtlConnection) processDotCommand() error {
-	if !conn.hasAuthenticated {
+	if conn.State() != StateAuthenticated {
 		return ErrConnectBeforeAuth
 	}
+	if err := conn.transitionTo(StateStreaming); err != nil {
+		return err
+	}
 
 	err := conn.listenForMedia()
 	if err != nil {
@@ -406,20 +750,20 @@ func scanCRLF(data []byte, atEOF bool) (advance int, token []byte, err error) {
 }
 
 func (conn *FtlConnection) listenForMedia() error {
-	udpAddr, err := net.ResolveUDPAddr("udp", ":0")
+	mediaConn, rtcpConn, err := listenMediaPorts(conn.mediaPortMin, conn.mediaPortMax)
 	if err != nil {
 		return err
 	}
-	mediaConn, mediaErr := net.ListenUDP("udp", udpAddr)
-	if mediaErr != nil {
-		return err
-	}
 
 	conn.assignedMediaPort = mediaConn.LocalAddr().(*net.UDPAddr).Port
 	conn.mediaTransport = mediaConn
-	conn.mediaConnected = true
+	conn.rtcpTransport = rtcpConn
+	if stats := MediaPortUsage(conn.mediaPortMin, conn.mediaPortMax); stats.low() {
+		conn.log.Errorf("Only %d of %d FTL media ports left in %d-%d", stats.Available, stats.Total, stats.PortMin, stats.PortMax)
+	}
 
 	conn.log.Infof("Listening for UDP connections on: %d", conn.assignedMediaPort)
+	conn.readRTCP()
 
 	// Create NACK Generator
 	generatorFactory, err := nack.NewGeneratorInterceptor()
@@ -442,9 +786,9 @@ func (conn *FtlConnection) listenForMedia() error {
 		RTCPFeedback: []interceptor.RTCPFeedback{{Type: "nack", Parameter: ""}},
 	}, interceptor.RTPReaderFunc(func(b []byte, _ interceptor.Attributes) (int, interceptor.Attributes, error) { return len(b), nil, nil }))
 
-	go func() {
+	conn.goTracked(func() {
 		for rtcpBound, buffer := false, make([]byte, 1500); ; {
-			if !conn.mediaConnected {
+			if conn.State() == StateClosed {
 				return
 			}
 
@@ -455,6 +799,10 @@ func (conn *FtlConnection) listenForMedia() error {
 				return
 			}
 
+			if !conn.allowMedia(n) {
+				continue
+			}
+
 			packet := &rtp.Packet{}
 			buf := buffer[:n]
 			if err = packet.Unmarshal(buf); err != nil {
@@ -543,7 +891,7 @@ func (conn *FtlConnection) listenForMedia() error {
 				rtcpBound = true
 			}
 		}
-	}()
+	})
 
 	return nil
 }
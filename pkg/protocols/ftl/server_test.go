@@ -0,0 +1,154 @@
+package ftl
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCustomAttributesNeedVersion10(t *testing.T) {
+	tests := []struct {
+		version string
+		kept    bool
+	}{
+		{"1.0", true},
+		{"0.9", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		conn := &FtlConnection{
+			log:      logrus.New(),
+			Metadata: &FtlConnectionMetadata{ProtocolVersion: tt.version, CustomAttributes: make(map[string]string)},
+		}
+
+		assert.NoError(t, conn.setAttribute("X-Scene", "intro"), tt.version)
+		if tt.kept {
+			assert.Equal(t, map[string]string{"X-Scene": "intro"}, conn.Metadata.CustomAttributes, tt.version)
+		} else {
+			assert.Empty(t, conn.Metadata.CustomAttributes, tt.version)
+		}
+	}
+}
+
+type testHandler struct {
+	connectErr error
+	connects   int
+	closes     int
+}
+
+func (h *testHandler) GetHmacKey() (string, error)        { return "secret", nil }
+func (h *testHandler) OnPlay(FtlConnectionMetadata) error { return nil }
+func (h *testHandler) OnVideo(*rtp.Packet) error          { return nil }
+func (h *testHandler) OnAudio(*rtp.Packet) error          { return nil }
+func (h *testHandler) OnRTCPStats(RTCPStats)              {}
+func (h *testHandler) OnClose()                           { h.closes++ }
+func (h *testHandler) OnConnect(ChannelID) error {
+	h.connects++
+	return h.connectErr
+}
+
+// newTestConnection is a connection that asked for its HMAC challenge,
+// with whatever it sends back discarded
+func newTestConnection(t *testing.T, handler Handler) *FtlConnection {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go io.Copy(io.Discard, client)
+
+	conn := &FtlConnection{
+		log:           logrus.New(),
+		transport:     server,
+		handler:       handler,
+		state:         StateNew,
+		hmacAlgorithm: DefaultHmacAlgorithm,
+		Metadata:      &FtlConnectionMetadata{CustomAttributes: make(map[string]string)},
+	}
+	if err := conn.ProcessCommand(requestHmac); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// connectCommand answers the connection's challenge with key
+func connectCommand(conn *FtlConnection, key string) string {
+	hash := hmac.New(hmacHash(conn.hmacAlgorithm), []byte(key))
+	hash.Write(conn.hmacPayload)
+	return fmt.Sprintf(requestConnect, 1, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func TestOnCloseOnlyAfterOnConnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		connectErr error
+		key        string
+		wantErr    error
+		connects   int
+		closes     int
+	}{
+		{"authenticated", nil, "secret", nil, 1, 1},
+		{"channel in use", ErrChannelInUse, "secret", ErrChannelInUse, 1, 0},
+		// OnConnect already started the stream before the HMAC is checked
+		{"wrong hmac", nil, "wrong", ErrInvalidHmacHash, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			handler := &testHandler{connectErr: tt.connectErr}
+			conn := newTestConnection(t, handler)
+
+			err := conn.ProcessCommand(connectCommand(conn, tt.key))
+			if tt.wantErr != nil {
+				assert.ErrorIs(err, tt.wantErr)
+			} else {
+				assert.NoError(err)
+			}
+
+			conn.Close()
+			conn.Close()
+			assert.Equal(StateClosed, conn.State())
+			assert.Equal(tt.connects, handler.connects)
+			assert.Equal(tt.closes, handler.closes)
+		})
+	}
+}
+
+func TestOnCloseNeverConnected(t *testing.T) {
+	assert := assert.New(t)
+	handler := &testHandler{}
+	conn := newTestConnection(t, handler)
+
+	// Dropped before it ever sent CONNECT, eg a port scanner
+	assert.NoError(conn.Close())
+	assert.Zero(handler.connects)
+	assert.Zero(handler.closes)
+}
+
+func TestOnCloseWhileConnecting(t *testing.T) {
+	assert := assert.New(t)
+	handler := &testHandler{}
+	conn := newTestConnection(t, handler)
+
+	// Closed by another goroutine while OnConnect is running
+	conn.handler = &closingHandler{testHandler: handler, conn: conn}
+	assert.ErrorIs(conn.ProcessCommand(connectCommand(conn, "secret")), ErrClosed)
+	assert.Equal(1, handler.connects)
+	assert.Equal(1, handler.closes)
+}
+
+type closingHandler struct {
+	*testHandler
+	conn *FtlConnection
+}
+
+func (h *closingHandler) OnConnect(channelID ChannelID) error {
+	h.conn.Close()
+	return h.testHandler.OnConnect(channelID)
+}
@@ -0,0 +1,66 @@
+package ftl
+
+import "fmt"
+
+// FtlState is the lifecycle of an FTL control connection
+type FtlState int
+
+const (
+	// StateNew is a freshly accepted connection
+	StateNew FtlState = iota
+	// StateHmacSent means we've sent the HMAC challenge and are waiting for CONNECT
+	StateHmacSent
+	// StateAuthenticated means CONNECT succeeded and the client is sending attributes
+	StateAuthenticated
+	// StateStreaming means media is flowing over UDP
+	StateStreaming
+	// StateClosed is terminal
+	StateClosed
+)
+
+var stateNames = map[FtlState]string{
+	StateNew:           "New",
+	StateHmacSent:      "HmacSent",
+	StateAuthenticated: "Authenticated",
+	StateStreaming:     "Streaming",
+	StateClosed:        "Closed",
+}
+
+func (s FtlState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("FtlState(%d)", int(s))
+}
+
+// validTransitions lists the states each state may move to. Any state other
+// than StateClosed may be closed.
+var validTransitions = map[FtlState][]FtlState{
+	StateNew:           {StateHmacSent, StateClosed},
+	StateHmacSent:      {StateAuthenticated, StateClosed},
+	StateAuthenticated: {StateStreaming, StateClosed},
+	StateStreaming:     {StateClosed},
+}
+
+// State returns the current state of the connection
+func (conn *FtlConnection) State() FtlState {
+	conn.stateMutex.Lock()
+	defer conn.stateMutex.Unlock()
+
+	return conn.state
+}
+
+func (conn *FtlConnection) transitionTo(next FtlState) error {
+	conn.stateMutex.Lock()
+	defer conn.stateMutex.Unlock()
+
+	for _, allowed := range validTransitions[conn.state] {
+		if allowed == next {
+			conn.log.Debugf("FTL state %s -> %s", conn.state, next)
+			conn.state = next
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, conn.state, next)
+}
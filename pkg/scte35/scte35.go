@@ -0,0 +1,167 @@
+// Package scte35 parses the parts of SCTE-35 splice_info_section we need to
+// mark ad breaks, which is the splice_insert command. See ANSI/SCTE 35 2019
+// section 9.
+package scte35
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	tableID = 0xFC
+
+	CommandSpliceNull   = 0x00
+	CommandSpliceInsert = 0x05
+	CommandTimeSignal   = 0x06
+
+	// PTS and durations are on the 90kHz MPEG clock
+	clockRate = 90000
+)
+
+var (
+	ErrShortSection   = errors.New("splice_info_section is truncated")
+	ErrInvalidTableID = errors.New("not a splice_info_section")
+	ErrEncrypted      = errors.New("encrypted splice_info_section")
+)
+
+// SpliceInsert is a splice_insert command, the start or end of an ad break
+type SpliceInsert struct {
+	EventID uint32
+	// Cancels a previously sent splice_insert with the same EventID
+	Cancel bool
+	// Set when leaving the network feed for an ad break, unset when returning
+	OutOfNetwork bool
+	Immediate    bool
+	// Length of the break, zero if it wasn't given
+	Duration time.Duration
+	// The break ends on its own once Duration has passed
+	AutoReturn bool
+	// Presentation time of the splice point, only set when it was given
+	PTS          uint64
+	PTSSpecified bool
+}
+
+// SpliceInfo is a parsed splice_info_section
+type SpliceInfo struct {
+	PTSAdjustment uint64
+	CommandType   uint8
+	// Only set for splice_insert commands
+	Insert *SpliceInsert
+}
+
+// Parse decodes a splice_info_section. Commands other than splice_insert
+// are returned with only CommandType set.
+func Parse(data []byte) (*SpliceInfo, error) {
+	r := &bitReader{data: data}
+
+	if r.bits(8) != tableID {
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, ErrInvalidTableID
+	}
+	r.bits(4) // section_syntax_indicator, private_indicator, reserved
+	sectionLength := int(r.bits(12))
+	if r.err == nil && sectionLength > len(data)-3 {
+		return nil, ErrShortSection
+	}
+	r.bits(8) // protocol_version
+	if r.bits(1) == 1 {
+		return nil, ErrEncrypted
+	}
+	r.bits(6) // encryption_algorithm
+
+	info := &SpliceInfo{PTSAdjustment: r.bits(33)}
+	r.bits(8)  // cw_index
+	r.bits(12) // tier
+	r.bits(12) // splice_command_length, 0xFFF in older encoders so it's not relied on
+	info.CommandType = uint8(r.bits(8))
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	switch info.CommandType {
+	case CommandSpliceInsert:
+		insert, err := parseSpliceInsert(r)
+		if err != nil {
+			return nil, err
+		}
+		info.Insert = insert
+	}
+
+	return info, nil
+}
+
+func parseSpliceInsert(r *bitReader) (*SpliceInsert, error) {
+	insert := &SpliceInsert{EventID: uint32(r.bits(32))}
+	insert.Cancel = r.bits(1) == 1
+	r.bits(7)
+	if insert.Cancel {
+		return insert, r.err
+	}
+
+	insert.OutOfNetwork = r.bits(1) == 1
+	programSplice := r.bits(1) == 1
+	durationFlag := r.bits(1) == 1
+	insert.Immediate = r.bits(1) == 1
+	r.bits(4)
+
+	if programSplice && !insert.Immediate {
+		insert.PTS, insert.PTSSpecified = r.spliceTime()
+	}
+	if !programSplice {
+		components := int(r.bits(8))
+		for i := 0; i < components && r.err == nil; i++ {
+			r.bits(8) // component_tag
+			if !insert.Immediate {
+				r.spliceTime()
+			}
+		}
+	}
+	if durationFlag {
+		insert.AutoReturn = r.bits(1) == 1
+		r.bits(6)
+		insert.Duration = time.Duration(r.bits(33)) * time.Second / clockRate
+	}
+	r.bits(16) // unique_program_id
+	r.bits(8)  // avail_num
+	r.bits(8)  // avails_expected
+
+	return insert, r.err
+}
+
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+// bits reads n bits, up to 64, most significant first
+func (r *bitReader) bits(n int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+n > len(r.data)*8 {
+		r.err = ErrShortSection
+		return 0
+	}
+
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+// spliceTime reads a splice_time(), returning the PTS if one was given
+func (r *bitReader) spliceTime() (uint64, bool) {
+	if r.bits(1) == 1 {
+		r.bits(6)
+		return r.bits(33), true
+	}
+	r.bits(7)
+	return 0, false
+}
@@ -0,0 +1,242 @@
+package scte35
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bitWriter packs fields most significant bit first, the way bitReader
+// reads them
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) bits(n int, v uint64) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[w.pos/8] |= byte(v>>uint(i)&1) << (7 - uint(w.pos%8))
+		w.pos++
+	}
+}
+
+// section builds a splice_info_section around a command written by command
+func section(commandType uint8, command func(w *bitWriter)) []byte {
+	w := &bitWriter{}
+	w.bits(8, tableID)
+	w.bits(4, 0x3)    // section_syntax_indicator, private_indicator, reserved
+	w.bits(12, 0)     // section_length, filled in below
+	w.bits(8, 0)      // protocol_version
+	w.bits(1, 0)      // encrypted_packet
+	w.bits(6, 0)      // encryption_algorithm
+	w.bits(33, 1000)  // pts_adjustment
+	w.bits(8, 0)      // cw_index
+	w.bits(12, 0xFFF) // tier
+	w.bits(12, 0xFFF) // splice_command_length
+	w.bits(8, uint64(commandType))
+	if command != nil {
+		command(w)
+	}
+	w.bits(16, 0) // descriptor_loop_length
+	w.bits(32, 0) // CRC_32, not checked
+
+	length := len(w.data) - 3
+	w.data[1] |= byte(length >> 8)
+	w.data[2] = byte(length)
+	return w.data
+}
+
+func spliceTime(w *bitWriter, pts uint64) {
+	w.bits(1, 1)
+	w.bits(6, 0x3F)
+	w.bits(33, pts)
+}
+
+func breakDuration(w *bitWriter, autoReturn bool, duration uint64) {
+	if autoReturn {
+		w.bits(1, 1)
+	} else {
+		w.bits(1, 0)
+	}
+	w.bits(6, 0x3F)
+	w.bits(33, duration)
+}
+
+func spliceInsertTrailer(w *bitWriter) {
+	w.bits(16, 1) // unique_program_id
+	w.bits(8, 0)  // avail_num
+	w.bits(8, 0)  // avails_expected
+}
+
+// An ad break starting at PTS 900000, returning on its own after 30s
+var outSection = section(CommandSpliceInsert, func(w *bitWriter) {
+	w.bits(32, 42)
+	w.bits(1, 0) // splice_event_cancel_indicator
+	w.bits(7, 0x7F)
+	w.bits(1, 1) // out_of_network_indicator
+	w.bits(1, 1) // program_splice_flag
+	w.bits(1, 1) // duration_flag
+	w.bits(1, 0) // splice_immediate_flag
+	w.bits(4, 0xF)
+	spliceTime(w, 900000)
+	breakDuration(w, true, 30*clockRate)
+	spliceInsertTrailer(w)
+})
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want *SpliceInfo
+		err  error
+	}{
+		{
+			name: "out",
+			data: outSection,
+			want: &SpliceInfo{PTSAdjustment: 1000, CommandType: CommandSpliceInsert, Insert: &SpliceInsert{
+				EventID:      42,
+				OutOfNetwork: true,
+				Duration:     30 * time.Second,
+				AutoReturn:   true,
+				PTS:          900000,
+				PTSSpecified: true,
+			}},
+		},
+		{
+			name: "in",
+			data: section(CommandSpliceInsert, func(w *bitWriter) {
+				w.bits(32, 42)
+				w.bits(1, 0)
+				w.bits(7, 0x7F)
+				w.bits(1, 0) // back to the network
+				w.bits(1, 1)
+				w.bits(1, 0)
+				w.bits(1, 1) // immediate, so no splice_time
+				w.bits(4, 0xF)
+				spliceInsertTrailer(w)
+			}),
+			want: &SpliceInfo{PTSAdjustment: 1000, CommandType: CommandSpliceInsert, Insert: &SpliceInsert{
+				EventID:   42,
+				Immediate: true,
+			}},
+		},
+		{
+			name: "cancel",
+			data: section(CommandSpliceInsert, func(w *bitWriter) {
+				w.bits(32, 7)
+				w.bits(1, 1)
+				w.bits(7, 0x7F)
+			}),
+			want: &SpliceInfo{PTSAdjustment: 1000, CommandType: CommandSpliceInsert, Insert: &SpliceInsert{
+				EventID: 7,
+				Cancel:  true,
+			}},
+		},
+		{
+			name: "component mode",
+			data: section(CommandSpliceInsert, func(w *bitWriter) {
+				w.bits(32, 99)
+				w.bits(1, 0)
+				w.bits(7, 0x7F)
+				w.bits(1, 1)
+				w.bits(1, 0) // splices components rather than the program
+				w.bits(1, 1)
+				w.bits(1, 0)
+				w.bits(4, 0xF)
+				w.bits(8, 2) // component_count
+				for tag := uint64(1); tag <= 2; tag++ {
+					w.bits(8, tag)
+					spliceTime(w, 450000+tag)
+				}
+				breakDuration(w, false, 60*clockRate)
+				spliceInsertTrailer(w)
+			}),
+			// Component splice times aren't kept, the duration after them is
+			want: &SpliceInfo{PTSAdjustment: 1000, CommandType: CommandSpliceInsert, Insert: &SpliceInsert{
+				EventID:      99,
+				OutOfNetwork: true,
+				Duration:     60 * time.Second,
+			}},
+		},
+		{
+			name: "time signal",
+			data: section(CommandTimeSignal, func(w *bitWriter) {
+				spliceTime(w, 900000)
+			}),
+			want: &SpliceInfo{PTSAdjustment: 1000, CommandType: CommandTimeSignal},
+		},
+		{
+			name: "splice null",
+			data: section(CommandSpliceNull, nil),
+			want: &SpliceInfo{PTSAdjustment: 1000, CommandType: CommandSpliceNull},
+		},
+		{
+			name: "not scte35",
+			data: append([]byte{0x00}, outSection[1:]...),
+			err:  ErrInvalidTableID,
+		},
+		{
+			name: "encrypted",
+			data: func() []byte {
+				data := append([]byte{}, outSection...)
+				data[4] |= 0x80
+				return data
+			}(),
+			err: ErrEncrypted,
+		},
+		{
+			name: "truncated splice_insert",
+			data: section(CommandSpliceInsert, func(w *bitWriter) {
+				w.bits(16, 42)
+			}),
+			err: ErrShortSection,
+		},
+		{
+			name: "empty",
+			data: []byte{},
+			err:  ErrShortSection,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Parse(tt.data)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				assert.Nil(t, info)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, info)
+		})
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	// Cut off anywhere, including inside section_length
+	for i := 0; i < len(outSection); i++ {
+		info, err := Parse(outSection[:i])
+		assert.ErrorIs(t, err, ErrShortSection, "%d bytes", i)
+		assert.Nil(t, info, "%d bytes", i)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(outSection)
+	f.Add(section(CommandSpliceInsert, func(w *bitWriter) {
+		w.bits(32, 7)
+		w.bits(1, 1)
+		w.bits(7, 0x7F)
+	}))
+	f.Add(section(CommandTimeSignal, nil))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Any error is fine, it just mustn't panic
+		Parse(data)
+	})
+}
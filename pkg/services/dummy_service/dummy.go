@@ -2,12 +2,17 @@ package dummy_service
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/sirupsen/logrus"
 )
 
+// Key-only stream keys are looked up by trying the channels up to this,
+// there's no going back from a key to its channel
+const maxLookupChannelID = 10000
+
 type Service struct {
 	config *Config
 	log    logrus.FieldLogger
@@ -39,13 +44,28 @@ func (s *Service) Connect() error {
 
 // GetHmacKey returns a sha256 string of the encoded channel ID
 func (s *Service) GetHmacKey(channelID control.ChannelID) ([]byte, error) {
-	h := sha256.New()
-	h.Write([]byte(fmt.Sprint(channelID)))
-	hmacKey := fmt.Sprintf("%x", h.Sum(nil))
+	hmacKey := dummyHmacKey(channelID)
 	s.log.Debugf("Dummy service key for %d is %s", channelID, hmacKey)
 	return []byte(hmacKey), nil
 }
 
+// GetChannelIDByStreamKey finds the channel with streamKey as its HMAC key,
+// among the first maxLookupChannelID channels
+func (s *Service) GetChannelIDByStreamKey(streamKey control.StreamKey) (control.ChannelID, error) {
+	for channelID := control.ChannelID(0); channelID <= maxLookupChannelID; channelID++ {
+		if dummyHmacKey(channelID) == string(streamKey) {
+			return channelID, nil
+		}
+	}
+	return 0, errors.New("no channel for stream key")
+}
+
+func dummyHmacKey(channelID control.ChannelID) string {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprint(channelID)))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 func (s *Service) StartStream(channelID control.ChannelID) (control.StreamID, error) {
 	return control.StreamID(channelID + 1), nil
 }
@@ -63,3 +83,8 @@ func (s *Service) UpdateStreamMetadata(streamID control.StreamID, metadata contr
 func (s *Service) SendJpegPreviewImage(streamID control.StreamID, img []byte) error {
 	return nil
 }
+
+// GetChannelCategory puts every channel in the "default" category
+func (s *Service) GetChannelCategory(channelID control.ChannelID) (string, error) {
+	return "default", nil
+}
@@ -7,11 +7,12 @@ import (
 	"mime/multipart"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Glimesh/waveguide/pkg/control"
 	"github.com/hasura/go-graphql-client"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 type Service struct {
@@ -22,6 +23,13 @@ type Service struct {
 	httpClient *http.Client
 	config     *Config
 
+	// The OAuth2 token API calls are made with, see token()
+	refreshMutex sync.Mutex
+	tokenMutex   sync.Mutex
+	accessToken  string
+	refreshToken string
+	tokenExpiry  time.Time
+
 	log logrus.FieldLogger
 }
 
@@ -36,6 +44,7 @@ func New(config Config) *Service {
 		tokenUrl: "/api/oauth/token",
 		apiUrl:   "/api/graph",
 		config:   &config,
+		log:      logrus.StandardLogger(),
 	}
 }
 
@@ -48,13 +57,9 @@ func (s *Service) Name() string {
 }
 
 func (s *Service) Connect() error {
-	config := clientcredentials.Config{
-		ClientID:     s.config.ClientID,
-		ClientSecret: s.config.ClientSecret,
-		TokenURL:     fmt.Sprintf("%s%s", s.config.Endpoint, s.tokenUrl),
-		Scopes:       []string{"streamkey"},
+	s.httpClient = &http.Client{
+		Transport: &tokenTransport{service: s, base: http.DefaultTransport},
 	}
-	s.httpClient = config.Client(context.Background())
 	s.client = graphql.NewClient(fmt.Sprintf("%s%s", s.config.Endpoint, s.apiUrl), s.httpClient)
 
 	return nil
@@ -75,6 +80,46 @@ func (s *Service) GetHmacKey(channelID control.ChannelID) ([]byte, error) {
 	return []byte(hmacQuery.Channel.HmacKey), nil
 }
 
+// GetChannelIDByStreamKey finds the channel whose HMAC key, which is what
+// broadcasters use as their stream key, is streamKey
+func (s *Service) GetChannelIDByStreamKey(streamKey control.StreamKey) (control.ChannelID, error) {
+	var channelQuery struct {
+		Channel struct {
+			Id graphql.String
+		} `graphql:"channel(hmacKey: $hmacKey)"`
+	}
+	err := s.client.Query(context.Background(), &channelQuery, map[string]interface{}{
+		"hmacKey": graphql.String(streamKey),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(string(channelQuery.Channel.Id), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("no channel for stream key: %w", err)
+	}
+	return control.ChannelID(id), nil
+}
+
+// GetChannelCategory returns the slug of the category the channel streams in
+func (s *Service) GetChannelCategory(channelID control.ChannelID) (string, error) {
+	var categoryQuery struct {
+		Channel struct {
+			Category struct {
+				Slug graphql.String
+			}
+		} `graphql:"channel(id: $id)"`
+	}
+	err := s.client.Query(context.Background(), &categoryQuery, map[string]interface{}{
+		"id": graphql.ID(fmt.Sprint(channelID)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(categoryQuery.Channel.Category.Slug), nil
+}
+
 func (s *Service) StartStream(channelID control.ChannelID) (control.StreamID, error) {
 	var startStreamMutation struct {
 		Stream struct {
@@ -106,7 +151,24 @@ func (s *Service) EndStream(streamID control.StreamID) error {
 	})
 }
 
-type StreamMetadataInput control.StreamMetadata
+// StreamMetadataInput mirrors the GraphQL input type, control.StreamMetadata
+// carries extra fields the Glimesh API does not accept
+type StreamMetadataInput struct {
+	AudioCodec        string
+	IngestServer      string
+	IngestViewers     int
+	LostPackets       int
+	NackPackets       int
+	RecvPackets       int
+	SourceBitrate     int
+	SourcePing        int
+	StreamTimeSeconds int
+	VendorName        string
+	VendorVersion     string
+	VideoCodec        string
+	VideoHeight       int
+	VideoWidth        int
+}
 
 func (s *Service) UpdateStreamMetadata(streamID control.StreamID, metadata control.StreamMetadata) error {
 	var logStreamMetadata struct {
@@ -0,0 +1,115 @@
+package glimesh
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	// Tokens expiring sooner than this are refreshed before they're used
+	tokenRefreshMargin = 60 * time.Second
+	// How long a token request has before it's given up on
+	tokenRequestTimeout = 10 * time.Second
+)
+
+// token returns an access token that's good for at least tokenRefreshMargin,
+// refreshing it first if needed. Only one refresh runs at a time, and callers
+// with a good token don't wait for it.
+func (s *Service) token() (string, error) {
+	if token, ok := s.currentToken(); ok {
+		return token, nil
+	}
+
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+
+	// Someone else may have refreshed it while we waited
+	if token, ok := s.currentToken(); ok {
+		return token, nil
+	}
+	return s.refresh()
+}
+
+// currentToken returns the access token if it's good for long enough
+func (s *Service) currentToken() (string, bool) {
+	s.tokenMutex.Lock()
+	defer s.tokenMutex.Unlock()
+
+	if s.accessToken != "" && (s.tokenExpiry.IsZero() || time.Until(s.tokenExpiry) > tokenRefreshMargin) {
+		return s.accessToken, true
+	}
+	return "", false
+}
+
+// refresh uses the refresh token if we have one, otherwise it asks for a new
+// token with the client credentials. A refresh token that's been revoked or
+// has expired is dropped for the client credentials.
+func (s *Service) refresh() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRequestTimeout)
+	defer cancel()
+	tokenURL := fmt.Sprintf("%s%s", s.config.Endpoint, s.tokenUrl)
+
+	s.tokenMutex.Lock()
+	refreshToken := s.refreshToken
+	s.tokenMutex.Unlock()
+
+	var token *oauth2.Token
+	var err error
+	if refreshToken != "" {
+		config := oauth2.Config{
+			ClientID:     s.config.ClientID,
+			ClientSecret: s.config.ClientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+		}
+		// Without an access token the source goes straight to the refresh grant
+		token, err = config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+		if err != nil {
+			s.log.Warnf("Failed to refresh glimesh token, using client credentials: %s", err)
+		}
+	}
+	if token == nil {
+		config := clientcredentials.Config{
+			ClientID:     s.config.ClientID,
+			ClientSecret: s.config.ClientSecret,
+			TokenURL:     tokenURL,
+			Scopes:       []string{"streamkey"},
+		}
+		token, err = config.Token(ctx)
+	}
+
+	s.tokenMutex.Lock()
+	defer s.tokenMutex.Unlock()
+
+	if err != nil {
+		s.refreshToken = ""
+		return "", fmt.Errorf("failed to refresh glimesh token: %w", err)
+	}
+	s.accessToken = token.AccessToken
+	s.tokenExpiry = token.Expiry
+	// Client credentials don't always come with one
+	s.refreshToken = token.RefreshToken
+
+	return s.accessToken, nil
+}
+
+// tokenTransport adds a fresh access token to every API request
+type tokenTransport struct {
+	service *Service
+	base    http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.service.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,150 @@
+package glimesh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockGlimesh serves the token endpoint and answers every API call with a
+// channel HMAC key, recording the Authorization headers it was sent
+type mockGlimesh struct {
+	*httptest.Server
+
+	refreshes     int32
+	failRefresh   bool
+	authMutex     sync.Mutex
+	authorization []string
+}
+
+func newMockGlimesh() *mockGlimesh {
+	m := &mockGlimesh{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/oauth/token", m.tokenHandler)
+	mux.HandleFunc("/api/graph", m.graphHandler)
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockGlimesh) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Form.Get("grant_type") {
+	case "client_credentials":
+		// Expires inside the refresh margin, so the next call refreshes it
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "initial",
+			"refresh_token": "refresh-1",
+			"token_type":    "bearer",
+			"expires_in":    30,
+		})
+	case "refresh_token":
+		atomic.AddInt32(&m.refreshes, 1)
+		if m.failRefresh || r.Form.Get("refresh_token") != "refresh-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "refreshed",
+			"refresh_token": "refresh-2",
+			"token_type":    "bearer",
+			"expires_in":    3600,
+		})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (m *mockGlimesh) graphHandler(w http.ResponseWriter, r *http.Request) {
+	m.authMutex.Lock()
+	m.authorization = append(m.authorization, r.Header.Get("Authorization"))
+	m.authMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"data":{"channel":{"hmacKey":"secret"}}}`))
+}
+
+func newTestService(endpoint string) *Service {
+	s := New(Config{Endpoint: endpoint, ClientID: "id", ClientSecret: "secret"})
+	s.Connect()
+	return s
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	assert := assert.New(t)
+	mock := newMockGlimesh()
+	defer mock.Close()
+	s := newTestService(mock.URL)
+
+	key, err := s.GetHmacKey(1)
+	assert.NoError(err)
+	assert.Equal([]byte("secret"), key)
+
+	// The first token expires within 60s, so it gets refreshed
+	_, err = s.GetHmacKey(1)
+	assert.NoError(err)
+	_, err = s.GetHmacKey(1)
+	assert.NoError(err)
+
+	assert.Equal(int32(1), atomic.LoadInt32(&mock.refreshes))
+	assert.Equal("refresh-2", s.refreshToken)
+	assert.Equal([]string{"Bearer initial", "Bearer refreshed", "Bearer refreshed"}, mock.authorization)
+}
+
+func TestTokenRefreshOnlyOnceWhenConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	mock := newMockGlimesh()
+	defer mock.Close()
+	s := newTestService(mock.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.GetHmacKey(1)
+			assert.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int32(1), atomic.LoadInt32(&mock.refreshes))
+}
+
+func TestTokenRefreshFailureFallsBackToClientCredentials(t *testing.T) {
+	assert := assert.New(t)
+	mock := newMockGlimesh()
+	mock.failRefresh = true
+	defer mock.Close()
+	s := newTestService(mock.URL)
+
+	_, err := s.GetHmacKey(1)
+	assert.NoError(err)
+
+	// The refresh token has been revoked, so a new token comes from the
+	// client credentials instead
+	_, err = s.GetHmacKey(1)
+	assert.NoError(err)
+	assert.Equal(int32(1), atomic.LoadInt32(&mock.refreshes))
+	assert.Equal([]string{"Bearer initial", "Bearer initial"}, mock.authorization)
+}
+
+func TestTokenRequestFailure(t *testing.T) {
+	assert := assert.New(t)
+	mock := newMockGlimesh()
+	s := newTestService(mock.URL)
+	mock.Close()
+
+	// The API isn't called without a token
+	_, err := s.GetHmacKey(1)
+	assert.Error(err)
+	assert.Empty(mock.authorization)
+	assert.Empty(s.refreshToken)
+}